@@ -0,0 +1,103 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/DGHeroin/relay/webui/model"
+	"github.com/DGHeroin/relay/webui/service"
+)
+
+const (
+	defaultAutoStartRetries       = 5               // 默认重试次数
+	maxAutoStartRetries           = 20              // auto_start_retries 上限
+	defaultAutoStartRetryInterval = 5               // 默认首次重试间隔（秒）
+	maxAutoStartRetryInterval     = 300             // auto_start_retry_interval_sec 上限
+	maxAutoStartRetryDelay        = 5 * time.Minute // 退避后的最长等待时间
+)
+
+// AutoStartFailed 规则开机自动启动重试用尽事件
+type AutoStartFailed struct {
+	RelayID   string    `json:"relay_id"`
+	RelayName string    `json:"relay_name"`
+	Attempts  int       `json:"attempts"`
+	Error     string    `json:"error"`
+	Time      time.Time `json:"time"`
+}
+
+// loadAutoStartRetry 读取 auto_start_retries 与 auto_start_retry_interval_sec 设置
+func loadAutoStartRetry() (int, time.Duration) {
+	retries, interval := defaultAutoStartRetries, defaultAutoStartRetryInterval
+	if value, err := model.GetSetting("auto_start_retries"); err == nil && value != "" {
+		if n, err := strconv.Atoi(value); err == nil && n >= 0 && n <= maxAutoStartRetries {
+			retries = n
+		}
+	}
+	if value, err := model.GetSetting("auto_start_retry_interval_sec"); err == nil && value != "" {
+		if n, err := strconv.Atoi(value); err == nil && n >= 1 && n <= maxAutoStartRetryInterval {
+			interval = n
+		}
+	}
+	return retries, time.Duration(interval) * time.Second
+}
+
+// autoStart 启动所有已启用的规则，启动失败的规则按退避间隔在后台重试
+func (h *Handlers) autoStart() {
+	rules, err := model.GetEnabledRelayRules()
+	if err != nil {
+		log.Printf("获取规则失败: %v", err)
+		return
+	}
+	retries, interval := loadAutoStartRetry()
+	for _, rule := range rules {
+		// 设置了运行计划的规则由计划任务启动
+		if rule.Schedule != "" {
+			continue
+		}
+		if err := h.relayMgr.Start(rule, h.wsHub, h.geoIP, service.ReasonAutoStart); err != nil {
+			log.Printf("自动启动失败 %s: %v", rule.Name, err)
+			go h.retryAutoStart(rule.ID, rule.Name, err, retries, interval)
+		}
+	}
+}
+
+// retryAutoStart 重试启动单个规则，每次等待时间翻倍
+// 规则被禁用、删除、改为计划运行、被手动停止或已被其它途径启动时停止重试
+// 重试用尽时广播全局事件，未订阅该规则的客户端也能收到
+func (h *Handlers) retryAutoStart(id, name string, err error, retries int, interval time.Duration) {
+	delay := interval
+	for attempt := 1; attempt <= retries; attempt++ {
+		time.Sleep(delay)
+		if delay *= 2; delay > maxAutoStartRetryDelay {
+			delay = maxAutoStartRetryDelay
+		}
+
+		rule, getErr := model.GetRelayRule(id)
+		if getErr != nil || !rule.Enabled || rule.Schedule != "" {
+			log.Printf("规则 %s 已禁用或删除，停止自动启动重试", name)
+			return
+		}
+		if h.relayMgr.ManuallyStopped(id) {
+			log.Printf("规则 %s 已被手动停止，停止自动启动重试", name)
+			return
+		}
+		if h.relayMgr.IsRunning(id) {
+			return
+		}
+		if err = h.relayMgr.Start(rule, h.wsHub, h.geoIP, service.ReasonAutoStart); err == nil {
+			log.Printf("自动启动重试成功 %s (第 %d 次重试)", rule.Name, attempt)
+			return
+		}
+		log.Printf("自动启动重试失败 %s (%d/%d): %v", rule.Name, attempt, retries, err)
+	}
+
+	log.Printf("规则 %s 无法自动启动，已放弃: %v", name, err)
+	h.wsHub.Broadcast("relay.autostart_failed", AutoStartFailed{
+		RelayID:   id,
+		RelayName: name,
+		Attempts:  retries + 1,
+		Error:     err.Error(),
+		Time:      time.Now(),
+	})
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DGHeroin/relay/webui/model"
+	"github.com/DGHeroin/relay/webui/service"
+)
+
+// TestRetryAutoStartManualStop 重试期间被手动停止的规则不再启动
+func TestRetryAutoStartManualStop(t *testing.T) {
+	rule := &model.RelayRule{Name: "autostart-retry", Src: "127.0.0.1:0", Dst: "127.0.0.1:1", Protocol: "tcp"}
+	if err := model.CreateRelayRule(rule); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { model.DeleteRelayRule(rule.ID) })
+
+	h := &Handlers{relayMgr: service.NewRelayManager(), wsHub: NewWSHub()}
+	t.Cleanup(func() { h.relayMgr.StopAll(service.ReasonShutdown) })
+
+	h.relayMgr.StopManual(rule.ID)
+	h.retryAutoStart(rule.ID, rule.Name, errors.New("端口被占用"), 3, time.Millisecond)
+	if h.relayMgr.IsRunning(rule.ID) {
+		t.Fatal("手动停止的规则被自动启动重试启动")
+	}
+
+	// 未手动停止时重试会启动规则
+	h.relayMgr = service.NewRelayManager()
+	h.retryAutoStart(rule.ID, rule.Name, errors.New("端口被占用"), 3, time.Millisecond)
+	if !h.relayMgr.IsRunning(rule.ID) {
+		t.Fatal("自动启动重试未启动规则")
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/DGHeroin/relay/webui/model"
+)
+
+const (
+	defaultCleanupTime   = "04:00"          // 默认每天清理旧数据的时间（本地时间）
+	cleanupCheckInterval = 30 * time.Second // 检查是否到达清理时间的间隔
+)
+
+// cleanupRunning 为 1 时已有清理在进行，定时与手动清理不会同时执行
+var cleanupRunning int32
+
+// parseCleanupTime 解析 HH:MM 格式的清理时间
+func parseCleanupTime(value string) (int, int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, 0, fmt.Errorf("清理时间格式必须为 HH:MM（24 小时制），如 04:00")
+	}
+	return t.Hour(), t.Minute(), nil
+}
+
+// loadCleanupTime 读取 cleanup_time 设置，未设置或无效时使用默认值
+func loadCleanupTime() (int, int) {
+	value, _ := model.GetSetting("cleanup_time")
+	if hour, minute, err := parseCleanupTime(value); err == nil {
+		return hour, minute
+	}
+	hour, minute, _ := parseCleanupTime(defaultCleanupTime)
+	return hour, minute
+}
+
+// beginCleanup 占用清理标记，已有清理在进行时返回 false
+func beginCleanup() bool {
+	return atomic.CompareAndSwapInt32(&cleanupRunning, 0, 1)
+}
+
+// cleanOldData 清理过期数据并释放清理标记，调用前需要 beginCleanup 成功
+func cleanOldData(reason string) {
+	defer atomic.StoreInt32(&cleanupRunning, 0)
+	start := time.Now()
+	deleted, err := model.CleanOldStats()
+	if err != nil {
+		log.Printf("清理旧数据失败（%s）: 已删除 %d 行, err=%v", reason, deleted, err)
+		return
+	}
+	log.Printf("清理旧数据完成（%s）: 删除 %d 行，耗时 %v", reason, deleted, time.Since(start).Round(time.Millisecond))
+}
+
+// runCleanupScheduler 启动时清理一次，之后每天到达 cleanup_time 时清理一次
+// 每次检查都重新读取设置，修改清理时间后无需重启
+func runCleanupScheduler() {
+	if beginCleanup() {
+		cleanOldData("启动")
+	}
+
+	// 启动时已过当天的清理时间，启动清理即算作当天的清理
+	var lastDay string
+	now := time.Now()
+	if hour, minute := loadCleanupTime(); !now.Before(clockOn(now, hour, minute)) {
+		lastDay = now.Format("2006-01-02")
+	}
+
+	ticker := time.NewTicker(cleanupCheckInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		day := now.Format("2006-01-02")
+		hour, minute := loadCleanupTime()
+		if day == lastDay || now.Before(clockOn(now, hour, minute)) {
+			continue
+		}
+		lastDay = day
+		if !beginCleanup() {
+			log.Printf("跳过定时清理: 已有清理在进行")
+			continue
+		}
+		cleanOldData("定时")
+	}
+}
+
+// clockOn 返回 t 当天的 hour:minute
+func clockOn(t time.Time, hour, minute int) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, hour, minute, 0, 0, t.Location())
+}
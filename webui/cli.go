@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/DGHeroin/relay/webui/model"
+	"golang.org/x/term"
+)
+
+// envDataDir 指定数据目录的环境变量，优先级低于 -data-dir
+const envDataDir = "RELAY_DATA_DIR"
+
+// resolveDataDir 确定数据目录：-data-dir 参数、RELAY_DATA_DIR 环境变量，默认为可执行文件所在目录下的 data
+func resolveDataDir() {
+	switch {
+	case *dataDirFlag != "":
+		dataDir = *dataDirFlag
+	case os.Getenv(envDataDir) != "":
+		dataDir = os.Getenv(envDataDir)
+	default:
+		if execPath, err := os.Executable(); err == nil {
+			dataDir = filepath.Join(filepath.Dir(execPath), "data")
+		}
+	}
+	if abs, err := filepath.Abs(dataDir); err == nil {
+		dataDir = abs
+	}
+}
+
+// checkDataDir 创建数据目录并确认可写，在打开数据库前调用
+func checkDataDir() error {
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return fmt.Errorf("无法创建 %s: %v", dataDir, err)
+	}
+	f, err := os.CreateTemp(dataDir, ".write-test-*")
+	if err != nil {
+		return fmt.Errorf("%s 不可写: %v（可通过 -data-dir 或 %s 指定其它目录）", dataDir, err, envDataDir)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return nil
+}
+
+// runResetPassword 处理 reset-password 子命令：直接更新数据库中的管理员密码并清除所有会话
+// 标准输入为终端时提示输入两次（不回显），否则从标准输入读取一行，便于脚本调用
+// 子命令之后可以跟 -data-dir 等参数
+func runResetPassword(args []string) error {
+	if err := flag.CommandLine.Parse(args); err != nil {
+		return err
+	}
+	resolveDataDir()
+	if err := checkDataDir(); err != nil {
+		return fmt.Errorf("数据目录不可用: %v", err)
+	}
+	if err := model.InitDB(dataDir); err != nil {
+		return fmt.Errorf("数据库初始化失败: %v", err)
+	}
+	defer model.CloseDB()
+
+	if !model.IsSetupCompleted() {
+		return fmt.Errorf("系统尚未初始化，请先完成初始化")
+	}
+
+	password, err := readNewPassword()
+	if err != nil {
+		return err
+	}
+	if len(password) < 6 {
+		return fmt.Errorf("新密码长度至少 6 位")
+	}
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		return fmt.Errorf("密码加密失败: %v", err)
+	}
+	if err := model.SetSetting("admin_password", hash); err != nil {
+		return fmt.Errorf("保存密码失败: %v", err)
+	}
+	// 清除所有会话，强制重新登录
+	if err := model.DeleteAllSessions(); err != nil {
+		return fmt.Errorf("清除会话失败: %v", err)
+	}
+	return nil
+}
+
+// readNewPassword 读取新密码
+func readNewPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", fmt.Errorf("读取密码失败: %v", err)
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	fmt.Fprint(os.Stderr, "新密码: ")
+	first, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", fmt.Errorf("读取密码失败: %v", err)
+	}
+	fmt.Fprint(os.Stderr, "确认新密码: ")
+	second, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", fmt.Errorf("读取密码失败: %v", err)
+	}
+	if string(first) != string(second) {
+		return "", fmt.Errorf("两次输入的密码不一致")
+	}
+	return string(first), nil
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/DGHeroin/relay/webui/model"
+	"github.com/DGHeroin/relay/webui/service"
+)
+
+// configVersion 配置导出格式版本，格式不兼容地变化时递增
+const configVersion = 1
+
+const (
+	defaultImportMaxRules = 1000  // 单次导入规则数的默认上限
+	maxImportMaxRules     = 10000 // import_max_rules 上限
+)
+
+// errImportTooLarge 导入的规则数超过上限
+var errImportTooLarge = errors.New("导入的规则过多")
+
+// secretSettings 不导出也不允许导入的设置项
+var secretSettings = map[string]bool{
+	"admin_password":    true,
+	"setup_completed":   true,
+	"geoip_license_key": true,
+	"reverse_secret":    true,
+}
+
+// ConfigExport 完整配置导出格式
+type ConfigExport struct {
+	Version    int                `json:"version"`
+	ExportedAt time.Time          `json:"exported_at"`
+	Settings   map[string]string  `json:"settings"`
+	Rules      []*model.RelayRule `json:"rules"`
+}
+
+// exportConfig 导出非敏感设置与全部规则
+func exportConfig() (*ConfigExport, error) {
+	settings, err := model.GetAllSettings()
+	if err != nil {
+		return nil, err
+	}
+	for key := range settings {
+		if secretSettings[key] {
+			delete(settings, key)
+		}
+	}
+
+	rules, err := model.GetAllRelayRules()
+	if err != nil {
+		return nil, err
+	}
+	if rules == nil {
+		rules = []*model.RelayRule{}
+	}
+
+	return &ConfigExport{
+		Version:    configVersion,
+		ExportedAt: time.Now(),
+		Settings:   settings,
+		Rules:      model.RedactRules(rules),
+	}, nil
+}
+
+// importConfig 导入 exportConfig 生成的配置
+// 规则冲突处理见 importRules，导入的新规则不会自动启动
+func (h *Handlers) importConfig(data map[string]interface{}) (map[string]interface{}, error) {
+	raw, ok := data["config"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("无效的配置数据")
+	}
+	version, _ := raw["version"].(float64)
+	if version < 1 || int(version) > configVersion {
+		return nil, fmt.Errorf("不支持的配置版本: %v", raw["version"])
+	}
+	onConflict, err := parseOnConflict(data)
+	if err != nil {
+		return nil, err
+	}
+	// 先检查规则数，超过上限时不导入任何内容
+	rules, _ := raw["rules"].([]interface{})
+	if err := checkImportSize(len(rules)); err != nil {
+		return nil, err
+	}
+
+	// 设置
+	var settingsSet, settingsSkipped int
+	settings, _ := raw["settings"].(map[string]interface{})
+	for key, v := range settings {
+		value, ok := v.(string)
+		if !ok || secretSettings[key] {
+			settingsSkipped++
+			continue
+		}
+		if err := validateSetting(key, value); err != nil {
+			log.Printf("[Config] 跳过设置 %s: %v", key, err)
+			settingsSkipped++
+			continue
+		}
+		if err := model.SetSetting(key, value); err != nil {
+			return nil, fmt.Errorf("保存设置失败: %v", err)
+		}
+		settingsSet++
+	}
+
+	// 规则
+	created, updated, skipped, err := h.importRules(rules, onConflict)
+	if err != nil {
+		return nil, err
+	}
+
+	// 使导入的设置立即生效
+	invalidateCORSCache()
+	invalidateHTTPStatusCache()
+	model.InvalidateSessionPolicy()
+	if h.limiter != nil {
+		h.limiter.invalidate()
+	}
+	loadGeoIPLocales(h.geoIP)
+	if _, ok := settings["geoip_enabled"]; ok {
+		if v, _ := model.GetSetting("geoip_enabled"); v == "true" {
+			if err := h.geoIP.Load(filepath.Join(dataDir, "GeoLite2-City.mmdb")); err != nil {
+				log.Printf("[Config] GeoIP 加载失败: %v", err)
+				model.SetSetting("geoip_enabled", "false")
+			}
+		} else {
+			h.geoIP.Close()
+		}
+	}
+
+	log.Printf("[Config] 导入完成: 设置 %d 项, 新建规则 %d 条, 更新 %d 条, 跳过 %d 条", settingsSet, created, updated, skipped)
+	return map[string]interface{}{
+		"settings_set":     settingsSet,
+		"settings_skipped": settingsSkipped,
+		"created":          created,
+		"updated":          updated,
+		"skipped":          skipped,
+	}, nil
+}
+
+// parseOnConflict 读取 on_conflict 参数，默认 skip
+func parseOnConflict(data map[string]interface{}) (string, error) {
+	onConflict, _ := data["on_conflict"].(string)
+	switch onConflict {
+	case "":
+		return "skip", nil
+	case "skip", "update", "rename":
+		return onConflict, nil
+	}
+	return "", fmt.Errorf("on_conflict 必须是 skip、update 或 rename")
+}
+
+// loadImportMaxRules 读取 import_max_rules 设置
+func loadImportMaxRules() int {
+	if value, err := model.GetSetting("import_max_rules"); err == nil && value != "" {
+		if n, err := strconv.Atoi(value); err == nil && n >= 1 && n <= maxImportMaxRules {
+			return n
+		}
+	}
+	return defaultImportMaxRules
+}
+
+// checkImportSize 检查单次导入的规则数
+func checkImportSize(n int) error {
+	if limit := loadImportMaxRules(); n > limit {
+		return fmt.Errorf("%w: %d 条，单次最多 %d 条（import_max_rules）", errImportTooLarge, n, limit)
+	}
+	return nil
+}
+
+// importRules 导入规则列表，监听地址与现有规则冲突时按 onConflict 处理：
+//   - skip: 跳过
+//   - update: 监听地址完全相同时原地更新该规则（运行中的规则按新配置重启），部分重叠时跳过
+//   - rename: 以带后缀的名称新建规则（不保留 slug），为避免监听冲突新规则处于禁用状态
+func (h *Handlers) importRules(list []interface{}, onConflict string) (created, updated, skipped int, err error) {
+	for _, r := range list {
+		ruleData, ok := r.(map[string]interface{})
+		if !ok {
+			skipped++
+			continue
+		}
+		rule, err := parseRule(ruleData)
+		if err != nil {
+			log.Printf("[Import] 跳过规则 %v: %v", ruleData["name"], err)
+			skipped++
+			continue
+		}
+		enabled, hasEnabled := ruleData["enabled"].(bool)
+
+		// 反向模式规则不占用本机端口，不与已有规则比较
+		var conflict *model.RelayRule
+		if !rule.IsReverse() {
+			if conflict, err = model.FindConflictingRule(rule.Src, rule.Protocol, ""); err != nil {
+				return created, updated, skipped, fmt.Errorf("检查规则冲突失败: %v", err)
+			}
+		}
+
+		switch {
+		case conflict == nil:
+			if err := model.CreateRelayRule(rule); err != nil {
+				skipped++
+				continue
+			}
+			created++
+			if hasEnabled && !enabled {
+				model.SetRelayEnabled(rule.ID, false)
+			}
+
+		case onConflict == "update" && conflict.Src == rule.Src:
+			rule.ID = conflict.ID
+			if err := model.UpdateRelayRule(rule); err != nil {
+				skipped++
+				continue
+			}
+			updated++
+			if hasEnabled {
+				model.SetRelayEnabled(rule.ID, enabled)
+			}
+			// 正在运行的规则按新配置重启
+			if h.relayMgr.IsRunning(rule.ID) {
+				h.relayMgr.Stop(rule.ID, service.ReasonReload)
+				if current, err := model.GetRelayRule(rule.ID); err == nil && current.Enabled {
+					if err := h.relayMgr.Start(current, h.wsHub, h.geoIP, service.ReasonReload); err != nil {
+						log.Printf("[Import] 重启规则失败 %s: %v", current.Name, err)
+					}
+				}
+			}
+
+		case onConflict == "rename":
+			name, err := uniqueRuleName(rule.Name)
+			if err != nil {
+				return created, updated, skipped, err
+			}
+			rule.Name = name
+			rule.Slug = ""
+			if err := model.CreateRelayRule(rule); err != nil {
+				skipped++
+				continue
+			}
+			model.SetRelayEnabled(rule.ID, false)
+			created++
+
+		default:
+			skipped++
+		}
+	}
+	return created, updated, skipped, nil
+}
+
+// uniqueRuleName 返回未被使用的规则名称，重名时追加 " (2)"、" (3)" 等后缀
+func uniqueRuleName(name string) (string, error) {
+	rules, err := model.GetAllRelayRules()
+	if err != nil {
+		return "", err
+	}
+	used := make(map[string]bool, len(rules))
+	for _, rule := range rules {
+		used[rule.Name] = true
+	}
+	candidate := name
+	for i := 2; used[candidate]; i++ {
+		candidate = fmt.Sprintf("%s (%d)", name, i)
+	}
+	return candidate, nil
+}
@@ -30,12 +30,15 @@ export function handleAuthExpired() {
   removeToken()
   ElMessage.warning('登录已过期，请重新登录')
   setTimeout(() => {
-    window.location.href = '/login'
+    window.location.href = `${BASE_PATH}/login`
   }, 1500)
 }
 
+// 部署子路径，由服务端注入，根路径部署时为空
+export const BASE_PATH = window.__RELAY_BASE__ || ''
+
 // API 基础 URL
-const BASE_URL = import.meta.env.VITE_API_BASE_URL || ''
+export const BASE_URL = import.meta.env.VITE_API_BASE_URL || BASE_PATH
 
 // 健康检查接口（无需鉴权）
 export interface HealthResponse {
@@ -57,19 +60,50 @@ export async function checkHealth(): Promise<HealthResponse | null> {
 }
 
 // 统一 API 调用
-export async function api<T = unknown>(action: string, data: Record<string, unknown> = {}): Promise<ApiResponse<T>> {
+export function api<T = unknown>(action: string, data: Record<string, unknown> = {}): Promise<ApiResponse<T>> {
+  return post<T>('/api', { action, data })
+}
+
+export interface BatchItem {
+  action: string
+  data?: Record<string, unknown>
+}
+
+// 批量调用，一次请求按顺序执行多个 action，返回与 items 顺序一致的响应
+// 单个 action 失败不影响其余 action，需逐个检查 code
+export async function batch(items: BatchItem[]): Promise<ApiResponse<ApiResponse[]>> {
+  const res = await post<ApiResponse[]>('/api/batch', items.map(i => ({ action: i.action, data: i.data || {} })))
+  if (res.code === 0) {
+    for (const item of res.data) {
+      if (item.code === 401 && (item.msg === '未登录' || item.msg === '登录已过期')) {
+        handleAuthExpired()
+        break
+      }
+    }
+  }
+  return res
+}
+
+async function post<T>(path: string, body: unknown): Promise<ApiResponse<T>> {
   try {
-    const response = await fetch(`${BASE_URL}/api`, {
+    const response = await fetch(`${BASE_URL}${path}`, {
       method: 'POST',
       headers: {
         'Content-Type': 'application/json',
         'Authorization': getToken()
       },
-      body: JSON.stringify({ action, data })
+      body: JSON.stringify(body)
     })
 
-    // 检查 HTTP 状态码
+    // 检查 HTTP 状态码（开启 api_http_status 时错误响应仍带有 JSON body）
     if (!response.ok) {
+      const body = await response.json().catch(() => null) as ApiResponse<T> | null
+      if (body && typeof body.code === 'number') {
+        if (body.code === 401 && (body.msg === '未登录' || body.msg === '登录已过期')) {
+          handleAuthExpired()
+        }
+        return body
+      }
       return {
         code: response.status,
         msg: `HTTP ${response.status}: ${response.statusText}`,
@@ -109,6 +143,38 @@ export interface VersionInfo {
   git_commit: string
 }
 
+// 进程运行时指标，内存单位为字节，open_fds 在非 Linux 上为 -1，fd_limit 与 max_listeners 为 0 表示不限制
+export interface RuntimeStats {
+  uptime_seconds: number
+  goroutines: number
+  open_fds: number
+  fd_limit: number
+  fd_hard_limit: number
+  listeners: number
+  max_listeners: number
+  heap_alloc: number
+  heap_inuse: number
+  heap_objects: number
+  sys: number
+  total_alloc: number
+  num_gc: number
+  gc_pause_total_ms: number
+  last_gc: string
+  running_rules: number
+  active_connections: number
+  ws_clients: number
+  go_version: string
+}
+
+// IP 地理位置查询结果，内网或无法解析的 IP 各字段为空
+export interface IPLocation {
+  ip: string
+  location: string
+  country: string
+  asn?: number
+  as_org?: string
+}
+
 // System API
 export const systemApi = {
   login: (password: string) => api<{ token: string }>('system.login', { password }),
@@ -117,9 +183,11 @@ export const systemApi = {
   updateSettings: (key: string, value: string) => api('system.update_settings', { key, value }),
   changePassword: (oldPassword: string, newPassword: string) =>
     api('system.change_password', { old_password: oldPassword, new_password: newPassword }),
-  geoipStatus: () => api<{ enabled: boolean; path: string }>('system.geoip_status'),
+  geoipStatus: () => api<{ enabled: boolean; kind: '' | 'city' | 'country'; path: string }>('system.geoip_status'),
   deleteGeoip: () => api('system.delete_geoip'),
+  geoipLookup: (ips: string[]) => api<IPLocation[]>('system.geoip_lookup', { ips }),
   version: () => api<VersionInfo>('system.version'),
+  runtimeStats: () => api<RuntimeStats>('system.runtime_stats'),
   resetStatus: () => api<{ can_reset: boolean }>('system.reset_status'),
   resetPassword: (newPassword: string) =>
     api('system.reset_password', { new_password: newPassword })
@@ -134,12 +202,36 @@ export interface RelayRule {
   protocol: string
   enabled: boolean
   running: boolean
+  draining?: boolean
+  labels?: Record<string, string>
+  // 运行中时实际绑定的监听地址，src 端口为 0 时由系统分配
+  listen_addr?: { network: 'tcp' | 'udp'; addr: string }[]
+  // 反向模式：连接的服务端地址与控制连接状态，addr 为服务端上实际监听的地址
+  reverse_server?: string
+  reverse?: { server: string; connected: boolean; addr?: string } | null
+  // 本次运行的实时值，重启后清零
   connections: number
   bytes_in: number
   bytes_out: number
+  bytes_in_speed?: number
+  bytes_out_speed?: number
+  // 统计保留期内的累计值，不含仍在进行的连接
+  lifetime_bytes_in?: number
+  lifetime_bytes_out?: number
+  lifetime_connections?: number
   created_at: string
 }
 
+// 目标测试结果，UDP 未收到回复（replied 为空）时 ok 只表示报文已发出
+export interface TargetProbe {
+  target: string
+  protocol: string
+  ok: boolean
+  latency_ms: number
+  replied?: boolean
+  error?: string
+}
+
 // Relay API
 export const relayApi = {
   list: () => api<RelayRule[]>('relay.list'),
@@ -150,10 +242,14 @@ export const relayApi = {
   delete: (id: string) => api('relay.delete', { id }),
   start: (id: string) => api('relay.start', { id }),
   stop: (id: string) => api('relay.stop', { id }),
+  drain: (id: string) => api('relay.drain', { id }),
+  undrain: (id: string) => api('relay.undrain', { id }),
   startAll: () => api('relay.start_all'),
   stopAll: () => api('relay.stop_all'),
   setEnabled: (id: string, enabled: boolean) => api('relay.set_enabled', { id, enabled }),
   status: (id?: string) => api('relay.status', id ? { id } : {}),
+  testTarget: (target: { id?: string; dst?: string; protocol?: string }) =>
+    api<{ ok: boolean; results: TargetProbe[] }>('relay.test_target', target),
   exportRules: () => api<RelayRule[]>('relay.export'),
   importRules: (rules: unknown[]) => api('relay.import', { rules })
 }
@@ -168,6 +264,14 @@ export interface RelayStat {
   recorded_at: string
 }
 
+// 连接时长直方图的区间 [min, max) 秒，max 缺省表示没有上限
+export interface DurationBucket {
+  label: string
+  min: number
+  max?: number
+  count: number
+}
+
 export interface AccessLog {
   id: number
   relay_id: string
@@ -176,6 +280,11 @@ export interface AccessLog {
   bytes_in: number
   bytes_out: number
   duration: number
+  private?: boolean
+  tls_version?: string
+  tls_cipher?: string
+  tls_alpn?: string
+  labels?: Record<string, string>
   created_at: string
 }
 
@@ -188,6 +297,10 @@ export const statsApi = {
     active_relays: number
   }>('stats.overview'),
   relay: (id: string, range: string = '24h') => api<RelayStat[]>('stats.relay', { id, range }),
+  overviewSeries: (range: string = '24h', granularity: 'hour' | 'day' = 'hour') =>
+    api<Omit<RelayStat, 'id' | 'relay_id'>[]>('stats.overview_series', { range, granularity }),
+  durationHistogram: (relayId: string = '', range: string = '24h', buckets?: number[]) =>
+    api<DurationBucket[]>('stats.duration_histogram', { relay_id: relayId, range, ...(buckets ? { buckets } : {}) }),
   logs: (relayId: string, page: number, size: number) =>
     api<{ list: AccessLog[]; total: number }>('stats.logs', { relay_id: relayId, page, size }),
   clear: (relayId?: string) => api('stats.clear', relayId ? { relay_id: relayId } : {})
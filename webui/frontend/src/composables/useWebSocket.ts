@@ -1,5 +1,5 @@
 import { ref } from 'vue'
-import { getToken, api } from '../api'
+import { getToken, api, BASE_PATH } from '../api'
 
 export interface WSMessage {
   type: string
@@ -20,6 +20,12 @@ export interface Connection {
   ended_at?: string
   duration: number
   active: boolean
+  private?: boolean // 客户端为内网/回环地址
+  // TLS 终止规则协商的版本、加密套件与 ALPN 协议
+  tls_version?: string
+  tls_cipher?: string
+  tls_alpn?: string
+  labels?: Record<string, string> // 规则的静态标签
 }
 
 export interface TrafficData {
@@ -31,6 +37,16 @@ export interface TrafficData {
   connections: number
 }
 
+// stats.overview 推送的运行中规则实时汇总
+export interface LiveOverview {
+  active_relays: number
+  active_connections: number
+  bytes_in: number
+  bytes_out: number
+  bytes_in_speed: number
+  bytes_out_speed: number
+}
+
 type MessageCallback = (msg: WSMessage) => void
 
 // 全局单例
@@ -41,6 +57,7 @@ const dataActive = ref(false) // 数据活动状态（有数据流动时为 true
 let dataActiveTimer: number | null = null
 const connections = ref<Map<string, Connection[]>>(new Map())
 const traffic = ref<Map<string, TrafficData>>(new Map())
+const overview = ref<LiveOverview | null>(null)
 const subscribedRelayIds = new Set<string>()
 const messageCallbacks = new Set<MessageCallback>()
 
@@ -77,13 +94,11 @@ const connect = () => {
     wsUrl = baseUrl.replace(/^http/, 'ws') + '/ws'
   } else {
     const protocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:'
-    wsUrl = `${protocol}//${window.location.host}/ws`
+    wsUrl = `${protocol}//${window.location.host}${BASE_PATH}/ws`
   }
 
-  // 添加 token 到查询参数
-  wsUrl += `?token=${encodeURIComponent(token)}`
-
-  ws = new WebSocket(wsUrl)
+  // 通过子协议传递 token，避免出现在 URL 与代理日志中（子协议不允许 '='，去掉 base64 填充）
+  ws = new WebSocket(wsUrl, ['relay', `token.${token.replace(/=+$/, '')}`])
 
   ws.onopen = () => {
     connected.value = true
@@ -92,7 +107,7 @@ const connect = () => {
     // 订阅所有消息类型
     ws?.send(JSON.stringify({
       action: 'subscribe',
-      topics: ['relay.connections', 'relay.traffic', 'relay.status']
+      topics: ['relay.connections', 'relay.traffic', 'relay.status', 'relay.state', 'stats.overview']
     }))
     // 恢复之前的 relay 订阅
     subscribedRelayIds.forEach(relayId => {
@@ -185,6 +200,9 @@ const handleMessage = (msg: WSMessage) => {
       traffic.value = newMap
       break
     }
+    case 'stats.overview':
+      overview.value = msg.data as LiveOverview
+      break
   }
 }
 
@@ -231,6 +249,7 @@ export function useWebSocket() {
     dataActive,
     connections,
     traffic,
+    overview,
     subscribe: subscribeRelay,
     unsubscribe: unsubscribeRelay,
     subscribeRelay,
@@ -7,3 +7,8 @@ interface ImportMetaEnv {
 interface ImportMeta {
   readonly env: ImportMetaEnv
 }
+
+interface Window {
+  // 服务端以 -base-path 部署在子路径下时注入，如 /relay
+  __RELAY_BASE__?: string
+}
@@ -1,8 +1,8 @@
 import { createRouter, createWebHistory } from 'vue-router'
-import { checkHealth } from '../api'
+import { checkHealth, BASE_PATH } from '../api'
 
 const router = createRouter({
-  history: createWebHistory(),
+  history: createWebHistory(BASE_PATH),
   routes: [
     {
       path: '/setup',
@@ -3,6 +3,8 @@ import vue from '@vitejs/plugin-vue'
 
 export default defineConfig({
   plugins: [vue()],
+  // 资源使用相对路径，由服务端按 -base-path 改写为绝对地址
+  base: './',
   server: {
     port: 5173,
     proxy: {
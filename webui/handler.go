@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -19,7 +21,6 @@ import (
 	"github.com/DGHeroin/relay/webui/service"
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
-	"golang.org/x/crypto/bcrypt"
 )
 
 // 登录失败记录
@@ -35,13 +36,16 @@ var (
 	lockDuration     = 15 * time.Minute
 )
 
-const sessionTTL = 24 * time.Hour // 会话有效期 24 小时
-
 // Handlers API处理器
 type Handlers struct {
 	relayMgr *service.RelayManager
 	geoIP    *service.GeoIPService
 	wsHub    *WSHub
+	limiter  *rateLimiter           // API 限流，由 Server 设置
+	reverse  *service.ReverseServer // 反向隧道服务端，由 reverse_listen/reverse_secret 设置启用
+
+	loadedMu sync.Mutex
+	loaded   map[string]bool // 上次启动或重新加载时已启用的规则，reload 只启动之后新启用的规则
 }
 
 // NewHandlers 创建处理器
@@ -50,12 +54,33 @@ func NewHandlers() *Handlers {
 		relayMgr: service.NewRelayManager(),
 		geoIP:    service.NewGeoIPService(),
 		wsHub:    NewWSHub(),
+		reverse:  service.NewReverseServer(),
+	}
+	if err := h.applyReverseServer(); err != nil {
+		log.Printf("%v", err)
 	}
 	go h.wsHub.Run()
+	go h.pushOverview()    // stats.overview 实时推送
 	go h.cleanupSessions() // 启动会话清理
+	go h.autoUpdateGeoIP() // GeoIP 自动更新
 	return h
 }
 
+// applyReverseServer 按 reverse_listen 与 reverse_secret 设置启动、重启或停止反向隧道服务端，
+// reverse_port_range 限定客户端可以要求监听的端口
+func (h *Handlers) applyReverseServer() error {
+	portRange, _ := model.GetSetting("reverse_port_range")
+	portMin, portMax, err := service.ParseReversePortRange(portRange)
+	if err != nil {
+		portMin, portMax = service.DefaultReversePortMin, service.DefaultReversePortMax
+	}
+	h.reverse.SetPortRange(portMin, portMax)
+
+	listen, _ := model.GetSetting("reverse_listen")
+	secret, _ := model.GetSetting("reverse_secret")
+	return h.reverse.Apply(listen, secret)
+}
+
 // cleanupSessions 定期清理过期会话
 func (h *Handlers) cleanupSessions() {
 	ticker := time.NewTicker(time.Hour)
@@ -76,18 +101,8 @@ func (h *Handlers) Handle(action string, data map[string]interface{}, c *gin.Con
 
 	module, method := parts[0], parts[1]
 
-	// 无需认证的接口
-	noAuthRequired := map[string]bool{
-		"setup.status":          true,
-		"setup.init":            true,
-		"system.login":          true,
-		"system.version":        true,
-		"system.reset_status":   true,
-		"system.reset_password": true,
-	}
-
-	// 检查是否需要认证
-	if !noAuthRequired[action] {
+	// 检查是否需要认证，无需认证的接口见 noAuthActions
+	if !noAuthActions[action] {
 		token := c.GetHeader("Authorization")
 		if token == "" {
 			return Error(401, "未登录")
@@ -130,22 +145,8 @@ func (h *Handlers) handleSetup(method string, data map[string]interface{}) APIRe
 			return Error(400, "密码不能为空")
 		}
 
-		// 加密密码
-		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-		if err != nil {
-			return Error(500, "密码加密失败")
-		}
-
-		if err := model.SetSetting("admin_password", string(hash)); err != nil {
-			return Error(500, "保存密码失败")
-		}
-
-		// 设置默认配置
-		model.SetSetting("geoip_enabled", "false")
-		model.SetSetting("auto_start", "true")
-
-		if err := model.SetSetupCompleted(); err != nil {
-			return Error(500, "初始化失败")
+		if err := completeSetup(password); err != nil {
+			return Error(500, err.Error())
 		}
 
 		return Success(nil)
@@ -155,6 +156,28 @@ func (h *Handlers) handleSetup(method string, data map[string]interface{}) APIRe
 	}
 }
 
+// completeSetup 保存管理员密码与默认配置并标记初始化完成
+func completeSetup(password string) error {
+	// 加密密码
+	hash, err := hashPassword(password)
+	if err != nil {
+		return fmt.Errorf("密码加密失败")
+	}
+
+	if err := model.SetSetting("admin_password", hash); err != nil {
+		return fmt.Errorf("保存密码失败")
+	}
+
+	// 设置默认配置
+	model.SetSetting("geoip_enabled", "false")
+	model.SetSetting("auto_start", "true")
+
+	if err := model.SetSetupCompleted(); err != nil {
+		return fmt.Errorf("初始化失败")
+	}
+	return nil
+}
+
 // ==================== System 模块 ====================
 
 func (h *Handlers) handleSystem(method string, data map[string]interface{}, c *gin.Context) APIResponse {
@@ -181,7 +204,7 @@ func (h *Handlers) handleSystem(method string, data map[string]interface{}, c *g
 			return Error(500, "获取密码失败")
 		}
 
-		if err := bcrypt.CompareHashAndPassword([]byte(storedHash), []byte(password)); err != nil {
+		if !verifyPassword(storedHash, password) {
 			// 记录失败尝试
 			v, _ := loginAttempts.LoadOrStore(clientIP, &loginAttempt{})
 			attempt := v.(*loginAttempt)
@@ -200,12 +223,22 @@ func (h *Handlers) handleSystem(method string, data map[string]interface{}, c *g
 		// 登录成功，清除失败记录
 		loginAttempts.Delete(clientIP)
 
+		// 哈希算法或 bcrypt 成本与当前配置不一致时透明迁移，失败不影响登录
+		if passwordNeedsRehash(storedHash) {
+			if hash, err := hashPassword(password); err == nil {
+				if err := model.SetSetting("admin_password", hash); err != nil {
+					log.Printf("迁移密码哈希失败: %v", err)
+				}
+			}
+		}
+
 		// 生成 token 并存储会话数据
 		token, err := generateToken()
 		if err != nil {
 			return Error(500, "生成令牌失败")
 		}
-		if err := model.CreateSession(token, sessionTTL); err != nil {
+		ttl, _ := model.SessionPolicy()
+		if err := model.CreateSession(token, ttl); err != nil {
 			return Error(500, "创建会话失败")
 		}
 
@@ -217,10 +250,26 @@ func (h *Handlers) handleSystem(method string, data map[string]interface{}, c *g
 		return Success(nil)
 
 	case "version":
+		// 无数据库的 headless 模式下 schema_version 为 0
+		schema, _ := model.SchemaVersion()
+		return Success(map[string]interface{}{
+			"version":        Version,
+			"build_time":     BuildTime,
+			"git_commit":     GitCommit,
+			"schema_version": schema,
+		})
+
+	case "describe":
+		return Success(describeAPI())
+
+	case "runtime_stats":
+		return Success(h.runtimeStats())
+
+	case "reverse_status":
+		listen, clients := h.reverse.Status()
 		return Success(map[string]interface{}{
-			"version":    Version,
-			"build_time": BuildTime,
-			"git_commit": GitCommit,
+			"listen":  listen,
+			"clients": clients,
 		})
 
 	case "get_settings":
@@ -230,6 +279,11 @@ func (h *Handlers) handleSystem(method string, data map[string]interface{}, c *g
 		}
 		// 移除敏感信息
 		delete(settings, "admin_password")
+		for _, key := range []string{"geoip_license_key", "reverse_secret"} {
+			if settings[key] != "" {
+				settings[key] = "******"
+			}
+		}
 		return Success(settings)
 
 	case "update_settings":
@@ -242,9 +296,43 @@ func (h *Handlers) handleSystem(method string, data map[string]interface{}, c *g
 		if key == "admin_password" || key == "setup_completed" {
 			return Error(403, "禁止修改此设置")
 		}
+		// 掩码值表示未修改
+		if (key == "geoip_license_key" || key == "reverse_secret") && value == "******" {
+			return Success(nil)
+		}
+		if err := validateSetting(key, value); err != nil {
+			return Error(400, err.Error())
+		}
+		if key == "geoip_locale" {
+			// 语言需存在于当前加载的 City 库中
+			locales, _ := service.ParseGeoIPLocales(value)
+			if err := h.geoIP.CheckLocales(locales); err != nil {
+				return Error(400, err.Error())
+			}
+		}
 		if err := model.SetSetting(key, value); err != nil {
 			return Error(500, "保存失败")
 		}
+		if key == "api_rate_limit" || key == "api_rate_burst" {
+			h.limiter.invalidate()
+		}
+		if key == "cors_origin" {
+			invalidateCORSCache()
+		}
+		if key == "api_http_status" {
+			invalidateHTTPStatusCache()
+		}
+		if key == "session_mode" || key == "session_ttl_hours" {
+			model.InvalidateSessionPolicy()
+		}
+		if key == "geoip_locale" {
+			loadGeoIPLocales(h.geoIP)
+		}
+		if key == "reverse_listen" || key == "reverse_secret" || key == "reverse_port_range" {
+			if err := h.applyReverseServer(); err != nil {
+				return Error(500, err.Error())
+			}
+		}
 
 		// 如果修改了 geoip_enabled，重新加载
 		if key == "geoip_enabled" {
@@ -261,6 +349,31 @@ func (h *Handlers) handleSystem(method string, data map[string]interface{}, c *g
 
 		return Success(nil)
 
+	case "cleanup_now":
+		// 清理可能耗时较长，在后台执行，结果写入运行日志
+		if !beginCleanup() {
+			return Error(409, "清理正在进行中")
+		}
+		go cleanOldData("手动")
+		return Success(nil)
+
+	case "export_config":
+		cfg, err := exportConfig()
+		if err != nil {
+			return Error(500, "导出配置失败")
+		}
+		return Success(cfg)
+
+	case "import_config":
+		result, err := h.importConfig(data)
+		if errors.Is(err, errImportTooLarge) {
+			return Error(413, err.Error())
+		}
+		if err != nil {
+			return Error(400, err.Error())
+		}
+		return Success(result)
+
 	case "change_password":
 		oldPass, _ := data["old_password"].(string)
 		newPass, _ := data["new_password"].(string)
@@ -275,16 +388,16 @@ func (h *Handlers) handleSystem(method string, data map[string]interface{}, c *g
 			return Error(500, "获取密码失败")
 		}
 
-		if err := bcrypt.CompareHashAndPassword([]byte(storedHash), []byte(oldPass)); err != nil {
+		if !verifyPassword(storedHash, oldPass) {
 			return Error(401, "原密码错误")
 		}
 
-		hash, err := bcrypt.GenerateFromPassword([]byte(newPass), bcrypt.DefaultCost)
+		hash, err := hashPassword(newPass)
 		if err != nil {
 			return Error(500, "密码加密失败")
 		}
 
-		if err := model.SetSetting("admin_password", string(hash)); err != nil {
+		if err := model.SetSetting("admin_password", hash); err != nil {
 			return Error(500, "保存密码失败")
 		}
 
@@ -317,11 +430,11 @@ func (h *Handlers) handleSystem(method string, data map[string]interface{}, c *g
 		}
 
 		// 更新密码
-		hash, err := bcrypt.GenerateFromPassword([]byte(newPass), bcrypt.DefaultCost)
+		hash, err := hashPassword(newPass)
 		if err != nil {
 			return Error(500, "密码加密失败")
 		}
-		if err := model.SetSetting("admin_password", string(hash)); err != nil {
+		if err := model.SetSetting("admin_password", hash); err != nil {
 			return Error(500, "保存密码失败")
 		}
 
@@ -333,13 +446,55 @@ func (h *Handlers) handleSystem(method string, data map[string]interface{}, c *g
 
 		return Success(nil)
 
+	case "geoip_lookup":
+		ips, ok := getStringList(data, "ips")
+		if ip, _ := data["ip"].(string); ip != "" {
+			ips, ok = append(ips, ip), true
+		}
+		if !ok || len(ips) == 0 {
+			return Error(400, "ip 不能为空")
+		}
+		if len(ips) > maxGeoIPLookupBatch {
+			return Error(400, fmt.Sprintf("单次最多查询 %d 个 IP", maxGeoIPLookupBatch))
+		}
+		return Success(h.lookupIPs(ips))
+
+	case "update_geoip":
+		// 下载可能超过 -write-timeout，取消本次请求的写超时，下载本身有独立的超时
+		clearWriteDeadline(c)
+		if err := h.updateGeoIP(); err != nil {
+			log.Printf("GeoIP 更新失败: %v", err)
+			return Error(500, err.Error())
+		}
+		return Success(map[string]interface{}{
+			"build_epoch": h.geoIP.BuildEpoch(),
+		})
+
 	case "geoip_status":
+		// 未加载时 metadata 为 null
+		var buildEpoch interface{}
+		metadata := h.geoIP.Metadata()
+		if metadata != nil {
+			buildEpoch = metadata.BuildEpoch
+		}
 		return Success(map[string]interface{}{
-			"enabled": h.geoIP.IsLoaded(),
-			"path":    filepath.Join(dataDir, "GeoLite2-City.mmdb"),
+			"enabled":      metadata != nil,
+			"kind":         h.geoIP.Kind(),
+			"path":         filepath.Join(dataDir, "GeoLite2-City.mmdb"),
+			"build_epoch":  buildEpoch,
+			"metadata":     metadata,
+			"asn_enabled":  h.geoIP.IsASNLoaded(),
+			"asn_path":     filepath.Join(dataDir, "GeoLite2-ASN.mmdb"),
+			"asn_metadata": h.geoIP.ASNMetadata(),
 		})
 
 	case "delete_geoip":
+		// type=asn 时仅删除 ASN 库
+		if dbType, _ := data["type"].(string); dbType == "asn" {
+			h.geoIP.CloseASN()
+			os.Remove(filepath.Join(dataDir, "GeoLite2-ASN.mmdb"))
+			return Success(nil)
+		}
 		h.geoIP.Close()
 		os.Remove(filepath.Join(dataDir, "GeoLite2-City.mmdb"))
 		model.SetSetting("geoip_enabled", "false")
@@ -350,40 +505,317 @@ func (h *Handlers) handleSystem(method string, data map[string]interface{}, c *g
 	}
 }
 
+// updateGeoIP 下载最新的 GeoLite2-City 数据库并重新加载
+// 优先使用镜像地址 geoip_download_url，否则使用 MaxMind license key
+func (h *Handlers) updateGeoIP() error {
+	downloadURL, _ := model.GetSetting("geoip_download_url")
+	if downloadURL == "" {
+		licenseKey, _ := model.GetSetting("geoip_license_key")
+		if licenseKey == "" {
+			return fmt.Errorf("未配置 MaxMind license key 或下载地址")
+		}
+		downloadURL = service.MaxMindDownloadURL("GeoLite2-City", licenseKey)
+	}
+
+	dst := filepath.Join(dataDir, "GeoLite2-City.mmdb")
+	if err := service.DownloadGeoIPDatabase(downloadURL, dst); err != nil {
+		return err
+	}
+	if err := h.geoIP.Load(dst); err != nil {
+		return fmt.Errorf("GeoIP 数据库加载失败: %v", err)
+	}
+	model.SetSetting("geoip_enabled", "true")
+	log.Printf("GeoIP 数据库已更新，构建时间: %s", h.geoIP.BuildEpoch().Format(time.RFC3339))
+	return nil
+}
+
+// autoUpdateGeoIP 每周自动更新 GeoIP 数据库（需开启 geoip_auto_update）
+func (h *Handlers) autoUpdateGeoIP() {
+	ticker := time.NewTicker(7 * 24 * time.Hour)
+	defer ticker.Stop()
+	for range ticker.C {
+		if enabled, _ := model.GetSetting("geoip_auto_update"); enabled != "true" {
+			continue
+		}
+		if err := h.updateGeoIP(); err != nil {
+			log.Printf("GeoIP 自动更新失败: %v", err)
+		}
+	}
+}
+
+// maxGeoIPUploadSize GeoIP 数据库上传的大小上限，GeoLite2-City 约 60MB
+const maxGeoIPUploadSize = 256 << 20
+
 // HandleGeoIPUpload 处理 GeoIP 文件上传
 func (h *Handlers) HandleGeoIPUpload(c *gin.Context) {
-	// 验证登录状态
-	token := c.GetHeader("Authorization")
-	if token == "" {
-		c.JSON(200, Error(401, "未登录"))
+	if !requireAuth(c) {
 		return
 	}
-	if _, err := model.GetSession(token); err != nil {
-		c.JSON(200, Error(401, "登录已过期"))
+
+	clearDeadlines(c)
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxGeoIPUploadSize)
+	file, err := c.FormFile("file")
+	if err != nil {
+		if isBodyTooLarge(err) {
+			respond(c, Error(413, fmt.Sprintf("文件过大，GeoIP 数据库不能超过 %d MB", maxGeoIPUploadSize>>20)))
+			return
+		}
+		respond(c, Error(400, "文件上传失败"))
 		return
 	}
 
-	file, err := c.FormFile("file")
+	// 先保存到临时文件，识别数据库类型后再放到对应位置
+	tmp := filepath.Join(dataDir, "geoip_upload.tmp")
+	if err := c.SaveUploadedFile(file, tmp); err != nil {
+		respond(c, Error(500, "保存文件失败"))
+		return
+	}
+	defer os.Remove(tmp)
+
+	dbType, err := service.DetectDatabaseType(tmp)
 	if err != nil {
-		c.JSON(200, Error(400, "文件上传失败"))
+		respond(c, Error(400, "无效的 GeoIP 数据库文件"))
+		return
+	}
+
+	if service.IsASNDatabase(dbType) {
+		dst := filepath.Join(dataDir, "GeoLite2-ASN.mmdb")
+		if err := os.Rename(tmp, dst); err != nil {
+			respond(c, Error(500, "保存文件失败"))
+			return
+		}
+		if err := h.geoIP.LoadASN(dst); err != nil {
+			os.Remove(dst)
+			respond(c, Error(400, "无效的 ASN 数据库文件"))
+			return
+		}
+		respond(c, Success(map[string]interface{}{"type": dbType}))
 		return
 	}
 
 	dst := filepath.Join(dataDir, "GeoLite2-City.mmdb")
-	if err := c.SaveUploadedFile(file, dst); err != nil {
-		c.JSON(200, Error(500, "保存文件失败"))
+	if err := os.Rename(tmp, dst); err != nil {
+		respond(c, Error(500, "保存文件失败"))
 		return
 	}
 
-	// 尝试加载
+	// 尝试加载，City 与 Country 库都放在同一位置，加载时按试查结果识别
 	if err := h.geoIP.Load(dst); err != nil {
 		os.Remove(dst)
-		c.JSON(200, Error(400, "无效的 GeoIP 数据库文件"))
+		respond(c, Error(400, fmt.Sprintf("无效的 GeoIP 数据库文件: %v", err)))
 		return
 	}
 
 	model.SetSetting("geoip_enabled", "true")
-	c.JSON(200, Success(nil))
+	respond(c, Success(map[string]interface{}{"type": dbType, "kind": h.geoIP.Kind()}))
+}
+
+// validateSetting 校验有取值范围要求的设置项
+func validateSetting(key, value string) error {
+	switch key {
+	case "ws_push_interval_ms":
+		ms, err := strconv.Atoi(value)
+		if err != nil || time.Duration(ms)*time.Millisecond < service.MinPushInterval {
+			return fmt.Errorf("推送间隔必须为不小于 %d 的整数（毫秒）", service.MinPushInterval.Milliseconds())
+		}
+	case "ws_overview_interval_ms":
+		ms, err := strconv.Atoi(value)
+		if err != nil || time.Duration(ms)*time.Millisecond < minOverviewInterval {
+			return fmt.Errorf("总览推送间隔必须为不小于 %d 的整数（毫秒）", minOverviewInterval.Milliseconds())
+		}
+	case "api_rate_limit":
+		rate, err := strconv.ParseFloat(value, 64)
+		if err != nil || rate < 0 {
+			return fmt.Errorf("API 限流必须为不小于 0 的数字（每秒请求数，0 表示不限制）")
+		}
+	case "api_rate_burst":
+		burst, err := strconv.Atoi(value)
+		if err != nil || burst < 1 {
+			return fmt.Errorf("API 突发请求数必须为正整数")
+		}
+	case "api_http_status", "health_details", "persist_history":
+		if value != "true" && value != "false" {
+			return fmt.Errorf("%s 只能为 true 或 false", key)
+		}
+	case "password_algorithm":
+		if value != passwordAlgoBcrypt && value != passwordAlgoArgon2id {
+			return fmt.Errorf("密码哈希算法只能为 bcrypt 或 argon2id")
+		}
+	case "reverse_listen":
+		if value != "" {
+			if err := validateSingleListenAddr(value); err != nil {
+				return err
+			}
+		}
+	case "reverse_port_range":
+		if _, _, err := service.ParseReversePortRange(value); err != nil {
+			return err
+		}
+	case "reverse_secret":
+		if value != "" && len(value) < service.MinReverseSecretLen {
+			return fmt.Errorf("反向隧道密钥至少 %d 个字符", service.MinReverseSecretLen)
+		}
+	case "bcrypt_cost":
+		cost, err := strconv.Atoi(value)
+		if err != nil || cost < minBcryptCost || cost > maxBcryptCost {
+			return fmt.Errorf("bcrypt 成本必须为 %d-%d 之间的整数", minBcryptCost, maxBcryptCost)
+		}
+	case "quota_reset_day":
+		day, err := strconv.Atoi(value)
+		if err != nil || day < 1 || day > service.MaxQuotaResetDay {
+			return fmt.Errorf("配额重置日必须为 1-%d 之间的整数", service.MaxQuotaResetDay)
+		}
+	case "session_mode":
+		if value != model.SessionModeFixed && value != model.SessionModeSliding {
+			return fmt.Errorf("会话模式只能为 fixed 或 sliding")
+		}
+	case "session_ttl_hours":
+		hours, err := strconv.Atoi(value)
+		if err != nil || hours < 1 || hours > model.MaxSessionTTLHours {
+			return fmt.Errorf("会话有效期必须为 1-%d 之间的整数（小时）", model.MaxSessionTTLHours)
+		}
+	case "auto_start_retries":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 || n > maxAutoStartRetries {
+			return fmt.Errorf("自动启动重试次数必须为 0-%d 之间的整数", maxAutoStartRetries)
+		}
+	case "auto_start_retry_interval_sec":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxAutoStartRetryInterval {
+			return fmt.Errorf("自动启动重试间隔必须为 1-%d 之间的整数（秒）", maxAutoStartRetryInterval)
+		}
+	case "cleanup_time":
+		if _, _, err := parseCleanupTime(value); err != nil {
+			return err
+		}
+	case "import_max_rules":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxImportMaxRules {
+			return fmt.Errorf("单次导入规则数上限必须为 1-%d 之间的整数", maxImportMaxRules)
+		}
+	case "geoip_locale":
+		if _, err := service.ParseGeoIPLocales(value); err != nil {
+			return err
+		}
+	case "history_size":
+		size, err := strconv.Atoi(value)
+		if err != nil || size < 0 || size > service.MaxHistorySize {
+			return fmt.Errorf("历史记录条数必须为 0-%d 之间的整数", service.MaxHistorySize)
+		}
+	}
+	return nil
+}
+
+// requireAuth 校验非 /api 入口请求的登录状态，未登录时写入错误响应
+func requireAuth(c *gin.Context) bool {
+	token := c.GetHeader("Authorization")
+	if token == "" {
+		respond(c, Error(401, "未登录"))
+		return false
+	}
+	if _, err := model.GetSession(token); err != nil {
+		respond(c, Error(401, "登录已过期"))
+		return false
+	}
+	return true
+}
+
+// HandleBackup 下载数据库快照（规则、设置及统计）
+func (h *Handlers) HandleBackup(c *gin.Context) {
+	if !requireAuth(c) {
+		return
+	}
+
+	clearDeadlines(c)
+	tmp := filepath.Join(dataDir, fmt.Sprintf("backup_%d.tmp", time.Now().UnixNano()))
+	defer os.Remove(tmp)
+	if err := model.BackupDB(tmp); err != nil {
+		log.Printf("[Backup] 备份失败: %v", err)
+		model.SaveAccessLog(&model.AccessLog{ClientIP: c.ClientIP(), Action: "backup_failed", Detail: err.Error()})
+		respond(c, Error(500, "备份失败"))
+		return
+	}
+
+	log.Printf("[Backup] 已导出数据库备份, client=%s", c.ClientIP())
+	model.SaveAccessLog(&model.AccessLog{ClientIP: c.ClientIP(), Action: "backup"})
+	c.FileAttachment(tmp, fmt.Sprintf("relay-backup-%s.db", time.Now().Format("20060102-150405")))
+}
+
+// HandleRestore 上传数据库备份并替换当前数据库 (multipart/form-data)
+// 需要 confirm=true，恢复前停止所有转发，完成后按恢复的规则重新启动
+func (h *Handlers) HandleRestore(c *gin.Context) {
+	if !requireAuth(c) {
+		return
+	}
+	if c.PostForm("confirm") != "true" {
+		respond(c, Error(400, "恢复将覆盖当前所有规则与设置，请确认后再操作"))
+		return
+	}
+	clearDeadlines(c)
+
+	file, err := c.FormFile("file")
+	if err != nil {
+		respond(c, Error(400, "文件上传失败"))
+		return
+	}
+
+	tmp := filepath.Join(dataDir, "restore_upload.tmp")
+	if err := c.SaveUploadedFile(file, tmp); err != nil {
+		respond(c, Error(500, "保存文件失败"))
+		return
+	}
+	defer os.Remove(tmp)
+
+	if err := model.ValidateBackup(tmp); err != nil {
+		respond(c, Error(400, fmt.Sprintf("无效的备份文件: %v", err)))
+		return
+	}
+
+	h.relayMgr.StopAll(service.ReasonReload)
+	// 规则已全部停止，之后的 reload 需要启动所有已启用的规则
+	h.rememberEnabled(nil)
+	if err := model.RestoreDB(dataDir, tmp); err != nil {
+		log.Printf("[Restore] 恢复失败: %v", err)
+		model.SaveAccessLog(&model.AccessLog{ClientIP: c.ClientIP(), Action: "restore_failed", Detail: err.Error()})
+		h.reload()
+		respond(c, Error(500, fmt.Sprintf("恢复失败: %v", err)))
+		return
+	}
+
+	// 恢复后的数据库中记录本次恢复
+	log.Printf("[Restore] 已从备份恢复数据库, client=%s", c.ClientIP())
+	model.SaveAccessLog(&model.AccessLog{ClientIP: c.ClientIP(), Action: "restore", Detail: file.Filename})
+	h.reload()
+	// 恢复时已清除所有会话，需要重新登录
+	respond(c, Success(nil))
+}
+
+// maxGeoIPLookupBatch system.geoip_lookup 单次查询的 IP 数量上限
+const maxGeoIPLookupBatch = 100
+
+// ipLocation 单个 IP 的查询结果，内网或无法解析的 IP 各字段为空
+type ipLocation struct {
+	IP       string `json:"ip"`
+	Location string `json:"location"`
+	Country  string `json:"country"`
+	ASN      uint   `json:"asn,omitempty"`
+	ASOrg    string `json:"as_org,omitempty"`
+}
+
+// lookupIPs 按请求顺序查询 IP 的地理位置与 ASN
+func (h *Handlers) lookupIPs(ips []string) []ipLocation {
+	result := make([]ipLocation, 0, len(ips))
+	for _, s := range ips {
+		s = strings.TrimSpace(s)
+		loc := ipLocation{IP: s}
+		if ip := net.ParseIP(s); ip != nil && !service.IsPrivateIP(ip) {
+			loc.Location = h.geoIP.Lookup(s)
+			loc.Country = h.geoIP.LookupCountryCode(s)
+			loc.ASN, loc.ASOrg = h.geoIP.LookupASN(s)
+		}
+		result = append(result, loc)
+	}
+	return result
 }
 
 // ==================== Relay 模块 ====================
@@ -391,7 +823,11 @@ func (h *Handlers) HandleGeoIPUpload(c *gin.Context) {
 func (h *Handlers) handleRelay(method string, data map[string]interface{}) APIResponse {
 	switch method {
 	case "list":
-		rules, err := model.GetAllRelayRules()
+		filter, paged, err := h.parseRuleFilter(data)
+		if err != nil {
+			return Error(400, err.Error())
+		}
+		rules, total, err := model.QueryRelayRules(filter)
 		if err != nil {
 			return Error(500, "获取规则失败")
 		}
@@ -400,64 +836,137 @@ func (h *Handlers) handleRelay(method string, data map[string]interface{}) APIRe
 		for i, rule := range rules {
 			status := h.relayMgr.GetStatus(rule.ID)
 			result[i] = map[string]interface{}{
-				"id":          rule.ID,
-				"name":        rule.Name,
-				"src":         rule.Src,
-				"dst":         rule.Dst,
-				"protocol":    rule.Protocol,
-				"enabled":     rule.Enabled,
-				"running":     status.Running,
-				"connections": status.Connections,
-				"bytes_in":    status.BytesIn,
-				"bytes_out":   status.BytesOut,
-				"created_at":  rule.CreatedAt,
+				"id":                          rule.ID,
+				"slug":                        rule.Slug,
+				"name":                        rule.Name,
+				"labels":                      rule.Labels,
+				"src":                         rule.Src,
+				"dst":                         rule.Dst,
+				"protocol":                    rule.Protocol,
+				"enabled":                     rule.Enabled,
+				"running":                     status.Running,
+				"draining":                    status.Draining,
+				"connections":                 status.Connections,
+				"bytes_in":                    status.BytesIn,
+				"bytes_out":                   status.BytesOut,
+				"bytes_in_speed":              status.SpeedIn,
+				"bytes_out_speed":             status.SpeedOut,
+				"lifetime_bytes_in":           status.LifetimeBytesIn,
+				"lifetime_bytes_out":          status.LifetimeBytesOut,
+				"lifetime_connections":        status.LifetimeConnections,
+				"alert_speed_in":              rule.AlertSpeedIn,
+				"alert_speed_out":             rule.AlertSpeedOut,
+				"alert_speed_duration":        rule.AlertSpeedDuration,
+				"alert_daily_bytes":           rule.AlertDailyBytes,
+				"allow_countries":             rule.AllowCountries,
+				"deny_countries":              rule.DenyCountries,
+				"network":                     rule.Network,
+				"transparent":                 rule.Transparent,
+				"max_connections_per_ip":      rule.MaxConnectionsPerIP,
+				"max_new_connections_per_sec": rule.MaxNewConnectionsPerSec,
+				"monthly_byte_quota":          rule.MonthlyByteQuota,
+				"schedule":                    rule.Schedule,
+				"schedule_tz":                 rule.ScheduleTZ,
+				"tls_cert":                    rule.TLSCert,
+				"tls_key":                     rule.TLSKey,
+				"tls_client_ca":               rule.TLSClientCA,
+				"tls_alpn":                    rule.TLSALPN,
+				"upstream_tls":                rule.UpstreamTLS,
+				"http_aware":                  rule.HTTPAware,
+				"log_connections":             rule.LogConnections,
+				"reverse_server":              rule.ReverseServer,
+				"reverse":                     status.Reverse,
+				"upstream_proxy":              model.RedactProxyURL(rule.UpstreamProxy),
+				"speed_limit":                 rule.SpeedLimit,
+				"conn_speed_limit":            rule.ConnSpeedLimit,
+				"balance":                     rule.Balance,
+				"scheduled_off":               status.ScheduledOff,
+				"uptime_seconds":              status.UptimeSeconds,
+				"restart_count":               status.RestartCount,
+				"created_at":                  rule.CreatedAt,
+			}
+			if len(status.ListenAddrs) > 0 {
+				result[i]["listen_addr"] = status.ListenAddrs
+			}
+			if rule.MonthlyByteQuota > 0 {
+				used, _ := h.relayMgr.QuotaUsed(rule)
+				result[i]["quota_used"] = used
+				result[i]["quota_remaining"] = max(rule.MonthlyByteQuota-used, 0)
+			}
+			if len(status.Targets) > 0 {
+				result[i]["targets"] = status.Targets
 			}
 		}
-		return Success(result)
-
-	case "create":
-		name, _ := data["name"].(string)
-		src, _ := data["src"].(string)
-		dst, _ := data["dst"].(string)
-		protocol, _ := data["protocol"].(string)
-		if protocol == "" {
-			protocol = "both"
+		// 未指定分页参数时保持返回完整数组
+		if !paged {
+			return Success(result)
 		}
+		return Success(map[string]interface{}{
+			"list":  result,
+			"total": total,
+			"page":  filter.Page,
+			"size":  filter.Size,
+		})
 
-		log.Printf("[Relay] 创建规则请求: name=%s, src=%s, dst=%s, protocol=%s", name, src, dst, protocol)
-
-		if name == "" || src == "" || dst == "" {
-			log.Printf("[Relay] 创建失败: 参数不完整")
-			return Error(400, "参数不完整")
-		}
+	case "create":
+		log.Printf("[Relay] 创建规则请求: name=%v, src=%v, dst=%v, protocol=%v", data["name"], data["src"], data["dst"], data["protocol"])
 
-		// 验证监听地址格式
-		if err := validateListenAddr(src); err != nil {
+		rule, err := parseRule(data)
+		if err != nil {
 			log.Printf("[Relay] 创建失败: %v", err)
 			return Error(400, err.Error())
 		}
 
-		// 验证目标地址格式
-		if err := validateTargetAddr(dst); err != nil {
+		if err := checkRuleConflict(rule); err != nil {
 			log.Printf("[Relay] 创建失败: %v", err)
-			return Error(400, err.Error())
+			return Error(409, err.Error())
 		}
 
-		// 验证协议
-		if protocol != "tcp" && protocol != "udp" && protocol != "both" {
-			return Error(400, "协议必须是 tcp、udp 或 both")
+		// 端口占用与转发环路预检查，force=true 时跳过
+		if force, _ := data["force"].(bool); !force {
+			if err := h.checkListenAvailable(rule); err != nil {
+				log.Printf("[Relay] 创建失败: %v", err)
+				return Error(409, err.Error())
+			}
+			if err := checkRelayLoop(rule); err != nil {
+				log.Printf("[Relay] 创建失败: %v", err)
+				return Error(409, err.Error())
+			}
 		}
 
-		rule, err := model.CreateRelayRule(name, src, dst, protocol)
-		if err != nil {
+		if err := model.CreateRelayRule(rule); err != nil {
 			log.Printf("[Relay] 创建失败: %v", err)
+			if err == model.ErrSlugExists {
+				return Error(409, "slug 已被其它规则使用")
+			}
 			return Error(500, "创建失败")
 		}
 		log.Printf("[Relay] 创建成功: id=%s", rule.ID)
-		return Success(rule)
+		return Success(rule.Redacted())
+
+	case "validate":
+		valid, checks := h.validateRule(data)
+		return Success(map[string]interface{}{
+			"valid":  valid,
+			"checks": checks,
+		})
+
+	case "test_target":
+		targets, protocols, rule, err := testTargetsFor(data)
+		if err == errRuleNotFound {
+			return Error(404, "规则不存在")
+		}
+		if err != nil {
+			return Error(400, err.Error())
+		}
+		ok, results := probeTargets(targets, protocols, rule)
+		return Success(map[string]interface{}{
+			"ok":      ok,
+			"results": results,
+		})
 
 	case "update":
-		id, _ := data["id"].(string)
+		id := resolveRuleID(data)
 		name, _ := data["name"].(string)
 		src, _ := data["src"].(string)
 		dst, _ := data["dst"].(string)
@@ -467,13 +976,6 @@ func (h *Handlers) handleRelay(method string, data map[string]interface{}) APIRe
 			return Error(400, "id 不能为空")
 		}
 
-		// 验证监听地址格式
-		if src != "" {
-			if err := validateListenAddr(src); err != nil {
-				return Error(400, err.Error())
-			}
-		}
-
 		// 验证目标地址格式
 		if dst != "" {
 			if err := validateTargetAddr(dst); err != nil {
@@ -486,24 +988,77 @@ func (h *Handlers) handleRelay(method string, data map[string]interface{}) APIRe
 			return Error(400, "协议必须是 tcp、udp 或 both")
 		}
 
+		rule, err := model.GetRelayRule(id)
+		if err != nil {
+			return Error(404, "规则不存在")
+		}
+
+		// 验证监听地址格式；关闭透明代理时原有的监听地址也需要重新检查
+		transparent := ruleTransparent(data, rule.Transparent)
+		if src != "" || (rule.Transparent && !transparent) {
+			listen := src
+			if listen == "" {
+				listen = rule.Src
+			}
+			if err := validateListenAddr(listen, transparent); err != nil {
+				return Error(400, err.Error())
+			}
+		}
+
+		if name != "" {
+			rule.Name = name
+		}
+		if src != "" {
+			rule.Src = src
+		}
+		if dst != "" {
+			rule.Dst = dst
+		}
+		if protocol != "" {
+			rule.Protocol = protocol
+		}
+		if err := applyRuleOptions(rule, data); err != nil {
+			return Error(400, err.Error())
+		}
+		if _, err := service.ExpandMappings(rule.Src, rule.Dst); err != nil {
+			return Error(400, err.Error())
+		}
+
+		if err := checkRuleConflict(rule); err != nil {
+			return Error(409, err.Error())
+		}
+
+		// 端口占用与转发环路预检查，force=true 时跳过
+		if force, _ := data["force"].(bool); !force {
+			if err := h.checkListenAvailable(rule); err != nil {
+				return Error(409, err.Error())
+			}
+			if err := checkRelayLoop(rule); err != nil {
+				return Error(409, err.Error())
+			}
+		}
+
 		// 如果正在运行，先停止
 		if h.relayMgr.IsRunning(id) {
-			h.relayMgr.Stop(id)
+			h.relayMgr.Stop(id, service.ReasonManual)
 		}
 
-		if err := model.UpdateRelayRule(id, name, src, dst, protocol); err != nil {
+		if err := model.UpdateRelayRule(rule); err != nil {
+			if err == model.ErrSlugExists {
+				return Error(409, "slug 已被其它规则使用")
+			}
 			return Error(500, "更新失败")
 		}
 		return Success(nil)
 
 	case "delete":
-		id, _ := data["id"].(string)
+		id := resolveRuleID(data)
 		if id == "" {
 			return Error(400, "id 不能为空")
 		}
 
 		// 停止运行
-		h.relayMgr.Stop(id)
+		h.relayMgr.Stop(id, service.ReasonManual)
 
 		if err := model.DeleteRelayRule(id); err != nil {
 			return Error(500, "删除失败")
@@ -511,7 +1066,7 @@ func (h *Handlers) handleRelay(method string, data map[string]interface{}) APIRe
 		return Success(nil)
 
 	case "start":
-		id, _ := data["id"].(string)
+		id := resolveRuleID(data)
 		log.Printf("[Relay] 启动请求: id=%s", id)
 		if id == "" {
 			return Error(400, "id 不能为空")
@@ -525,7 +1080,15 @@ func (h *Handlers) handleRelay(method string, data map[string]interface{}) APIRe
 
 		log.Printf("[Relay] 找到规则: name=%s, src=%s, dst=%s, protocol=%s", rule.Name, rule.Src, rule.Dst, rule.Protocol)
 
-		if err := h.relayMgr.Start(rule, h.wsHub, h.geoIP); err != nil {
+		// 排空中的规则仍在运行，启动即恢复接受新连接
+		if h.relayMgr.IsDraining(id) {
+			if err := h.relayMgr.SetDraining(id, false); err != nil {
+				return Error(409, err.Error())
+			}
+			return Success(nil)
+		}
+
+		if err := h.relayMgr.Start(rule, h.wsHub, h.geoIP, service.ReasonManual); err != nil {
 			log.Printf("[Relay] 启动失败: %v", err)
 			return Error(500, err.Error())
 		}
@@ -533,38 +1096,53 @@ func (h *Handlers) handleRelay(method string, data map[string]interface{}) APIRe
 		return Success(nil)
 
 	case "stop":
-		id, _ := data["id"].(string)
+		id := resolveRuleID(data)
 		log.Printf("[Relay] 停止请求: id=%s", id)
 		if id == "" {
 			return Error(400, "id 不能为空")
 		}
-		h.relayMgr.Stop(id)
+		h.relayMgr.StopManual(id)
 		log.Printf("[Relay] 停止成功: id=%s", id)
 		return Success(nil)
 
+	case "drain", "undrain":
+		id := resolveRuleID(data)
+		if id == "" {
+			return Error(400, "id 不能为空")
+		}
+		if _, err := model.GetRelayRule(id); err != nil {
+			return Error(404, "规则不存在")
+		}
+		if err := h.relayMgr.SetDraining(id, method == "drain"); err != nil {
+			return Error(409, err.Error())
+		}
+		return Success(nil)
+
 	case "start_all":
 		rules, err := model.GetEnabledRelayRules()
 		if err != nil {
 			return Error(500, "获取规则失败")
 		}
 		for _, rule := range rules {
-			h.relayMgr.Start(rule, h.wsHub, h.geoIP)
+			h.relayMgr.Start(rule, h.wsHub, h.geoIP, service.ReasonManual)
 		}
 		return Success(nil)
 
 	case "stop_all":
-		h.relayMgr.StopAll()
+		for _, id := range h.relayMgr.RunningIDs() {
+			h.relayMgr.StopManual(id)
+		}
 		return Success(nil)
 
 	case "set_enabled":
-		id, _ := data["id"].(string)
+		id := resolveRuleID(data)
 		enabled, _ := data["enabled"].(bool)
 		if id == "" {
 			return Error(400, "id 不能为空")
 		}
 		// 如果禁用且正在运行，先停止
 		if !enabled && h.relayMgr.IsRunning(id) {
-			h.relayMgr.Stop(id)
+			h.relayMgr.Stop(id, service.ReasonManual)
 		}
 		if err := model.SetRelayEnabled(id, enabled); err != nil {
 			return Error(500, "设置失败")
@@ -572,7 +1150,7 @@ func (h *Handlers) handleRelay(method string, data map[string]interface{}) APIRe
 		return Success(nil)
 
 	case "status":
-		id, _ := data["id"].(string)
+		id := resolveRuleID(data)
 		if id != "" {
 			status := h.relayMgr.GetStatus(id)
 			return Success(status)
@@ -580,45 +1158,75 @@ func (h *Handlers) handleRelay(method string, data map[string]interface{}) APIRe
 		// 返回所有状态
 		return Success(h.relayMgr.GetAllStatus())
 
-	case "export":
-		rules, err := model.GetAllRelayRules()
-		if err != nil {
-			return Error(500, "获取规则失败")
+	case "errors":
+		id := resolveRuleID(data)
+		if id == "" {
+			return Error(400, "id 不能为空")
+		}
+		return Success(h.relayMgr.Errors(id))
+
+	case "history":
+		id := resolveRuleID(data)
+		page := int(getFloat(data, "page", 1))
+		size := int(getFloat(data, "size", 20))
+		if id == "" {
+			return Error(400, "id 不能为空")
+		}
+		if page < 1 {
+			page = 1
+		}
+		if size < 1 || size > 500 {
+			size = 20
+		}
+
+		// 历史保存在运行中实例的内存中；开启 persist_history 时规则启动会从数据库恢复最近的记录
+		conns, total := h.relayMgr.GetHistory(id, page, size)
+		return Success(map[string]interface{}{
+			"list":  conns,
+			"total": total,
+			"page":  page,
+			"size":  size,
+		})
+
+	case "connections":
+		id := resolveRuleID(data)
+		if id == "" {
+			return Error(400, "id 不能为空")
+		}
+		filter := parseConnectionFilter(data)
+		if err := filter.Validate(); err != nil {
+			return Error(400, err.Error())
 		}
-		return Success(rules)
+		// 活跃连接与内存中的历史记录一起过滤排序
+		return Success(h.relayMgr.ListConnections(id, filter))
+
+	case "export":
+		rules, err := model.GetAllRelayRules()
+		if err != nil {
+			return Error(500, "获取规则失败")
+		}
+		return Success(model.RedactRules(rules))
 
 	case "import":
 		rulesData, ok := data["rules"].([]interface{})
 		if !ok {
 			return Error(400, "无效的规则数据")
 		}
+		onConflict, err := parseOnConflict(data)
+		if err != nil {
+			return Error(400, err.Error())
+		}
+		if err := checkImportSize(len(rulesData)); err != nil {
+			return Error(413, err.Error())
+		}
 
-		var created, skipped int
-		for _, r := range rulesData {
-			rule, ok := r.(map[string]interface{})
-			if !ok {
-				continue
-			}
-			name, _ := rule["name"].(string)
-			src, _ := rule["src"].(string)
-			dst, _ := rule["dst"].(string)
-			protocol, _ := rule["protocol"].(string)
-			if protocol == "" {
-				protocol = "both"
-			}
-
-			// 检查监听地址是否已存在
-			if existing, _ := model.GetRelayRuleBySrc(src); existing != nil {
-				skipped++
-				continue
-			}
-
-			if _, err := model.CreateRelayRule(name, src, dst, protocol); err == nil {
-				created++
-			}
+		created, updated, skipped, err := h.importRules(rulesData, onConflict)
+		if err != nil {
+			return Error(500, err.Error())
 		}
 		return Success(map[string]interface{}{
 			"created": created,
+			"updated": updated,
 			"skipped": skipped,
 		})
 
@@ -627,6 +1235,107 @@ func (h *Handlers) handleRelay(method string, data map[string]interface{}) APIRe
 	}
 }
 
+// parseRuleFilter 解析 relay.list 的过滤与分页参数，提供了 page 或 size 时 paged 为 true
+func (h *Handlers) parseRuleFilter(data map[string]interface{}) (model.RelayRuleFilter, bool, error) {
+	var f model.RelayRuleFilter
+	f.Name, _ = data["name"].(string)
+	f.Protocol, _ = data["protocol"].(string)
+	if f.Protocol != "" && f.Protocol != "tcp" && f.Protocol != "udp" && f.Protocol != "both" {
+		return f, false, fmt.Errorf("协议必须是 tcp、udp 或 both")
+	}
+	if enabled, ok := data["enabled"].(bool); ok {
+		f.Enabled = &enabled
+	}
+	if running, ok := data["running"].(bool); ok {
+		f.Running = &running
+		f.RunningIDs = h.relayMgr.RunningIDs()
+	}
+
+	_, hasPage := data["page"]
+	_, hasSize := data["size"]
+	if !hasPage && !hasSize {
+		return f, false, nil
+	}
+	f.Page = int(getFloat(data, "page", 1))
+	f.Size = int(getFloat(data, "size", 20))
+	if f.Page < 1 {
+		f.Page = 1
+	}
+	if f.Size < 1 || f.Size > 500 {
+		return f, false, fmt.Errorf("size 必须在 1-500 之间")
+	}
+	return f, true, nil
+}
+
+// checkRuleConflict 检查规则是否与其它规则的监听地址及协议冲突（包括未运行的规则）
+func checkRuleConflict(rule *model.RelayRule) error {
+	if rule.IsReverse() {
+		return nil
+	}
+	conflict, err := model.FindConflictingRule(rule.Src, rule.Protocol, rule.ID)
+	if err != nil {
+		return fmt.Errorf("检查规则冲突失败: %v", err)
+	}
+	if conflict != nil {
+		return fmt.Errorf("与规则 %s 冲突: 监听地址 %s (%s) 与 %s (%s) 重叠",
+			conflict.Name, rule.Src, rule.Protocol, conflict.Src, conflict.Protocol)
+	}
+	return nil
+}
+
+// checkRelayLoop 检查规则的目标是否指向自身或其它规则的监听地址
+func checkRelayLoop(rule *model.RelayRule) error {
+	rules, err := model.GetAllRelayRules()
+	if err != nil {
+		return fmt.Errorf("检查转发环路失败: %v", err)
+	}
+	loop, err := service.FindRelayLoop(rule, rules)
+	if err != nil {
+		return fmt.Errorf("检查转发环路失败: %v", err)
+	}
+	if loop != nil {
+		return fmt.Errorf("%v（确认无误可设置 force=true 跳过检查）", loop)
+	}
+	return nil
+}
+
+// checkListenAvailable 检查监听地址是否已被其它进程占用
+func (h *Handlers) checkListenAvailable(rule *model.RelayRule) error {
+	// 反向模式由服务端监听
+	if rule.IsReverse() {
+		return nil
+	}
+	// 规则自身正在监听同一地址时无需再试探
+	if running, ok := h.relayMgr.RunningRule(rule.ID); ok && running.Src == rule.Src {
+		return nil
+	}
+
+	mappings, err := service.ExpandMappings(rule.Src, rule.Dst)
+	if err != nil {
+		return err
+	}
+
+	// 逐端口尝试绑定后立即释放
+	lc := service.ListenConfig(rule)
+	for _, m := range mappings {
+		if (rule.Protocol == "tcp" || rule.Protocol == "both") && !service.HasActivatedSocket("tcp", m.Src) {
+			ln, err := lc.Listen(context.Background(), rule.ListenNetworkFor("tcp", m.Src), m.Src)
+			if err != nil {
+				return fmt.Errorf("TCP 端口不可用: %s", service.DescribeListenError(err))
+			}
+			ln.Close()
+		}
+		if (rule.Protocol == "udp" || rule.Protocol == "both") && !service.HasActivatedSocket("udp", m.Src) {
+			pc, err := lc.ListenPacket(context.Background(), rule.ListenNetworkFor("udp", m.Src), m.Src)
+			if err != nil {
+				return fmt.Errorf("UDP 端口不可用: %s", service.DescribeListenError(err))
+			}
+			pc.Close()
+		}
+	}
+	return nil
+}
+
 // ==================== Stats 模块 ====================
 
 func (h *Handlers) handleStats(method string, data map[string]interface{}) APIResponse {
@@ -643,30 +1352,120 @@ func (h *Handlers) handleStats(method string, data map[string]interface{}) APIRe
 			"active_relays":     h.relayMgr.ActiveCount(),
 		})
 
+	case "overview_series":
+		rangeStr, _ := data["range"].(string)
+		hours := statsRangeHours(rangeStr)
+
+		granularity, _ := data["granularity"].(string)
+		var points []*model.TrafficPoint
+		var err error
+		switch granularity {
+		case "", "hour":
+			points, err = model.GetOverviewSeries(hours)
+		case "day":
+			points, err = model.GetOverviewDailySeries(hours / 24)
+		default:
+			return Error(400, "granularity 必须是 hour 或 day")
+		}
+		if err != nil {
+			return Error(500, "获取统计失败")
+		}
+		return Success(points)
+
 	case "relay":
 		id, _ := data["id"].(string)
 		rangeStr, _ := data["range"].(string)
 
-		hours := 24
-		switch rangeStr {
-		case "7d":
-			hours = 24 * 7
-		case "30d":
-			hours = 24 * 30
+		hours := statsRangeHours(rangeStr)
+
+		granularity, _ := data["granularity"].(string)
+		var stats []*model.RelayStat
+		var err error
+		switch granularity {
+		case "", "hour":
+			stats, err = model.GetRelayStats(id, hours)
+		case "day":
+			stats, err = model.GetRelayDailyStats(id, hours/24)
+		default:
+			return Error(400, "granularity 必须是 hour 或 day")
+		}
+		if err != nil {
+			return Error(500, "获取统计失败")
+		}
+		return Success(stats)
+
+	case "by_country":
+		relayID, _ := data["relay_id"].(string)
+		rangeStr, _ := data["range"].(string)
+		limit := int(getFloat(data, "limit", 10))
+		if limit < 1 || limit > 250 {
+			limit = 10
+		}
+
+		hours := statsRangeHours(rangeStr)
+
+		stats, err := model.GetCountryStats(relayID, time.Now().Add(-time.Duration(hours)*time.Hour), limit)
+		if err != nil {
+			return Error(500, "获取统计失败")
 		}
+		return Success(stats)
 
-		stats, err := model.GetRelayStats(id, hours)
+	case "top_clients":
+		relayID, _ := data["relay_id"].(string)
+		rangeStr, _ := data["range"].(string)
+		limit := int(getFloat(data, "limit", 20))
+		if limit < 1 || limit > 500 {
+			limit = 20
+		}
+
+		hours := statsRangeHours(rangeStr)
+		stats, err := model.GetTopClients(relayID, time.Now().Add(-time.Duration(hours)*time.Hour), limit)
 		if err != nil {
 			return Error(500, "获取统计失败")
 		}
+		for _, s := range stats {
+			s.Location = h.geoIP.Lookup(s.ClientIP)
+		}
 		return Success(stats)
 
-	case "logs":
+	case "duration_histogram":
 		relayID, _ := data["relay_id"].(string)
+		rangeStr, _ := data["range"].(string)
+		bounds := model.DefaultDurationBuckets
+		if _, ok := data["buckets"]; ok {
+			var err error
+			if bounds, err = parseDurationBuckets(data["buckets"]); err != nil {
+				return Error(400, err.Error())
+			}
+		}
+
+		hours := statsRangeHours(rangeStr)
+		buckets, err := model.GetDurationHistogram(relayID, time.Now().Add(-time.Duration(hours)*time.Hour), bounds)
+		if err != nil {
+			return Error(500, "获取统计失败")
+		}
+		return Success(buckets)
+
+	case "logs":
+		var filter model.AccessLogFilter
+		filter.RelayID, _ = data["relay_id"].(string)
+		filter.ClientIP, _ = data["client_ip"].(string)
+		filter.Action, _ = data["action"].(string)
 		page := int(getFloat(data, "page", 1))
 		size := int(getFloat(data, "size", 20))
 
-		logs, total, err := model.GetAccessLogs(relayID, page, size)
+		if !validIPFilter(filter.ClientIP) {
+			return Error(400, "client_ip 只能包含 IP 地址字符，前缀匹配时以 * 结尾")
+		}
+		// label 为 key=value，或只给出 key 表示存在该标签
+		if label, _ := data["label"].(string); label != "" {
+			filter.LabelKey, filter.LabelValue, _ = strings.Cut(label, "=")
+			if filter.LabelKey == "" || !labelChars(filter.LabelKey, "_.-") {
+				return Error(400, "label 格式为 key=value 或 key")
+			}
+		}
+
+		logs, total, err := model.GetAccessLogs(filter, page, size)
 		if err != nil {
 			return Error(500, "获取日志失败")
 		}
@@ -682,6 +1481,7 @@ func (h *Handlers) handleStats(method string, data map[string]interface{}) APIRe
 		if err := model.ClearStats(relayID); err != nil {
 			return Error(500, "清除失败")
 		}
+		h.relayMgr.InvalidateLifetime()
 		return Success(nil)
 
 	default:
@@ -691,9 +1491,37 @@ func (h *Handlers) handleStats(method string, data map[string]interface{}) APIRe
 
 // ==================== WebSocket ====================
 
+// wsSubprotocol 浏览器通过 Sec-WebSocket-Protocol 传递令牌时协商的子协议
+// 客户端同时提供 "relay" 与 "token.<令牌>"，服务端仅回应 "relay"
+const (
+	wsSubprotocol   = "relay"
+	wsTokenProtocol = "token."
+)
+
+// wsToken 读取 WebSocket 认证令牌，优先使用请求头
+// 依次检查 Authorization、Sec-WebSocket-Protocol，最后兼容查询参数 token
+// （查询参数会出现在代理日志与浏览器历史中，不推荐使用）
+func wsToken(c *gin.Context) string {
+	if token := c.GetHeader("Authorization"); token != "" {
+		return strings.TrimPrefix(token, "Bearer ")
+	}
+	for _, p := range websocket.Subprotocols(c.Request) {
+		if strings.HasPrefix(p, wsTokenProtocol) {
+			// 子协议不允许出现 '='，客户端去掉了 base64 填充
+			token := strings.TrimPrefix(p, wsTokenProtocol)
+			if n := len(token) % 4; n != 0 {
+				token += strings.Repeat("=", 4-n)
+			}
+			return token
+		}
+	}
+	return c.Query("token")
+}
+
 // createUpgrader 创建 WebSocket upgrader，验证 Origin
 func createUpgrader(r *http.Request) websocket.Upgrader {
 	return websocket.Upgrader{
+		Subprotocols: []string{wsSubprotocol},
 		CheckOrigin: func(req *http.Request) bool {
 			origin := req.Header.Get("Origin")
 			if origin == "" {
@@ -712,21 +1540,14 @@ func createUpgrader(r *http.Request) websocket.Upgrader {
 			}
 
 			// 检查是否在允许列表中
-			origins := strings.Split(allowOrigin, ",")
-			for _, o := range origins {
-				trimmed := strings.TrimSpace(o)
-				if trimmed == "*" || trimmed == origin {
-					return true
-				}
-			}
-			return false
+			return originAllowed(allowOrigin, origin)
 		},
 	}
 }
 
 func (h *Handlers) HandleWebSocket(c *gin.Context) {
 	// 验证 token
-	token := c.Query("token")
+	token := wsToken(c)
 	if token == "" {
 		c.JSON(401, Error(401, "未提供认证令牌"))
 		return
@@ -737,6 +1558,9 @@ func (h *Handlers) HandleWebSocket(c *gin.Context) {
 		return
 	}
 
+	// 升级后的连接长期保持，不受 HTTP 读写超时限制
+	clearDeadlines(c)
+
 	// 创建 upgrader 并升级连接
 	upgrader := createUpgrader(c.Request)
 	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
@@ -746,11 +1570,13 @@ func (h *Handlers) HandleWebSocket(c *gin.Context) {
 	}
 
 	client := &WSClient{
-		hub:      h.wsHub,
-		conn:     conn,
-		send:     make(chan []byte, 256),
-		topics:   make(map[string]bool),
-		relayIDs: make(map[string]bool),
+		hub:       h.wsHub,
+		conn:      conn,
+		send:      make(chan []byte, 256),
+		topics:    make(map[string]bool),
+		relayIDs:  make(map[string]bool),
+		lastSent:  make(map[string]time.Time),
+		readLimit: loadWSReadLimit(),
 	}
 
 	h.wsHub.register <- client
@@ -771,6 +1597,29 @@ func generateToken() (string, error) {
 	return base64.URLEncoding.EncodeToString(b), nil
 }
 
+// parseConnectionFilter 读取连接列表的过滤与排序参数
+func parseConnectionFilter(data map[string]interface{}) service.ConnectionFilter {
+	var f service.ConnectionFilter
+	f.ClientIP, _ = data["client_ip"].(string)
+	f.Country, _ = data["country"].(string)
+	f.MinBytes = int64(getFloat(data, "min_bytes", 0))
+	f.Sort, _ = data["sort"].(string)
+	f.Order, _ = data["order"].(string)
+	f.Limit = int(getFloat(data, "limit", 0))
+	return f
+}
+
+// statsRangeHours 将统计范围 24h/7d/30d 转换为小时数，默认 24 小时
+func statsRangeHours(rangeStr string) int {
+	switch rangeStr {
+	case "7d":
+		return 24 * 7
+	case "30d":
+		return 24 * 30
+	}
+	return 24
+}
+
 func getFloat(data map[string]interface{}, key string, defaultVal float64) float64 {
 	if v, ok := data[key].(float64); ok {
 		return v
@@ -778,56 +1627,582 @@ func getFloat(data map[string]interface{}, key string, defaultVal float64) float
 	return defaultVal
 }
 
-// validateListenAddr 验证监听地址格式
-func validateListenAddr(addr string) error {
-	host, portStr, err := net.SplitHostPort(addr)
+// maxDurationBuckets 连接时长直方图最多的分界数
+const maxDurationBuckets = 20
+
+// parseDurationBuckets 解析时长直方图的分界（秒），必须为严格递增的正整数
+func parseDurationBuckets(v interface{}) ([]int64, error) {
+	list, ok := v.([]interface{})
+	if !ok || len(list) == 0 || len(list) > maxDurationBuckets {
+		return nil, fmt.Errorf("buckets 必须为 1-%d 个递增的秒数", maxDurationBuckets)
+	}
+	bounds := make([]int64, 0, len(list))
+	for _, item := range list {
+		f, ok := item.(float64)
+		if !ok || f <= 0 || f != float64(int64(f)) {
+			return nil, fmt.Errorf("buckets 的分界必须为正整数（秒）")
+		}
+		if n := len(bounds); n > 0 && int64(f) <= bounds[n-1] {
+			return nil, fmt.Errorf("buckets 的分界必须严格递增")
+		}
+		bounds = append(bounds, int64(f))
+	}
+	return bounds, nil
+}
+
+// parseRule 从请求数据构造并校验新规则（不写入数据库）
+func parseRule(data map[string]interface{}) (*model.RelayRule, error) {
+	name, _ := data["name"].(string)
+	src, _ := data["src"].(string)
+	dst, _ := data["dst"].(string)
+	protocol, _ := data["protocol"].(string)
+	if protocol == "" {
+		protocol = "both"
+	}
+
+	if name == "" || src == "" || dst == "" {
+		return nil, fmt.Errorf("参数不完整")
+	}
+
+	// 验证监听地址格式
+	if err := validateListenAddr(src, ruleTransparent(data, false)); err != nil {
+		return nil, err
+	}
+
+	// 验证目标地址格式
+	if err := validateTargetAddr(dst); err != nil {
+		return nil, err
+	}
+
+	// 验证端口段两侧长度一致
+	if _, err := service.ExpandMappings(src, dst); err != nil {
+		return nil, err
+	}
+
+	// 验证协议
+	if protocol != "tcp" && protocol != "udp" && protocol != "both" {
+		return nil, fmt.Errorf("协议必须是 tcp、udp 或 both")
+	}
+
+	rule := &model.RelayRule{Name: name, Src: src, Dst: dst, Protocol: protocol, LogConnections: true}
+	if err := applyRuleOptions(rule, data); err != nil {
+		return nil, err
+	}
+	return rule, nil
+}
+
+// applyRuleOptions 从请求数据中读取规则的可选配置并校验，未提供的字段保持原值
+func applyRuleOptions(rule *model.RelayRule, data map[string]interface{}) error {
+	rule.AlertSpeedIn = int64(getFloat(data, "alert_speed_in", float64(rule.AlertSpeedIn)))
+	rule.AlertSpeedOut = int64(getFloat(data, "alert_speed_out", float64(rule.AlertSpeedOut)))
+	rule.AlertSpeedDuration = int64(getFloat(data, "alert_speed_duration", float64(rule.AlertSpeedDuration)))
+	rule.AlertDailyBytes = int64(getFloat(data, "alert_daily_bytes", float64(rule.AlertDailyBytes)))
+
+	if rule.AlertSpeedIn < 0 || rule.AlertSpeedOut < 0 || rule.AlertDailyBytes < 0 {
+		return fmt.Errorf("告警阈值不能为负数")
+	}
+	if rule.AlertSpeedDuration < 0 || rule.AlertSpeedDuration > 3600 {
+		return fmt.Errorf("告警持续时间必须在 0-3600 秒之间")
+	}
+
+	rule.MaxConnectionsPerIP = int64(getFloat(data, "max_connections_per_ip", float64(rule.MaxConnectionsPerIP)))
+	if rule.MaxConnectionsPerIP < 0 || rule.MaxConnectionsPerIP > 100000 {
+		return fmt.Errorf("单 IP 连接上限必须在 0-100000 之间")
+	}
+	rule.MaxNewConnectionsPerSec = int64(getFloat(data, "max_new_connections_per_sec", float64(rule.MaxNewConnectionsPerSec)))
+	if rule.MaxNewConnectionsPerSec < 0 || rule.MaxNewConnectionsPerSec > 100000 {
+		return fmt.Errorf("每秒新建连接上限必须在 0-100000 之间")
+	}
+
+	rule.SpeedLimit = int64(getFloat(data, "speed_limit", float64(rule.SpeedLimit)))
+	rule.ConnSpeedLimit = int64(getFloat(data, "conn_speed_limit", float64(rule.ConnSpeedLimit)))
+	for _, limit := range []int64{rule.SpeedLimit, rule.ConnSpeedLimit} {
+		if limit != 0 && limit < service.MinSpeedLimit {
+			return fmt.Errorf("限速必须为 0（不限速）或不小于 %d bytes/s", service.MinSpeedLimit)
+		}
+	}
+	if (rule.SpeedLimit > 0 || rule.ConnSpeedLimit > 0) && rule.Protocol == "udp" {
+		return fmt.Errorf("限速仅支持 TCP 转发")
+	}
+
+	if v, ok := data["balance"].(string); ok {
+		rule.Balance = v
+	}
+	if rule.Balance != "" && rule.Balance != service.BalanceIPHash {
+		return fmt.Errorf("负载均衡方式必须为空（加权轮询）或 %s", service.BalanceIPHash)
+	}
+
+	rule.MonthlyByteQuota = int64(getFloat(data, "monthly_byte_quota", float64(rule.MonthlyByteQuota)))
+	if rule.MonthlyByteQuota < 0 {
+		return fmt.Errorf("流量配额不能为负数")
+	}
+
+	if schedule, ok := data["schedule"].(string); ok {
+		rule.Schedule = strings.TrimSpace(schedule)
+	}
+	if tz, ok := data["schedule_tz"].(string); ok {
+		rule.ScheduleTZ = strings.TrimSpace(tz)
+	}
+	if rule.Schedule != "" {
+		if _, err := service.ParseSchedule(rule.Schedule, rule.ScheduleTZ); err != nil {
+			return fmt.Errorf("运行计划无效: %v", err)
+		}
+	}
+
+	for key, field := range map[string]*string{
+		"tls_cert":      &rule.TLSCert,
+		"tls_key":       &rule.TLSKey,
+		"tls_client_ca": &rule.TLSClientCA,
+	} {
+		if v, ok := data[key].(string); ok {
+			*field = strings.TrimSpace(v)
+		}
+	}
+	if upstreamTLS, ok := data["upstream_tls"].(bool); ok {
+		rule.UpstreamTLS = upstreamTLS
+	}
+	if rule.UpstreamTLS && rule.Protocol != "tcp" {
+		return fmt.Errorf("TLS 仅支持 tcp 协议")
+	}
+	if upstreamProxy, ok := data["upstream_proxy"].(string); ok {
+		upstreamProxy = strings.TrimSpace(upstreamProxy)
+		// 与隐藏密码后的原值相同表示保持原值，其它带掩码密码的地址（如导入导出结果）需要重新填写
+		if rule.UpstreamProxy == "" || upstreamProxy != model.RedactProxyURL(rule.UpstreamProxy) {
+			if model.ProxyPasswordMasked(upstreamProxy) {
+				return fmt.Errorf("上游代理密码已隐藏，请重新填写")
+			}
+			rule.UpstreamProxy = upstreamProxy
+		}
+	}
+	if rule.UpstreamProxy != "" {
+		if rule.Protocol != "tcp" {
+			return fmt.Errorf("上游代理仅支持 tcp 协议")
+		}
+		if _, err := service.ParseUpstreamProxy(rule.UpstreamProxy); err != nil {
+			return err
+		}
+	}
+	if httpAware, ok := data["http_aware"].(bool); ok {
+		rule.HTTPAware = httpAware
+	}
+	if logConnections, ok := data["log_connections"].(bool); ok {
+		rule.LogConnections = logConnections
+	}
+	if rule.HTTPAware && rule.Protocol != "tcp" {
+		return fmt.Errorf("HTTP 感知模式仅支持 tcp 协议")
+	}
+	if list, ok := getStringList(data, "tls_alpn"); ok {
+		protos, err := normalizeALPN(list)
+		if err != nil {
+			return err
+		}
+		rule.TLSALPN = protos
+	}
+	if len(rule.TLSALPN) > 0 && rule.TLSCert == "" {
+		return fmt.Errorf("tls_alpn 需要同时配置 TLS 证书")
+	}
+	if rule.TLSCert != "" || rule.TLSKey != "" || rule.TLSClientCA != "" {
+		if rule.Protocol != "tcp" {
+			return fmt.Errorf("TLS 仅支持 tcp 协议")
+		}
+		// 保存前确认证书、私钥与 CA 文件可以正常加载
+		if _, err := service.LoadTLSConfig(rule); err != nil {
+			return err
+		}
+	}
+
+	if slug, ok := data["slug"].(string); ok {
+		if err := validateSlug(slug); err != nil {
+			return err
+		}
+		rule.Slug = slug
+	}
+
+	if raw, ok := data["labels"]; ok {
+		labels, err := parseLabels(raw)
+		if err != nil {
+			return err
+		}
+		rule.Labels = labels
+	}
+
+	if network, ok := data["network"].(string); ok {
+		rule.Network = network
+	}
+	// 协议可能在更新时被修改，始终重新校验
+	if err := validateNetwork(rule.Network, rule.Protocol); err != nil {
+		return err
+	}
+
+	if transparent, ok := data["transparent"].(bool); ok {
+		if transparent && !service.TransparentSupported {
+			return fmt.Errorf("透明代理仅支持 Linux")
+		}
+		rule.Transparent = transparent
+	}
+	if rule.Transparent && rule.UpstreamProxy != "" {
+		return fmt.Errorf("透明代理不能与上游代理同时使用")
+	}
+
+	if reverseServer, ok := data["reverse_server"].(string); ok {
+		rule.ReverseServer = strings.TrimSpace(reverseServer)
+	}
+	if reverseSecret, ok := data["reverse_secret"].(string); ok {
+		// 掩码表示保持原值，没有原值时（如导入导出结果）需要重新填写
+		if reverseSecret != model.SecretMask {
+			rule.ReverseSecret = reverseSecret
+		} else if rule.ReverseSecret == "" {
+			return fmt.Errorf("反向隧道密钥已隐藏，请重新填写")
+		}
+	}
+	if rule.IsReverse() {
+		if err := validateReverseRule(rule); err != nil {
+			return err
+		}
+	}
+
+	if list, ok := getStringList(data, "allow_countries"); ok {
+		codes, err := normalizeCountryCodes(list)
+		if err != nil {
+			return err
+		}
+		rule.AllowCountries = codes
+	}
+	if list, ok := getStringList(data, "deny_countries"); ok {
+		codes, err := normalizeCountryCodes(list)
+		if err != nil {
+			return err
+		}
+		rule.DenyCountries = codes
+	}
+	return nil
+}
+
+// validateReverseRule 校验反向模式规则：服务端地址为单个 host:port，监听地址为服务端上的单个端口，仅支持 TCP
+func validateReverseRule(rule *model.RelayRule) error {
+	host, port, err := net.SplitHostPort(rule.ReverseServer)
+	if err != nil || host == "" {
+		return fmt.Errorf("反向隧道服务端地址格式为 host:port")
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("反向隧道服务端端口必须在 1-65535 之间")
+	}
+	if len(rule.ReverseSecret) < service.MinReverseSecretLen {
+		return fmt.Errorf("反向隧道密钥至少 %d 个字符", service.MinReverseSecretLen)
+	}
+	if rule.Protocol != "tcp" {
+		return fmt.Errorf("反向模式仅支持 tcp 协议")
+	}
+	// src 为服务端上的监听地址，无法按本机网卡校验，只允许监听服务端的全部地址
+	host, start, end, err := model.ParsePortRange(rule.Src)
 	if err != nil {
-		return fmt.Errorf("地址格式错误: %v", err)
+		return fmt.Errorf("反向模式的监听地址必须是单个地址: %v", err)
+	}
+	if start != end {
+		return fmt.Errorf("反向模式不支持端口段")
+	}
+	if host != "" && host != "0.0.0.0" && host != "::" {
+		return fmt.Errorf("反向模式的监听地址主机部分只能为空、0.0.0.0 或 ::")
+	}
+	if rule.Transparent || rule.Network != "" {
+		return fmt.Errorf("反向模式不能与透明代理或网络类型同时使用")
+	}
+	return nil
+}
+
+// validateSlug 校验规则 slug，仅允许小写字母、数字和连字符，空值表示不设置
+func validateSlug(slug string) error {
+	if len(slug) > 64 {
+		return fmt.Errorf("slug 长度不能超过 64")
+	}
+	for _, c := range slug {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+			return fmt.Errorf("slug 只能包含小写字母、数字和连字符")
+		}
+	}
+	return nil
+}
+
+const (
+	maxRuleLabels    = 16  // 单条规则的标签数上限
+	maxLabelKeyLen   = 63  // 标签键长度上限
+	maxLabelValueLen = 128 // 标签值长度上限
+)
+
+// parseLabels 解析规则标签，格式为 {"env": "prod"}，null 表示清空
+// 键以字母或数字开头，只能包含字母、数字和 _.-；值不能为空，另外允许 :/@
+func parseLabels(raw interface{}) (map[string]string, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	obj, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("labels 必须为对象，如 {\"env\": \"prod\"}")
+	}
+	if len(obj) > maxRuleLabels {
+		return nil, fmt.Errorf("标签最多 %d 个", maxRuleLabels)
+	}
+	labels := make(map[string]string, len(obj))
+	for key, v := range obj {
+		value, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("标签 %s 的值必须为字符串", key)
+		}
+		if key == "" || len(key) > maxLabelKeyLen || !labelChars(key, "_.-") || !isAlnum(key[0]) {
+			return nil, fmt.Errorf("无效的标签键 %q：长度 1-%d，以字母或数字开头，只能包含字母、数字和 _.-", key, maxLabelKeyLen)
+		}
+		if value == "" || len(value) > maxLabelValueLen || !labelChars(value, "_.-:/@") {
+			return nil, fmt.Errorf("无效的标签值 %s=%q：长度 1-%d，只能包含字母、数字和 _.-:/@", key, value, maxLabelValueLen)
+		}
+		labels[key] = value
+	}
+	if len(labels) == 0 {
+		return nil, nil
+	}
+	return labels, nil
+}
+
+func isAlnum(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// labelChars 检查 s 只包含字母、数字和 extra 中的字符
+func labelChars(s, extra string) bool {
+	for i := 0; i < len(s); i++ {
+		if !isAlnum(s[i]) && !strings.ContainsRune(extra, rune(s[i])) {
+			return false
+		}
 	}
+	return true
+}
+
+// resolveRuleID 读取请求中的 id，支持传入规则 ID 或 slug
+func resolveRuleID(data map[string]interface{}) string {
+	ref, _ := data["id"].(string)
+	return model.ResolveRelayRuleID(ref)
+}
 
-	port, err := strconv.Atoi(portStr)
+// validateNetwork 校验监听网络类型与协议是否匹配
+// 协议为 both 时可填写 tcp 或 udp 的任一类型，仅取其地址族
+func validateNetwork(network, protocol string) error {
+	switch network {
+	case "":
+		return nil
+	case "tcp", "tcp4", "tcp6":
+		if protocol == "udp" {
+			return fmt.Errorf("网络类型 %s 与协议 udp 不匹配", network)
+		}
+	case "udp", "udp4", "udp6":
+		if protocol == "tcp" {
+			return fmt.Errorf("网络类型 %s 与协议 tcp 不匹配", network)
+		}
+	default:
+		return fmt.Errorf("网络类型必须是 tcp、tcp4、tcp6、udp、udp4 或 udp6")
+	}
+	return nil
+}
+
+// getStringList 读取字符串数组，兼容逗号分隔的字符串
+func getStringList(data map[string]interface{}, key string) ([]string, bool) {
+	switch v := data[key].(type) {
+	case []interface{}:
+		list := make([]string, 0, len(v))
+		for _, item := range v {
+			if str, ok := item.(string); ok {
+				list = append(list, str)
+			}
+		}
+		return list, true
+	case string:
+		return strings.Split(v, ","), true
+	}
+	return nil, false
+}
+
+// normalizeCountryCodes 校验并统一国家代码为大写 ISO 3166-1 alpha-2
+func normalizeCountryCodes(list []string) ([]string, error) {
+	var codes []string
+	for _, code := range list {
+		code = strings.ToUpper(strings.TrimSpace(code))
+		if code == "" {
+			continue
+		}
+		if len(code) != 2 || code[0] < 'A' || code[0] > 'Z' || code[1] < 'A' || code[1] > 'Z' {
+			return nil, fmt.Errorf("无效的国家代码: %s", code)
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// maxALPNProtocols tls_alpn 最多包含的协议数
+const maxALPNProtocols = 8
+
+// normalizeALPN 校验 ALPN 协议名，去掉空项与重复项
+func normalizeALPN(list []string) ([]string, error) {
+	var protos []string
+	seen := make(map[string]bool)
+	for _, p := range list {
+		p = strings.TrimSpace(p)
+		if p == "" || seen[p] {
+			continue
+		}
+		if len(p) > 255 {
+			return nil, fmt.Errorf("ALPN 协议名过长: %s", p)
+		}
+		for i := 0; i < len(p); i++ {
+			if p[i] <= ' ' || p[i] > '~' {
+				return nil, fmt.Errorf("无效的 ALPN 协议名: %s", p)
+			}
+		}
+		seen[p] = true
+		protos = append(protos, p)
+	}
+	if len(protos) > maxALPNProtocols {
+		return nil, fmt.Errorf("tls_alpn 最多 %d 个协议", maxALPNProtocols)
+	}
+	return protos, nil
+}
+
+// ruleTransparent 返回请求中 transparent 的值，未提供时为 current
+func ruleTransparent(data map[string]interface{}, current bool) bool {
+	if v, ok := data["transparent"].(bool); ok {
+		return v
+	}
+	return current
+}
+
+// validateListenAddr 验证监听地址格式
+// 可以是逗号分隔的多个地址，端口可以是单个端口或端口段，如 0.0.0.0:20000-20010；
+// 透明代理规则通过 IP_TRANSPARENT 可以监听非本机地址，此时不要求主机部分是本机网卡上的地址
+func validateListenAddr(src string, transparent bool) error {
+	addrs := model.SplitListenAddrs(src)
+	if len(addrs) == 0 {
+		return fmt.Errorf("监听地址不能为空")
+	}
+	for _, addr := range addrs {
+		if err := validateListenAddrFormat(addr, !transparent); err != nil {
+			return fmt.Errorf("%s: %v", addr, err)
+		}
+	}
+	return nil
+}
+
+// validateSingleListenAddr 验证单个监听地址，主机部分必须是本机地址
+func validateSingleListenAddr(addr string) error {
+	return validateListenAddrFormat(addr, true)
+}
+
+// validateListenAddrFormat 验证单个监听地址，requireLocal 为 true 时确认主机部分是本机地址
+func validateListenAddrFormat(addr string, requireLocal bool) error {
+	host, start, end, err := model.ParsePortRange(addr)
 	if err != nil {
-		return fmt.Errorf("端口格式错误")
+		return fmt.Errorf("地址格式错误: %v", err)
 	}
 
 	// 端口范围检查（允许 1-65535，但建议使用非特权端口）
-	if port < 1 || port > 65535 {
-		return fmt.Errorf("端口必须在 1-65535 之间")
+	// 端口 0 表示启动时由系统分配空闲端口，实际端口见 listen_addr
+	if start == 0 && end != 0 {
+		return fmt.Errorf("端口段不能包含端口 0")
+	}
+	if start < 0 || end > 65535 {
+		return fmt.Errorf("端口必须在 0-65535 之间")
 	}
 
-	// 如果指定了主机，验证格式
+	// 如果指定了主机，验证格式，并确认是本机地址
 	if host != "" && host != "0.0.0.0" && host != "::" {
-		if ip := net.ParseIP(host); ip == nil {
+		ip, zone := model.ParseIPZone(host)
+		if ip == nil {
 			return fmt.Errorf("无效的 IP 地址: %s", host)
 		}
+		if err := validateIPZone(ip, zone); err != nil {
+			return err
+		}
+		if requireLocal && !isLocalIP(ip) {
+			return fmt.Errorf("%s 不是本机网卡上的地址，无法监听（监听所有地址请使用 0.0.0.0 或 ::）", host)
+		}
 	}
 
 	return nil
 }
 
+// validateIPZone 检查 IPv6 区域标识（如 fe80::1%eth0 中的 eth0）：
+// 只能用于 IPv6 地址，且必须是本机存在的网卡名称或序号
+func validateIPZone(ip net.IP, zone string) error {
+	if zone == "" {
+		return nil
+	}
+	if ip.To4() != nil {
+		return fmt.Errorf("IPv4 地址不能带区域标识: %s%%%s", ip, zone)
+	}
+	if _, err := net.InterfaceByName(zone); err == nil {
+		return nil
+	}
+	if index, err := strconv.Atoi(zone); err == nil {
+		if _, err := net.InterfaceByIndex(index); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("区域标识 %s 不是本机的网卡", zone)
+}
+
+// isLocalIP 检查 IP 是否为本机地址：回环地址或任一网卡上配置的地址
+// 无法获取网卡地址时不做限制，由绑定时报错
+func isLocalIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return true
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 // validateTargetAddr 验证目标地址格式
-func validateTargetAddr(addr string) error {
-	host, portStr, err := net.SplitHostPort(addr)
+// 可以是逗号分隔的多个目标，每项可带权重 "host:port|weight"；多个目标时每项只能是单个端口
+func validateTargetAddr(dst string) error {
+	targets, err := model.ParseTargets(dst)
 	if err != nil {
 		return fmt.Errorf("目标地址格式错误: %v", err)
 	}
+	for _, t := range targets {
+		if err := validateSingleTargetAddr(t.Addr, len(targets) > 1); err != nil {
+			return fmt.Errorf("%s: %v", t.Addr, err)
+		}
+	}
+	return nil
+}
 
-	port, err := strconv.Atoi(portStr)
+// validateSingleTargetAddr 验证单个目标地址，multi 为 true 时不允许端口段
+func validateSingleTargetAddr(addr string, multi bool) error {
+	host, start, end, err := model.ParsePortRange(addr)
 	if err != nil {
-		return fmt.Errorf("目标端口格式错误")
+		return fmt.Errorf("目标地址格式错误: %v", err)
 	}
 
-	if port < 1 || port > 65535 {
+	if start < 1 || end > 65535 {
 		return fmt.Errorf("目标端口必须在 1-65535 之间")
 	}
+	if multi && start != end {
+		return fmt.Errorf("多个目标时不支持端口段")
+	}
 
 	if host == "" {
 		return fmt.Errorf("目标主机不能为空")
 	}
 
 	// 检查是否为内网地址（可选安全策略）
-	if ip := net.ParseIP(host); ip != nil {
-		if isPrivateIP(ip) {
+	if ip, zone := model.ParseIPZone(host); ip != nil {
+		if err := validateIPZone(ip, zone); err != nil {
+			return err
+		}
+		if service.IsPrivateIP(ip) {
 			// 允许内网地址，但记录日志
 			log.Printf("[安全警告] 目标地址为内网 IP: %s", addr)
 		}
@@ -836,24 +2211,13 @@ func validateTargetAddr(addr string) error {
 	return nil
 }
 
-// isPrivateIP 检查是否为内网 IP
-func isPrivateIP(ip net.IP) bool {
-	private := []string{
-		"10.0.0.0/8",
-		"172.16.0.0/12",
-		"192.168.0.0/16",
-		"127.0.0.0/8",
-		"169.254.0.0/16",
-		"::1/128",
-		"fc00::/7",
-		"fe80::/10",
-	}
-
-	for _, cidr := range private {
-		_, block, _ := net.ParseCIDR(cidr)
-		if block.Contains(ip) {
-			return true
+// validIPFilter 检查 IP 过滤条件只包含 IPv4/IPv6 字符，允许末尾一个 * 表示前缀匹配
+func validIPFilter(s string) bool {
+	s = strings.TrimSuffix(s, "*")
+	for _, c := range s {
+		if !strings.ContainsRune("0123456789abcdefABCDEF.:", c) {
+			return false
 		}
 	}
-	return false
+	return true
 }
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/DGHeroin/relay/webui/model"
+	"github.com/DGHeroin/relay/webui/service"
+	"github.com/google/uuid"
+)
+
+// HeadlessConfig headless 模式配置文件
+type HeadlessConfig struct {
+	// Rules 规则列表，字段与 relay.create 的参数一致
+	Rules []map[string]interface{} `json:"rules"`
+	// SaveStats 为 true 时将统计与访问日志写入数据目录下的数据库
+	SaveStats bool `json:"save_stats"`
+	// GeoIP 可选的 GeoLite2-City.mmdb 路径
+	GeoIP string `json:"geoip"`
+}
+
+// headlessIDNamespace headless 规则 ID 的命名空间
+var headlessIDNamespace = uuid.NewSHA1(uuid.NameSpaceURL, []byte("relay:headless"))
+
+// headlessRuleID 由 slug（未设置时为名称）派生规则 ID，重启后不变，save_stats 写入的统计与访问日志得以延续
+func headlessRuleID(rule *model.RelayRule) string {
+	key := "name:" + rule.Name
+	if rule.Slug != "" {
+		key = "slug:" + rule.Slug
+	}
+	return uuid.NewSHA1(headlessIDNamespace, []byte(key)).String()
+}
+
+// loadHeadlessConfig 读取并校验配置文件
+func loadHeadlessConfig(path string) (*HeadlessConfig, []*model.RelayRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cfg := &HeadlessConfig{}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, nil, fmt.Errorf("配置文件格式错误: %v", err)
+	}
+	if len(cfg.Rules) == 0 {
+		return nil, nil, fmt.Errorf("配置文件中没有规则")
+	}
+
+	rules := make([]*model.RelayRule, 0, len(cfg.Rules))
+	seen := make(map[string]int, len(cfg.Rules)) // 规则 ID -> 序号
+	for i, data := range cfg.Rules {
+		rule, err := parseRule(data)
+		if err != nil {
+			return nil, nil, fmt.Errorf("第 %d 条规则无效: %v", i+1, err)
+		}
+		rule.ID = headlessRuleID(rule)
+		if j, ok := seen[rule.ID]; ok {
+			return nil, nil, fmt.Errorf("第 %d 条规则与第 %d 条规则的名称重复，请修改名称或设置不同的 slug", i+1, j)
+		}
+		seen[rule.ID] = i + 1
+		rule.Enabled = true
+		rules = append(rules, rule)
+	}
+	return cfg, rules, nil
+}
+
+// runHeadless 不启动 Web 界面，仅按配置文件运行转发
+func runHeadless(path string) {
+	cfg, rules, err := loadHeadlessConfig(path)
+	if err != nil {
+		log.Fatalf("加载配置失败: %v", err)
+	}
+
+	if cfg.SaveStats {
+		if err := checkDataDir(); err != nil {
+			log.Fatalf("数据目录不可用: %v", err)
+		}
+		if err := model.InitDB(dataDir); err != nil {
+			log.Fatalf("数据库初始化失败: %v", err)
+		}
+		defer model.CloseDB()
+	}
+
+	geoIP := service.NewGeoIPService()
+	if cfg.GeoIP != "" {
+		if err := geoIP.Load(cfg.GeoIP); err != nil {
+			log.Printf("GeoIP 加载失败: %v", err)
+		}
+	}
+
+	service.CheckFDLimit(rules)
+	relayMgr := service.NewRelayManager()
+	for _, rule := range rules {
+		// 设置了运行计划的规则由计划任务启动
+		if rule.Schedule != "" {
+			continue
+		}
+		if err := relayMgr.Start(rule, nil, geoIP, service.ReasonAutoStart); err != nil {
+			log.Printf("启动失败 %s: %v", rule.Name, err)
+		}
+	}
+	go relayMgr.RunScheduler(func() ([]*model.RelayRule, error) { return rules, nil }, nil, geoIP)
+	log.Printf("Headless 模式运行中: %d/%d 条规则已启动", relayMgr.ActiveCount(), len(rules))
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	<-sigCh
+	log.Println("正在关闭...")
+	relayMgr.StopAll(service.ReasonShutdown)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeHeadlessConfig 将配置写入临时文件并返回路径
+func writeHeadlessConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "relay.json")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// TestHeadlessRuleIDStable 规则 ID 由 slug 或名称派生，重复加载得到相同 ID
+func TestHeadlessRuleIDStable(t *testing.T) {
+	path := writeHeadlessConfig(t, `{"rules": [
+		{"name": "web", "src": "127.0.0.1:18080", "dst": "127.0.0.1:80", "protocol": "tcp"},
+		{"name": "dns", "slug": "dns-main", "src": "127.0.0.1:10053", "dst": "127.0.0.1:53", "protocol": "udp"}
+	]}`)
+
+	_, first, err := loadHeadlessConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, second, err := loadHeadlessConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range first {
+		if first[i].ID != second[i].ID {
+			t.Errorf("规则 %s 两次加载 ID 不同: %s != %s", first[i].Name, first[i].ID, second[i].ID)
+		}
+	}
+	if first[0].ID == first[1].ID {
+		t.Errorf("不同规则得到相同 ID %s", first[0].ID)
+	}
+
+	// 设置了 slug 时改名不影响 ID
+	renamed := writeHeadlessConfig(t, `{"rules": [
+		{"name": "dns-renamed", "slug": "dns-main", "src": "127.0.0.1:10053", "dst": "127.0.0.1:53", "protocol": "udp"}
+	]}`)
+	_, rules, err := loadHeadlessConfig(renamed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rules[0].ID != first[1].ID {
+		t.Errorf("slug 相同但 ID 变化: %s != %s", rules[0].ID, first[1].ID)
+	}
+}
+
+// TestHeadlessDuplicateName 名称重复且未设置 slug 的规则会得到相同 ID，应拒绝
+func TestHeadlessDuplicateName(t *testing.T) {
+	path := writeHeadlessConfig(t, `{"rules": [
+		{"name": "web", "src": "127.0.0.1:18080", "dst": "127.0.0.1:80", "protocol": "tcp"},
+		{"name": "web", "src": "127.0.0.1:18081", "dst": "127.0.0.1:81", "protocol": "tcp"}
+	]}`)
+	_, _, err := loadHeadlessConfig(path)
+	if err == nil || !strings.Contains(err.Error(), "名称重复") {
+		t.Fatalf("期望名称重复错误, got %v", err)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// rotatingWriter 按大小轮转的日志文件
+// 当前文件超过 maxSize 时依次重命名为 .1 .. .N，超出 maxFiles 的备份会被删除
+type rotatingWriter struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+// newRotatingWriter 打开（或创建）日志文件
+func newRotatingWriter(path string, maxSize int64, maxFiles int) (*rotatingWriter, error) {
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("日志文件大小上限必须大于 0")
+	}
+	if maxFiles < 0 {
+		maxFiles = 0
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	w := &rotatingWriter{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *rotatingWriter) open() error {
+	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.file = f
+	w.size = info.Size()
+	return nil
+}
+
+// Write 实现 io.Writer
+func (w *rotatingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.size > 0 && w.size+int64(len(p)) > w.maxSize {
+		if err := w.rotate(); err != nil {
+			// 轮转失败时继续写入当前文件，避免丢失日志
+			fmt.Fprintf(os.Stderr, "日志轮转失败: %v\n", err)
+		}
+	}
+
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// rotate 关闭当前文件并依次后移备份
+func (w *rotatingWriter) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+
+	if w.maxFiles == 0 {
+		os.Remove(w.path)
+	} else {
+		os.Remove(fmt.Sprintf("%s.%d", w.path, w.maxFiles))
+		for i := w.maxFiles - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", w.path, i), fmt.Sprintf("%s.%d", w.path, i+1))
+		}
+		if err := os.Rename(w.path, w.path+".1"); err != nil {
+			w.open()
+			return err
+		}
+	}
+	return w.open()
+}
+
+// Close 关闭日志文件
+func (w *rotatingWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.file.Close()
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/signal"
@@ -10,6 +12,7 @@ import (
 	"time"
 
 	"github.com/DGHeroin/relay/webui/model"
+	"github.com/DGHeroin/relay/webui/service"
 )
 
 // 版本信息，通过 ldflags 注入
@@ -20,12 +23,37 @@ var (
 )
 
 var (
-	addr        = flag.String("addr", ":8080", "监听地址")
-	showVersion = flag.Bool("version", false, "显示版本信息")
-	dataDir     = "data"
+	addr              = flag.String("addr", ":8080", "管理界面监听地址")
+	adminAddr         = flag.String("admin-addr", "", "管理界面监听地址，设置后覆盖 -addr，如 127.0.0.1:8080")
+	adminAllow        = flag.String("admin-allow", "", "允许访问管理界面的来源 IP/CIDR，逗号分隔，为空时不限制")
+	trustedProxies    = flag.String("trusted-proxies", "", "信任的反向代理 IP/CIDR，逗号分隔；来自这些地址的请求按 X-Forwarded-For 识别客户端 IP，为空时不信任任何代理")
+	showVersion       = flag.Bool("version", false, "显示版本信息")
+	logFile           = flag.String("log-file", "", "运行日志文件路径，为空时仅输出到标准输出")
+	logMaxSize        = flag.Int("log-max-size-mb", 10, "单个日志文件大小上限 (MB)")
+	logMaxFiles       = flag.Int("log-max-files", 5, "保留的日志备份数量")
+	configFile        = flag.String("config", "", "headless 模式：从 JSON 配置文件加载规则，不启动 Web 界面")
+	basePath          = flag.String("base-path", "", "管理界面部署子路径，如 /relay，用于反向代理")
+	readHeaderTimeout = flag.Duration("read-header-timeout", 10*time.Second, "管理界面读取请求头的超时，0 表示不限制")
+	readTimeout       = flag.Duration("read-timeout", 60*time.Second, "管理界面读取整个请求的超时，0 表示不限制")
+	writeTimeout      = flag.Duration("write-timeout", 60*time.Second, "管理界面写响应的超时，0 表示不限制")
+	idleTimeout       = flag.Duration("idle-timeout", 120*time.Second, "管理界面 keep-alive 连接的空闲超时，0 表示不限制")
+	noUI              = flag.Bool("no-ui", false, "不提供内置前端，仅提供 API、WebSocket 与健康检查，用于前端单独部署")
+	dataDirFlag       = flag.String("data-dir", "", "数据目录（数据库、GeoIP 数据库等），默认为可执行文件所在目录下的 data，也可通过 RELAY_DATA_DIR 设置")
+	dataDir           = "data"
 )
 
 func main() {
+	// 子命令：relay reset-password
+	if len(os.Args) > 1 && os.Args[1] == "reset-password" {
+		if err := runResetPassword(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "重置密码失败: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("密码已重置，所有会话已失效")
+		fmt.Println("服务正在运行时，请向其发送 SIGHUP（如 kill -HUP <pid>）或重启服务，已登录的会话才会失效")
+		return
+	}
+
 	flag.Parse()
 
 	// 显示版本信息
@@ -37,42 +65,114 @@ func main() {
 	}
 
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
+
+	// 运行日志写入轮转文件（访问日志仍记录在数据库中）
+	if *logFile != "" {
+		w, err := newRotatingWriter(*logFile, int64(*logMaxSize)<<20, *logMaxFiles)
+		if err != nil {
+			log.Fatalf("打开日志文件失败: %v", err)
+		}
+		defer w.Close()
+		log.SetOutput(io.MultiWriter(os.Stdout, w))
+	}
+
 	log.Printf("Relay WebUI %s starting...", Version)
 
-	// 获取可执行文件目录
-	execPath, err := os.Executable()
-	if err == nil {
-		dataDir = filepath.Join(filepath.Dir(execPath), "data")
+	// 确定数据目录
+	resolveDataDir()
+	log.Printf("数据目录: %s", dataDir)
+
+	// systemd socket activation 传入的 socket，启动规则时按端口匹配使用
+	if n := service.LoadActivatedSockets(); n > 0 {
+		log.Printf("已接收 %d 个 socket activation 监听", n)
+	}
+
+	// headless 模式不启动 Web 服务，也不需要初始化流程
+	if *configFile != "" {
+		runHeadless(*configFile)
+		return
 	}
 
 	// 初始化数据库
+	if err := checkDataDir(); err != nil {
+		log.Fatalf("数据目录不可用: %v", err)
+	}
 	if err := model.InitDB(dataDir); err != nil {
 		log.Fatalf("数据库初始化失败: %v", err)
 	}
 	defer model.CloseDB()
 
+	// 记录当前打开文件数限制，限制过低、不足以容纳已启用规则所需的监听时提前警告
+	if rules, err := model.GetEnabledRelayRules(); err == nil {
+		service.CheckFDLimit(rules)
+	}
+
+	// 非交互部署：通过环境变量或密钥文件提供初始管理员密码
+	if err := provisionAdmin(); err != nil {
+		log.Fatalf("自动初始化失败: %v", err)
+	}
+
+	// 管理界面与转发流量相互独立：规则的监听地址不受此处影响
+	listenAddr := *addr
+	if *adminAddr != "" {
+		listenAddr = *adminAddr
+	}
+	if err := validateAdminAddr(listenAddr); err != nil {
+		log.Fatalf("管理界面监听地址无效: %v", err)
+	}
+	allowNets, err := parseCIDRList(*adminAllow)
+	if err != nil {
+		log.Fatalf("-admin-allow 格式错误: %v", err)
+	}
+	if len(allowNets) > 0 {
+		log.Printf("管理界面仅允许来源: %s", *adminAllow)
+	}
+
+	proxyNets, err := parseCIDRList(*trustedProxies)
+	if err != nil {
+		log.Fatalf("-trusted-proxies 格式错误: %v", err)
+	}
+
+	base, err := normalizeBasePath(*basePath)
+	if err != nil {
+		log.Fatalf("-base-path 格式错误: %v", err)
+	}
+	if base != "" && len(proxyNets) == 0 {
+		log.Printf("警告: 设置了 -base-path 但未设置 -trusted-proxies，经反向代理的请求会以代理地址计入 API 限流与登录锁定")
+	}
+
+	for name, d := range map[string]time.Duration{
+		"-read-header-timeout": *readHeaderTimeout,
+		"-read-timeout":        *readTimeout,
+		"-write-timeout":       *writeTimeout,
+		"-idle-timeout":        *idleTimeout,
+	} {
+		if d < 0 {
+			log.Fatalf("%s 不能为负数", name)
+		}
+	}
+
 	// 创建服务器
-	server := NewServer(*addr)
+	server := NewServer(listenAddr, allowNets, proxyNets, base, HTTPTimeouts{
+		ReadHeader: *readHeaderTimeout,
+		Read:       *readTimeout,
+		Write:      *writeTimeout,
+		Idle:       *idleTimeout,
+	}, *noUI)
 
 	// 自动启动已启用的规则
 	if model.IsSetupCompleted() {
+		// 记录启动时已启用的规则，之后 SIGHUP 只启动新启用的规则
+		if rules, err := model.GetEnabledRelayRules(); err == nil {
+			server.handlers.rememberEnabled(rules)
+		}
 		autoStart, _ := model.GetSetting("auto_start")
 		if autoStart == "true" {
-			go func() {
-				rules, err := model.GetEnabledRelayRules()
-				if err != nil {
-					log.Printf("获取规则失败: %v", err)
-					return
-				}
-				for _, rule := range rules {
-					if err := server.handlers.relayMgr.Start(rule, server.handlers.wsHub, server.handlers.geoIP); err != nil {
-						log.Printf("自动启动失败 %s: %v", rule.Name, err)
-					}
-				}
-			}()
+			go server.handlers.autoStart()
 		}
 
 		// 加载 GeoIP
+		loadGeoIPLocales(server.handlers.geoIP)
 		geoEnabled, _ := model.GetSetting("geoip_enabled")
 		if geoEnabled == "true" {
 			geoPath := filepath.Join(dataDir, "GeoLite2-City.mmdb")
@@ -80,16 +180,28 @@ func main() {
 				log.Printf("GeoIP 加载失败: %v", err)
 			}
 		}
+
+		// ASN 库独立于 City 库，存在即加载
+		asnPath := filepath.Join(dataDir, "GeoLite2-ASN.mmdb")
+		if _, err := os.Stat(asnPath); err == nil {
+			if err := server.handlers.geoIP.LoadASN(asnPath); err != nil {
+				log.Printf("ASN 数据库加载失败: %v", err)
+			}
+		}
 	}
 
-	// 启动定时清理 (每天执行一次)
+	// 按运行计划启动/停止已启用的规则（初始化完成前没有规则）
+	go server.handlers.relayMgr.RunScheduler(model.GetEnabledRelayRules, server.handlers.wsHub, server.handlers.geoIP)
+
+	// 启动定时清理 (启动时一次，之后每天在 cleanup_time 执行)
+	go runCleanupScheduler()
+
+	// SIGHUP 重新加载规则与设置
 	go func() {
-		ticker := time.NewTicker(24 * time.Hour)
-		defer ticker.Stop()
-		// 启动时先清理一次
-		model.CleanOldStats()
-		for range ticker.C {
-			model.CleanOldStats()
+		hupCh := make(chan os.Signal, 1)
+		signal.Notify(hupCh, syscall.SIGHUP)
+		for range hupCh {
+			server.handlers.reload()
 		}
 	}()
 
@@ -99,7 +211,8 @@ func main() {
 		signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 		<-sigCh
 		log.Println("正在关闭...")
-		server.handlers.relayMgr.StopAll()
+		server.handlers.relayMgr.StopAll(service.ReasonShutdown)
+		server.handlers.reverse.Stop()
 		model.CloseDB()
 		os.Exit(0)
 	}()
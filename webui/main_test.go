@@ -0,0 +1,34 @@
+package main
+
+import (
+	"log"
+	"os"
+	"testing"
+
+	"github.com/DGHeroin/relay/webui/model"
+)
+
+// TestMain 在临时目录中初始化数据库
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "relay-webui-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := model.InitDB(dir); err != nil {
+		log.Fatal(err)
+	}
+	code := m.Run()
+	model.CloseDB()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// setSetting 修改设置，测试结束后恢复原值
+func setSetting(t *testing.T, key, value string) {
+	t.Helper()
+	old, _ := model.GetSetting(key)
+	if err := model.SetSetting(key, value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { model.SetSetting(key, old) })
+}
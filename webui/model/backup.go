@@ -0,0 +1,122 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"modernc.org/sqlite"
+)
+
+// restoreRetries 恢复时数据库被其它连接锁定的重试次数，等待时间从 writeRetryDelay 起每次翻倍
+const restoreRetries = 8
+
+// BackupDB 使用 VACUUM INTO 生成数据库的一致性快照，dst 不能已存在
+func BackupDB(dst string) error {
+	if DB == nil {
+		return ErrNoDB
+	}
+	_, err := DB.Exec(`VACUUM INTO ?`, dst)
+	return err
+}
+
+// ValidateBackup 检查文件是否为本程序的数据库备份
+func ValidateBackup(path string) error {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	// quick_check 发现损坏时返回问题描述而不是错误
+	var check string
+	if err := db.QueryRow(`PRAGMA quick_check`).Scan(&check); err != nil {
+		return fmt.Errorf("不是有效的 SQLite 数据库: %v", err)
+	}
+	if check != "ok" {
+		return fmt.Errorf("数据库文件已损坏: %s", check)
+	}
+	for _, table := range []string{"system_settings", "relay_rules"} {
+		var name string
+		err := db.QueryRow(`SELECT name FROM sqlite_master WHERE type = 'table' AND name = ?`, table).Scan(&name)
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("缺少数据表 %s", table)
+		}
+		if err != nil {
+			return fmt.Errorf("不是有效的 SQLite 数据库: %v", err)
+		}
+	}
+	return nil
+}
+
+// RestoreDB 用 src 的内容覆盖当前数据库，随后执行未应用的结构迁移并清除备份中的会话
+// 通过 SQLite 在线备份接口写入当前数据库，DB 句柄保持不变，并发的读写最多短暂遇到数据库忙；
+// 迁移失败时用恢复前的快照还原
+func RestoreDB(dataDir, src string) error {
+	if DB == nil {
+		return ErrNoDB
+	}
+	if err := ValidateBackup(src); err != nil {
+		return err
+	}
+
+	snapshot := filepath.Join(dataDir, fmt.Sprintf("restore_%d.old", time.Now().UnixNano()))
+	if err := BackupDB(snapshot); err != nil {
+		return fmt.Errorf("备份当前数据库失败: %v", err)
+	}
+	defer os.Remove(snapshot)
+
+	if err := restoreFrom(src); err != nil {
+		return err
+	}
+	if err := migrate(); err != nil {
+		if rollbackErr := restoreFrom(snapshot); rollbackErr != nil {
+			return fmt.Errorf("恢复失败: %v；还原原数据库失败: %v", err, rollbackErr)
+		}
+		return fmt.Errorf("恢复失败: %v", err)
+	}
+
+	// 备份中的登录会话不应在恢复后继续有效
+	if err := DeleteAllSessions(); err != nil {
+		return fmt.Errorf("清除会话失败: %v", err)
+	}
+	return nil
+}
+
+// restoreFrom 将 src 的全部页面复制到当前数据库，数据库忙时退避重试
+func restoreFrom(src string) error {
+	conn, err := DB.Conn(context.Background())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return conn.Raw(func(driverConn interface{}) error {
+		restorer, ok := driverConn.(interface {
+			NewRestore(string) (*sqlite.Backup, error)
+		})
+		if !ok {
+			return fmt.Errorf("数据库驱动不支持在线恢复")
+		}
+		b, err := restorer.NewRestore(src)
+		if err != nil {
+			return err
+		}
+		delay := writeRetryDelay
+		for attempt := 0; ; attempt++ {
+			more, err := b.Step(-1)
+			if err == nil && !more {
+				return b.Finish()
+			}
+			if err != nil && (!isBusy(err) || attempt == restoreRetries) {
+				b.Finish()
+				return err
+			}
+			time.Sleep(delay)
+			delay *= 2
+		}
+	})
+}
@@ -0,0 +1,106 @@
+package model
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestValidateBackupCorrupt quick_check 报告损坏的备份应被拒绝
+func TestValidateBackupCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "backup.db")
+	if err := BackupDB(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateBackup(path); err != nil {
+		t.Fatalf("完整的备份校验失败: %v", err)
+	}
+
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var root, pageSize int
+	if err := db.QueryRow(`SELECT rootpage FROM sqlite_master WHERE name = 'relay_rules'`).Scan(&root); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow(`PRAGMA page_size`).Scan(&pageSize); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// 把 relay_rules 根页的单元数改为超出页面的值，文件仍能打开，但 quick_check 会逐行报告问题
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	off := (root - 1) * pageSize
+	data[off+3], data[off+4] = 0xff, 0xff
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	err = ValidateBackup(path)
+	if err == nil || !strings.Contains(err.Error(), "损坏") {
+		t.Fatalf("期望损坏错误, got %v", err)
+	}
+}
+
+// TestRestoreDB 恢复在原 DB 句柄上进行，并发写入不会遇到数据库已关闭，备份中的会话被清除
+func TestRestoreDB(t *testing.T) {
+	dir := t.TempDir()
+	if err := SetSetting("restore_test", "before"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { DB.Exec(`DELETE FROM system_settings WHERE key = ?`, "restore_test") })
+	if err := CreateSession("restore-token", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	backup := filepath.Join(dir, "backup.db")
+	if err := BackupDB(backup); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetSetting("restore_test", "after"); err != nil {
+		t.Fatal(err)
+	}
+
+	handle := DB
+	stop := make(chan struct{})
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err := SaveRelayStat("restore-writer", 1, 1, 1); err != nil && !isBusy(err) {
+				errs <- err
+				return
+			}
+		}
+	}()
+	err := RestoreDB(dir, backup)
+	close(stop)
+	for err := range errs {
+		t.Errorf("恢复期间写入失败: %v", err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if DB != handle {
+		t.Error("恢复替换了 DB 句柄")
+	}
+	if value, _ := GetSetting("restore_test"); value != "before" {
+		t.Errorf("restore_test = %q, want before", value)
+	}
+	if _, err := GetSession("restore-token"); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("备份中的会话恢复后仍有效: err = %v", err)
+	}
+}
@@ -2,6 +2,7 @@ package model
 
 import (
 	"database/sql"
+	"errors"
 	"log"
 	"os"
 	"path/filepath"
@@ -11,6 +12,9 @@ import (
 
 var DB *sql.DB
 
+// ErrNoDB 数据库未初始化（无数据库的 headless 模式）
+var ErrNoDB = errors.New("database not initialized")
+
 // InitDB 初始化数据库
 func InitDB(dataDir string) error {
 	// 使用更严格的权限，仅所有者可读写执行
@@ -25,8 +29,8 @@ func InitDB(dataDir string) error {
 		return err
 	}
 
-	// 创建表
-	if err := createTables(); err != nil {
+	// 创建表并执行未应用的结构迁移
+	if err := migrate(); err != nil {
 		return err
 	}
 
@@ -34,9 +38,11 @@ func InitDB(dataDir string) error {
 	return nil
 }
 
-func createTables() error {
+// createTables 初始结构（迁移版本 1）
+// 引入 schema_migrations 之前新增的列也在这里以 ensureColumn 补齐，已有数据库重复执行无副作用
+func createTables(tx *sql.Tx) error {
 	// system_settings 表
-	_, err := DB.Exec(`
+	_, err := tx.Exec(`
 		CREATE TABLE IF NOT EXISTS system_settings (
 			key TEXT PRIMARY KEY,
 			value TEXT NOT NULL,
@@ -49,7 +55,7 @@ func createTables() error {
 	}
 
 	// relay_rules 表
-	_, err = DB.Exec(`
+	_, err = tx.Exec(`
 		CREATE TABLE IF NOT EXISTS relay_rules (
 			id TEXT PRIMARY KEY,
 			name TEXT NOT NULL,
@@ -65,8 +71,45 @@ func createTables() error {
 		return err
 	}
 
+	// relay_rules 后续新增的列（兼容旧数据库）
+	ruleColumns := []struct{ name, def string }{
+		{"alert_speed_in", "INTEGER NOT NULL DEFAULT 0"},
+		{"alert_speed_out", "INTEGER NOT NULL DEFAULT 0"},
+		{"alert_speed_duration", "INTEGER NOT NULL DEFAULT 0"},
+		{"alert_daily_bytes", "INTEGER NOT NULL DEFAULT 0"},
+		{"allow_countries", "TEXT NOT NULL DEFAULT ''"},
+		{"deny_countries", "TEXT NOT NULL DEFAULT ''"},
+		{"network", "TEXT NOT NULL DEFAULT ''"},
+		{"transparent", "INTEGER NOT NULL DEFAULT 0"},
+		{"slug", "TEXT NOT NULL DEFAULT ''"},
+		{"max_connections_per_ip", "INTEGER NOT NULL DEFAULT 0"},
+		{"monthly_byte_quota", "INTEGER NOT NULL DEFAULT 0"},
+		{"schedule", "TEXT NOT NULL DEFAULT ''"},
+		{"schedule_tz", "TEXT NOT NULL DEFAULT ''"},
+		{"tls_cert", "TEXT NOT NULL DEFAULT ''"},
+		{"tls_key", "TEXT NOT NULL DEFAULT ''"},
+		{"tls_client_ca", "TEXT NOT NULL DEFAULT ''"},
+		{"upstream_tls", "INTEGER NOT NULL DEFAULT 0"},
+		{"http_aware", "INTEGER NOT NULL DEFAULT 0"},
+		{"speed_limit", "INTEGER NOT NULL DEFAULT 0"},
+		{"conn_speed_limit", "INTEGER NOT NULL DEFAULT 0"},
+		{"balance", "TEXT NOT NULL DEFAULT ''"},
+		{"upstream_proxy", "TEXT NOT NULL DEFAULT ''"},
+		{"tls_alpn", "TEXT NOT NULL DEFAULT ''"},
+		{"max_new_connections_per_sec", "INTEGER NOT NULL DEFAULT 0"},
+	}
+	for _, col := range ruleColumns {
+		if err := ensureColumn(tx, "relay_rules", col.name, col.def); err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_relay_rules_slug ON relay_rules(slug) WHERE slug != ''`)
+	if err != nil {
+		return err
+	}
+
 	// relay_stats 表
-	_, err = DB.Exec(`
+	_, err = tx.Exec(`
 		CREATE TABLE IF NOT EXISTS relay_stats (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
 			relay_id TEXT NOT NULL,
@@ -82,22 +125,22 @@ func createTables() error {
 	}
 
 	// 创建索引
-	_, err = DB.Exec(`CREATE INDEX IF NOT EXISTS idx_relay_stats_relay_id ON relay_stats(relay_id)`)
+	_, err = tx.Exec(`CREATE INDEX IF NOT EXISTS idx_relay_stats_relay_id ON relay_stats(relay_id)`)
 	if err != nil {
 		return err
 	}
-	_, err = DB.Exec(`CREATE INDEX IF NOT EXISTS idx_relay_stats_recorded_at ON relay_stats(recorded_at)`)
+	_, err = tx.Exec(`CREATE INDEX IF NOT EXISTS idx_relay_stats_recorded_at ON relay_stats(recorded_at)`)
 	if err != nil {
 		return err
 	}
 	// 唯一索引用于 UPSERT 操作
-	_, err = DB.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_relay_stats_unique ON relay_stats(relay_id, recorded_at)`)
+	_, err = tx.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_relay_stats_unique ON relay_stats(relay_id, recorded_at)`)
 	if err != nil {
 		return err
 	}
 
 	// access_logs 表
-	_, err = DB.Exec(`
+	_, err = tx.Exec(`
 		CREATE TABLE IF NOT EXISTS access_logs (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
 			relay_id TEXT NOT NULL,
@@ -114,17 +157,40 @@ func createTables() error {
 		return err
 	}
 
-	_, err = DB.Exec(`CREATE INDEX IF NOT EXISTS idx_access_logs_relay_id ON access_logs(relay_id)`)
+	// access_logs 后续新增的列
+	logColumns := []struct{ name, def string }{
+		{"detail", "TEXT NOT NULL DEFAULT ''"},
+		{"country", "TEXT NOT NULL DEFAULT ''"},
+		{"asn", "INTEGER NOT NULL DEFAULT 0"},
+		{"as_org", "TEXT NOT NULL DEFAULT ''"},
+		{"latency_ms", "INTEGER NOT NULL DEFAULT 0"},
+		{"client_cert", "TEXT NOT NULL DEFAULT ''"},
+		{"tls_version", "TEXT NOT NULL DEFAULT ''"},
+		{"tls_cipher", "TEXT NOT NULL DEFAULT ''"},
+		{"tls_alpn", "TEXT NOT NULL DEFAULT ''"},
+		{"private", "INTEGER NOT NULL DEFAULT 0"},
+	}
+	for _, col := range logColumns {
+		if err := ensureColumn(tx, "access_logs", col.name, col.def); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`CREATE INDEX IF NOT EXISTS idx_access_logs_relay_id ON access_logs(relay_id)`)
 	if err != nil {
 		return err
 	}
-	_, err = DB.Exec(`CREATE INDEX IF NOT EXISTS idx_access_logs_created_at ON access_logs(created_at)`)
+	_, err = tx.Exec(`CREATE INDEX IF NOT EXISTS idx_access_logs_created_at ON access_logs(created_at)`)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`CREATE INDEX IF NOT EXISTS idx_access_logs_client_ip ON access_logs(client_ip)`)
 	if err != nil {
 		return err
 	}
 
 	// sessions 表
-	_, err = DB.Exec(`
+	_, err = tx.Exec(`
 		CREATE TABLE IF NOT EXISTS sessions (
 			token TEXT PRIMARY KEY,
 			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
@@ -135,7 +201,7 @@ func createTables() error {
 		return err
 	}
 
-	_, err = DB.Exec(`CREATE INDEX IF NOT EXISTS idx_sessions_expires_at ON sessions(expires_at)`)
+	_, err = tx.Exec(`CREATE INDEX IF NOT EXISTS idx_sessions_expires_at ON sessions(expires_at)`)
 	if err != nil {
 		return err
 	}
@@ -143,6 +209,47 @@ func createTables() error {
 	return nil
 }
 
+// ensureColumn 列不存在时添加
+func ensureColumn(tx *sql.Tx, table, column, definition string) error {
+	rows, err := tx.Query("PRAGMA table_info(" + table + ")")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			colType   string
+			notNull   int
+			dfltValue sql.NullString
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dfltValue, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = tx.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	return err
+}
+
+// PingDB 检查数据库是否可访问
+func PingDB() error {
+	if DB == nil {
+		return ErrNoDB
+	}
+	return DB.Ping()
+}
+
 // CloseDB 关闭数据库
 func CloseDB() {
 	if DB != nil {
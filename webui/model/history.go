@@ -0,0 +1,58 @@
+package model
+
+import "time"
+
+// SaveConnectionHistory 保存一条已断开连接的记录
+func SaveConnectionHistory(relayID string, data []byte, endedAt time.Time) error {
+	if DB == nil {
+		return ErrNoDB
+	}
+	_, err := execWithRetry(`INSERT INTO connection_history (relay_id, data, ended_at) VALUES (?, ?, ?)`,
+		relayID, string(data), endedAt)
+	return err
+}
+
+// GetConnectionHistory 获取规则最近的 limit 条连接记录，最新的在前
+func GetConnectionHistory(relayID string, limit int) ([][]byte, error) {
+	if DB == nil {
+		return nil, ErrNoDB
+	}
+	rows, err := DB.Query(`SELECT data FROM connection_history WHERE relay_id = ? ORDER BY id DESC LIMIT ?`,
+		relayID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records [][]byte
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		records = append(records, []byte(data))
+	}
+	return records, rows.Err()
+}
+
+// TrimConnectionHistory 只保留规则最近的 keep 条连接记录
+func TrimConnectionHistory(relayID string, keep int) error {
+	if DB == nil {
+		return ErrNoDB
+	}
+	_, err := execWithRetry(`
+		DELETE FROM connection_history WHERE relay_id = ? AND id NOT IN (
+			SELECT id FROM connection_history WHERE relay_id = ? ORDER BY id DESC LIMIT ?
+		)`, relayID, relayID, keep)
+	return err
+}
+
+// ClearConnectionHistory 删除连接记录，relayID 为空时删除全部
+func ClearConnectionHistory(relayID string) error {
+	if relayID != "" {
+		_, err := execWithRetry("DELETE FROM connection_history WHERE relay_id = ?", relayID)
+		return err
+	}
+	_, err := execWithRetry("DELETE FROM connection_history")
+	return err
+}
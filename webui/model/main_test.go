@@ -0,0 +1,22 @@
+package model
+
+import (
+	"log"
+	"os"
+	"testing"
+)
+
+// TestMain 在临时目录中初始化数据库
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "relay-model-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := InitDB(dir); err != nil {
+		log.Fatal(err)
+	}
+	code := m.Run()
+	CloseDB()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
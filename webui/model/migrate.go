@@ -0,0 +1,113 @@
+package model
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// migration 一次数据库结构变更，按 version 顺序执行且只执行一次
+// up 在事务中执行，失败时整体回滚，下次启动重试
+type migration struct {
+	version int
+	name    string
+	up      func(tx *sql.Tx) error
+}
+
+// migrations 全部结构迁移，只能在末尾追加，已发布的版本不能修改或重新编号
+// 新增列优先使用 ensureColumn，保证在已手动加过该列的数据库上也能执行
+var migrations = []migration{
+	{1, "initial schema", createTables},
+	{2, "connection history", func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+			CREATE TABLE IF NOT EXISTS connection_history (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				relay_id TEXT NOT NULL,
+				data TEXT NOT NULL,
+				ended_at DATETIME NOT NULL,
+				FOREIGN KEY (relay_id) REFERENCES relay_rules(id) ON DELETE CASCADE
+			)
+		`)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`CREATE INDEX IF NOT EXISTS idx_connection_history_relay_id ON connection_history(relay_id, id)`)
+		return err
+	}},
+	{3, "rule labels", func(tx *sql.Tx) error {
+		if err := ensureColumn(tx, "relay_rules", "labels", "TEXT NOT NULL DEFAULT ''"); err != nil {
+			return err
+		}
+		return ensureColumn(tx, "access_logs", "labels", "TEXT NOT NULL DEFAULT ''")
+	}},
+	{4, "rule log connections", func(tx *sql.Tx) error {
+		return ensureColumn(tx, "relay_rules", "log_connections", "INTEGER NOT NULL DEFAULT 1")
+	}},
+	{5, "rule reverse mode", func(tx *sql.Tx) error {
+		if err := ensureColumn(tx, "relay_rules", "reverse_server", "TEXT NOT NULL DEFAULT ''"); err != nil {
+			return err
+		}
+		return ensureColumn(tx, "relay_rules", "reverse_secret", "TEXT NOT NULL DEFAULT ''")
+	}},
+}
+
+// migrate 创建 schema_migrations 表并依次执行未应用的迁移
+// 数据库版本高于程序已知的最新版本时拒绝打开，避免旧版本程序写坏新结构
+func migrate() error {
+	_, err := DB.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	current, err := SchemaVersion()
+	if err != nil {
+		return err
+	}
+	latest := migrations[len(migrations)-1].version
+	if current > latest {
+		return fmt.Errorf("数据库结构版本 %d 高于程序支持的版本 %d，请升级程序", current, latest)
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := applyMigration(m); err != nil {
+			return fmt.Errorf("数据库迁移 %d (%s) 失败: %v", m.version, m.name, err)
+		}
+		log.Printf("数据库迁移完成: %d (%s)", m.version, m.name)
+	}
+	return nil
+}
+
+func applyMigration(m migration) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := m.up(tx); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO schema_migrations (version, name) VALUES (?, ?)`, m.version, m.name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SchemaVersion 返回已应用的最高迁移版本，尚未执行任何迁移时为 0
+func SchemaVersion() (int, error) {
+	if DB == nil {
+		return 0, ErrNoDB
+	}
+	var version int
+	err := DB.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version)
+	return version, err
+}
@@ -0,0 +1,91 @@
+package model
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+// TestMigrateOldSchema 在引入 schema_migrations 之前的旧数据库上执行迁移：
+// 缺失的列和表被补齐，已有数据保留，再次打开时不重复执行
+func TestMigrateOldSchema(t *testing.T) {
+	dir := t.TempDir()
+	old, err := sql.Open("sqlite", filepath.Join(dir, "relay.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range []string{
+		`CREATE TABLE system_settings (
+			key TEXT PRIMARY KEY,
+			value TEXT NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE relay_rules (
+			id TEXT PRIMARY KEY,
+			name TEXT NOT NULL,
+			src TEXT NOT NULL,
+			dst TEXT NOT NULL,
+			protocol TEXT NOT NULL DEFAULT 'both',
+			enabled INTEGER NOT NULL DEFAULT 1,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`INSERT INTO relay_rules (id, name, src, dst, protocol) VALUES ('old-rule', 'old', '0.0.0.0:8080', '10.0.0.1:80', 'tcp')`,
+		`INSERT INTO system_settings (key, value) VALUES ('history_size', '50')`,
+	} {
+		if _, err := old.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old.Close()
+
+	// 临时替换全局数据库，测试结束后恢复
+	shared := DB
+	t.Cleanup(func() { DB = shared })
+
+	if err := InitDB(dir); err != nil {
+		t.Fatalf("迁移旧数据库失败: %v", err)
+	}
+	defer CloseDB()
+
+	version, err := SchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest := migrations[len(migrations)-1].version; version != latest {
+		t.Fatalf("迁移后版本 %d, want %d", version, latest)
+	}
+
+	rule, err := GetRelayRule("old-rule")
+	if err != nil {
+		t.Fatalf("读取旧规则失败: %v", err)
+	}
+	if rule.Name != "old" || rule.Dst != "10.0.0.1:80" || rule.Protocol != "tcp" {
+		t.Errorf("旧规则数据改变: %+v", rule)
+	}
+	// 新增列使用默认值
+	if !rule.LogConnections || rule.SpeedLimit != 0 || len(rule.Labels) != 0 {
+		t.Errorf("新增列默认值错误: log_connections=%v speed_limit=%d labels=%v", rule.LogConnections, rule.SpeedLimit, rule.Labels)
+	}
+	if v, _ := GetSetting("history_size"); v != "50" {
+		t.Errorf("旧设置丢失: history_size=%q", v)
+	}
+	// 迁移 2 新建的表可用
+	if _, err := DB.Exec(`INSERT INTO connection_history (relay_id, data, ended_at) VALUES ('old-rule', '{}', CURRENT_TIMESTAMP)`); err != nil {
+		t.Errorf("connection_history 表不可用: %v", err)
+	}
+
+	// 再次打开时不重复执行迁移
+	CloseDB()
+	if err := InitDB(dir); err != nil {
+		t.Fatalf("重新打开数据库失败: %v", err)
+	}
+	var applied int
+	if err := DB.QueryRow(`SELECT COUNT(*) FROM schema_migrations`).Scan(&applied); err != nil {
+		t.Fatal(err)
+	}
+	if applied != len(migrations) {
+		t.Errorf("schema_migrations 有 %d 条记录, want %d", applied, len(migrations))
+	}
+}
@@ -0,0 +1,45 @@
+package model
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// 数据库忙（SQLITE_BUSY/SQLITE_LOCKED）时的重试次数与初始等待，每次重试等待时间翻倍
+const (
+	writeRetries    = 4
+	writeRetryDelay = 10 * time.Millisecond
+)
+
+// isBusy 错误是否为数据库被其他连接锁定
+func isBusy(err error) bool {
+	var e *sqlite.Error
+	if errors.As(err, &e) {
+		code := e.Code() & 0xff // 扩展错误码的低 8 位为主错误码
+		return code == sqlite3.SQLITE_BUSY || code == sqlite3.SQLITE_LOCKED
+	}
+	return false
+}
+
+// execWithRetry 执行写操作，数据库忙时短暂退避后重试，多次重试仍失败时记录警告
+func execWithRetry(query string, args ...interface{}) (sql.Result, error) {
+	delay := writeRetryDelay
+	for attempt := 0; ; attempt++ {
+		result, err := DB.Exec(query, args...)
+		if err == nil || !isBusy(err) {
+			return result, err
+		}
+		if attempt == writeRetries {
+			log.Printf("[DB] 数据库忙，重试 %d 次后写入失败: %v, sql=%s", writeRetries, err, strings.Join(strings.Fields(query), " "))
+			return result, err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
@@ -0,0 +1,64 @@
+package model
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+)
+
+// lockDB 通过另一个连接以排他事务锁住数据库，返回释放锁的函数
+func lockDB(t *testing.T) func() {
+	t.Helper()
+	var seq int
+	var name, path string
+	if err := DB.QueryRow(`PRAGMA database_list`).Scan(&seq, &name, &path); err != nil {
+		t.Fatal(err)
+	}
+	other, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := other.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec(`INSERT INTO system_settings (key, value) VALUES ('lock_holder', '1')
+		ON CONFLICT(key) DO UPDATE SET value = excluded.value`); err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		tx.Rollback()
+		other.Close()
+	}
+}
+
+// TestExecWithRetryContention 其他连接短暂持有写锁时重试后写入成功，持锁超过全部退避时间时返回忙错误
+func TestExecWithRetryContention(t *testing.T) {
+	const query = `INSERT INTO system_settings (key, value) VALUES ('retry_test', ?)
+		ON CONFLICT(key) DO UPDATE SET value = excluded.value`
+
+	unlock := lockDB(t)
+	if _, err := DB.Exec(query, "direct"); !isBusy(err) {
+		unlock()
+		t.Fatalf("持锁期间直接写入应返回忙错误, got %v", err)
+	}
+	// 锁在第二、三次重试之间释放
+	time.AfterFunc(25*time.Millisecond, unlock)
+	if _, err := execWithRetry(query, "retried"); err != nil {
+		t.Fatalf("锁释放后重试仍失败: %v", err)
+	}
+	if v, _ := GetSetting("retry_test"); v != "retried" {
+		t.Fatalf("retry_test = %q, want retried", v)
+	}
+
+	// 持锁时间超过全部退避（10+20+40+80ms）
+	unlock = lockDB(t)
+	defer unlock()
+	start := time.Now()
+	if _, err := execWithRetry(query, "gave-up"); !isBusy(err) {
+		t.Fatalf("持续持锁时应返回忙错误, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("放弃前只等待了 %v", elapsed)
+	}
+}
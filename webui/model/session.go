@@ -1,10 +1,19 @@
 package model
 
 import (
+	"strconv"
 	"sync"
 	"time"
 )
 
+const (
+	DefaultSessionTTL     = 24 * time.Hour   // 默认会话有效期
+	MaxSessionTTLHours    = 720              // session_ttl_hours 上限（30 天）
+	sessionConfigCacheTTL = 30 * time.Second // 会话设置缓存时间
+	SessionModeFixed      = "fixed"          // 自创建起固定有效期
+	SessionModeSliding    = "sliding"        // 使用中自动续期
+)
+
 // Session 会话数据
 type Session struct {
 	Token     string    `json:"token"`
@@ -14,16 +23,52 @@ type Session struct {
 
 // 内存缓存
 var (
-	sessionCache     sync.Map // token -> *Session (有效会话)
-	invalidTokens    sync.Map // token -> time.Time (无效 token 及其过期时间)
-	invalidTokenTTL  = 5 * time.Minute // 无效 token 缓存 5 分钟
+	sessionCache    sync.Map          // token -> *Session (有效会话)
+	invalidTokens   sync.Map          // token -> time.Time (无效 token 及其过期时间)
+	invalidTokenTTL = 5 * time.Minute // 无效 token 缓存 5 分钟
+
+	// session_mode / session_ttl_hours 设置缓存
+	sessionConfig struct {
+		sync.Mutex
+		ttl      time.Duration
+		sliding  bool
+		loadedAt time.Time
+	}
 )
 
+// SessionPolicy 返回会话有效期及是否滑动续期，设置缓存 30 秒
+func SessionPolicy() (time.Duration, bool) {
+	sessionConfig.Lock()
+	defer sessionConfig.Unlock()
+
+	if time.Since(sessionConfig.loadedAt) < sessionConfigCacheTTL {
+		return sessionConfig.ttl, sessionConfig.sliding
+	}
+	sessionConfig.ttl, sessionConfig.sliding = DefaultSessionTTL, false
+	if v, err := GetSetting("session_ttl_hours"); err == nil && v != "" {
+		if h, err := strconv.Atoi(v); err == nil && h >= 1 && h <= MaxSessionTTLHours {
+			sessionConfig.ttl = time.Duration(h) * time.Hour
+		}
+	}
+	if v, _ := GetSetting("session_mode"); v == SessionModeSliding {
+		sessionConfig.sliding = true
+	}
+	sessionConfig.loadedAt = time.Now()
+	return sessionConfig.ttl, sessionConfig.sliding
+}
+
+// InvalidateSessionPolicy 使会话设置缓存失效
+func InvalidateSessionPolicy() {
+	sessionConfig.Lock()
+	sessionConfig.loadedAt = time.Time{}
+	sessionConfig.Unlock()
+}
+
 // CreateSession 创建会话
 func CreateSession(token string, ttl time.Duration) error {
 	now := time.Now()
 	expiresAt := now.Add(ttl)
-	_, err := DB.Exec(`
+	_, err := execWithRetry(`
 		INSERT INTO sessions (token, created_at, expires_at) VALUES (?, ?, ?)
 	`, token, now, expiresAt)
 	if err != nil {
@@ -59,7 +104,7 @@ func GetSession(token string) (*Session, error) {
 	if v, ok := sessionCache.Load(token); ok {
 		s := v.(*Session)
 		if now.Before(s.ExpiresAt) {
-			return s, nil
+			return slideSession(s, now)
 		}
 		// 缓存中的会话已过期，删除
 		sessionCache.Delete(token)
@@ -79,7 +124,37 @@ func GetSession(token string) (*Session, error) {
 
 	// 写入缓存
 	sessionCache.Store(token, &s)
-	return &s, nil
+	return slideSession(&s, now)
+}
+
+// slideSession 滑动模式下，剩余有效期不足一半时续期
+// 每个会话每半个有效期最多写一次数据库；写入失败时沿用原有效期。
+// 数据库中的会话已被删除（并发的退出登录或吊销）时不再写回缓存，返回 ErrSessionNotFound
+func slideSession(s *Session, now time.Time) (*Session, error) {
+	ttl, sliding := SessionPolicy()
+	if !sliding || s.ExpiresAt.Sub(now) > ttl/2 {
+		return s, nil
+	}
+	expiresAt := now.Add(ttl)
+	result, err := execWithRetry(`UPDATE sessions SET expires_at = ? WHERE token = ?`, expiresAt, s.Token)
+	if err != nil {
+		return s, nil
+	}
+	if n, err := result.RowsAffected(); err == nil && n != 1 {
+		sessionCache.Delete(s.Token)
+		return nil, ErrSessionNotFound
+	}
+	// 缓存中的会话可能正被其他请求读取，替换而不是修改；
+	// 只替换仍在缓存中的旧会话，UPDATE 之后被删除的会话不会被放回缓存
+	refreshed := &Session{Token: s.Token, CreatedAt: s.CreatedAt, ExpiresAt: expiresAt}
+	if !sessionCache.CompareAndSwap(s.Token, s, refreshed) {
+		// 其他请求已先续期时沿用其结果
+		if v, ok := sessionCache.Load(s.Token); ok {
+			return v.(*Session), nil
+		}
+		return nil, ErrSessionNotFound
+	}
+	return refreshed, nil
 }
 
 // DeleteSession 删除会话
@@ -89,20 +164,25 @@ func DeleteSession(token string) error {
 	// 加入黑名单
 	invalidTokens.Store(token, time.Now().Add(invalidTokenTTL))
 	// 从数据库删除
-	_, err := DB.Exec(`DELETE FROM sessions WHERE token = ?`, token)
+	_, err := execWithRetry(`DELETE FROM sessions WHERE token = ?`, token)
 	return err
 }
 
 // DeleteAllSessions 删除所有会话
 func DeleteAllSessions() error {
-	// 清空缓存
+	ClearSessionCache()
+	// 从数据库删除
+	_, err := execWithRetry(`DELETE FROM sessions`)
+	return err
+}
+
+// ClearSessionCache 清空会话缓存，之后的请求重新从数据库读取会话；
+// 用于数据库被其它进程（如 reset-password 子命令）修改之后
+func ClearSessionCache() {
 	sessionCache.Range(func(key, value interface{}) bool {
 		sessionCache.Delete(key)
 		return true
 	})
-	// 从数据库删除
-	_, err := DB.Exec(`DELETE FROM sessions`)
-	return err
 }
 
 // CleanExpiredSessions 清理过期会话
@@ -125,7 +205,7 @@ func CleanExpiredSessions() error {
 		return true
 	})
 	// 从数据库清理
-	_, err := DB.Exec(`DELETE FROM sessions WHERE expires_at < ?`, now)
+	_, err := execWithRetry(`DELETE FROM sessions WHERE expires_at < ?`, now)
 	return err
 }
 
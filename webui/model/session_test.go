@@ -0,0 +1,73 @@
+package model
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// useSlidingSessions 切换到滑动续期模式，测试结束后恢复
+func useSlidingSessions(t *testing.T) {
+	t.Helper()
+	if err := SetSetting("session_mode", SessionModeSliding); err != nil {
+		t.Fatal(err)
+	}
+	InvalidateSessionPolicy()
+	t.Cleanup(func() {
+		SetSetting("session_mode", SessionModeFixed)
+		InvalidateSessionPolicy()
+	})
+}
+
+func TestSlideSessionExtends(t *testing.T) {
+	useSlidingSessions(t)
+	// 剩余有效期不足一半，使用时续期
+	if err := CreateSession("slide-extend", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	s, err := GetSession("slide-extend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Until(s.ExpiresAt) < DefaultSessionTTL-time.Minute {
+		t.Fatalf("未续期: expires_at=%v", s.ExpiresAt)
+	}
+}
+
+// TestSlideSessionDeletedConcurrently 会话在缓存命中后、续期前被删除时不能被放回缓存
+func TestSlideSessionDeletedConcurrently(t *testing.T) {
+	useSlidingSessions(t)
+	if err := CreateSession("slide-deleted", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	// 只删除数据库中的记录，缓存仍然命中
+	if _, err := DB.Exec(`DELETE FROM sessions WHERE token = ?`, "slide-deleted"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetSession("slide-deleted"); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("err = %v, want ErrSessionNotFound", err)
+	}
+	if _, ok := sessionCache.Load("slide-deleted"); ok {
+		t.Fatal("已删除的会话不应留在缓存中")
+	}
+	if _, err := GetSession("slide-deleted"); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("再次获取 err = %v, want ErrSessionNotFound", err)
+	}
+}
+
+// TestClearSessionCache 其它进程删除会话后，清空缓存使其立即失效
+func TestClearSessionCache(t *testing.T) {
+	if err := CreateSession("cleared-elsewhere", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DB.Exec(`DELETE FROM sessions`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetSession("cleared-elsewhere"); err != nil {
+		t.Fatalf("缓存命中时应仍然有效: %v", err)
+	}
+	ClearSessionCache()
+	if _, err := GetSession("cleared-elsewhere"); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("err = %v, want ErrSessionNotFound", err)
+	}
+}
@@ -14,6 +14,9 @@ type Setting struct {
 
 // GetSetting 获取设置
 func GetSetting(key string) (string, error) {
+	if DB == nil {
+		return "", ErrNoDB
+	}
 	var value string
 	err := DB.QueryRow("SELECT value FROM system_settings WHERE key = ?", key).Scan(&value)
 	if err != nil {
@@ -24,7 +27,7 @@ func GetSetting(key string) (string, error) {
 
 // SetSetting 设置值
 func SetSetting(key, value string) error {
-	_, err := DB.Exec(`
+	_, err := execWithRetry(`
 		INSERT INTO system_settings (key, value, updated_at) VALUES (?, ?, CURRENT_TIMESTAMP)
 		ON CONFLICT(key) DO UPDATE SET value = ?, updated_at = CURRENT_TIMESTAMP
 	`, key, value, value)
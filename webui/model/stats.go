@@ -1,39 +1,56 @@
 package model
 
 import (
+	"fmt"
+	"strconv"
+	"strings"
 	"time"
 )
 
 // RelayStat 流量统计
 type RelayStat struct {
-	ID         int64     `json:"id"`
-	RelayID    string    `json:"relay_id"`
-	BytesIn    int64     `json:"bytes_in"`
-	BytesOut   int64     `json:"bytes_out"`
-	Connections int64    `json:"connections"`
-	RecordedAt time.Time `json:"recorded_at"`
+	ID          int64     `json:"id"`
+	RelayID     string    `json:"relay_id"`
+	BytesIn     int64     `json:"bytes_in"`
+	BytesOut    int64     `json:"bytes_out"`
+	Connections int64     `json:"connections"`
+	RecordedAt  time.Time `json:"recorded_at"`
 }
 
 // AccessLog 访问日志
 type AccessLog struct {
-	ID        int64     `json:"id"`
-	RelayID   string    `json:"relay_id"`
-	ClientIP  string    `json:"client_ip"`
-	Action    string    `json:"action"` // connect, disconnect
-	BytesIn   int64     `json:"bytes_in"`
-	BytesOut  int64     `json:"bytes_out"`
-	Duration  int64     `json:"duration"` // 秒
-	CreatedAt time.Time `json:"created_at"`
+	ID         int64             `json:"id"`
+	RelayID    string            `json:"relay_id"`
+	ClientIP   string            `json:"client_ip"`
+	Action     string            `json:"action"` // connect, disconnect, failed, geo_denied, per_ip_limit, tls_denied, rate_limited；backup、restore 等系统操作的 relay_id 为空
+	BytesIn    int64             `json:"bytes_in"`
+	BytesOut   int64             `json:"bytes_out"`
+	Duration   int64             `json:"duration"`          // 秒
+	Detail     string            `json:"detail,omitempty"`  // 附加信息，如拒绝原因、TCP 断开原因
+	Country    string            `json:"country,omitempty"` // ISO 国家代码
+	ASN        uint              `json:"asn,omitempty"`
+	ASOrg      string            `json:"as_org,omitempty"`
+	LatencyMs  int64             `json:"latency_ms,omitempty"`  // 连接目标耗时，UDP 为首个响应包耗时
+	ClientCert string            `json:"client_cert,omitempty"` // mTLS 客户端证书标识 (CN/SAN)
+	TLSVersion string            `json:"tls_version,omitempty"` // TLS 终止规则协商的版本
+	TLSCipher  string            `json:"tls_cipher,omitempty"`  // TLS 终止规则协商的加密套件
+	TLSALPN    string            `json:"tls_alpn,omitempty"`    // TLS 终止规则协商的 ALPN 协议
+	Private    bool              `json:"private,omitempty"`     // 客户端为内网/回环地址
+	Labels     map[string]string `json:"labels,omitempty"`      // 规则的静态标签
+	CreatedAt  time.Time         `json:"created_at"`
 }
 
 // SaveRelayStat 保存统计数据
 func SaveRelayStat(relayID string, bytesIn, bytesOut, connections int64) error {
+	if DB == nil {
+		return ErrNoDB
+	}
 	// 按小时聚合
 	now := time.Now().Truncate(time.Hour)
 
 	// 使用 INSERT OR REPLACE 避免竞态条件
 	// SQLite 支持 UPSERT 语法 (INSERT ... ON CONFLICT)
-	_, err := DB.Exec(`
+	_, err := execWithRetry(`
 		INSERT INTO relay_stats (relay_id, bytes_in, bytes_out, connections, recorded_at)
 		VALUES (?, ?, ?, ?, ?)
 		ON CONFLICT(relay_id, recorded_at) DO UPDATE SET
@@ -67,6 +84,104 @@ func GetRelayStats(relayID string, hours int) ([]*RelayStat, error) {
 	return stats, nil
 }
 
+// GetRelayDailyStats 获取按天汇总的统计数据
+// recorded_at 以本地时区文本存储，取前 10 位即为本地日期（SQLite 的 date() 无法解析该格式）
+func GetRelayDailyStats(relayID string, days int) ([]*RelayStat, error) {
+	now := time.Now()
+	since := startOfLocalDay(now).AddDate(0, 0, -(days - 1))
+	rows, err := DB.Query(`
+		SELECT substr(recorded_at, 1, 10) AS day,
+			SUM(bytes_in), SUM(bytes_out), SUM(connections)
+		FROM relay_stats WHERE relay_id = ? AND recorded_at >= ?
+		GROUP BY day ORDER BY day ASC
+	`, relayID, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var stats []*RelayStat
+	for rows.Next() {
+		s := &RelayStat{RelayID: relayID}
+		var day string
+		if err := rows.Scan(&day, &s.BytesIn, &s.BytesOut, &s.Connections); err != nil {
+			return nil, err
+		}
+		if s.RecordedAt, err = time.ParseInLocation("2006-01-02", day, now.Location()); err != nil {
+			return nil, err
+		}
+		stats = append(stats, s)
+	}
+	return stats, rows.Err()
+}
+
+func startOfLocalDay(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+// TrafficPoint 全部规则在一个时间段内的流量合计
+type TrafficPoint struct {
+	BytesIn     int64     `json:"bytes_in"`
+	BytesOut    int64     `json:"bytes_out"`
+	Connections int64     `json:"connections"`
+	RecordedAt  time.Time `json:"recorded_at"`
+}
+
+// GetOverviewSeries 获取全部规则按小时汇总的流量，没有数据时返回空列表
+func GetOverviewSeries(hours int) ([]*TrafficPoint, error) {
+	since := time.Now().Add(-time.Duration(hours) * time.Hour)
+	rows, err := DB.Query(`
+		SELECT recorded_at, SUM(bytes_in), SUM(bytes_out), SUM(connections)
+		FROM relay_stats WHERE recorded_at >= ?
+		GROUP BY recorded_at ORDER BY recorded_at ASC
+	`, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	points := []*TrafficPoint{}
+	for rows.Next() {
+		p := &TrafficPoint{}
+		if err := rows.Scan(&p.RecordedAt, &p.BytesIn, &p.BytesOut, &p.Connections); err != nil {
+			return nil, err
+		}
+		points = append(points, p)
+	}
+	return points, rows.Err()
+}
+
+// GetOverviewDailySeries 获取全部规则按天汇总的流量，日期划分同 GetRelayDailyStats
+func GetOverviewDailySeries(days int) ([]*TrafficPoint, error) {
+	now := time.Now()
+	since := startOfLocalDay(now).AddDate(0, 0, -(days - 1))
+	rows, err := DB.Query(`
+		SELECT substr(recorded_at, 1, 10) AS day,
+			SUM(bytes_in), SUM(bytes_out), SUM(connections)
+		FROM relay_stats WHERE recorded_at >= ?
+		GROUP BY day ORDER BY day ASC
+	`, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	points := []*TrafficPoint{}
+	for rows.Next() {
+		p := &TrafficPoint{}
+		var day string
+		if err := rows.Scan(&day, &p.BytesIn, &p.BytesOut, &p.Connections); err != nil {
+			return nil, err
+		}
+		if p.RecordedAt, err = time.ParseInLocation("2006-01-02", day, now.Location()); err != nil {
+			return nil, err
+		}
+		points = append(points, p)
+	}
+	return points, rows.Err()
+}
+
 // GetOverviewStats 获取总览统计
 func GetOverviewStats() (totalBytesIn, totalBytesOut, totalConnections int64, err error) {
 	err = DB.QueryRow(`
@@ -76,41 +191,119 @@ func GetOverviewStats() (totalBytesIn, totalBytesOut, totalConnections int64, er
 	return
 }
 
+// RelayTotal 规则在统计保留期内的累计流量与连接数
+type RelayTotal struct {
+	BytesIn     int64
+	BytesOut    int64
+	Connections int64
+}
+
+// GetRelayTotals 按规则汇总 relay_stats，返回规则 ID 到累计值的映射
+func GetRelayTotals() (map[string]RelayTotal, error) {
+	if DB == nil {
+		return nil, ErrNoDB
+	}
+	rows, err := DB.Query(`
+		SELECT relay_id, SUM(bytes_in), SUM(bytes_out), SUM(connections)
+		FROM relay_stats GROUP BY relay_id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	totals := make(map[string]RelayTotal)
+	for rows.Next() {
+		var id string
+		var t RelayTotal
+		if err := rows.Scan(&id, &t.BytesIn, &t.BytesOut, &t.Connections); err != nil {
+			return nil, err
+		}
+		totals[id] = t
+	}
+	return totals, rows.Err()
+}
+
+// GetRelayTrafficSince 获取规则自某时刻以来的累计流量
+func GetRelayTrafficSince(relayID string, since time.Time) (bytesIn, bytesOut int64, err error) {
+	if DB == nil {
+		return 0, 0, ErrNoDB
+	}
+	err = DB.QueryRow(`
+		SELECT COALESCE(SUM(bytes_in), 0), COALESCE(SUM(bytes_out), 0)
+		FROM relay_stats WHERE relay_id = ? AND recorded_at >= ?
+	`, relayID, since).Scan(&bytesIn, &bytesOut)
+	return
+}
+
 // SaveAccessLog 保存访问日志
-func SaveAccessLog(relayID, clientIP, action string, bytesIn, bytesOut, duration int64) error {
-	_, err := DB.Exec(`
-		INSERT INTO access_logs (relay_id, client_ip, action, bytes_in, bytes_out, duration)
-		VALUES (?, ?, ?, ?, ?, ?)
-	`, relayID, clientIP, action, bytesIn, bytesOut, duration)
+func SaveAccessLog(l *AccessLog) error {
+	if DB == nil {
+		return ErrNoDB
+	}
+	_, err := execWithRetry(`
+		INSERT INTO access_logs (relay_id, client_ip, action, bytes_in, bytes_out, duration, detail, country, asn, as_org, latency_ms, client_cert, tls_version, tls_cipher, tls_alpn, private, labels)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, l.RelayID, l.ClientIP, l.Action, l.BytesIn, l.BytesOut, l.Duration, l.Detail, l.Country, l.ASN, l.ASOrg, l.LatencyMs, l.ClientCert, l.TLSVersion, l.TLSCipher, l.TLSALPN, l.Private, EncodeLabels(l.Labels))
 	return err
 }
 
+// AccessLogFilter 访问日志查询条件，空字段表示不限制
+type AccessLogFilter struct {
+	RelayID  string
+	ClientIP string // 客户端 IP，以 * 结尾时按前缀匹配，如 10.0.*
+	Action   string
+	// 按标签筛选，LabelValue 为空时只要求存在该标签
+	LabelKey   string
+	LabelValue string
+}
+
 // GetAccessLogs 获取访问日志
-func GetAccessLogs(relayID string, page, size int) ([]*AccessLog, int, error) {
+func GetAccessLogs(f AccessLogFilter, page, size int) ([]*AccessLog, int, error) {
+	var where []string
+	var args []interface{}
+	if f.RelayID != "" {
+		where = append(where, "relay_id = ?")
+		args = append(args, f.RelayID)
+	}
+	if prefix, ok := strings.CutSuffix(f.ClientIP, "*"); ok {
+		// GLOB 区分大小写，可以使用 client_ip 索引；调用方需保证前缀不含通配符
+		where = append(where, "client_ip GLOB ?")
+		args = append(args, prefix+"*")
+	} else if f.ClientIP != "" {
+		where = append(where, "client_ip = ?")
+		args = append(args, f.ClientIP)
+	}
+	if f.Action != "" {
+		where = append(where, "action = ?")
+		args = append(args, f.Action)
+	}
+	if f.LabelKey != "" {
+		// 标签键只含字母、数字与 _.-，可以直接放入 JSON 路径
+		path := `$."` + f.LabelKey + `"`
+		if f.LabelValue != "" {
+			where = append(where, "json_extract(NULLIF(labels, ''), ?) = ?")
+			args = append(args, path, f.LabelValue)
+		} else {
+			where = append(where, "json_extract(NULLIF(labels, ''), ?) IS NOT NULL")
+			args = append(args, path)
+		}
+	}
+	cond := ""
+	if len(where) > 0 {
+		cond = " WHERE " + strings.Join(where, " AND ")
+	}
+
 	// 获取总数
 	var total int
-	query := "SELECT COUNT(*) FROM access_logs"
-	args := []interface{}{}
-	if relayID != "" {
-		query += " WHERE relay_id = ?"
-		args = append(args, relayID)
-	}
-	if err := DB.QueryRow(query, args...).Scan(&total); err != nil {
+	if err := DB.QueryRow("SELECT COUNT(*) FROM access_logs"+cond, args...).Scan(&total); err != nil {
 		return nil, 0, err
 	}
 
 	// 获取数据
-	query = "SELECT id, relay_id, client_ip, action, bytes_in, bytes_out, duration, created_at FROM access_logs"
-	if relayID != "" {
-		query += " WHERE relay_id = ?"
-	}
-	query += " ORDER BY created_at DESC LIMIT ? OFFSET ?"
-
-	if relayID != "" {
-		args = []interface{}{relayID, size, (page - 1) * size}
-	} else {
-		args = []interface{}{size, (page - 1) * size}
-	}
+	query := "SELECT id, relay_id, client_ip, action, bytes_in, bytes_out, duration, detail, country, asn, as_org, latency_ms, client_cert, tls_version, tls_cipher, tls_alpn, private, labels, created_at FROM access_logs" +
+		cond + " ORDER BY created_at DESC LIMIT ? OFFSET ?"
+	args = append(args, size, (page-1)*size)
 
 	rows, err := DB.Query(query, args...)
 	if err != nil {
@@ -121,9 +314,11 @@ func GetAccessLogs(relayID string, page, size int) ([]*AccessLog, int, error) {
 	var logs []*AccessLog
 	for rows.Next() {
 		l := &AccessLog{}
-		if err := rows.Scan(&l.ID, &l.RelayID, &l.ClientIP, &l.Action, &l.BytesIn, &l.BytesOut, &l.Duration, &l.CreatedAt); err != nil {
+		var labels string
+		if err := rows.Scan(&l.ID, &l.RelayID, &l.ClientIP, &l.Action, &l.BytesIn, &l.BytesOut, &l.Duration, &l.Detail, &l.Country, &l.ASN, &l.ASOrg, &l.LatencyMs, &l.ClientCert, &l.TLSVersion, &l.TLSCipher, &l.TLSALPN, &l.Private, &labels, &l.CreatedAt); err != nil {
 			return nil, 0, err
 		}
+		l.Labels = DecodeLabels(labels)
 		logs = append(logs, l)
 	}
 	return logs, total, nil
@@ -132,28 +327,232 @@ func GetAccessLogs(relayID string, page, size int) ([]*AccessLog, int, error) {
 // ClearStats 清除统计数据
 func ClearStats(relayID string) error {
 	if relayID != "" {
-		_, err := DB.Exec("DELETE FROM relay_stats WHERE relay_id = ?", relayID)
+		_, err := execWithRetry("DELETE FROM relay_stats WHERE relay_id = ?", relayID)
+		if err != nil {
+			return err
+		}
+		_, err = execWithRetry("DELETE FROM access_logs WHERE relay_id = ?", relayID)
 		if err != nil {
 			return err
 		}
-		_, err = DB.Exec("DELETE FROM access_logs WHERE relay_id = ?", relayID)
+		return ClearConnectionHistory(relayID)
+	}
+	_, err := execWithRetry("DELETE FROM relay_stats")
+	if err != nil {
 		return err
 	}
-	_, err := DB.Exec("DELETE FROM relay_stats")
+	_, err = execWithRetry("DELETE FROM access_logs")
 	if err != nil {
 		return err
 	}
-	_, err = DB.Exec("DELETE FROM access_logs")
-	return err
+	return ClearConnectionHistory("")
+}
+
+const (
+	statsRetentionDays = 30                    // 统计、访问日志与连接历史的保留天数
+	cleanBatchSize     = 1000                  // 清理时每批删除的行数
+	cleanBatchPause    = 50 * time.Millisecond // 两批之间的停顿，让出写锁给统计写入
+)
+
+// CleanOldStats 清理旧数据 (保留30天)，返回删除的行数
+// 分批删除并在批次之间短暂停顿，数据量大时不会长时间占用写锁阻塞转发统计的写入
+func CleanOldStats() (int64, error) {
+	threshold := time.Now().AddDate(0, 0, -statsRetentionDays)
+	var total int64
+	for _, t := range []struct{ table, column string }{
+		{"relay_stats", "recorded_at"},
+		{"access_logs", "created_at"},
+		{"connection_history", "ended_at"},
+	} {
+		n, err := deleteInBatches(t.table, t.column, threshold)
+		total += n
+		if err != nil {
+			return total, fmt.Errorf("清理 %s 失败: %v", t.table, err)
+		}
+	}
+	return total, nil
+}
+
+// deleteInBatches 分批删除 column 早于 before 的行
+// SQLite 默认不支持 DELETE ... LIMIT，以 rowid 子查询限制每批的行数
+func deleteInBatches(table, column string, before time.Time) (int64, error) {
+	query := fmt.Sprintf(`DELETE FROM %s WHERE rowid IN (SELECT rowid FROM %s WHERE %s < ? LIMIT ?)`,
+		table, table, column)
+	var total int64
+	for {
+		result, err := execWithRetry(query, before, cleanBatchSize)
+		if err != nil {
+			return total, err
+		}
+		n, _ := result.RowsAffected()
+		total += n
+		if n < cleanBatchSize {
+			return total, nil
+		}
+		time.Sleep(cleanBatchPause)
+	}
+}
+
+// CountryStat 按国家汇总的流量
+type CountryStat struct {
+	Country     string `json:"country"` // ISO 国家代码，未知时为 unknown
+	BytesIn     int64  `json:"bytes_in"`
+	BytesOut    int64  `json:"bytes_out"`
+	Connections int64  `json:"connections"`
 }
 
-// CleanOldStats 清理旧数据 (保留30天)
-func CleanOldStats() error {
-	threshold := time.Now().AddDate(0, 0, -30)
-	_, err := DB.Exec("DELETE FROM relay_stats WHERE recorded_at < ?", threshold)
+// GetCountryStats 按国家汇总自某时刻以来的流量，按总流量降序返回前 limit 个
+// relayID 为空时统计全部规则；流量取自 disconnect 日志，连接数为 connect 次数
+func GetCountryStats(relayID string, since time.Time, limit int) ([]*CountryStat, error) {
+	query := `
+		SELECT CASE WHEN country = '' THEN 'unknown' ELSE country END AS c,
+			COALESCE(SUM(CASE WHEN action = 'disconnect' THEN bytes_in END), 0),
+			COALESCE(SUM(CASE WHEN action = 'disconnect' THEN bytes_out END), 0),
+			COUNT(CASE WHEN action = 'connect' THEN 1 END)
+		FROM access_logs WHERE created_at >= ? AND action IN ('connect', 'disconnect')`
+	// created_at 由 CURRENT_TIMESTAMP 生成，为 UTC 文本
+	args := []interface{}{since.UTC().Format("2006-01-02 15:04:05")}
+	if relayID != "" {
+		query += " AND relay_id = ?"
+		args = append(args, relayID)
+	}
+	query += `
+		GROUP BY c ORDER BY SUM(bytes_in + bytes_out) DESC, COUNT(*) DESC LIMIT ?`
+	args = append(args, limit)
+
+	rows, err := DB.Query(query, args...)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	_, err = DB.Exec("DELETE FROM access_logs WHERE created_at < ?", threshold)
-	return err
+	defer rows.Close()
+
+	var stats []*CountryStat
+	for rows.Next() {
+		s := &CountryStat{}
+		if err := rows.Scan(&s.Country, &s.BytesIn, &s.BytesOut, &s.Connections); err != nil {
+			return nil, err
+		}
+		stats = append(stats, s)
+	}
+	return stats, rows.Err()
+}
+
+// ClientStat 按客户端 IP 汇总的流量
+type ClientStat struct {
+	ClientIP    string `json:"client_ip"`
+	Location    string `json:"client_location,omitempty"`
+	BytesIn     int64  `json:"bytes_in"`
+	BytesOut    int64  `json:"bytes_out"`
+	Connections int64  `json:"connections"`
+}
+
+// GetTopClients 按客户端 IP 汇总自某时刻以来的流量，按总流量降序返回前 limit 个
+func GetTopClients(relayID string, since time.Time, limit int) ([]*ClientStat, error) {
+	query := `
+		SELECT client_ip,
+			COALESCE(SUM(CASE WHEN action = 'disconnect' THEN bytes_in END), 0),
+			COALESCE(SUM(CASE WHEN action = 'disconnect' THEN bytes_out END), 0),
+			COUNT(CASE WHEN action = 'connect' THEN 1 END)
+		FROM access_logs WHERE created_at >= ? AND action IN ('connect', 'disconnect')`
+	args := []interface{}{since.UTC().Format("2006-01-02 15:04:05")}
+	if relayID != "" {
+		query += " AND relay_id = ?"
+		args = append(args, relayID)
+	}
+	query += `
+		GROUP BY client_ip ORDER BY SUM(bytes_in + bytes_out) DESC, COUNT(*) DESC LIMIT ?`
+	args = append(args, limit)
+
+	rows, err := DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var stats []*ClientStat
+	for rows.Next() {
+		s := &ClientStat{}
+		if err := rows.Scan(&s.ClientIP, &s.BytesIn, &s.BytesOut, &s.Connections); err != nil {
+			return nil, err
+		}
+		stats = append(stats, s)
+	}
+	return stats, rows.Err()
+}
+
+// DefaultDurationBuckets 连接时长直方图的默认分界（秒）：<1s、1-10s、10s-1m、1-10m、>=10m
+var DefaultDurationBuckets = []int64{1, 10, 60, 600}
+
+// DurationBucket 时长落在 [Min, Max) 秒内的连接数，Max 为 0 表示没有上限
+type DurationBucket struct {
+	Label string `json:"label"`
+	Min   int64  `json:"min"`
+	Max   int64  `json:"max,omitempty"`
+	Count int64  `json:"count"`
+}
+
+// GetDurationHistogram 按分界统计自某时刻以来已断开连接的时长分布，bounds 为升序的正整数（秒）
+// relayID 为空时统计全部规则；每个区间都会返回，没有连接的区间计数为 0
+func GetDurationHistogram(relayID string, since time.Time, bounds []int64) ([]*DurationBucket, error) {
+	buckets := make([]*DurationBucket, len(bounds)+1)
+	var min int64
+	for i, max := range bounds {
+		buckets[i] = &DurationBucket{Min: min, Max: max, Label: durationRangeLabel(min, max)}
+		min = max
+	}
+	buckets[len(bounds)] = &DurationBucket{Min: min, Label: ">=" + formatDurationBound(min)}
+
+	var cases strings.Builder
+	var args []interface{}
+	for i, max := range bounds {
+		cases.WriteString(" WHEN duration < ? THEN " + strconv.Itoa(i))
+		args = append(args, max)
+	}
+	query := "SELECT CASE" + cases.String() + " ELSE " + strconv.Itoa(len(bounds)) + ` END AS bucket, COUNT(*)
+		FROM access_logs WHERE action = 'disconnect' AND created_at >= ?`
+	args = append(args, since.UTC().Format("2006-01-02 15:04:05"))
+	if relayID != "" {
+		query += " AND relay_id = ?"
+		args = append(args, relayID)
+	}
+	query += " GROUP BY bucket"
+
+	rows, err := DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var bucket int
+		var count int64
+		if err := rows.Scan(&bucket, &count); err != nil {
+			return nil, err
+		}
+		if bucket >= 0 && bucket < len(buckets) {
+			buckets[bucket].Count = count
+		}
+	}
+	return buckets, rows.Err()
+}
+
+// durationRangeLabel 区间名称，如 <1s、1s-10s、10s-1m
+func durationRangeLabel(min, max int64) string {
+	if min == 0 {
+		return "<" + formatDurationBound(max)
+	}
+	return formatDurationBound(min) + "-" + formatDurationBound(max)
+}
+
+// formatDurationBound 把秒数格式化为能整除的最大单位，如 60 -> 1m，90 -> 90s
+func formatDurationBound(seconds int64) string {
+	switch {
+	case seconds >= 86400 && seconds%86400 == 0:
+		return strconv.FormatInt(seconds/86400, 10) + "d"
+	case seconds >= 3600 && seconds%3600 == 0:
+		return strconv.FormatInt(seconds/3600, 10) + "h"
+	case seconds >= 60 && seconds%60 == 0:
+		return strconv.FormatInt(seconds/60, 10) + "m"
+	}
+	return strconv.FormatInt(seconds, 10) + "s"
 }
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/DGHeroin/relay/webui/model"
+)
+
+const (
+	defaultOverviewInterval = 3 * time.Second // 默认 stats.overview 推送间隔
+	minOverviewInterval     = time.Second     // 最小 stats.overview 推送间隔
+)
+
+// loadOverviewInterval 读取 ws_overview_interval_ms 设置，未设置或无效时使用默认值
+func loadOverviewInterval() time.Duration {
+	value, _ := model.GetSetting("ws_overview_interval_ms")
+	ms, err := strconv.Atoi(value)
+	if err != nil {
+		return defaultOverviewInterval
+	}
+	if interval := time.Duration(ms) * time.Millisecond; interval > minOverviewInterval {
+		return interval
+	}
+	return minOverviewInterval
+}
+
+// pushOverview 定期向订阅了 stats.overview 的客户端推送运行中规则的实时汇总
+// 没有订阅者时跳过计算；每次推送后重新读取间隔，修改设置后无需重启
+func (h *Handlers) pushOverview() {
+	for {
+		time.Sleep(loadOverviewInterval())
+		if !h.wsHub.HasSubscribers("stats.overview") {
+			continue
+		}
+		h.wsHub.Broadcast("stats.overview", h.relayMgr.LiveOverview())
+	}
+}
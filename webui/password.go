@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/DGHeroin/relay/webui/model"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// 密码哈希算法，通过 password_algorithm 设置选择
+const (
+	passwordAlgoBcrypt   = "bcrypt"
+	passwordAlgoArgon2id = "argon2id"
+)
+
+// argon2id 参数，随哈希一起以 PHC 格式保存，调整后旧哈希仍可验证
+const (
+	argon2Memory  = 64 * 1024 // KiB
+	argon2Time    = 3
+	argon2Threads = 2
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+)
+
+// 校验已保存哈希时接受的 argon2id 参数范围，超出范围的哈希视为无效：
+// t 或 p 为 0 会使 argon2 panic，过大的 m 可被用来在登录时耗尽内存
+const (
+	argon2MaxMemory  = 1024 * 1024 // KiB，1 GiB
+	argon2MaxTime    = 16
+	argon2MaxThreads = 64
+	argon2MinKeyLen  = 16
+	argon2MaxKeyLen  = 128
+	argon2MinSaltLen = 8
+)
+
+// bcrypt 成本范围，通过 bcrypt_cost 设置调整，默认 bcrypt.DefaultCost
+const (
+	minBcryptCost = 10
+	maxBcryptCost = 15
+)
+
+var errInvalidHash = errors.New("无法识别的密码哈希格式")
+
+// 非交互部署时提供初始管理员密码的环境变量，_FILE 指向挂载的密钥文件
+const (
+	envAdminPassword     = "RELAY_ADMIN_PASSWORD"
+	envAdminPasswordFile = "RELAY_ADMIN_PASSWORD_FILE"
+)
+
+// initialAdminPassword 读取环境变量或密钥文件中的初始管理员密码，均未设置时返回空字符串
+func initialAdminPassword() (string, error) {
+	password := os.Getenv(envAdminPassword)
+	path := os.Getenv(envAdminPasswordFile)
+	if password != "" && path != "" {
+		return "", fmt.Errorf("%s 与 %s 不能同时设置", envAdminPassword, envAdminPasswordFile)
+	}
+	if path != "" {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("读取密码文件失败: %v", err)
+		}
+		// 密钥文件末尾通常带换行
+		password = strings.TrimRight(string(content), "\r\n")
+		if password == "" {
+			return "", fmt.Errorf("密码文件为空: %s", path)
+		}
+	}
+	return password, nil
+}
+
+// provisionAdmin 系统未初始化且提供了初始密码时自动完成初始化，已初始化时忽略
+func provisionAdmin() error {
+	password, err := initialAdminPassword()
+	if err != nil || password == "" {
+		return err
+	}
+	if model.IsSetupCompleted() {
+		log.Printf("系统已初始化，忽略 %s/%s", envAdminPassword, envAdminPasswordFile)
+		return nil
+	}
+	if err := completeSetup(password); err != nil {
+		return err
+	}
+	log.Println("已使用环境变量提供的管理员密码完成初始化")
+	return nil
+}
+
+// passwordAlgorithm 返回当前配置的哈希算法，默认 bcrypt
+func passwordAlgorithm() string {
+	if v, _ := model.GetSetting("password_algorithm"); v == passwordAlgoArgon2id {
+		return passwordAlgoArgon2id
+	}
+	return passwordAlgoBcrypt
+}
+
+// bcryptCost 返回当前配置的 bcrypt 成本，未设置或超出范围时使用默认值
+func bcryptCost() int {
+	v, _ := model.GetSetting("bcrypt_cost")
+	if cost, err := strconv.Atoi(v); err == nil && cost >= minBcryptCost && cost <= maxBcryptCost {
+		return cost
+	}
+	return bcrypt.DefaultCost
+}
+
+// hashPassword 使用当前配置的算法生成密码哈希
+func hashPassword(password string) (string, error) {
+	if passwordAlgorithm() == passwordAlgoArgon2id {
+		return hashArgon2id(password)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost())
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// verifyPassword 按哈希自身的格式选择算法校验密码
+func verifyPassword(hash, password string) bool {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		ok, err := verifyArgon2id(hash, password)
+		return err == nil && ok
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// passwordNeedsRehash 哈希算法或 bcrypt 成本与当前配置不一致时返回 true，登录成功后据此迁移
+func passwordNeedsRehash(hash string) bool {
+	isArgon := strings.HasPrefix(hash, "$argon2id$")
+	if isArgon != (passwordAlgorithm() == passwordAlgoArgon2id) {
+		return true
+	}
+	if isArgon {
+		return false
+	}
+	// bcrypt 哈希自带成本，旧成本的哈希仍可验证
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err == nil && cost != bcryptCost()
+}
+
+// hashArgon2id 生成 PHC 格式的 argon2id 哈希：$argon2id$v=19$m=,t=,p=$salt$key
+func hashArgon2id(password string) (string, error) {
+	salt := make([]byte, argon2SaltLen)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, argon2Memory, argon2Time, argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// verifyArgon2id 使用哈希中保存的参数重新计算并比较
+func verifyArgon2id(hash, password string) (bool, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != passwordAlgoArgon2id {
+		return false, errInvalidHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, errInvalidHash
+	}
+	var memory, time, threads uint32
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false, errInvalidHash
+	}
+	if time < 1 || time > argon2MaxTime || threads < 1 || threads > argon2MaxThreads ||
+		memory < 8*threads || memory > argon2MaxMemory {
+		return false, errInvalidHash
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil || len(salt) < argon2MinSaltLen {
+		return false, errInvalidHash
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(want) < argon2MinKeyLen || len(want) > argon2MaxKeyLen {
+		return false, errInvalidHash
+	}
+	got := argon2.IDKey([]byte(password), salt, time, memory, uint8(threads), uint32(len(want)))
+	return subtle.ConstantTimeCompare(got, want) == 1, nil
+}
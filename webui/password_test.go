@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/DGHeroin/relay/webui/model"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// TestPasswordCrossAlgorithm 切换算法后旧哈希仍可验证，并在登录成功后迁移到新算法
+func TestPasswordCrossAlgorithm(t *testing.T) {
+	setSetting(t, "password_algorithm", passwordAlgoBcrypt)
+	bcryptHash, err := hashPassword("secret-pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setSetting(t, "password_algorithm", passwordAlgoArgon2id)
+	argonHash, err := hashPassword("secret-pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(argonHash, "$argon2id$") || !strings.HasPrefix(bcryptHash, "$2") {
+		t.Fatalf("哈希格式错误: %s / %s", bcryptHash, argonHash)
+	}
+
+	for _, algo := range []string{passwordAlgoBcrypt, passwordAlgoArgon2id} {
+		setSetting(t, "password_algorithm", algo)
+		for _, hash := range []string{bcryptHash, argonHash} {
+			if !verifyPassword(hash, "secret-pass") {
+				t.Errorf("algorithm=%s: 正确密码验证失败 %s", algo, hash)
+			}
+			if verifyPassword(hash, "wrong-pass") {
+				t.Errorf("algorithm=%s: 错误密码验证通过 %s", algo, hash)
+			}
+		}
+	}
+
+	setSetting(t, "password_algorithm", passwordAlgoArgon2id)
+	if !passwordNeedsRehash(bcryptHash) || passwordNeedsRehash(argonHash) {
+		t.Error("配置为 argon2id 时只有 bcrypt 哈希需要迁移")
+	}
+	setSetting(t, "password_algorithm", passwordAlgoBcrypt)
+	if passwordNeedsRehash(bcryptHash) || !passwordNeedsRehash(argonHash) {
+		t.Error("配置为 bcrypt 时只有 argon2id 哈希需要迁移")
+	}
+}
+
+// TestVerifyArgon2idRejectsBadParams 参数超出范围的哈希直接视为无效，不会 panic 或分配过多内存
+func TestVerifyArgon2idRejectsBadParams(t *testing.T) {
+	const salt = "c2FsdHNhbHRzYWx0c2FsdA"                     // 16 字节
+	const key = "a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2U" // 32 字节
+	for _, params := range []string{
+		"m=65536,t=0,p=2",    // t=0 会 panic
+		"m=65536,t=3,p=0",    // p=0 会 panic
+		"m=4194304,t=3,p=2",  // 4 GiB
+		"m=65536,t=1000,p=2", // 过多迭代
+		"m=8,t=3,p=2",        // m 小于 8*p
+		"m=65536,t=3,p=300",  // 超出 uint8
+	} {
+		hash := "$argon2id$v=19$" + params + "$" + salt + "$" + key
+		ok, err := verifyArgon2id(hash, "secret-pass")
+		if ok || err != errInvalidHash {
+			t.Errorf("%s: ok=%v err=%v, want errInvalidHash", params, ok, err)
+		}
+	}
+}
+
+// TestBcryptCost 不同成本生成的哈希都能验证，成本与配置不一致时需要重新哈希
+func TestBcryptCost(t *testing.T) {
+	setSetting(t, "password_algorithm", passwordAlgoBcrypt)
+	hashes := make(map[int]string)
+	for _, cost := range []int{minBcryptCost, 11, 12} {
+		setSetting(t, "bcrypt_cost", strconv.Itoa(cost))
+		hash, err := hashPassword("secret-pass")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := bcrypt.Cost([]byte(hash)); got != cost {
+			t.Errorf("bcrypt_cost=%d 生成的哈希成本为 %d", cost, got)
+		}
+		hashes[cost] = hash
+	}
+
+	for configured := range hashes {
+		setSetting(t, "bcrypt_cost", strconv.Itoa(configured))
+		for cost, hash := range hashes {
+			if !verifyPassword(hash, "secret-pass") {
+				t.Errorf("bcrypt_cost=%d: 成本 %d 的哈希验证失败", configured, cost)
+			}
+			if got := passwordNeedsRehash(hash); got != (cost != configured) {
+				t.Errorf("bcrypt_cost=%d: 成本 %d 的哈希 needsRehash=%v", configured, cost, got)
+			}
+		}
+	}
+
+	// 超出范围或无效时使用默认成本
+	for _, v := range []string{"", "9", "16", "abc"} {
+		setSetting(t, "bcrypt_cost", v)
+		if got := bcryptCost(); got != bcrypt.DefaultCost {
+			t.Errorf("bcrypt_cost=%q: 成本 %d, want %d", v, got, bcrypt.DefaultCost)
+		}
+	}
+}
+
+// TestLoginRehashesBcryptCost 登录成功后旧成本的哈希被替换为当前成本
+func TestLoginRehashesBcryptCost(t *testing.T) {
+	setSetting(t, "password_algorithm", passwordAlgoBcrypt)
+	setSetting(t, "bcrypt_cost", "10")
+	hash, err := hashPassword("secret-pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setSetting(t, "admin_password", hash)
+	setSetting(t, "bcrypt_cost", "11")
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("POST", "/api", nil)
+	resp := (&Handlers{}).handleSystem("login", map[string]interface{}{"password": "secret-pass"}, c)
+	if resp.Code != 0 {
+		t.Fatalf("登录失败: %+v", resp)
+	}
+	stored, _ := model.GetSetting("admin_password")
+	if cost, _ := bcrypt.Cost([]byte(stored)); cost != 11 {
+		t.Fatalf("登录后哈希成本 %d, want 11", cost)
+	}
+	if !verifyPassword(stored, "secret-pass") {
+		t.Fatal("迁移后的哈希无法验证原密码")
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"container/list"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/DGHeroin/relay/webui/model"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultAPIRateLimit = 20.0             // 默认每个来源 IP 每秒请求数
+	defaultAPIRateBurst = 40               // 默认突发请求数
+	rateLimitConfigTTL  = 30 * time.Second // 设置缓存时间
+	rateBucketIdle      = 5 * time.Minute  // 空闲超过该时长的桶会被清理
+	maxRateBuckets      = 10000            // 最多跟踪的来源 IP 数
+)
+
+// tokenBucket 单个来源 IP 的令牌桶
+type tokenBucket struct {
+	ip       string
+	tokens   float64
+	lastSeen time.Time
+}
+
+// rateLimiter 按客户端 IP 限制 API 请求频率
+// 桶按最近使用时间排成链表，跟踪的来源达到上限时淘汰最久未使用的桶
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*list.Element // 来源 IP -> lru 中的 *tokenBucket
+	lru     *list.List               // 最近使用的在前
+
+	// 设置缓存，rate <= 0 表示不限制；由 cfgMu 保护，读取数据库时不持有 mu
+	cfgMu    sync.Mutex
+	rate     float64
+	burst    float64
+	loadedAt time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	l := &rateLimiter{buckets: make(map[string]*list.Element), lru: list.New()}
+	go l.cleanupLoop()
+	return l
+}
+
+// config 返回 api_rate_limit / api_rate_burst 设置，缓存过期时重新读取
+func (l *rateLimiter) config() (rate, burst float64) {
+	l.cfgMu.Lock()
+	if time.Since(l.loadedAt) < rateLimitConfigTTL {
+		rate, burst = l.rate, l.burst
+		l.cfgMu.Unlock()
+		return rate, burst
+	}
+	l.cfgMu.Unlock()
+
+	rate, burst = defaultAPIRateLimit, defaultAPIRateBurst
+	if v, err := model.GetSetting("api_rate_limit"); err == nil && v != "" {
+		if r, err := strconv.ParseFloat(v, 64); err == nil && r >= 0 {
+			rate = r
+		}
+	}
+	if v, err := model.GetSetting("api_rate_burst"); err == nil && v != "" {
+		if b, err := strconv.Atoi(v); err == nil && b >= 1 {
+			burst = float64(b)
+		}
+	}
+
+	l.cfgMu.Lock()
+	l.rate, l.burst, l.loadedAt = rate, burst, time.Now()
+	l.cfgMu.Unlock()
+	return rate, burst
+}
+
+// invalidate 使设置缓存失效，下次请求时重新读取
+func (l *rateLimiter) invalidate() {
+	l.cfgMu.Lock()
+	l.loadedAt = time.Time{}
+	l.cfgMu.Unlock()
+}
+
+// allow 消耗一个令牌，令牌不足时返回 false
+func (l *rateLimiter) allow(ip string) bool {
+	return l.allowN(ip, 1)
+}
+
+// allowN 消耗 n 个令牌，令牌不足时不消耗并返回 false
+func (l *rateLimiter) allowN(ip string, n int) bool {
+	rate, burst := l.config()
+	if rate <= 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	var b *tokenBucket
+	if e, ok := l.buckets[ip]; ok {
+		l.lru.MoveToFront(e)
+		b = e.Value.(*tokenBucket)
+	} else {
+		if len(l.buckets) >= maxRateBuckets {
+			// 跟踪的来源过多时淘汰最久未使用的桶，保证内存有界且新来源仍可访问
+			oldest := l.lru.Back()
+			l.lru.Remove(oldest)
+			delete(l.buckets, oldest.Value.(*tokenBucket).ip)
+		}
+		b = &tokenBucket{ip: ip, tokens: burst, lastSeen: now}
+		l.buckets[ip] = l.lru.PushFront(b)
+	}
+
+	b.tokens += now.Sub(b.lastSeen).Seconds() * rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.lastSeen = now
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// cleanup 从最久未使用的一端删除空闲的桶，调用方需持有 mu
+func (l *rateLimiter) cleanup(now time.Time) {
+	for e := l.lru.Back(); e != nil; e = l.lru.Back() {
+		b := e.Value.(*tokenBucket)
+		if now.Sub(b.lastSeen) <= rateBucketIdle {
+			return
+		}
+		l.lru.Remove(e)
+		delete(l.buckets, b.ip)
+	}
+}
+
+func (l *rateLimiter) cleanupLoop() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		l.mu.Lock()
+		l.cleanup(now)
+		l.mu.Unlock()
+	}
+}
+
+// middleware 超过频率限制时返回 429
+// 按 ClientIP 计数，经 -trusted-proxies 中的代理转发时为 X-Forwarded-For 中的客户端地址
+func (l *rateLimiter) middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !l.allow(c.ClientIP()) {
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, Error(429, "请求过于频繁，请稍后再试"))
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TestRateLimiterEvictsOldest 来源数达到上限时淘汰最久未使用的桶，新来源仍可访问
+func TestRateLimiterEvictsOldest(t *testing.T) {
+	l := newRateLimiter()
+	for i := 0; i < maxRateBuckets; i++ {
+		if !l.allow(fmt.Sprintf("10.0.%d.%d", i/256, i%256)) {
+			t.Fatalf("第 %d 个来源被拒绝", i)
+		}
+	}
+	// 最早的来源再次访问后变为最近使用
+	l.allow("10.0.0.0")
+
+	if !l.allow("192.0.2.1") {
+		t.Fatal("来源数达到上限时新来源被拒绝")
+	}
+	if len(l.buckets) != maxRateBuckets {
+		t.Fatalf("跟踪 %d 个来源, want %d", len(l.buckets), maxRateBuckets)
+	}
+	if _, ok := l.buckets["10.0.0.1"]; ok {
+		t.Error("最久未使用的来源未被淘汰")
+	}
+	if _, ok := l.buckets["10.0.0.0"]; !ok {
+		t.Error("最近使用的来源被淘汰")
+	}
+}
+
+// TestRateLimiterTrustedProxy 只有来自信任代理的请求按 X-Forwarded-For 区分客户端
+func TestRateLimiterTrustedProxy(t *testing.T) {
+	setSetting(t, "api_rate_limit", "0.001")
+	setSetting(t, "api_rate_burst", "1")
+	l := newRateLimiter()
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	if err := r.SetTrustedProxies([]string{"10.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	r.GET("/api", l.middleware(), func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	do := func(remote, forwarded string) int {
+		req := httptest.NewRequest("GET", "/api", nil)
+		req.RemoteAddr = remote + ":12345"
+		req.Header.Set("X-Forwarded-For", forwarded)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// 经信任代理转发的不同客户端各自计数
+	if code := do("10.0.0.1", "192.0.2.1"); code != http.StatusOK {
+		t.Fatalf("客户端 192.0.2.1: HTTP %d", code)
+	}
+	if code := do("10.0.0.1", "192.0.2.2"); code != http.StatusOK {
+		t.Fatalf("客户端 192.0.2.2 与 192.0.2.1 共用了令牌桶: HTTP %d", code)
+	}
+	if code := do("10.0.0.1", "192.0.2.1"); code != http.StatusTooManyRequests {
+		t.Fatalf("客户端 192.0.2.1 第二次请求: HTTP %d, want 429", code)
+	}
+
+	// 不受信任的来源伪造 X-Forwarded-For 无法绕过限流
+	if code := do("198.51.100.1", "192.0.2.3"); code != http.StatusOK {
+		t.Fatalf("来源 198.51.100.1: HTTP %d", code)
+	}
+	if code := do("198.51.100.1", "192.0.2.4"); code != http.StatusTooManyRequests {
+		t.Fatalf("伪造 X-Forwarded-For 绕过了限流: HTTP %d", code)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/DGHeroin/relay/webui/model"
+	"github.com/DGHeroin/relay/webui/service"
+)
+
+// reload 重新读取规则与设置，只对有变化的规则执行启停，不影响其它正在运行的转发
+func (h *Handlers) reload() {
+	log.Println("[Reload] 重新加载规则与设置")
+
+	rules, err := model.GetEnabledRelayRules()
+	if err != nil {
+		log.Printf("[Reload] 获取规则失败: %v", err)
+		return
+	}
+
+	enabled := make(map[string]*model.RelayRule, len(rules))
+	for _, rule := range rules {
+		enabled[rule.ID] = rule
+	}
+	previous := h.rememberEnabled(rules)
+
+	// 停止已禁用/已删除的规则，重启配置有变化的规则
+	for _, id := range h.relayMgr.RunningIDs() {
+		running, ok := h.relayMgr.RunningRule(id)
+		if !ok {
+			continue
+		}
+		rule, stillEnabled := enabled[id]
+		if !stillEnabled {
+			h.relayMgr.Stop(id, service.ReasonReload)
+			log.Printf("[Reload] 停止规则: %s", running.Name)
+			continue
+		}
+		if !rule.UpdatedAt.Equal(running.UpdatedAt) {
+			h.relayMgr.Stop(id, service.ReasonReload)
+			if err := h.relayMgr.Start(rule, h.wsHub, h.geoIP, service.ReasonReload); err != nil {
+				log.Printf("[Reload] 重启规则失败 %s: %v", rule.Name, err)
+			} else {
+				log.Printf("[Reload] 规则配置已变化，已重启: %s", rule.Name)
+			}
+		}
+		delete(enabled, id)
+	}
+
+	// 只启动上次加载后新启用的规则：此前已启用却未运行的规则可能是被手动停止或启动失败，保持原状；
+	// 手动停止后又重新启用的规则同样跳过。不在运行计划时间内的留给计划任务
+	for _, rule := range enabled {
+		if previous[rule.ID] || h.relayMgr.ManuallyStopped(rule.ID) {
+			continue
+		}
+		if !service.ScheduleActive(rule, time.Now()) {
+			continue
+		}
+		if err := h.relayMgr.Start(rule, h.wsHub, h.geoIP, service.ReasonReload); err != nil {
+			log.Printf("[Reload] 启动规则失败 %s: %v", rule.Name, err)
+			continue
+		}
+		log.Printf("[Reload] 启动规则: %s", rule.Name)
+	}
+
+	// 数据库可能已被恢复替换
+	h.relayMgr.InvalidateLifetime()
+
+	// 刷新 GeoIP
+	geoPath := filepath.Join(dataDir, "GeoLite2-City.mmdb")
+	if geoEnabled, _ := model.GetSetting("geoip_enabled"); geoEnabled == "true" {
+		if err := h.geoIP.Load(geoPath); err != nil {
+			log.Printf("[Reload] GeoIP 加载失败: %v", err)
+		}
+	} else if h.geoIP.IsLoaded() {
+		h.geoIP.Close()
+		log.Println("[Reload] GeoIP 已关闭")
+	}
+	asnPath := filepath.Join(dataDir, "GeoLite2-ASN.mmdb")
+	if _, err := os.Stat(asnPath); err == nil {
+		if err := h.geoIP.LoadASN(asnPath); err != nil {
+			log.Printf("[Reload] ASN 数据库加载失败: %v", err)
+		}
+	} else if h.geoIP.IsASNLoaded() {
+		h.geoIP.CloseASN()
+	}
+
+	loadGeoIPLocales(h.geoIP)
+
+	// 反向隧道服务端设置可能已变化
+	if err := h.applyReverseServer(); err != nil {
+		log.Printf("[Reload] %v", err)
+	}
+
+	// 刷新 CORS 设置
+	invalidateCORSCache()
+	invalidateHTTPStatusCache()
+	model.InvalidateSessionPolicy()
+	// 会话可能已被 reset-password 子命令清除
+	model.ClearSessionCache()
+	if h.limiter != nil {
+		h.limiter.invalidate()
+	}
+
+	log.Println("[Reload] 完成")
+}
+
+// rememberEnabled 记录本次加载时已启用的规则，返回上次记录的集合
+func (h *Handlers) rememberEnabled(rules []*model.RelayRule) map[string]bool {
+	ids := make(map[string]bool, len(rules))
+	for _, rule := range rules {
+		ids[rule.ID] = true
+	}
+	h.loadedMu.Lock()
+	defer h.loadedMu.Unlock()
+	previous := h.loaded
+	h.loaded = ids
+	return previous
+}
+
+// loadGeoIPLocales 按 geoip_locale 设置名称的语言优先级，设置无效时使用默认优先级
+func loadGeoIPLocales(geoIP *service.GeoIPService) {
+	value, _ := model.GetSetting("geoip_locale")
+	locales, err := service.ParseGeoIPLocales(value)
+	if err != nil {
+		log.Printf("GeoIP 语言设置无效: %v", err)
+		locales = service.DefaultGeoIPLocales
+	}
+	geoIP.SetLocales(locales)
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/DGHeroin/relay/webui/model"
+	"github.com/DGHeroin/relay/webui/service"
+)
+
+const (
+	dialCheckTimeout = 3 * time.Second
+	maxDialChecks    = 5 // 端口段规则最多试连的目标数
+)
+
+// ruleCheck 单项校验结果
+type ruleCheck struct {
+	Name    string `json:"name"`
+	Passed  bool   `json:"passed"`
+	Skipped bool   `json:"skipped,omitempty"` // 前置校验失败或未请求时跳过
+	Message string `json:"message,omitempty"`
+}
+
+// ruleChecker 按顺序记录校验结果
+type ruleChecker struct {
+	checks []ruleCheck
+	failed bool
+}
+
+// run 执行一项校验，ready 为 false（前置校验未通过）时记为跳过
+func (rc *ruleChecker) run(name string, ready bool, fn func() error) bool {
+	if !ready {
+		rc.skip(name, "前置校验未通过")
+		return false
+	}
+	if err := fn(); err != nil {
+		rc.checks = append(rc.checks, ruleCheck{Name: name, Message: err.Error()})
+		rc.failed = true
+		return false
+	}
+	rc.checks = append(rc.checks, ruleCheck{Name: name, Passed: true})
+	return true
+}
+
+func (rc *ruleChecker) skip(name, reason string) {
+	rc.checks = append(rc.checks, ruleCheck{Name: name, Skipped: true, Message: reason})
+}
+
+// validateRule 对规则做完整的预检查但不保存，data 与 create/update 的参数相同
+// 提供 id 时以已有规则为基础校验修改，dial=true 时试连目标地址
+// 地址与配置校验依次进行，之后的冲突、端口占用与试连相互独立
+func (h *Handlers) validateRule(data map[string]interface{}) (bool, []ruleCheck) {
+	rc := &ruleChecker{}
+	rule := &model.RelayRule{Protocol: "both"}
+
+	ok := rc.run("fields", true, func() error {
+		if id := resolveRuleID(data); id != "" {
+			existing, err := model.GetRelayRule(id)
+			if err != nil {
+				return fmt.Errorf("规则不存在")
+			}
+			rule = existing
+		}
+		for key, field := range map[string]*string{
+			"name":     &rule.Name,
+			"src":      &rule.Src,
+			"dst":      &rule.Dst,
+			"protocol": &rule.Protocol,
+		} {
+			if v, ok := data[key].(string); ok && v != "" {
+				*field = v
+			}
+		}
+		if rule.Name == "" || rule.Src == "" || rule.Dst == "" {
+			return fmt.Errorf("参数不完整")
+		}
+		if rule.Protocol != "tcp" && rule.Protocol != "udp" && rule.Protocol != "both" {
+			return fmt.Errorf("协议必须是 tcp、udp 或 both")
+		}
+		return nil
+	})
+	listenOK := rc.run("listen_addr", ok, func() error {
+		return validateListenAddr(rule.Src, ruleTransparent(data, rule.Transparent))
+	})
+	targetOK := rc.run("target_addr", ok, func() error { return validateTargetAddr(rule.Dst) })
+
+	var mappings []service.AddrMapping
+	ok = rc.run("mappings", listenOK && targetOK, func() (err error) {
+		mappings, err = service.ExpandMappings(rule.Src, rule.Dst)
+		return err
+	})
+	// 可选配置：国家访问控制、网络类型、告警、配额、运行计划、TLS 等
+	ok = rc.run("options", ok, func() error { return applyRuleOptions(rule, data) })
+	rc.run("conflict", ok, func() error { return checkRuleConflict(rule) })
+	rc.run("port_available", ok, func() error { return h.checkListenAvailable(rule) })
+	rc.run("loop", ok, func() error { return checkRelayLoop(rule) })
+
+	switch dial, _ := data["dial"].(bool); {
+	case !dial:
+		rc.skip("dial", "未请求试连")
+	case ok && rule.Protocol == "udp":
+		rc.skip("dial", "UDP 目标无法试连")
+	default:
+		rc.run("dial", ok, func() error { return dialTargets(mappings, rule.UpstreamProxy) })
+	}
+
+	return !rc.failed, rc.checks
+}
+
+// dialTargets 以 TCP 试连规则的目标地址，端口段规则只试连前几个，多目标规则试连全部目标
+// 设置了上游代理时经代理试连
+func dialTargets(mappings []service.AddrMapping, upstreamProxy string) error {
+	seen := make(map[string]bool)
+	for _, m := range mappings {
+		for _, t := range m.Targets {
+			if seen[t.Addr] {
+				continue
+			}
+			if len(m.Targets) == 1 && len(seen) >= maxDialChecks {
+				return nil
+			}
+			seen[t.Addr] = true
+			var conn net.Conn
+			var err error
+			if upstreamProxy != "" {
+				conn, err = service.DialThroughProxy(upstreamProxy, t.Addr)
+			} else {
+				conn, err = net.DialTimeout("tcp", t.Addr, dialCheckTimeout)
+			}
+			if err != nil {
+				return fmt.Errorf("无法连接 %s: %v", t.Addr, err)
+			}
+			conn.Close()
+		}
+	}
+	return nil
+}
+
+var errRuleNotFound = errors.New("规则不存在")
+
+// testTargetsFor 确定 relay.test_target 要测试的目标地址与协议
+// 提供 id 时测试规则展开后的目标并沿用规则的协议、上游代理与上游 TLS 配置；
+// 否则测试 dst，protocol 默认为 tcp。端口段只测试前几个端口
+func testTargetsFor(data map[string]interface{}) ([]string, []string, *model.RelayRule, error) {
+	rule := &model.RelayRule{Protocol: "tcp"}
+	var targets []string
+	if ref, _ := data["id"].(string); ref != "" {
+		existing, err := model.GetRelayRule(model.ResolveRelayRuleID(ref))
+		if err != nil {
+			return nil, nil, nil, errRuleNotFound
+		}
+		rule = existing
+		mappings, err := service.ExpandMappings(rule.Src, rule.Dst)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		seen := make(map[string]bool)
+		for _, m := range mappings {
+			for _, t := range m.Targets {
+				if seen[t.Addr] || (len(m.Targets) == 1 && len(targets) >= maxDialChecks) {
+					continue
+				}
+				seen[t.Addr] = true
+				targets = append(targets, t.Addr)
+			}
+		}
+	} else {
+		dst, _ := data["dst"].(string)
+		if dst == "" {
+			return nil, nil, nil, fmt.Errorf("需要提供 id 或 dst")
+		}
+		if err := validateTargetAddr(dst); err != nil {
+			return nil, nil, nil, err
+		}
+		parsed, _ := model.ParseTargets(dst)
+		for _, t := range parsed {
+			host, start, end, _ := model.ParsePortRange(t.Addr)
+			for port := start; port <= end && len(targets) < maxDialChecks; port++ {
+				targets = append(targets, net.JoinHostPort(host, strconv.Itoa(port)))
+			}
+		}
+	}
+
+	if protocol, _ := data["protocol"].(string); protocol != "" {
+		rule.Protocol = protocol
+	}
+	switch rule.Protocol {
+	case "tcp", "udp":
+		return targets, []string{rule.Protocol}, rule, nil
+	case "both":
+		return targets, []string{"tcp", "udp"}, rule, nil
+	}
+	return nil, nil, nil, fmt.Errorf("协议必须是 tcp、udp 或 both")
+}
+
+// probeTargets 并发测试全部目标，结果按目标与协议的顺序返回，全部成功时 ok 为 true
+func probeTargets(targets, protocols []string, rule *model.RelayRule) (bool, []*service.TargetProbe) {
+	results := make([]*service.TargetProbe, len(targets)*len(protocols))
+	var wg sync.WaitGroup
+	for i, addr := range targets {
+		for j, protocol := range protocols {
+			wg.Add(1)
+			go func(idx int, protocol, addr string) {
+				defer wg.Done()
+				// 上游代理与上游 TLS 只作用于 TCP
+				results[idx] = service.ProbeTarget(protocol, addr, rule.UpstreamProxy, rule.UpstreamTLS && protocol == "tcp")
+			}(i*len(protocols)+j, protocol, addr)
+		}
+	}
+	wg.Wait()
+
+	ok := true
+	for _, r := range results {
+		ok = ok && r.OK
+	}
+	return ok, results
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/DGHeroin/relay/webui/service"
+)
+
+// processStart 进程启动时间
+var processStart = time.Now()
+
+// runtimeStats 返回进程运行时指标，用于排查内存与 goroutine 泄漏
+func (h *Handlers) runtimeStats() map[string]interface{} {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	var lastGC string
+	if mem.LastGC > 0 {
+		lastGC = time.Unix(0, int64(mem.LastGC)).Format(time.RFC3339)
+	}
+
+	fdSoft, fdHard := service.FDLimit()
+
+	return map[string]interface{}{
+		"uptime_seconds":     int64(time.Since(processStart).Seconds()),
+		"goroutines":         runtime.NumGoroutine(),
+		"open_fds":           openFDCount(),
+		"fd_limit":           fdSoft,
+		"fd_hard_limit":      fdHard,
+		"listeners":          h.relayMgr.ListenerCount(),
+		"max_listeners":      service.MaxListeners(),
+		"heap_alloc":         mem.HeapAlloc,
+		"heap_inuse":         mem.HeapInuse,
+		"heap_objects":       mem.HeapObjects,
+		"sys":                mem.Sys,
+		"total_alloc":        mem.TotalAlloc,
+		"num_gc":             mem.NumGC,
+		"gc_pause_total_ms":  float64(mem.PauseTotalNs) / float64(time.Millisecond),
+		"last_gc":            lastGC,
+		"running_rules":      h.relayMgr.ActiveCount(),
+		"active_connections": h.relayMgr.TotalConnections(),
+		"ws_clients":         h.wsHub.ClientCount(),
+		"go_version":         runtime.Version(),
+	}
+}
+
+// openFDCount 当前打开的文件描述符数，无法读取 /proc 时（非 Linux）返回 -1
+func openFDCount() int {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	// 减去 ReadDir 自身打开的目录
+	return len(entries) - 1
+}
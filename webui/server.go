@@ -2,9 +2,14 @@ package main
 
 import (
 	"embed"
+	"errors"
+	"fmt"
 	"io/fs"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -21,6 +26,13 @@ var (
 		updatedAt time.Time
 	}
 	corsCacheTTL = 30 * time.Second // 缓存 30 秒
+
+	// api_http_status 设置缓存，开启后错误响应使用对应的 HTTP 状态码
+	httpStatusCache struct {
+		sync.RWMutex
+		enabled   bool
+		updatedAt time.Time
+	}
 )
 
 //go:embed all:frontend/dist
@@ -30,21 +42,52 @@ var frontendFS embed.FS
 type Server struct {
 	engine   *gin.Engine
 	addr     string
+	basePath string // 部署子路径，如 /relay，根路径时为空
+	timeouts HTTPTimeouts
 	handlers *Handlers
+	limiter  *rateLimiter
+	noUI     bool // 不提供内置前端，仅 API、WebSocket 与健康检查
 }
 
-// NewServer 创建服务器
-func NewServer(addr string) *Server {
+// HTTPTimeouts 管理界面 HTTP 服务的超时设置，0 表示不限制
+// WebSocket 升级后、文件上传与备份下载在鉴权通过后不受 Read/Write 超时限制
+type HTTPTimeouts struct {
+	ReadHeader time.Duration // 读取请求头
+	Read       time.Duration // 读取整个请求（含请求体）
+	Write      time.Duration // 从读完请求头到写完响应
+	Idle       time.Duration // keep-alive 连接的空闲时间
+}
+
+// NewServer 创建服务器，allowNets 非空时仅允许其中的来源访问
+// 来自 trustedProxies 的请求按 X-Forwarded-For 识别客户端 IP，用于 API 限流与登录锁定
+// basePath 非空时所有路由（API、WebSocket、健康检查与静态文件）都位于该路径下
+func NewServer(addr string, allowNets, trustedProxies []*net.IPNet, basePath string, timeouts HTTPTimeouts, noUI bool) *Server {
 	gin.SetMode(gin.ReleaseMode)
 	engine := gin.New()
+	// gin 默认信任所有代理，任何客户端都能通过 X-Forwarded-For 伪造来源
+	proxies := make([]string, 0, len(trustedProxies))
+	for _, n := range trustedProxies {
+		proxies = append(proxies, n.String())
+	}
+	if err := engine.SetTrustedProxies(proxies); err != nil {
+		log.Printf("设置信任代理失败: %v", err)
+	}
 	engine.Use(gin.Recovery())
+	if len(allowNets) > 0 {
+		engine.Use(sourceACLMiddleware(allowNets))
+	}
 	engine.Use(corsMiddleware())
 
 	s := &Server{
 		engine:   engine,
 		addr:     addr,
+		basePath: basePath,
+		timeouts: timeouts,
 		handlers: NewHandlers(),
+		limiter:  newRateLimiter(),
+		noUI:     noUI,
 	}
+	s.handlers.limiter = s.limiter
 
 	s.setupRoutes()
 	return s
@@ -80,6 +123,187 @@ func getCachedCORSOrigin() string {
 	return allowOrigin
 }
 
+// invalidateCORSCache 使 CORS 缓存失效，下次请求时重新读取设置
+func invalidateCORSCache() {
+	corsCache.Lock()
+	corsCache.updatedAt = time.Time{}
+	corsCache.Unlock()
+}
+
+// httpStatusEnabled 是否将错误码映射为 HTTP 状态码，默认关闭以兼容旧客户端
+func httpStatusEnabled() bool {
+	httpStatusCache.RLock()
+	if time.Since(httpStatusCache.updatedAt) < corsCacheTTL {
+		enabled := httpStatusCache.enabled
+		httpStatusCache.RUnlock()
+		return enabled
+	}
+	httpStatusCache.RUnlock()
+
+	httpStatusCache.Lock()
+	defer httpStatusCache.Unlock()
+	if time.Since(httpStatusCache.updatedAt) < corsCacheTTL {
+		return httpStatusCache.enabled
+	}
+	v, _ := model.GetSetting("api_http_status")
+	httpStatusCache.enabled = v == "true"
+	httpStatusCache.updatedAt = time.Now()
+	return httpStatusCache.enabled
+}
+
+// invalidateHTTPStatusCache 使 api_http_status 缓存失效
+func invalidateHTTPStatusCache() {
+	httpStatusCache.Lock()
+	httpStatusCache.updatedAt = time.Time{}
+	httpStatusCache.Unlock()
+}
+
+// respond 写入 API 响应，body 中的 code 保持不变
+// 认证失败 (401/403) 与限流 (429) 始终使用对应的 HTTP 状态码，便于反向代理识别；
+// 开启 api_http_status 后，其余 4xx/5xx 错误码也作为 HTTP 状态码返回
+func respond(c *gin.Context, resp APIResponse) {
+	status := http.StatusOK
+	switch {
+	case resp.Code == http.StatusUnauthorized || resp.Code == http.StatusForbidden || resp.Code == http.StatusTooManyRequests:
+		status = resp.Code
+	case resp.Code >= 400 && resp.Code <= 599 && httpStatusEnabled():
+		status = resp.Code
+	}
+	c.JSON(status, resp)
+}
+
+// sourceACLMiddleware 按来源地址限制管理界面访问，在鉴权之前拒绝
+// 使用 TCP 连接的对端地址，不信任 X-Forwarded-For 等请求头
+func sourceACLMiddleware(allowNets []*net.IPNet) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ip := net.ParseIP(c.RemoteIP())
+		for _, n := range allowNets {
+			if ip != nil && n.Contains(ip) {
+				c.Next()
+				return
+			}
+		}
+		c.AbortWithStatusJSON(http.StatusForbidden, Error(403, "来源地址不允许访问"))
+	}
+}
+
+// parseCIDRList 解析逗号分隔的 CIDR 列表，单个 IP 视为 /32 或 /128
+func parseCIDRList(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("无效的 IP 地址: %s", item)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("无效的 CIDR: %s", item)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// normalizeBasePath 规范化 -base-path：补全开头的 /，去掉末尾的 /，"/" 视为根路径
+// 路径会写入页面脚本，只允许字母、数字与 -._~ 组成的路径段
+func normalizeBasePath(p string) (string, error) {
+	p = strings.Trim(strings.TrimSpace(p), "/")
+	if p == "" {
+		return "", nil
+	}
+	for _, seg := range strings.Split(p, "/") {
+		if seg == "" || seg == "." || seg == ".." {
+			return "", fmt.Errorf("无效的路径: /%s", p)
+		}
+		for _, c := range seg {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-._~", c)) {
+				return "", fmt.Errorf("路径包含不支持的字符: %q", c)
+			}
+		}
+	}
+	return "/" + p, nil
+}
+
+// validateAdminAddr 校验管理界面监听地址，主机部分为空表示监听所有地址
+// 主机名需要能够解析，是否为本机地址由监听时检查
+func validateAdminAddr(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if p, err := strconv.Atoi(port); err != nil || p < 0 || p > 65535 {
+		return fmt.Errorf("无效的端口: %s", port)
+	}
+	if host == "" {
+		return nil
+	}
+	if ip, _ := model.ParseIPZone(host); ip != nil {
+		return nil
+	}
+	if _, err := net.LookupHost(host); err != nil {
+		return fmt.Errorf("无法解析主机名 %s: %v", host, err)
+	}
+	return nil
+}
+
+// originAllowed 检查 origin 是否在逗号分隔的允许列表中
+// 列表项可以是 *、完整来源（https://app.example.com）或通配子域名：
+// *.example.com 匹配 example.com 任意层级的子域名（不含 example.com 本身），
+// 带协议或端口时（https://*.example.com:8443）协议与端口也必须一致
+func originAllowed(allowOrigin, origin string) bool {
+	for _, o := range strings.Split(allowOrigin, ",") {
+		pattern := strings.TrimSpace(o)
+		if pattern == "*" || pattern == origin || matchOriginPattern(pattern, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchOriginPattern 按通配子域名规则匹配来源，pattern 不含 *. 时返回 false
+func matchOriginPattern(pattern, origin string) bool {
+	patternScheme, patternHost, hasScheme := strings.Cut(pattern, "://")
+	if !hasScheme {
+		patternScheme, patternHost = "", pattern
+	}
+	if !strings.HasPrefix(patternHost, "*.") {
+		return false
+	}
+	scheme, host, ok := strings.Cut(origin, "://")
+	if !ok || (hasScheme && !strings.EqualFold(scheme, patternScheme)) {
+		return false
+	}
+
+	// 主机名与端口分开比较，避免 *.example.com 匹配 app.example.com.evil.com 之类的来源
+	suffix, patternPort := splitOriginPort(patternHost[1:])
+	hostname, port := splitOriginPort(host)
+	if port != patternPort {
+		return false
+	}
+	hostname, suffix = strings.ToLower(hostname), strings.ToLower(suffix)
+	return len(hostname) > len(suffix) && strings.HasSuffix(hostname, suffix)
+}
+
+// splitOriginPort 拆分 host[:port]，没有端口时 port 为空
+func splitOriginPort(hostport string) (string, string) {
+	if host, port, err := net.SplitHostPort(hostport); err == nil {
+		return host, port
+	}
+	return hostport, ""
+}
+
 // corsMiddleware CORS 中间件
 func corsMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -92,23 +316,7 @@ func corsMiddleware() gin.HandlerFunc {
 		// 使用缓存的 CORS 设置
 		allowOrigin := getCachedCORSOrigin()
 
-		// 检查是否允许该来源
-		allowed := false
-		if allowOrigin == "*" {
-			allowed = true
-		} else {
-			// 支持多个来源，用逗号分隔
-			origins := strings.Split(allowOrigin, ",")
-			for _, o := range origins {
-				trimmed := strings.TrimSpace(o)
-				if trimmed == "*" || trimmed == origin {
-					allowed = true
-					break
-				}
-			}
-		}
-
-		if allowed {
+		if originAllowed(allowOrigin, origin) {
 			c.Header("Access-Control-Allow-Origin", origin)
 			c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
 			c.Header("Access-Control-Allow-Headers", "Content-Type, Authorization")
@@ -127,61 +335,107 @@ func corsMiddleware() gin.HandlerFunc {
 }
 
 func (s *Server) setupRoutes() {
+	g := s.engine.Group(s.basePath)
+
 	// 健康检查（无需鉴权）
-	s.engine.GET("/health", func(c *gin.Context) {
-		c.JSON(200, gin.H{
-			"status":       "ok",
-			"version":      Version,
-			"need_setup":   !model.IsSetupCompleted(),
-		})
-	})
+	g.GET("/health", s.handleHealth)
+
+	// 按来源 IP 限流，健康检查与静态文件不受限制
+	limit := s.limiter.middleware()
 
 	// 统一 API 入口
-	s.engine.POST("/api", s.handleAPI)
+	g.POST("/api", limit, s.handleAPI)
+	g.POST("/api/batch", limit, s.handleBatch)
 
 	// WebSocket
-	s.engine.GET("/ws", s.handlers.HandleWebSocket)
+	g.GET("/ws", limit, s.handlers.HandleWebSocket)
 
 	// GeoIP 文件上传 (multipart/form-data)
-	s.engine.POST("/api/upload/geoip", s.handlers.HandleGeoIPUpload)
+	g.POST("/api/upload/geoip", limit, s.handlers.HandleGeoIPUpload)
+
+	// 数据库备份下载与恢复上传
+	g.GET("/api/backup", limit, s.handlers.HandleBackup)
+	g.POST("/api/upload/restore", limit, s.handlers.HandleRestore)
 
-	// 静态文件
-	s.setupStaticFiles()
+	// 静态文件，前端单独部署时其余路径一律返回 404
+	if s.noUI {
+		s.engine.NoRoute(func(c *gin.Context) {
+			c.JSON(404, gin.H{"code": 404, "msg": "not found"})
+		})
+		return
+	}
+	s.setupStaticFiles(g)
 }
 
-func (s *Server) setupStaticFiles() {
+func (s *Server) setupStaticFiles(g *gin.RouterGroup) {
 	// 尝试使用嵌入的前端文件
 	subFS, err := fs.Sub(frontendFS, "frontend/dist")
 	if err != nil {
 		log.Printf("警告: 未找到嵌入的前端文件，使用开发模式")
 		// 开发模式：使用本地文件
-		s.engine.Static("/assets", "./webui/frontend/dist/assets")
-		s.engine.StaticFile("/", "./webui/frontend/dist/index.html")
-		s.engine.NoRoute(func(c *gin.Context) {
-			c.File("./webui/frontend/dist/index.html")
-		})
+		g.Static("/assets", "./webui/frontend/dist/assets")
+		s.engine.NoRoute(s.spaFallback(func() ([]byte, error) {
+			return os.ReadFile("./webui/frontend/dist/index.html")
+		}))
 		return
 	}
 
 	// 生产模式：使用嵌入文件
-	s.engine.StaticFS("/assets", http.FS(mustSubFS(subFS, "assets")))
+	g.StaticFS("/assets", http.FS(mustSubFS(subFS, "assets")))
 
 	// SPA 路由支持
-	s.engine.NoRoute(func(c *gin.Context) {
+	s.engine.NoRoute(s.spaFallback(func() ([]byte, error) {
+		return fs.ReadFile(subFS, "index.html")
+	}))
+}
+
+// spaFallback 未匹配的路由返回 index.html，由前端路由处理
+// 部署在子路径下时，子路径之外的请求返回 404
+func (s *Server) spaFallback(readIndex func() ([]byte, error)) gin.HandlerFunc {
+	return func(c *gin.Context) {
 		path := c.Request.URL.Path
+		if s.basePath != "" {
+			if path == s.basePath {
+				c.Redirect(http.StatusMovedPermanently, s.basePath+"/")
+				return
+			}
+			if !strings.HasPrefix(path, s.basePath+"/") {
+				c.String(404, "404 page not found")
+				return
+			}
+			path = strings.TrimPrefix(path, s.basePath)
+		}
 		// API 和 WebSocket 请求不走静态文件
 		if strings.HasPrefix(path, "/api") || strings.HasPrefix(path, "/ws") {
 			c.JSON(404, gin.H{"code": 404, "msg": "not found"})
 			return
 		}
 		// 返回 index.html
-		data, err := fs.ReadFile(subFS, "index.html")
+		data, err := readIndex()
 		if err != nil {
 			c.String(500, "Internal Server Error")
 			return
 		}
-		c.Data(200, "text/html; charset=utf-8", data)
-	})
+		c.Data(200, "text/html; charset=utf-8", s.injectBasePath(data))
+	}
+}
+
+// injectBasePath 将 index.html 中的资源地址改为子路径下的绝对地址，并把子路径提供给前端
+// 前端以相对路径 (./assets) 构建，SPA 的多级路由下需要改为绝对地址才能正确加载
+func (s *Server) injectBasePath(html []byte) []byte {
+	page := string(html)
+	for _, attr := range []string{`src="`, `href="`} {
+		if s.basePath != "" {
+			page = strings.ReplaceAll(page, attr+"/", attr+s.basePath+"/")
+		}
+		page = strings.ReplaceAll(page, attr+"./", attr+s.basePath+"/")
+	}
+	if s.basePath == "" {
+		return []byte(page)
+	}
+	script := fmt.Sprintf("<script>window.__RELAY_BASE__=%q</script>", s.basePath)
+	page = strings.Replace(page, "<head>", "<head>\n    "+script, 1)
+	return []byte(page)
 }
 
 func mustSubFS(fsys fs.FS, dir string) fs.FS {
@@ -192,22 +446,130 @@ func mustSubFS(fsys fs.FS, dir string) fs.FS {
 	return sub
 }
 
+// handleHealth 健康检查，数据库不可访问时返回 503
+// 设置 health_details=true 后附带运行中规则数与活跃连接数，供外部监控使用
+func (s *Server) handleHealth(c *gin.Context) {
+	if err := model.PingDB(); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status":  "error",
+			"version": Version,
+			"db":      false,
+		})
+		return
+	}
+
+	resp := gin.H{
+		"status":     "ok",
+		"version":    Version,
+		"need_setup": !model.IsSetupCompleted(),
+	}
+	if v, _ := model.GetSetting("health_details"); v == "true" {
+		resp["db"] = true
+		resp["running_relays"] = s.handlers.relayMgr.ActiveCount()
+		resp["active_connections"] = s.handlers.relayMgr.TotalConnections()
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
 // handleAPI 统一 API 处理
 func (s *Server) handleAPI(c *gin.Context) {
 	var req APIRequest
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxAPIBodySize)
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(200, APIResponse{Code: 400, Msg: "请求格式错误"})
+		if isBodyTooLarge(err) {
+			respond(c, Error(413, fmt.Sprintf("请求体过大，不能超过 %d MB", maxAPIBodySize>>20)))
+			return
+		}
+		respond(c, Error(400, "请求格式错误"))
 		return
 	}
 
-	resp := s.handlers.Handle(req.Action, req.Data, c)
-	c.JSON(200, resp)
+	respond(c, s.handlers.Handle(req.Action, req.Data, c))
 }
 
 // Run 启动服务器
 func (s *Server) Run() error {
 	log.Printf("服务器启动: http://%s", s.addr)
-	return s.engine.Run(s.addr)
+	if s.noUI {
+		log.Printf("已禁用内置前端，仅提供 API")
+	}
+	srv := &http.Server{
+		Addr:              s.addr,
+		Handler:           s.engine,
+		ReadHeaderTimeout: s.timeouts.ReadHeader,
+		ReadTimeout:       s.timeouts.Read,
+		WriteTimeout:      s.timeouts.Write,
+		IdleTimeout:       s.timeouts.Idle,
+	}
+	return srv.ListenAndServe()
+}
+
+// clearDeadlines 取消当前连接的读写超时，用于 WebSocket 与大文件传输
+// 只应在鉴权通过后调用，未登录的请求仍受超时限制
+func clearDeadlines(c *gin.Context) {
+	rc := http.NewResponseController(c.Writer)
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Time{})
+}
+
+// clearWriteDeadline 只取消当前连接的写超时，用于耗时较长但自身有超时限制的 action
+func clearWriteDeadline(c *gin.Context) {
+	if c == nil {
+		return
+	}
+	http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{})
+}
+
+// maxBatchSize /api/batch 单次最多执行的 action 数
+const maxBatchSize = 20
+
+// handleBatch 按顺序执行多个 action，返回与请求顺序一致的响应数组
+// 每个 action 使用同一请求的认证信息单独鉴权，某个 action 失败不影响其余 action；
+// 每个 action 都计入 API 限流
+func (s *Server) handleBatch(c *gin.Context) {
+	var reqs []APIRequest
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxAPIBodySize)
+	if err := c.ShouldBindJSON(&reqs); err != nil {
+		if isBodyTooLarge(err) {
+			respond(c, Error(413, fmt.Sprintf("请求体过大，不能超过 %d MB", maxAPIBodySize>>20)))
+			return
+		}
+		respond(c, Error(400, "请求格式错误，应为 [{action, data}, ...]"))
+		return
+	}
+	if len(reqs) == 0 {
+		respond(c, Error(400, "批量请求不能为空"))
+		return
+	}
+	if len(reqs) > maxBatchSize {
+		respond(c, Error(400, fmt.Sprintf("单次最多执行 %d 个 action", maxBatchSize)))
+		return
+	}
+	// 令牌桶最多只有 burst 个令牌，超过的批量请求永远无法通过
+	if rate, burst := s.limiter.config(); rate > 0 && float64(len(reqs)) > burst {
+		respond(c, Error(400, fmt.Sprintf("单次最多执行 %d 个 action（受 api_rate_burst 限制）", int(burst))))
+		return
+	}
+	// 中间件已消耗一个令牌
+	if !s.limiter.allowN(c.ClientIP(), len(reqs)-1) {
+		respond(c, Error(429, "请求过于频繁，请稍后再试"))
+		return
+	}
+
+	results := make([]APIResponse, len(reqs))
+	for i, req := range reqs {
+		results[i] = s.handlers.Handle(req.Action, req.Data, c)
+	}
+	respond(c, Success(results))
+}
+
+// maxAPIBodySize /api 请求体的大小上限
+const maxAPIBodySize = 8 << 20
+
+// isBodyTooLarge 判断读取请求体的错误是否因为超过 http.MaxBytesReader 的上限
+func isBodyTooLarge(err error) bool {
+	var maxErr *http.MaxBytesError
+	return errors.As(err, &maxErr)
 }
 
 // APIRequest 统一请求格式
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestOriginAllowed(t *testing.T) {
+	tests := []struct {
+		allow, origin string
+		want          bool
+	}{
+		{"*.example.com", "https://app.example.com", true},
+		{"*.example.com", "https://a.b.example.com", true},
+		{"*.example.com", "https://APP.Example.com", true},
+		{"*.example.com", "https://evil.com", false},
+		{"*.example.com", "https://example.com", false},
+		{"*.example.com", "https://evilexample.com", false},
+		{"*.example.com", "https://app.example.com.evil.com", false},
+		{"*.example.com", "https://app.example.com:8443", false},
+		{"https://*.example.com", "https://app.example.com", true},
+		{"https://*.example.com", "http://app.example.com", false},
+		{"https://*.example.com:8443", "https://app.example.com:8443", true},
+		{"https://*.example.com:8443", "https://app.example.com", false},
+		{"https://a.com, *.example.com", "https://a.com", true},
+		{"https://a.com, *.example.com", "https://app.example.com", true},
+		{"https://a.com, *.example.com", "https://evil.com", false},
+		{"*", "https://evil.com", true},
+	}
+	for _, tt := range tests {
+		if got := originAllowed(tt.allow, tt.origin); got != tt.want {
+			t.Errorf("originAllowed(%q, %q) = %v, want %v", tt.allow, tt.origin, got, tt.want)
+		}
+	}
+}
+
+// TestUpgraderCheckOrigin WebSocket 升级与 CORS 使用同一套来源匹配规则
+func TestUpgraderCheckOrigin(t *testing.T) {
+	setSetting(t, "cors_origin", "*.example.com")
+	invalidateCORSCache()
+	t.Cleanup(invalidateCORSCache)
+
+	for origin, want := range map[string]bool{
+		"https://app.example.com": true,
+		"https://evil.com":        false,
+		"":                        true,
+	} {
+		req := httptest.NewRequest("GET", "/ws", nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		upgrader := createUpgrader(req)
+		if got := upgrader.CheckOrigin(req); got != want {
+			t.Errorf("CheckOrigin(%q) = %v, want %v", origin, got, want)
+		}
+	}
+}
+
+// TestRespondStatus 认证失败与限流始终使用真实状态码，其余错误码由 api_http_status 控制
+func TestRespondStatus(t *testing.T) {
+	for _, enabled := range []string{"false", "true"} {
+		setSetting(t, "api_http_status", enabled)
+		invalidateHTTPStatusCache()
+		for code, want := range map[int]int{
+			0:   200,
+			400: 200,
+			401: 401,
+			403: 403,
+			429: 429,
+			500: 200,
+		} {
+			if enabled == "true" && code != 0 {
+				want = code
+			}
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			respond(c, APIResponse{Code: code})
+			if w.Code != want {
+				t.Errorf("api_http_status=%s code=%d: HTTP %d, want %d", enabled, code, w.Code, want)
+			}
+		}
+	}
+	invalidateHTTPStatusCache()
+}
+
+// TestBatchLargerThanBurst action 数超过 api_rate_burst 的批量请求直接返回错误，而不是永远 429
+func TestBatchLargerThanBurst(t *testing.T) {
+	setSetting(t, "api_rate_burst", "3")
+	s := &Server{limiter: newRateLimiter(), handlers: &Handlers{}}
+
+	body := `[{"action":"setup.status"},{"action":"setup.status"},{"action":"setup.status"},{"action":"setup.status"}]`
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/api/batch", strings.NewReader(body))
+	s.handleBatch(c)
+
+	var resp APIResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Code != 400 || !strings.Contains(resp.Msg, "api_rate_burst") {
+		t.Fatalf("响应 %+v, want 400 并提示 api_rate_burst", resp)
+	}
+}
+
+func TestValidateAdminAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		ok   bool
+	}{
+		{":8080", true},
+		{"127.0.0.1:8080", true},
+		{"[::1]:8080", true},
+		{"[fe80::1%eth0]:8080", true},
+		{"localhost:8080", true},
+		{"no-such-host.invalid:8080", false},
+		{"127.0.0.1:70000", false},
+		{"127.0.0.1", false},
+	}
+	for _, tt := range tests {
+		if err := validateAdminAddr(tt.addr); (err == nil) != tt.ok {
+			t.Errorf("validateAdminAddr(%q) = %v, want ok=%v", tt.addr, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/DGHeroin/relay/webui/model"
+)
+
+// listenFdsStart systemd 传递的第一个文件描述符
+const listenFdsStart = 3
+
+// activatedSocket systemd socket activation 传入的监听 socket
+type activatedSocket struct {
+	network string // tcp 或 udp
+	ip      net.IP
+	port    int
+	file    *os.File
+}
+
+var (
+	activatedMu      sync.Mutex
+	activatedSockets []*activatedSocket
+)
+
+// LoadActivatedSockets 读取 systemd socket activation 传入的 socket（LISTEN_PID/LISTEN_FDS）
+// 应在启动时调用一次，返回接收到的 socket 数量；未通过 socket activation 启动时返回 0
+func LoadActivatedSockets() int {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return 0
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return 0
+	}
+
+	activatedMu.Lock()
+	defer activatedMu.Unlock()
+	for fd := listenFdsStart; fd < listenFdsStart+n; fd++ {
+		f := os.NewFile(uintptr(fd), fmt.Sprintf("LISTEN_FD_%d", fd))
+		s, err := inspectActivatedSocket(f)
+		if err != nil {
+			log.Printf("[Activation] 忽略文件描述符 %d: %v", fd, err)
+			f.Close()
+			continue
+		}
+		log.Printf("[Activation] 接收到 %s 监听: %s", s.network, net.JoinHostPort(s.ip.String(), strconv.Itoa(s.port)))
+		activatedSockets = append(activatedSockets, s)
+	}
+	return len(activatedSockets)
+}
+
+// inspectActivatedSocket 识别 socket 类型与监听地址
+func inspectActivatedSocket(f *os.File) (*activatedSocket, error) {
+	if ln, err := net.FileListener(f); err == nil {
+		defer ln.Close()
+		addr, ok := ln.Addr().(*net.TCPAddr)
+		if !ok {
+			return nil, fmt.Errorf("不支持的监听类型 %s", ln.Addr().Network())
+		}
+		return &activatedSocket{network: "tcp", ip: addr.IP, port: addr.Port, file: f}, nil
+	}
+	if pc, err := net.FilePacketConn(f); err == nil {
+		defer pc.Close()
+		addr, ok := pc.LocalAddr().(*net.UDPAddr)
+		if !ok {
+			return nil, fmt.Errorf("不支持的监听类型 %s", pc.LocalAddr().Network())
+		}
+		return &activatedSocket{network: "udp", ip: addr.IP, port: addr.Port, file: f}, nil
+	}
+	return nil, fmt.Errorf("不是 TCP 或 UDP socket")
+}
+
+// findActivatedSocket 按端口查找与监听地址匹配的 socket，主机部分相同，或规则一方为通配地址时匹配；
+// socket 绑定在通配地址而规则指定了具体地址时不匹配，以免规则接收到其它地址上的连接
+func findActivatedSocket(network, addr string) *activatedSocket {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil
+	}
+	ip, _ := model.ParseIPZone(host)
+	wildcard := host == "" || (ip != nil && ip.IsUnspecified())
+
+	activatedMu.Lock()
+	defer activatedMu.Unlock()
+	for _, s := range activatedSockets {
+		if s.network != network || s.port != port {
+			continue
+		}
+		if wildcard || (ip != nil && s.ip.Equal(ip)) {
+			return s
+		}
+	}
+	return nil
+}
+
+// HasActivatedSocket 监听地址是否由 systemd socket activation 提供
+func HasActivatedSocket(network, addr string) bool {
+	return findActivatedSocket(network, addr) != nil
+}
+
+// use 记录规则使用的 socket 与配置不一致之处：
+// 通配地址的规则实际只在 socket 绑定的地址上接收连接；socket 已由 systemd 创建，
+// ListenConfig 的选项（透明代理的 IP_TRANSPARENT）不会生效，需要在 .socket 单元中设置 Transparent=yes
+func (s *activatedSocket) use(rule *model.RelayRule, addr string) {
+	bound := net.JoinHostPort(s.ip.String(), strconv.Itoa(s.port))
+	host, _, _ := net.SplitHostPort(addr)
+	if ip, _ := model.ParseIPZone(host); ip == nil || !ip.Equal(s.ip) {
+		log.Printf("[Activation] 规则 %s 的监听地址 %s 使用 systemd 传入的 %s socket: %s", rule.Name, addr, s.network, bound)
+	}
+	if rule.Transparent {
+		log.Printf("[Activation] 警告: 规则 %s 开启了透明代理，但 %s socket %s 由 systemd 创建，"+
+			"IP_TRANSPARENT 需要在 .socket 单元中设置 Transparent=yes", rule.Name, s.network, bound)
+	}
+}
+
+// activatedListener 返回匹配的 TCP 监听，没有时返回 nil
+// 每次调用复制文件描述符，关闭返回的监听不影响原 socket，规则可以重复启停
+func activatedListener(rule *model.RelayRule, addr string) (net.Listener, error) {
+	s := findActivatedSocket("tcp", addr)
+	if s == nil {
+		return nil, nil
+	}
+	s.use(rule, addr)
+	return net.FileListener(s.file)
+}
+
+// activatedPacketConn 返回匹配的 UDP 监听，没有时返回 nil
+func activatedPacketConn(rule *model.RelayRule, addr string) (net.PacketConn, error) {
+	s := findActivatedSocket("udp", addr)
+	if s == nil {
+		return nil, nil
+	}
+	s.use(rule, addr)
+	return net.FilePacketConn(s.file)
+}
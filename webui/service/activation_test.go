@@ -0,0 +1,45 @@
+package service
+
+import (
+	"net"
+	"testing"
+)
+
+// TestFindActivatedSocket 只有规则一方的通配地址可以匹配具体地址上的 socket
+func TestFindActivatedSocket(t *testing.T) {
+	activatedMu.Lock()
+	saved := activatedSockets
+	activatedSockets = []*activatedSocket{
+		{network: "tcp", ip: net.ParseIP("127.0.0.1"), port: 443},
+		{network: "tcp", ip: net.ParseIP("0.0.0.0"), port: 8443},
+		{network: "udp", ip: net.ParseIP("::"), port: 53},
+	}
+	activatedMu.Unlock()
+	t.Cleanup(func() {
+		activatedMu.Lock()
+		activatedSockets = saved
+		activatedMu.Unlock()
+	})
+
+	tests := []struct {
+		network, addr string
+		want          bool
+	}{
+		{"tcp", "127.0.0.1:443", true},
+		{"tcp", "0.0.0.0:443", true},
+		{"tcp", ":443", true},
+		{"tcp", "[::]:443", true},
+		{"tcp", "127.0.0.2:443", false},
+		{"tcp", "localhost:443", false},
+		{"udp", "127.0.0.1:443", false},
+		{"tcp", "0.0.0.0:8443", true},
+		{"tcp", "127.0.0.1:8443", false},
+		{"udp", "[::]:53", true},
+		{"udp", "10.0.0.1:53", false},
+	}
+	for _, tt := range tests {
+		if got := HasActivatedSocket(tt.network, tt.addr); got != tt.want {
+			t.Errorf("HasActivatedSocket(%q, %q) = %v, want %v", tt.network, tt.addr, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package service
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/DGHeroin/relay/webui/model"
+)
+
+// privateNets 内网、回环、链路本地与运营商级 NAT (CGNAT) 地址段
+var privateNets = func() []*net.IPNet {
+	cidrs := []string{
+		"10.0.0.0/8",
+		"172.16.0.0/12",
+		"192.168.0.0/16",
+		"100.64.0.0/10",
+		"127.0.0.0/8",
+		"169.254.0.0/16",
+		"::1/128",
+		"fc00::/7",
+		"fe80::/10",
+	}
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, block, _ := net.ParseCIDR(cidr)
+		nets = append(nets, block)
+	}
+	return nets
+}()
+
+// isPrivateClient 检查客户端地址是否为内网 IP，链路本地地址可能带有区域标识
+func isPrivateClient(clientIP string) bool {
+	ip, _ := model.ParseIPZone(clientIP)
+	return IsPrivateIP(ip)
+}
+
+// IsPrivateIP 检查是否为内网 IP，nil 返回 false
+func IsPrivateIP(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, block := range privateNets {
+		if block.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// AddrMapping 一组监听地址到目标地址的映射
+type AddrMapping struct {
+	Src string
+	Dst string // 单目标时的目标地址，多目标时为第一个目标
+
+	// 负载均衡目标，单目标时只有一项
+	Targets []model.Target
+}
+
+// ExpandMappings 将规则的 src/dst 展开为逐端口的映射
+// src 可以是逗号分隔的多个监听地址，每个地址分别映射到同一目标
+// 端口段 "host:20000-20010" 按顺序一一对应到目标端口段，两侧长度必须一致
+// dst 为多个目标时各目标只能是单个端口，每个监听端口按权重轮询全部目标
+func ExpandMappings(src, dst string) ([]AddrMapping, error) {
+	targets, err := model.ParseTargets(dst)
+	if err != nil {
+		return nil, fmt.Errorf("目标地址格式错误: %v", err)
+	}
+	dstHost, dstStart, dstEnd, err := model.ParsePortRange(targets[0].Addr)
+	if err != nil {
+		return nil, fmt.Errorf("目标地址格式错误: %v", err)
+	}
+	if len(targets) > 1 {
+		for _, t := range targets {
+			if _, start, end, err := model.ParsePortRange(t.Addr); err != nil {
+				return nil, fmt.Errorf("目标地址格式错误: %v", err)
+			} else if start != end {
+				return nil, fmt.Errorf("多个目标时不支持端口段")
+			}
+		}
+	}
+
+	addrs := model.SplitListenAddrs(src)
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("监听地址不能为空")
+	}
+
+	var mappings []AddrMapping
+	seen := make(map[string]bool)
+	for _, addr := range addrs {
+		srcHost, srcStart, srcEnd, err := model.ParsePortRange(addr)
+		if err != nil {
+			return nil, fmt.Errorf("监听地址格式错误: %v", err)
+		}
+		if srcEnd-srcStart != dstEnd-dstStart {
+			return nil, fmt.Errorf("监听端口段与目标端口段长度不一致 (%d != %d)",
+				srcEnd-srcStart+1, dstEnd-dstStart+1)
+		}
+		for i := 0; i <= srcEnd-srcStart; i++ {
+			m := AddrMapping{
+				Src: net.JoinHostPort(srcHost, strconv.Itoa(srcStart+i)),
+				Dst: net.JoinHostPort(dstHost, strconv.Itoa(dstStart+i)),
+			}
+			if len(targets) > 1 {
+				m.Targets = targets
+			} else {
+				m.Targets = []model.Target{{Addr: m.Dst, Weight: targets[0].Weight}}
+			}
+			if seen[m.Src] {
+				return nil, fmt.Errorf("监听地址重复: %s", m.Src)
+			}
+			seen[m.Src] = true
+			mappings = append(mappings, m)
+		}
+	}
+	if len(mappings) > model.MaxPortRange {
+		return nil, fmt.Errorf("单条规则最多监听 %d 个端口", model.MaxPortRange)
+	}
+	return mappings, nil
+}
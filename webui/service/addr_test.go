@@ -0,0 +1,81 @@
+package service
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/DGHeroin/relay/webui/model"
+)
+
+// linkLocalAddr 返回本机某个网卡上的 IPv6 链路本地地址及网卡名，没有时跳过测试
+func linkLocalAddr(t *testing.T) (net.IP, string) {
+	t.Helper()
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Skip(err)
+	}
+	for _, iface := range ifaces {
+		addrs, _ := iface.Addrs()
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() == nil && ipNet.IP.IsLinkLocalUnicast() {
+				return ipNet.IP, iface.Name
+			}
+		}
+	}
+	t.Skip("没有 IPv6 链路本地地址")
+	return nil, ""
+}
+
+func TestExpandMappingsZone(t *testing.T) {
+	mappings, err := ExpandMappings("[fe80::1%eth0]:8000-8001", "[fe80::2%eth1]:9000-9001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct{ src, dst string }{
+		{"[fe80::1%eth0]:8000", "[fe80::2%eth1]:9000"},
+		{"[fe80::1%eth0]:8001", "[fe80::2%eth1]:9001"},
+	}
+	if len(mappings) != len(want) {
+		t.Fatalf("展开得到 %d 个映射, want %d", len(mappings), len(want))
+	}
+	for i, m := range mappings {
+		if m.Src != want[i].src || m.Dst != want[i].dst {
+			t.Errorf("映射 %d = %s -> %s, want %s -> %s", i, m.Src, m.Dst, want[i].src, want[i].dst)
+		}
+	}
+}
+
+// TestRelayLinkLocalTarget 经规则转发到带区域标识的链路本地目标，区域标识保留到拨号
+func TestRelayLinkLocalTarget(t *testing.T) {
+	ip, zone := linkLocalAddr(t)
+	target := net.JoinHostPort(ip.String()+"%"+zone, "0")
+	echo, err := net.Listen("tcp", target)
+	if err != nil {
+		t.Skipf("无法监听链路本地地址: %v", err)
+	}
+	defer echo.Close()
+	go serveTCPEcho(echo)
+
+	// 监听地址的字符串形式不一定带区域标识，只取端口
+	_, port, _ := net.SplitHostPort(echo.Addr().String())
+	dst := net.JoinHostPort(ip.String()+"%"+zone, port)
+	rule := &model.RelayRule{Protocol: "tcp", Src: "127.0.0.1:0", Dst: dst}
+	_, r := startTestRelay(t, rule)
+
+	conn, err := net.Dial("tcp", relayAddr(t, r, "tcp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("ping"))
+	if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+		t.Fatalf("经链路本地目标 %s 回显失败: %v", dst, err)
+	}
+	conns := r.connectionList(0)
+	if len(conns) != 1 || conns[0].Target != dst {
+		t.Fatalf("连接目标 %+v, want %s", conns, dst)
+	}
+}
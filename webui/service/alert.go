@@ -0,0 +1,115 @@
+package service
+
+import (
+	"log"
+	"time"
+
+	"github.com/DGHeroin/relay/webui/model"
+)
+
+// Alert 流量告警
+type Alert struct {
+	RelayID   string    `json:"relay_id"`
+	RelayName string    `json:"relay_name"`
+	Type      string    `json:"type"` // speed_in, speed_out, daily_bytes
+	Value     int64     `json:"value"`
+	Threshold int64     `json:"threshold"`
+	Time      time.Time `json:"time"`
+}
+
+// alertState 告警去抖状态，仅在 pushStatus 所在 goroutine 中访问
+type alertState struct {
+	overIn   int64 // 入站速度连续超限时长 (ms)
+	overOut  int64 // 出站速度连续超限时长 (ms)
+	firedIn  bool  // 本次持续超限是否已告警
+	firedOut bool
+	dayStart time.Time
+	dayBase  int64 // 启动前当天已入库的流量
+	dayMark  int64 // 当天开始时的实例累计流量
+	firedDay bool
+}
+
+// initAlertState 初始化当天流量基准
+func (r *RelayInstance) initAlertState() {
+	r.alerts.dayStart = startOfDay(time.Now())
+	if r.rule.AlertDailyBytes <= 0 {
+		return
+	}
+	in, out, err := model.GetRelayTrafficSince(r.rule.ID, r.alerts.dayStart)
+	if err != nil {
+		log.Printf("[Alert] 获取当日流量失败 %s: %v", r.rule.Name, err)
+		return
+	}
+	r.alerts.dayBase = in + out
+}
+
+// checkAlerts 根据平滑后的速度和累计流量检查告警阈值
+// elapsed 为距上次检查经过的时间，用于换算持续超限时长
+func (r *RelayInstance) checkAlerts(speedIn, speedOut, totalBytes int64, elapsed time.Duration) {
+	rule := r.rule
+	st := &r.alerts
+	step := int64(elapsed / time.Millisecond)
+
+	if rule.AlertSpeedIn > 0 {
+		if speedIn > rule.AlertSpeedIn {
+			st.overIn += step
+			if !st.firedIn && st.overIn >= rule.AlertSpeedDuration*1000 {
+				st.firedIn = true
+				r.emitAlert("speed_in", speedIn, rule.AlertSpeedIn)
+			}
+		} else {
+			st.overIn = 0
+			st.firedIn = false
+		}
+	}
+
+	if rule.AlertSpeedOut > 0 {
+		if speedOut > rule.AlertSpeedOut {
+			st.overOut += step
+			if !st.firedOut && st.overOut >= rule.AlertSpeedDuration*1000 {
+				st.firedOut = true
+				r.emitAlert("speed_out", speedOut, rule.AlertSpeedOut)
+			}
+		} else {
+			st.overOut = 0
+			st.firedOut = false
+		}
+	}
+
+	if rule.AlertDailyBytes > 0 {
+		now := time.Now()
+		if today := startOfDay(now); today.After(st.dayStart) {
+			// 跨天，重置当日统计
+			st.dayStart = today
+			st.dayBase = 0
+			st.dayMark = totalBytes
+			st.firedDay = false
+		}
+		daily := st.dayBase + totalBytes - st.dayMark
+		if !st.firedDay && daily > rule.AlertDailyBytes {
+			st.firedDay = true
+			r.emitAlert("daily_bytes", daily, rule.AlertDailyBytes)
+		}
+	}
+}
+
+// emitAlert 记录并推送告警
+func (r *RelayInstance) emitAlert(alertType string, value, threshold int64) {
+	log.Printf("[Alert] %s 触发告警: type=%s, value=%d, threshold=%d", r.rule.Name, alertType, value, threshold)
+	if r.broadcaster == nil {
+		return
+	}
+	r.broadcaster.BroadcastToRelay(r.rule.ID, "relay.alert", Alert{
+		RelayID:   r.rule.ID,
+		RelayName: r.rule.Name,
+		Type:      alertType,
+		Value:     value,
+		Threshold: threshold,
+		Time:      time.Now(),
+	})
+}
+
+func startOfDay(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
@@ -0,0 +1,150 @@
+package service
+
+import (
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/DGHeroin/relay/webui/model"
+)
+
+// BalanceIPHash 按客户端 IP 哈希选择目标，同一客户端固定连接同一目标
+const BalanceIPHash = "iphash"
+
+// targetDownDuration 连接目标失败后，iphash 模式在这段时间内跳过该目标
+const targetDownDuration = 10 * time.Second
+
+// TargetStatus 负载均衡目标的连接计数
+type TargetStatus struct {
+	Addr        string `json:"addr"`
+	Weight      int    `json:"weight"`
+	Connections int64  `json:"connections"` // 本次运行累计分配的连接数
+	Active      int64  `json:"active"`
+	Down        bool   `json:"down,omitempty"` // 最近连接失败，iphash 模式暂时跳过
+}
+
+// targetStat 单个目标的连接计数，同一规则中地址相同的目标共用
+type targetStat struct {
+	total     int64
+	active    int64
+	downUntil int64 // 连接失败后暂停分配的截止时间 (UnixNano)
+}
+
+func (s *targetStat) acquire() {
+	atomic.AddInt64(&s.total, 1)
+	atomic.AddInt64(&s.active, 1)
+}
+
+func (s *targetStat) release() {
+	atomic.AddInt64(&s.active, -1)
+}
+
+// markDown 记录连接目标失败
+func (s *targetStat) markDown() {
+	atomic.StoreInt64(&s.downUntil, time.Now().Add(targetDownDuration).UnixNano())
+}
+
+func (s *targetStat) down() bool {
+	return time.Now().UnixNano() < atomic.LoadInt64(&s.downUntil)
+}
+
+// pickedTarget 选中的目标
+type pickedTarget struct {
+	addr string
+	stat *targetStat
+}
+
+// targetPicker 目标选择器
+// 默认为平滑加权轮询（与 nginx 相同）：权重越大分到的连接越多，且分配尽量均匀交错；
+// iphash 模式按客户端 IP 哈希到按权重展开的槽位上，目标不可用时顺延到下一个可用目标
+type targetPicker struct {
+	mu      sync.Mutex
+	targets []pickedTarget
+	weights []int
+	current []int
+	total   int
+
+	slots []int // iphash 模式下每个槽位对应的目标下标，目标 i 占 weights[i] 个槽位
+}
+
+// newTargetPicker 为一个监听地址创建目标选择器
+func (r *RelayInstance) newTargetPicker(targets []model.Target) *targetPicker {
+	p := &targetPicker{
+		targets: make([]pickedTarget, len(targets)),
+		weights: make([]int, len(targets)),
+		current: make([]int, len(targets)),
+	}
+	for i, t := range targets {
+		v, _ := r.targetStats.LoadOrStore(t.Addr, &targetStat{})
+		p.targets[i] = pickedTarget{addr: t.Addr, stat: v.(*targetStat)}
+		p.weights[i] = t.Weight
+		p.total += t.Weight
+		if r.rule.Balance == BalanceIPHash {
+			for j := 0; j < t.Weight; j++ {
+				p.slots = append(p.slots, i)
+			}
+		}
+	}
+	return p
+}
+
+// next 为客户端选出目标
+func (p *targetPicker) next(clientIP string) pickedTarget {
+	if len(p.targets) == 1 {
+		return p.targets[0]
+	}
+	if p.slots != nil {
+		return p.hashPick(clientIP)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	best := 0
+	for i := range p.targets {
+		p.current[i] += p.weights[i]
+		if p.current[i] > p.current[best] {
+			best = i
+		}
+	}
+	p.current[best] -= p.total
+	return p.targets[best]
+}
+
+// hashPick 按客户端 IP 选择目标，槽位对应的目标不可用时依次尝试后面的槽位，全部不可用时仍返回原目标
+func (p *targetPicker) hashPick(clientIP string) pickedTarget {
+	h := fnv.New32a()
+	h.Write([]byte(clientIP))
+	start := int(h.Sum32() % uint32(len(p.slots)))
+	for i := 0; i < len(p.slots); i++ {
+		if t := p.targets[p.slots[(start+i)%len(p.slots)]]; !t.stat.down() {
+			return t
+		}
+	}
+	return p.targets[p.slots[start]]
+}
+
+// targetStatus 返回多目标规则各目标的连接计数，单目标规则返回 nil
+func (r *RelayInstance) targetStatus() []TargetStatus {
+	var result []TargetStatus
+	seen := make(map[string]bool)
+	for _, m := range r.mappings {
+		if len(m.Targets) < 2 {
+			continue
+		}
+		for _, t := range m.Targets {
+			if seen[t.Addr] {
+				continue
+			}
+			seen[t.Addr] = true
+			status := TargetStatus{Addr: t.Addr, Weight: t.Weight}
+			if v, ok := r.targetStats.Load(t.Addr); ok {
+				stat := v.(*targetStat)
+				status.Connections = atomic.LoadInt64(&stat.total)
+				status.Active = atomic.LoadInt64(&stat.active)
+				status.Down = stat.down()
+			}
+			result = append(result, status)
+		}
+	}
+	return result
+}
@@ -0,0 +1,63 @@
+package service
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/DGHeroin/relay/webui/model"
+)
+
+// TestHashPick iphash 模式下同一客户端固定选中同一目标，目标不可用时顺延，恢复后回到原目标
+func TestHashPick(t *testing.T) {
+	r := &RelayInstance{rule: &model.RelayRule{Balance: BalanceIPHash}}
+	p := r.newTargetPicker([]model.Target{
+		{Addr: "10.0.0.1:80", Weight: 1},
+		{Addr: "10.0.0.2:80", Weight: 2},
+		{Addr: "10.0.0.3:80", Weight: 1},
+	})
+	if len(p.slots) != 4 {
+		t.Fatalf("槽位数 %d, want 4", len(p.slots))
+	}
+
+	used := make(map[string]bool)
+	for i := 0; i < 32; i++ {
+		ip := fmt.Sprintf("192.0.2.%d", i)
+		first := p.next(ip).addr
+		for j := 0; j < 5; j++ {
+			if got := p.next(ip).addr; got != first {
+				t.Fatalf("客户端 %s 第 %d 次选中 %s, 首次为 %s", ip, j+2, got, first)
+			}
+		}
+		used[first] = true
+	}
+	if len(used) < 2 {
+		t.Errorf("32 个客户端全部哈希到同一目标: %v", used)
+	}
+
+	const ip = "192.0.2.1"
+	orig := p.next(ip)
+	orig.stat.markDown()
+	fallback := p.next(ip)
+	if fallback.addr == orig.addr {
+		t.Fatalf("目标 %s 不可用时仍被选中", orig.addr)
+	}
+	if got := p.next(ip).addr; got != fallback.addr {
+		t.Errorf("顺延目标不稳定: %s != %s", got, fallback.addr)
+	}
+
+	// 全部不可用时仍返回原目标
+	for _, target := range p.targets {
+		target.stat.markDown()
+	}
+	if got := p.next(ip).addr; got != orig.addr {
+		t.Errorf("全部目标不可用时选中 %s, want %s", got, orig.addr)
+	}
+
+	// 恢复后回到原目标
+	for _, target := range p.targets {
+		target.stat.downUntil = 0
+	}
+	if got := p.next(ip).addr; got != orig.addr {
+		t.Errorf("目标恢复后选中 %s, want %s", got, orig.addr)
+	}
+}
@@ -0,0 +1,88 @@
+package service
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// MinSpeedLimit 限速的最小值 (bytes/s)，0 表示不限速
+const MinSpeedLimit = 1024
+
+// maxLimitedRead 限速读取时单次读取的上限，保证每次等待不超过约 1 秒
+const maxLimitedRead = 32 * 1024
+
+// byteLimiter 按字节计的令牌桶，令牌可以透支，透支部分通过等待偿还
+type byteLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // bytes/s
+	tokens float64
+	last   time.Time
+}
+
+func newByteLimiter(rate int64) *byteLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &byteLimiter{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// take 取走 n 个令牌，返回需要等待的时间
+func (l *byteLimiter) take(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	// 桶容量为 1 秒的流量
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// limitedReader 读取后按所有限速器中最长的等待时间暂停，即较严格的限速生效
+type limitedReader struct {
+	r        io.Reader
+	limiters []*byteLimiter
+	chunk    int
+}
+
+// newLimitedReader 包装 r，limiters 中的 nil 会被忽略，全部为 nil 时直接返回 r
+func newLimitedReader(r io.Reader, limiters ...*byteLimiter) io.Reader {
+	lr := &limitedReader{r: r, chunk: maxLimitedRead}
+	for _, l := range limiters {
+		if l == nil {
+			continue
+		}
+		lr.limiters = append(lr.limiters, l)
+		if int(l.rate) < lr.chunk {
+			lr.chunk = int(l.rate)
+		}
+	}
+	if len(lr.limiters) == 0 {
+		return r
+	}
+	return lr
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > lr.chunk {
+		p = p[:lr.chunk]
+	}
+	n, err := lr.r.Read(p)
+	if n > 0 {
+		var wait time.Duration
+		for _, l := range lr.limiters {
+			wait = max(wait, l.take(n))
+		}
+		if wait > 0 {
+			time.Sleep(wait)
+		}
+	}
+	return n, err
+}
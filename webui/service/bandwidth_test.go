@@ -0,0 +1,76 @@
+package service
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DGHeroin/relay/webui/model"
+)
+
+// TestConnSpeedLimit 两个连接同时满速传输，各自的吞吐量都不超过单连接上限
+func TestConnSpeedLimit(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go serveTCPEcho(echo)
+
+	const (
+		limit    = 64 * 1024
+		duration = 2 * time.Second
+	)
+	rule := &model.RelayRule{Protocol: "tcp", Src: "127.0.0.1:0", Dst: echo.Addr().String(), ConnSpeedLimit: limit}
+	_, r := startTestRelay(t, rule)
+	addr := relayAddr(t, r, "tcp")
+
+	received := make([]int, 2)
+	var wg sync.WaitGroup
+	for i := range received {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			go func() {
+				chunk := make([]byte, 32*1024)
+				for {
+					if _, err := conn.Write(chunk); err != nil {
+						return
+					}
+				}
+			}()
+			conn.SetReadDeadline(time.Now().Add(duration))
+			buf := make([]byte, 32*1024)
+			for {
+				n, err := conn.Read(buf)
+				received[i] += n
+				if err != nil {
+					if !errors.Is(err, os.ErrDeadlineExceeded) {
+						t.Errorf("连接 %d 读取失败: %v", i, err)
+					}
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// 令牌桶初始有 1 秒的令牌，再留 10% 余量
+	ceiling := int(float64(limit) * (duration.Seconds() + 1) * 1.1)
+	for i, n := range received {
+		if n > ceiling {
+			t.Errorf("连接 %d 在 %v 内收到 %d 字节，超过上限 %d", i, duration, n, ceiling)
+		}
+		if n < limit {
+			t.Errorf("连接 %d 只收到 %d 字节，被其它连接饿死", i, n)
+		}
+	}
+}
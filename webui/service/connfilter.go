@@ -0,0 +1,86 @@
+package service
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ConnectionFilter 连接列表的过滤与排序条件，零值表示返回全部、按开始时间倒序
+type ConnectionFilter struct {
+	ClientIP string `json:"client_ip"` // 客户端 IP 子串
+	Country  string `json:"country"`   // ISO 国家代码，不区分大小写
+	MinBytes int64  `json:"min_bytes"` // 入站加出站字节数下限
+	Sort     string `json:"sort"`      // bytes、duration、started_at（默认）
+	Order    string `json:"order"`     // desc（默认）或 asc
+	Limit    int    `json:"limit"`     // 最多返回条数，0 表示不限制
+}
+
+// Validate 校验排序字段与顺序
+func (f *ConnectionFilter) Validate() error {
+	switch f.Sort {
+	case "", "bytes", "duration", "started_at":
+	default:
+		return fmt.Errorf("排序字段必须是 bytes、duration 或 started_at")
+	}
+	if f.Order != "" && f.Order != "asc" && f.Order != "desc" {
+		return fmt.Errorf("排序顺序必须是 asc 或 desc")
+	}
+	if f.MinBytes < 0 || f.Limit < 0 {
+		return fmt.Errorf("min_bytes 与 limit 不能为负数")
+	}
+	return nil
+}
+
+// IsZero 是否未设置任何条件
+func (f *ConnectionFilter) IsZero() bool {
+	return *f == ConnectionFilter{}
+}
+
+// Apply 过滤并排序连接列表，返回新的切片
+func (f *ConnectionFilter) Apply(conns []Connection) []Connection {
+	result := make([]Connection, 0, len(conns))
+	for _, c := range conns {
+		if f.ClientIP != "" && !strings.Contains(c.ClientIP, f.ClientIP) {
+			continue
+		}
+		if f.Country != "" && !strings.EqualFold(c.Country, f.Country) {
+			continue
+		}
+		if f.MinBytes > 0 && c.BytesIn+c.BytesOut < f.MinBytes {
+			continue
+		}
+		result = append(result, c)
+	}
+
+	var less func(a, b *Connection) bool
+	switch f.Sort {
+	case "bytes":
+		less = func(a, b *Connection) bool { return a.BytesIn+a.BytesOut < b.BytesIn+b.BytesOut }
+	case "duration":
+		less = func(a, b *Connection) bool { return a.Duration < b.Duration }
+	default:
+		less = func(a, b *Connection) bool { return a.StartedAt.Before(b.StartedAt) }
+	}
+	asc := f.Order == "asc"
+	sort.SliceStable(result, func(i, j int) bool {
+		if asc {
+			return less(&result[i], &result[j])
+		}
+		return less(&result[j], &result[i])
+	})
+
+	if f.Limit > 0 && len(result) > f.Limit {
+		result = result[:f.Limit]
+	}
+	return result
+}
+
+// ListConnections 返回活跃连接与全部历史记录中符合条件的连接
+func (m *RelayManager) ListConnections(id string, f ConnectionFilter) []Connection {
+	var conns []Connection
+	if v, ok := m.instances.Load(id); ok {
+		conns = v.(*RelayInstance).connectionList(0)
+	}
+	return f.Apply(conns)
+}
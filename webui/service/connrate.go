@@ -0,0 +1,65 @@
+package service
+
+import (
+	"sync"
+	"time"
+)
+
+// maxRateLimitedIPs 每个汇总周期内单独记录访问日志的客户端 IP 数上限，其余只计入总数
+const maxRateLimitedIPs = 256
+
+// connRateLimiter 新建连接速率的令牌桶，桶容量为 1 秒的配额；
+// 被拒绝的连接按客户端 IP 汇总，每秒最多回调一次 report，避免连接洪泛时逐条写日志
+type connRateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // 连接数/秒
+	tokens float64
+	last   time.Time
+
+	pending map[string]int64 // 本周期内被拒绝的客户端 IP -> 次数
+	total   int64            // 本周期内被拒绝的连接总数
+	report  func(total int64, perIP map[string]int64)
+}
+
+func newConnRateLimiter(rate int64, report func(total int64, perIP map[string]int64)) *connRateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &connRateLimiter{rate: float64(rate), tokens: float64(rate), last: time.Now(), report: report}
+}
+
+// allow 取走一个令牌，令牌不足时返回 false 并记录 clientIP 被拒绝一次
+func (l *connRateLimiter) allow(clientIP string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	if l.tokens >= 1 {
+		l.tokens--
+		return true
+	}
+
+	if l.pending == nil {
+		l.pending = make(map[string]int64)
+		time.AfterFunc(time.Second, l.flush)
+	}
+	l.total++
+	if _, ok := l.pending[clientIP]; ok || len(l.pending) < maxRateLimitedIPs {
+		l.pending[clientIP]++
+	}
+	return false
+}
+
+func (l *connRateLimiter) flush() {
+	l.mu.Lock()
+	total, perIP := l.total, l.pending
+	l.total, l.pending = 0, nil
+	l.mu.Unlock()
+	if total > 0 && l.report != nil {
+		l.report(total, perIP)
+	}
+}
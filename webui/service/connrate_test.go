@@ -0,0 +1,63 @@
+package service
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/DGHeroin/relay/webui/model"
+)
+
+// TestConnRateBurst 突发建立连接时只有桶容量内的连接被转发，其余被立即关闭并汇总记录为 rate_limited
+func TestConnRateBurst(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go serveTCPEcho(echo)
+
+	const (
+		rate  = 5
+		burst = 30
+	)
+	rule := &model.RelayRule{Protocol: "tcp", Src: "127.0.0.1:0", Dst: echo.Addr().String(), MaxNewConnectionsPerSec: rate}
+	_, r := startTestRelay(t, rule)
+	addr := relayAddr(t, r, "tcp")
+
+	start := time.Now()
+	served := 0
+	for i := 0; i < burst; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		conn.Write([]byte("ping"))
+		if _, err := io.ReadFull(conn, make([]byte, 4)); err == nil {
+			served++
+		}
+		conn.Close()
+	}
+	elapsed := time.Since(start)
+
+	// 桶容量为 1 秒的配额，突发期间按速率补充
+	want := rate + int(elapsed.Seconds()*rate) + 1
+	if served < rate || served > want {
+		t.Fatalf("%v 内转发了 %d/%d 个连接, want %d-%d", elapsed, served, burst, rate, want)
+	}
+
+	// 被拒绝的连接每秒汇总写入一次访问日志；其它测试的后台写入可能使查询短暂遇到数据库忙
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		_, total, err := model.GetAccessLogs(model.AccessLogFilter{RelayID: rule.ID, Action: "rate_limited"}, 1, 10)
+		if err == nil && total > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("没有记录 rate_limited 访问日志: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
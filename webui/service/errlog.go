@@ -0,0 +1,110 @@
+package service
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	maxRuleErrors      = 50  // 每条规则保留的最近错误数
+	maxRuleErrorLength = 256 // 单条错误信息的最大长度
+)
+
+// 错误发生的阶段
+const (
+	PhaseListen = "listen" // 启动监听或 Accept
+	PhaseTLS    = "tls"    // 客户端 TLS 握手
+	PhaseDial   = "dial"   // 连接目标
+	PhaseProxy  = "proxy"  // 经上游代理连接目标
+	PhaseCopy   = "copy"   // 数据转发
+
+	PhaseReverse = "reverse" // 反向模式连接服务端
+)
+
+// RuleError 规则运行中的一条错误记录
+type RuleError struct {
+	Time    time.Time `json:"time"`
+	Phase   string    `json:"phase"`
+	Message string    `json:"message"`
+}
+
+// errorRing 固定容量的错误环形缓冲，按规则 ID 保存在管理器中，规则重启后保留
+type errorRing struct {
+	mu    sync.Mutex
+	items []RuleError
+	next  int   // 下一条写入位置
+	total int64 // 累计错误数
+}
+
+func (e *errorRing) add(phase string, err error) {
+	item := RuleError{Time: time.Now(), Phase: phase, Message: describeError(err)}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.items) < maxRuleErrors {
+		e.items = append(e.items, item)
+	} else {
+		e.items[e.next] = item
+	}
+	e.next = (e.next + 1) % maxRuleErrors
+	e.total++
+}
+
+// list 按时间倒序返回全部错误
+func (e *errorRing) list() []RuleError {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	result := make([]RuleError, 0, len(e.items))
+	for i := 1; i <= len(e.items); i++ {
+		result = append(result, e.items[(e.next-i+len(e.items))%len(e.items)])
+	}
+	return result
+}
+
+// last 返回最近一条错误与累计错误数
+func (e *errorRing) last() (*RuleError, int64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.items) == 0 {
+		return nil, e.total
+	}
+	item := e.items[(e.next-1+len(e.items))%len(e.items)]
+	return &item, e.total
+}
+
+// describeError 生成可展示的错误信息
+// 去掉 net.OpError 中的本地与客户端地址（连接目标失败时保留目标地址），并限制长度
+func describeError(err error) string {
+	msg := err.Error()
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Err != nil {
+		msg = opErr.Err.Error()
+		if opErr.Op == "dial" && opErr.Addr != nil {
+			msg = "dial " + opErr.Addr.String() + ": " + msg
+		}
+	}
+	if len(msg) > maxRuleErrorLength {
+		msg = msg[:maxRuleErrorLength]
+		for !utf8.ValidString(msg) {
+			msg = msg[:len(msg)-1]
+		}
+		msg += "..."
+	}
+	return msg
+}
+
+// errorRing 返回规则的错误记录，不存在时创建
+func (m *RelayManager) errorRing(id string) *errorRing {
+	v, _ := m.errors.LoadOrStore(id, &errorRing{})
+	return v.(*errorRing)
+}
+
+// Errors 返回规则最近的错误记录，按时间倒序
+func (m *RelayManager) Errors(id string) []RuleError {
+	if v, ok := m.errors.Load(id); ok {
+		return v.(*errorRing).list()
+	}
+	return []RuleError{}
+}
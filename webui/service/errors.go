@@ -0,0 +1,30 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// listenErrorHints 常见监听错误对应的处理建议
+var listenErrorHints = []struct {
+	errno syscall.Errno
+	hint  string
+}{
+	{syscall.EACCES, "权限不足（请使用 1024 以上的端口，或以 root / CAP_NET_BIND_SERVICE 运行）"},
+	{syscall.EPERM, "操作不被允许（透明代理等功能需要 root 或 CAP_NET_ADMIN）"},
+	{syscall.EADDRINUSE, "地址已被占用（端口正被其它程序或规则使用）"},
+	{syscall.EADDRNOTAVAIL, "本机没有该 IP 地址"},
+	{syscall.EMFILE, "打开的文件数已达上限（请调高 ulimit -n）"},
+	{syscall.ENFILE, "系统打开的文件数已达上限"},
+}
+
+// DescribeListenError 将监听失败的底层错误转换为可操作的提示，并保留原始错误信息
+func DescribeListenError(err error) string {
+	for _, h := range listenErrorHints {
+		if errors.Is(err, h.errno) {
+			return fmt.Sprintf("%s: %v", h.hint, err)
+		}
+	}
+	return err.Error()
+}
@@ -0,0 +1,83 @@
+package service
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/DGHeroin/relay/webui/model"
+)
+
+// listenerFDShare 监听最多占用软限制的 1/listenerFDShare，其余留给转发中的连接
+// （每个 TCP 连接占用客户端与目标两个描述符）
+const listenerFDShare = 2
+
+// RuleListenerCount 规则运行时占用的监听数：端口段逐端口计算，协议为 both 时 TCP 与 UDP 各一个；
+// 反向模式每个端口占用一条控制连接。地址格式错误时返回 0
+func RuleListenerCount(rule *model.RelayRule) int {
+	mappings, err := ExpandMappings(rule.Src, rule.Dst)
+	if err != nil {
+		return 0
+	}
+	return listenersFor(rule, mappings)
+}
+
+func listenersFor(rule *model.RelayRule, mappings []AddrMapping) int {
+	if rule.Protocol == "both" {
+		return 2 * len(mappings)
+	}
+	return len(mappings)
+}
+
+// ListenerCount 所有运行中规则的监听数之和
+func (m *RelayManager) ListenerCount() int {
+	count := 0
+	m.instances.Range(func(key, value interface{}) bool {
+		instance := value.(*RelayInstance)
+		count += len(instance.tcpListeners) + len(instance.udpConns)
+		return true
+	})
+	return count
+}
+
+// MaxListeners 按当前软限制允许的监听总数，无法读取限制时返回 0 表示不限制
+func MaxListeners() int {
+	soft, _ := FDLimit()
+	if soft == 0 || soft > 1<<30 {
+		return 0
+	}
+	return int(soft) / listenerFDShare
+}
+
+// checkListenerLimit 启动规则前检查监听总数是否会超过文件描述符限制的安全比例，
+// 避免描述符耗尽后 accept 静默失败
+func (m *RelayManager) checkListenerLimit(rule *model.RelayRule, mappings []AddrMapping) error {
+	limit := MaxListeners()
+	if limit == 0 {
+		return nil
+	}
+	need := listenersFor(rule, mappings)
+	if current := m.ListenerCount(); current+need > limit {
+		soft, _ := FDLimit()
+		return fmt.Errorf("监听数将达到 %d，超过打开文件数限制 %d 的 1/%d，请提高 ulimit -n 或减少规则", current+need, soft, listenerFDShare)
+	}
+	return nil
+}
+
+// CheckFDLimit 启动时调用：记录打开文件数限制，并在即将启动的规则所需监听数超过安全比例时打印警告
+// Go 1.19 起运行时已在启动时尽量提高软限制（macOS 上受 kern.maxfilesperproc 限制），这里不再调整
+func CheckFDLimit(rules []*model.RelayRule) {
+	soft, hard := FDLimit()
+	if soft == 0 {
+		return
+	}
+	log.Printf("[FDLimit] 打开文件数限制: soft=%d, hard=%d", soft, hard)
+
+	total := 0
+	for _, rule := range rules {
+		total += RuleListenerCount(rule)
+	}
+	if limit := MaxListeners(); limit > 0 && total > limit {
+		log.Printf("[FDLimit] 警告: %d 条规则共需 %d 个监听，超过打开文件数限制 %d 的 1/%d，超出的规则将无法启动，请提高 ulimit -n",
+			len(rules), total, soft, listenerFDShare)
+	}
+}
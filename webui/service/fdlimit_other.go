@@ -0,0 +1,8 @@
+//go:build !unix
+
+package service
+
+// FDLimit 当前系统没有 RLIMIT_NOFILE，返回 0 表示不限制
+func FDLimit() (soft, hard uint64) {
+	return 0, 0
+}
@@ -0,0 +1,14 @@
+//go:build unix
+
+package service
+
+import "syscall"
+
+// FDLimit 返回进程打开文件数（RLIMIT_NOFILE）的软限制与硬限制，读取失败时返回 0
+func FDLimit() (soft, hard uint64) {
+	var lim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &lim); err != nil {
+		return 0, 0
+	}
+	return uint64(lim.Cur), uint64(lim.Max)
+}
@@ -1,17 +1,96 @@
 package service
 
 import (
+	"fmt"
 	"net"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/oschwald/maxminddb-golang"
 )
 
 // GeoIPService GeoIP 服务
+// City 库与 ASN 库相互独立，均为可选
 type GeoIPService struct {
-	db   *maxminddb.Reader
-	mu   sync.RWMutex
-	path string
+	db      *maxminddb.Reader
+	asnDB   *maxminddb.Reader
+	mu      sync.RWMutex
+	path    string
+	asnPath string
+	kind    string   // 已加载库的类型：GeoIPKindCity 或 GeoIPKindCountry
+	locales []string // 名称的语言优先级
+}
+
+// 地理位置库的类型，Country 库只有国家数据，查询结果不含城市
+const (
+	GeoIPKindCity    = "city"
+	GeoIPKindCountry = "country"
+)
+
+// geoProbeIPs 识别库类型时用于试查的公网地址
+var geoProbeIPs = []string{"8.8.8.8", "1.1.1.1", "81.2.69.142", "2001:4860:4860::8888"}
+
+// detectGeoKind 试查样例 IP 判断库提供城市还是仅国家数据；试查无结果时按元信息中的库类型判断
+func detectGeoKind(db *maxminddb.Reader) (string, error) {
+	hasCountry := false
+	for _, s := range geoProbeIPs {
+		var record geoRecord
+		if err := db.Lookup(net.ParseIP(s), &record); err != nil {
+			continue
+		}
+		if len(record.City.Names) > 0 {
+			return GeoIPKindCity, nil
+		}
+		if len(record.Country.Names) > 0 {
+			hasCountry = true
+		}
+	}
+	dbType := db.Metadata.DatabaseType
+	switch {
+	case strings.Contains(dbType, "City"):
+		return GeoIPKindCity, nil
+	case hasCountry || strings.Contains(dbType, "Country"):
+		return GeoIPKindCountry, nil
+	}
+	return "", fmt.Errorf("%s 不是 City 或 Country 数据库", dbType)
+}
+
+// DefaultGeoIPLocales 未设置 geoip_locale 时名称的语言优先级
+var DefaultGeoIPLocales = []string{"zh-CN", "en"}
+
+// GeoIPLocales MaxMind City 库提供名称的语言
+var GeoIPLocales = []string{"de", "en", "es", "fr", "ja", "pt-BR", "ru", "zh-CN"}
+
+// ParseGeoIPLocales 解析逗号分隔的语言列表，如 "en,zh-CN"，不区分大小写；空字符串返回默认优先级
+func ParseGeoIPLocales(value string) ([]string, error) {
+	if strings.TrimSpace(value) == "" {
+		return DefaultGeoIPLocales, nil
+	}
+	var locales []string
+	seen := make(map[string]bool)
+	for _, s := range strings.Split(value, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		locale := ""
+		for _, l := range GeoIPLocales {
+			if strings.EqualFold(l, s) {
+				locale = l
+				break
+			}
+		}
+		if locale == "" {
+			return nil, fmt.Errorf("不支持的语言 %s，可选 %s", s, strings.Join(GeoIPLocales, ", "))
+		}
+		if !seen[locale] {
+			seen[locale] = true
+			locales = append(locales, locale)
+		}
+	}
+	return locales, nil
 }
 
 // geoRecord GeoIP 记录
@@ -24,6 +103,38 @@ type geoRecord struct {
 	} `maxminddb:"city"`
 }
 
+// asnRecord ASN 记录
+type asnRecord struct {
+	Number       uint   `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+}
+
+// GeoIPMetadata 数据库元信息
+type GeoIPMetadata struct {
+	DatabaseType string    `json:"database_type"`
+	BuildEpoch   time.Time `json:"build_epoch"`
+	MajorVersion uint      `json:"major_version"`
+	MinorVersion uint      `json:"minor_version"`
+	NodeCount    uint      `json:"node_count"`
+	RecordSize   uint      `json:"record_size"`
+	IPVersion    uint      `json:"ip_version"`
+	Languages    []string  `json:"languages"`
+}
+
+func newGeoIPMetadata(db *maxminddb.Reader) *GeoIPMetadata {
+	m := db.Metadata
+	return &GeoIPMetadata{
+		DatabaseType: m.DatabaseType,
+		BuildEpoch:   time.Unix(int64(m.BuildEpoch), 0),
+		MajorVersion: m.BinaryFormatMajorVersion,
+		MinorVersion: m.BinaryFormatMinorVersion,
+		NodeCount:    m.NodeCount,
+		RecordSize:   m.RecordSize,
+		IPVersion:    m.IPVersion,
+		Languages:    m.Languages,
+	}
+}
+
 // NewGeoIPService 创建服务
 func NewGeoIPService() *GeoIPService {
 	return &GeoIPService{}
@@ -44,9 +155,15 @@ func (g *GeoIPService) Load(path string) error {
 	if err != nil {
 		return err
 	}
+	kind, err := detectGeoKind(db)
+	if err != nil {
+		db.Close()
+		return err
+	}
 
 	g.db = db
 	g.path = path
+	g.kind = kind
 	return nil
 }
 
@@ -60,6 +177,51 @@ func (g *GeoIPService) Close() {
 		g.db = nil
 	}
 	g.path = ""
+	g.kind = ""
+}
+
+// Kind 返回已加载库的类型，未加载时为空
+func (g *GeoIPService) Kind() string {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.kind
+}
+
+// SetLocales 设置名称的语言优先级，为空时使用默认优先级
+func (g *GeoIPService) SetLocales(locales []string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.locales = locales
+}
+
+// CheckLocales 检查已加载的 City 库是否提供 locales 中的全部语言，未加载时不检查
+func (g *GeoIPService) CheckLocales(locales []string) error {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	if g.db == nil {
+		return nil
+	}
+	for _, l := range locales {
+		if !slices.Contains(g.db.Metadata.Languages, l) {
+			return fmt.Errorf("GeoIP 数据库不包含语言 %s，可选 %s", l, strings.Join(g.db.Metadata.Languages, ", "))
+		}
+	}
+	return nil
+}
+
+// localizedName 按语言优先级取名称，均不存在时退回英文
+func (g *GeoIPService) localizedName(names map[string]string) string {
+	locales := g.locales
+	if len(locales) == 0 {
+		locales = DefaultGeoIPLocales
+	}
+	for _, l := range locales {
+		if name := names[l]; name != "" {
+			return name
+		}
+	}
+	return names["en"]
 }
 
 // IsLoaded 是否已加载
@@ -69,6 +231,28 @@ func (g *GeoIPService) IsLoaded() bool {
 	return g.db != nil
 }
 
+// Metadata 返回 City/Country 库的元信息，未加载时返回 nil
+func (g *GeoIPService) Metadata() *GeoIPMetadata {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	if g.db == nil {
+		return nil
+	}
+	return newGeoIPMetadata(g.db)
+}
+
+// ASNMetadata 返回 ASN 库的元信息，未加载时返回 nil
+func (g *GeoIPService) ASNMetadata() *GeoIPMetadata {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	if g.asnDB == nil {
+		return nil
+	}
+	return newGeoIPMetadata(g.asnDB)
+}
+
 // Lookup 查询 IP 地理位置
 func (g *GeoIPService) Lookup(ipStr string) string {
 	g.mu.RLock()
@@ -88,15 +272,8 @@ func (g *GeoIPService) Lookup(ipStr string) string {
 		return ""
 	}
 
-	country := record.Country.Names["zh-CN"]
-	if country == "" {
-		country = record.Country.Names["en"]
-	}
-
-	city := record.City.Names["zh-CN"]
-	if city == "" {
-		city = record.City.Names["en"]
-	}
+	country := g.localizedName(record.Country.Names)
+	city := g.localizedName(record.City.Names)
 
 	if country == "" {
 		return ""
@@ -107,3 +284,103 @@ func (g *GeoIPService) Lookup(ipStr string) string {
 	}
 	return country
 }
+
+// LookupCountryCode 查询 IP 所属国家的 ISO 代码，未加载或查询失败时返回空字符串
+func (g *GeoIPService) LookupCountryCode(ipStr string) string {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	if g.db == nil {
+		return ""
+	}
+
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return ""
+	}
+
+	var record struct {
+		Country struct {
+			IsoCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+	}
+	if err := g.db.Lookup(ip, &record); err != nil {
+		return ""
+	}
+	return record.Country.IsoCode
+}
+
+// DetectDatabaseType 读取 mmdb 文件的数据库类型，如 GeoLite2-City、GeoLite2-ASN
+func DetectDatabaseType(path string) (string, error) {
+	db, err := maxminddb.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+	return db.Metadata.DatabaseType, nil
+}
+
+// IsASNDatabase 判断数据库类型是否为 ASN 库
+func IsASNDatabase(dbType string) bool {
+	return strings.Contains(dbType, "ASN")
+}
+
+// LoadASN 加载 ASN 数据库
+func (g *GeoIPService) LoadASN(path string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.asnDB != nil {
+		g.asnDB.Close()
+		g.asnDB = nil
+	}
+
+	db, err := maxminddb.Open(path)
+	if err != nil {
+		return err
+	}
+
+	g.asnDB = db
+	g.asnPath = path
+	return nil
+}
+
+// CloseASN 关闭 ASN 数据库
+func (g *GeoIPService) CloseASN() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.asnDB != nil {
+		g.asnDB.Close()
+		g.asnDB = nil
+	}
+	g.asnPath = ""
+}
+
+// IsASNLoaded ASN 数据库是否已加载
+func (g *GeoIPService) IsASNLoaded() bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.asnDB != nil
+}
+
+// LookupASN 查询 IP 所属的自治系统编号及组织名称
+func (g *GeoIPService) LookupASN(ipStr string) (uint, string) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	if g.asnDB == nil {
+		return 0, ""
+	}
+
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return 0, ""
+	}
+
+	var record asnRecord
+	if err := g.asnDB.Lookup(ip, &record); err != nil {
+		return 0, ""
+	}
+	return record.Number, record.Organization
+}
@@ -0,0 +1,118 @@
+package service
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// maxMindDownloadURL MaxMind 官方下载地址
+const maxMindDownloadURL = "https://download.maxmind.com/app/geoip_download"
+
+// maxGeoIPDownloadSize 下载大小上限，防止异常响应占满磁盘
+const maxGeoIPDownloadSize = 512 << 20
+
+// MaxMindDownloadURL 根据 license key 生成官方下载地址
+func MaxMindDownloadURL(editionID, licenseKey string) string {
+	q := url.Values{}
+	q.Set("edition_id", editionID)
+	q.Set("license_key", licenseKey)
+	q.Set("suffix", "tar.gz")
+	return maxMindDownloadURL + "?" + q.Encode()
+}
+
+// DownloadGeoIPDatabase 下载 GeoIP 数据库并原子替换 dst
+// 支持直接的 .mmdb 文件以及 MaxMind 官方的 tar.gz 包
+func DownloadGeoIPDatabase(downloadURL, dst string) error {
+	client := &http.Client{Timeout: 5 * time.Minute}
+	resp, err := client.Get(downloadURL)
+	if err != nil {
+		return fmt.Errorf("下载失败: %v", redactURLError(err))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("下载失败: HTTP %d", resp.StatusCode)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), filepath.Base(dst)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	if err := extractMMDB(io.LimitReader(resp.Body, maxGeoIPDownloadSize), tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	// 校验文件可以正常打开
+	db, err := maxminddb.Open(tmpPath)
+	if err != nil {
+		return fmt.Errorf("下载的数据库无效: %v", err)
+	}
+	db.Close()
+
+	return os.Rename(tmpPath, dst)
+}
+
+// extractMMDB 将响应内容写入 w，gzip 压缩的 tar 包会提取其中的 .mmdb 文件
+func extractMMDB(r io.Reader, w io.Writer) error {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(2)
+	if len(magic) < 2 || magic[0] != 0x1f || magic[1] != 0x8b {
+		_, err := io.Copy(w, br)
+		return err
+	}
+
+	gz, err := gzip.NewReader(br)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return fmt.Errorf("压缩包中未找到 .mmdb 文件")
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeReg && strings.HasSuffix(hdr.Name, ".mmdb") {
+			_, err := io.Copy(w, tr)
+			return err
+		}
+	}
+}
+
+// redactURLError 去掉错误信息中的 URL，避免 license key 出现在日志中
+func redactURLError(err error) error {
+	if ue, ok := err.(*url.Error); ok {
+		return ue.Err
+	}
+	return err
+}
+
+// BuildEpoch 返回已加载 City 库的构建时间，未加载时返回零值
+func (g *GeoIPService) BuildEpoch() time.Time {
+	if m := g.Metadata(); m != nil {
+		return m.BuildEpoch
+	}
+	return time.Time{}
+}
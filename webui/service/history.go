@@ -0,0 +1,98 @@
+package service
+
+import (
+	"encoding/json"
+	"log"
+	"sync/atomic"
+
+	"github.com/DGHeroin/relay/webui/model"
+)
+
+// connHistory 已断开连接的环形缓冲区，最多保留 size 条，写满后覆盖最旧的记录；
+// 追加为 O(1)，避免每次断开都在 historyMu 内复制整个历史
+type connHistory struct {
+	size int
+	buf  []*Connection // 未写满时按写入顺序追加，写满后 head 为最旧一条的位置
+	head int
+}
+
+func newConnHistory(size int) *connHistory {
+	return &connHistory{size: size}
+}
+
+// add 追加一条记录，size 为 0 时不保留
+func (h *connHistory) add(c *Connection) {
+	if h.size <= 0 {
+		return
+	}
+	if len(h.buf) < h.size {
+		h.buf = append(h.buf, c)
+		return
+	}
+	h.buf[h.head] = c
+	h.head = (h.head + 1) % h.size
+}
+
+// len 当前记录数
+func (h *connHistory) len() int {
+	return len(h.buf)
+}
+
+// at 返回第 i 条记录，0 为最新
+func (h *connHistory) at(i int) *Connection {
+	n := len(h.buf)
+	return h.buf[(h.head+n-1-i)%n]
+}
+
+// loadPersistHistory 读取 persist_history 设置，开启后已断开的连接写入数据库，规则启动时恢复
+func loadPersistHistory() bool {
+	value, _ := model.GetSetting("persist_history")
+	return value == "true"
+}
+
+// restoreHistory 从数据库恢复最近 historySize 条连接历史，并删除超出部分
+func (r *RelayInstance) restoreHistory() {
+	if r.historySize == 0 {
+		return
+	}
+	records, err := model.GetConnectionHistory(r.rule.ID, r.historySize)
+	if err != nil {
+		log.Printf("[Relay] 恢复连接历史失败: rule=%s, err=%v", r.rule.Name, err)
+		return
+	}
+	// records 最新的在前，按时间顺序写入
+	history := newConnHistory(r.historySize)
+	for i := len(records) - 1; i >= 0; i-- {
+		c := &Connection{}
+		if err := json.Unmarshal(records[i], c); err != nil {
+			continue
+		}
+		history.add(c)
+	}
+
+	r.historyMu.Lock()
+	r.history = history
+	r.historyMu.Unlock()
+
+	if err := model.TrimConnectionHistory(r.rule.ID, r.historySize); err != nil {
+		log.Printf("[Relay] 清理连接历史失败: rule=%s, err=%v", r.rule.Name, err)
+	}
+}
+
+// persistHistory 将已断开的连接写入数据库；每写入 historySize 条清理一次超出内存上限的旧记录
+func (r *RelayInstance) persistHistory(ended Connection) {
+	if !r.historyPersist || r.historySize == 0 {
+		return
+	}
+	data, err := json.Marshal(ended)
+	if err != nil {
+		return
+	}
+	if err := model.SaveConnectionHistory(r.rule.ID, data, *ended.EndedAt); err != nil {
+		log.Printf("[Relay] 保存连接历史失败: rule=%s, err=%v", r.rule.Name, err)
+		return
+	}
+	if atomic.AddInt64(&r.historySaved, 1)%int64(r.historySize) == 0 {
+		model.TrimConnectionHistory(r.rule.ID, r.historySize)
+	}
+}
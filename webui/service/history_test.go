@@ -0,0 +1,106 @@
+package service
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConnHistoryRing(t *testing.T) {
+	h := newConnHistory(3)
+	for i := 1; i <= 5; i++ {
+		h.add(&Connection{ID: fmt.Sprint(i)})
+	}
+	if h.len() != 3 {
+		t.Fatalf("len = %d, want 3", h.len())
+	}
+	// 最新的在前，最旧的两条已被覆盖
+	for i, want := range []string{"5", "4", "3"} {
+		if got := h.at(i).ID; got != want {
+			t.Errorf("at(%d) = %s, want %s", i, got, want)
+		}
+	}
+
+	empty := newConnHistory(0)
+	empty.add(&Connection{ID: "1"})
+	if empty.len() != 0 {
+		t.Fatal("size 为 0 时不应保留记录")
+	}
+}
+
+// TestFinalizeConnectionMidTransfer 模拟传输中途断开：读取方始终只看到连接出现在活跃列表或历史中的一处，
+// 字节数不回退，历史中的最终记录与断开时的计数一致
+func TestFinalizeConnectionMidTransfer(t *testing.T) {
+	r := &RelayInstance{historySize: 10, history: newConnHistory(10)}
+	const conns = 20
+
+	stop := make(chan struct{})
+	var readerErr atomic.Value
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		lastIn := make(map[string]int64)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			seen := make(map[string]int)
+			for _, c := range r.connectionList(0) {
+				seen[c.ID]++
+				if c.BytesIn < lastIn[c.ID] {
+					readerErr.Store(fmt.Sprintf("连接 %s 的字节数从 %d 回退到 %d", c.ID, lastIn[c.ID], c.BytesIn))
+				}
+				lastIn[c.ID] = c.BytesIn
+			}
+			for id, n := range seen {
+				if n != 1 {
+					readerErr.Store(fmt.Sprintf("连接 %s 出现 %d 次", id, n))
+				}
+			}
+		}
+	}()
+
+	finals := make(map[string]int64)
+	for i := 0; i < conns; i++ {
+		c := &Connection{ID: fmt.Sprint(i), StartedAt: time.Now(), Active: true}
+		r.connections.Store(c.ID, c)
+		atomic.AddInt64(&r.connCount, 1)
+
+		// 转发中途客户端断开
+		for j := 0; j < 100; j++ {
+			atomic.AddInt64(&c.BytesIn, 512)
+			atomic.AddInt64(&c.BytesOut, 256)
+		}
+		ended := r.finalizeConnection(c, "client_closed")
+		finals[c.ID] = ended.BytesIn
+		if ended.Active || ended.EndedAt == nil || ended.BytesIn != 100*512 || ended.BytesOut != 100*256 {
+			t.Fatalf("断开记录不一致: %+v", ended)
+		}
+	}
+	close(stop)
+	wg.Wait()
+	if err := readerErr.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := atomic.LoadInt64(&r.connCount); n != 0 {
+		t.Fatalf("connCount = %d, want 0", n)
+	}
+	list := r.connectionList(0)
+	if len(list) != 10 {
+		t.Fatalf("历史 %d 条, want 10", len(list))
+	}
+	for i, c := range list {
+		if want := fmt.Sprint(conns - 1 - i); c.ID != want {
+			t.Errorf("第 %d 条为 %s, want %s", i, c.ID, want)
+		}
+		if c.Active || c.BytesIn != finals[c.ID] {
+			t.Errorf("历史记录 %s 不一致: active=%v bytes_in=%d", c.ID, c.Active, c.BytesIn)
+		}
+	}
+}
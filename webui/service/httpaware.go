@@ -0,0 +1,128 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	httpHeadTimeout = 10 * time.Second // 等待首个请求头的超时，超时后按原始 TCP 转发
+	maxHTTPHeadSize = 16 << 10         // 请求头/响应头的最大解析长度
+)
+
+var errHTTPHeadTooLarge = errors.New("HTTP 头过长")
+
+// httpRequestInfo 首个 HTTP 请求的摘要
+type httpRequestInfo struct {
+	Method  string
+	Host    string
+	Path    string
+	Upgrade string // 请求的 Upgrade 协议，如 websocket，未请求时为空
+}
+
+// peekHTTPHead 预读直到空行为止的 HTTP 头，不消耗 br 中的数据
+func peekHTTPHead(br *bufio.Reader) ([]byte, error) {
+	if _, err := br.Peek(1); err != nil {
+		return nil, err
+	}
+	for {
+		buf, _ := br.Peek(br.Buffered())
+		if i := bytes.Index(buf, []byte("\r\n\r\n")); i >= 0 {
+			return buf[:i+4], nil
+		}
+		if br.Buffered() >= br.Size() {
+			return nil, errHTTPHeadTooLarge
+		}
+		if _, err := br.Peek(br.Buffered() + 1); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// sniffHTTPRequest 在连接目标之后预读客户端的首个 HTTP 请求头。
+// 目标先发送数据（SSH、SMTP 等服务端先发言的协议）或目标断开时立即停止预读，不等待超时；
+// 返回的 clientReader 与 remoteReader 依次给出已预读的数据与之后的数据，两端的读超时均已清除。
+// 非 HTTP 流量、等待超时或被中断时 info 为 nil，数据仍原样转发
+func sniffHTTPRequest(client, remote net.Conn) (clientReader, remoteReader io.Reader, info *httpRequestInfo) {
+	br := bufio.NewReaderSize(client, maxHTTPHeadSize)
+	client.SetReadDeadline(time.Now().Add(httpHeadTimeout))
+
+	// 同时等待目标的首个字节，收到后中断对客户端的预读
+	var first [1]byte
+	var firstN int
+	watchDone := make(chan struct{})
+	go func() {
+		defer close(watchDone)
+		var err error
+		firstN, err = remote.Read(first[:])
+		var ne net.Error
+		if firstN > 0 || !errors.As(err, &ne) || !ne.Timeout() {
+			client.SetReadDeadline(time.Now())
+		}
+	}()
+
+	head, err := peekHTTPHead(br)
+
+	// 停止等待目标，等待 goroutine 退出后再清除两端的超时，避免它在清除之后再设置
+	remote.SetReadDeadline(time.Now())
+	<-watchDone
+	remote.SetReadDeadline(time.Time{})
+	client.SetReadDeadline(time.Time{})
+
+	// bufio.Reader 会保留超时错误并在下次读取时返回，因此只取出已缓冲的数据，之后直接读连接
+	buffered, _ := br.Peek(br.Buffered())
+	clientReader = io.MultiReader(bytes.NewReader(buffered), client)
+	remoteReader = io.MultiReader(bytes.NewReader(first[:firstN]), remote)
+	if err != nil {
+		return clientReader, remoteReader, nil
+	}
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(head)))
+	if err != nil {
+		return clientReader, remoteReader, nil
+	}
+	info = &httpRequestInfo{
+		Method: req.Method,
+		Host:   req.Host,
+		Path:   req.URL.RequestURI(),
+	}
+	if headerHasToken(req.Header, "Connection", "upgrade") {
+		info.Upgrade = strings.ToLower(req.Header.Get("Upgrade"))
+	}
+	return clientReader, remoteReader, info
+}
+
+// sniffSwitchingProtocols 预读上游的响应头，判断是否为 101 Switching Protocols
+func sniffSwitchingProtocols(br *bufio.Reader) bool {
+	head, err := peekHTTPHead(br)
+	if err != nil {
+		return false
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(head)), nil)
+	if err != nil {
+		return false
+	}
+	return resp.StatusCode == http.StatusSwitchingProtocols
+}
+
+// headerHasToken 判断逗号分隔的头部值中是否包含 token（不区分大小写）
+func headerHasToken(h http.Header, key, token string) bool {
+	for _, v := range h.Values(key) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// String 返回用于访问日志的请求摘要，如 "GET example.com/chat"
+func (i *httpRequestInfo) String() string {
+	return i.Method + " " + i.Host + i.Path
+}
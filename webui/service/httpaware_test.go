@@ -0,0 +1,99 @@
+package service
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tcpPair 返回一对已连接的回环 TCP 连接
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := ln.Accept()
+		accepted <- c
+	}()
+	a, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := <-accepted
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	return a, b
+}
+
+func TestSniffHTTPRequest(t *testing.T) {
+	clientPeer, client := tcpPair(t)
+	remote, _ := tcpPair(t)
+
+	req := "GET /chat HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\nbody"
+	go clientPeer.Write([]byte(req))
+
+	clientReader, _, info := sniffHTTPRequest(client, remote)
+	if info == nil {
+		t.Fatal("未识别 HTTP 请求")
+	}
+	if info.String() != "GET example.com/chat" || info.Upgrade != "websocket" {
+		t.Fatalf("info = %+v", info)
+	}
+	// 预读的数据原样转发
+	got := make([]byte, len(req))
+	if _, err := io.ReadFull(clientReader, got); err != nil || string(got) != req {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
+
+// TestSniffServerFirst 服务端先发言的协议（如 SMTP）不等待预读超时，双方数据都不丢失
+func TestSniffServerFirst(t *testing.T) {
+	clientPeer, client := tcpPair(t)
+	remote, server := tcpPair(t)
+
+	server.Write([]byte("220 mail.example.com ESMTP\r\n"))
+
+	start := time.Now()
+	clientReader, remoteReader, info := sniffHTTPRequest(client, remote)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("预读耗时 %v，应在目标发言后立即结束", elapsed)
+	}
+	if info != nil {
+		t.Fatalf("info = %+v, want nil", info)
+	}
+
+	greeting, err := bufio.NewReader(remoteReader).ReadString('\n')
+	if err != nil || greeting != "220 mail.example.com ESMTP\r\n" {
+		t.Fatalf("greeting = %q, %v", greeting, err)
+	}
+
+	// 读超时已清除：之后客户端的数据照常可读
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		clientPeer.Write([]byte("EHLO client\r\n"))
+	}()
+	line, err := bufio.NewReader(clientReader).ReadString('\n')
+	if err != nil || line != "EHLO client\r\n" {
+		t.Fatalf("line = %q, %v", line, err)
+	}
+}
+
+func TestSniffSwitchingProtocols(t *testing.T) {
+	resp := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"
+	if !sniffSwitchingProtocols(bufio.NewReader(strings.NewReader(resp))) {
+		t.Fatal("未识别 101 响应")
+	}
+	ok := "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"
+	if sniffSwitchingProtocols(bufio.NewReader(strings.NewReader(ok))) {
+		t.Fatal("200 响应不应视为协议升级")
+	}
+}
@@ -0,0 +1,45 @@
+package service
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/DGHeroin/relay/webui/model"
+)
+
+// lifetimeCacheTTL 累计统计的缓存时间，避免每次查询规则状态都汇总 relay_stats
+const lifetimeCacheTTL = 10 * time.Second
+
+// lifetimeCache 各规则在统计保留期内的累计值
+// relay_stats 在连接断开时写入，累计值不含仍在进行的连接
+type lifetimeCache struct {
+	mu        sync.Mutex
+	totals    map[string]model.RelayTotal
+	updatedAt time.Time
+}
+
+// get 返回规则的累计值，缓存过期时重新查询，查询失败时沿用旧值
+func (c *lifetimeCache) get(id string) model.RelayTotal {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.updatedAt) >= lifetimeCacheTTL {
+		totals, err := model.GetRelayTotals()
+		if err != nil {
+			if err != model.ErrNoDB {
+				log.Printf("[RelayMgr] 查询累计统计失败: %v", err)
+			}
+		} else {
+			c.totals = totals
+		}
+		c.updatedAt = time.Now()
+	}
+	return c.totals[id]
+}
+
+// InvalidateLifetime 使累计统计缓存失效，清除统计数据后调用
+func (m *RelayManager) InvalidateLifetime() {
+	m.lifetime.mu.Lock()
+	m.lifetime.updatedAt = time.Time{}
+	m.lifetime.mu.Unlock()
+}
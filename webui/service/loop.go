@@ -0,0 +1,169 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/DGHeroin/relay/webui/model"
+)
+
+// loopResolveTimeout 检查转发环路时解析目标主机名的超时
+const loopResolveTimeout = 2 * time.Second
+
+// RelayLoop 规则的目标指向某条规则（可能是自身）的监听地址，转发会无限循环
+type RelayLoop struct {
+	Target string           // 形成环路的目标地址
+	Rule   *model.RelayRule // 被指向的规则
+	Listen string           // 被指向的监听地址
+}
+
+func (l *RelayLoop) Error() string {
+	return fmt.Sprintf("目标 %s 指向规则 %s 的监听地址 %s，会形成转发环路", l.Target, l.Rule.Name, l.Listen)
+}
+
+// FindRelayLoop 检查 rule 的目标是否指向 rules 中任一规则的本机监听地址
+// rules 中与 rule 同 ID 的规则以 rule 的当前配置代替；0.0.0.0/:: 监听地址匹配本机的任意地址，
+// 目标为 0.0.0.0/:: 时视为本机；主机名无法解析的目标与经上游代理连接的规则不做检查，反向模式规则的监听地址不参与匹配
+func FindRelayLoop(rule *model.RelayRule, rules []*model.RelayRule) (*RelayLoop, error) {
+	if rule.UpstreamProxy != "" {
+		return nil, nil
+	}
+	mappings, err := ExpandMappings(rule.Src, rule.Dst)
+	if err != nil {
+		return nil, err
+	}
+
+	local, err := localIPs()
+	if err != nil {
+		return nil, err
+	}
+
+	// 反向模式规则的监听地址在服务端上，不会与本机的目标形成环路
+	var candidates []*model.RelayRule
+	if !rule.IsReverse() {
+		candidates = append(candidates, rule)
+	}
+	for _, r := range rules {
+		if (r.ID != rule.ID || rule.ID == "") && !r.IsReverse() {
+			candidates = append(candidates, r)
+		}
+	}
+
+	// 端口段规则的目标与监听地址大多共用主机名，解析结果按主机名缓存
+	resolved := make(map[string][]net.IP)
+	resolve := func(host string) []net.IP {
+		ips, ok := resolved[host]
+		if !ok {
+			ips = resolveForLoop(host)
+			resolved[host] = ips
+		}
+		return ips
+	}
+
+	seen := make(map[string]bool)
+	for _, m := range mappings {
+		for _, t := range m.Targets {
+			if seen[t.Addr] {
+				continue
+			}
+			seen[t.Addr] = true
+
+			host, portStr, err := net.SplitHostPort(t.Addr)
+			if err != nil {
+				continue
+			}
+			port, _ := strconv.Atoi(portStr)
+			// 只有指向本机的地址才可能回到自己的监听端口
+			ips := localOnly(resolve(host), local)
+			if len(ips) == 0 {
+				continue
+			}
+			for _, other := range candidates {
+				if !model.ProtocolsOverlap(rule.Protocol, other.Protocol) {
+					continue
+				}
+				if listen := matchListen(other, ips, port, resolve); listen != "" {
+					return &RelayLoop{Target: t.Addr, Rule: other, Listen: listen}, nil
+				}
+			}
+		}
+	}
+	return nil, nil
+}
+
+// matchListen 返回 rule 中与目标 ips:port 相同的监听地址，没有时返回空字符串
+func matchListen(rule *model.RelayRule, ips []net.IP, port int, resolve func(string) []net.IP) string {
+	for _, addr := range model.SplitListenAddrs(rule.Src) {
+		host, start, end, err := model.ParsePortRange(addr)
+		if err != nil || port < start || port > end {
+			continue
+		}
+		listenIPs := resolve(host)
+		for _, ip := range ips {
+			for _, lip := range listenIPs {
+				// 任一方为未指定地址时：监听 0.0.0.0 接受发往本机任意地址的连接，连接 0.0.0.0 即连接本机
+				if lip.IsUnspecified() || ip.IsUnspecified() || lip.Equal(ip) {
+					return net.JoinHostPort(host, strconv.Itoa(port))
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// resolveForLoop 解析地址，空主机名视为未指定地址，解析失败返回 nil
+func resolveForLoop(host string) []net.IP {
+	if host == "" {
+		return []net.IP{net.IPv4zero}
+	}
+	if ip, _ := model.ParseIPZone(host); ip != nil {
+		return []net.IP{ip}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), loopResolveTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, a := range addrs {
+		ips = append(ips, a.IP)
+	}
+	return ips
+}
+
+// localIPs 返回本机网卡上的全部地址
+func localIPs() ([]net.IP, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok {
+			ips = append(ips, n.IP)
+		}
+	}
+	return ips, nil
+}
+
+// localOnly 返回 ips 中的本机地址（回环、未指定或网卡上的地址）
+func localOnly(ips, local []net.IP) []net.IP {
+	var result []net.IP
+	for _, ip := range ips {
+		if ip.IsLoopback() || ip.IsUnspecified() {
+			result = append(result, ip)
+			continue
+		}
+		for _, l := range local {
+			if l.Equal(ip) {
+				result = append(result, ip)
+				break
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,24 @@
+package service
+
+import (
+	"log"
+	"os"
+	"testing"
+
+	"github.com/DGHeroin/relay/webui/model"
+)
+
+// TestMain 为依赖数据库的测试初始化临时数据库
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "relay-service-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := model.InitDB(dir); err != nil {
+		log.Fatal(err)
+	}
+	code := m.Run()
+	model.CloseDB()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
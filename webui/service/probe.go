@@ -0,0 +1,93 @@
+package service
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"time"
+)
+
+// DialTimeout 直连目标的超时，转发与目标测试共用；经上游代理时使用代理的超时
+const DialTimeout = 5 * time.Second
+
+// udpProbeWait UDP 测试发出报文后等待回复的时间
+const udpProbeWait = time.Second
+
+// TargetProbe 单个目标的测试结果
+type TargetProbe struct {
+	Target    string `json:"target"`
+	Protocol  string `json:"protocol"`
+	OK        bool   `json:"ok"`
+	LatencyMs int64  `json:"latency_ms"`
+	Replied   bool   `json:"replied,omitempty"` // UDP 目标在等待时间内有回复
+	Error     string `json:"error,omitempty"`
+}
+
+// ProbeTarget 测试目标是否可达，不启动规则
+// TCP 测量建立连接的耗时，经上游代理时包括代理握手，upstreamTLS 时包括 TLS 握手；
+// UDP 没有握手，发出一个空报文后短暂等待：收到回复时 latency 为往返耗时，
+// 收到 ICMP 端口不可达时失败，没有任何回应时仍视为成功，只表示报文已发出
+func ProbeTarget(protocol, addr, upstreamProxy string, upstreamTLS bool) *TargetProbe {
+	p := &TargetProbe{Target: addr, Protocol: protocol}
+	start := time.Now()
+	var err error
+	if protocol == "udp" {
+		p.Replied, err = probeUDP(addr)
+	} else {
+		err = probeTCP(addr, upstreamProxy, upstreamTLS)
+	}
+	if err != nil {
+		p.Error = err.Error()
+		return p
+	}
+	p.OK = true
+	if protocol != "udp" || p.Replied {
+		p.LatencyMs = time.Since(start).Milliseconds()
+	}
+	return p
+}
+
+func probeTCP(addr, upstreamProxy string, upstreamTLS bool) error {
+	var conn net.Conn
+	var err error
+	if upstreamProxy != "" {
+		conn, err = DialThroughProxy(upstreamProxy, addr)
+	} else {
+		conn, err = net.DialTimeout("tcp", addr, DialTimeout)
+	}
+	if err != nil {
+		return err
+	}
+	if upstreamTLS {
+		conn, err = upstreamTLSClient(conn, addr)
+		if err != nil {
+			return err
+		}
+	}
+	return conn.Close()
+}
+
+// probeUDP 发出空报文并等待回复，返回是否收到回复
+func probeUDP(addr string) (bool, error) {
+	conn, err := net.DialTimeout("udp", addr, DialTimeout)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err := conn.Write(nil); err != nil {
+		return false, err
+	}
+	conn.SetReadDeadline(time.Now().Add(udpProbeWait))
+	buf := make([]byte, 1)
+	if _, err := conn.Read(buf); err != nil {
+		var ne net.Error
+		if errors.As(err, &ne) && ne.Timeout() {
+			return false, nil
+		}
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			return false, errors.New("目标端口不可达")
+		}
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,87 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// proxyDialTimeout 经代理连接目标的超时，包括连接代理与 SOCKS5 握手
+const proxyDialTimeout = 10 * time.Second
+
+// ParseUpstreamProxy 校验上游代理地址，支持 socks5:// 与 socks5h://，可带 user:pass@，端口默认 1080
+// 两种写法都由代理解析目标主机名
+func ParseUpstreamProxy(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("上游代理地址格式错误")
+	}
+	if u.Scheme != "socks5" && u.Scheme != "socks5h" {
+		return nil, fmt.Errorf("上游代理仅支持 socks5:// 或 socks5h://")
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("上游代理缺少主机地址")
+	}
+	if (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" {
+		return nil, fmt.Errorf("上游代理地址只能包含主机和端口")
+	}
+	if port := u.Port(); port != "" {
+		if _, err := net.LookupPort("tcp", port); err != nil {
+			return nil, fmt.Errorf("上游代理端口无效: %s", port)
+		}
+	}
+	if u.User != nil && u.User.Username() == "" {
+		return nil, fmt.Errorf("上游代理用户名不能为空")
+	}
+	return u, nil
+}
+
+// upstreamProxy 规则的 SOCKS5 上游代理
+type upstreamProxy struct {
+	addr   string // 代理地址，不含认证信息，用于日志
+	dialer proxy.ContextDialer
+}
+
+// newUpstreamProxy 按规则的上游代理设置创建拨号器，未设置时返回 nil
+func newUpstreamProxy(raw string) (*upstreamProxy, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	u, err := ParseUpstreamProxy(raw)
+	if err != nil {
+		return nil, err
+	}
+	d, err := proxy.FromURL(u, &net.Dialer{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	cd, ok := d.(proxy.ContextDialer)
+	if !ok {
+		return nil, fmt.Errorf("上游代理不支持超时控制")
+	}
+	return &upstreamProxy{addr: u.Host, dialer: cd}, nil
+}
+
+// dial 经代理连接目标
+func (p *upstreamProxy) dial(dst string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), proxyDialTimeout)
+	defer cancel()
+	conn, err := p.dialer.DialContext(ctx, "tcp", dst)
+	if err != nil {
+		return nil, fmt.Errorf("经代理 %s 连接 %s 失败: %w", p.addr, dst, err)
+	}
+	return conn, nil
+}
+
+// DialThroughProxy 经上游代理连接目标，用于规则预检查的试连
+func DialThroughProxy(raw, dst string) (net.Conn, error) {
+	p, err := newUpstreamProxy(raw)
+	if err != nil {
+		return nil, err
+	}
+	return p.dial(dst)
+}
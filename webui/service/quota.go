@@ -0,0 +1,127 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/DGHeroin/relay/webui/model"
+)
+
+const (
+	defaultQuotaResetDay = 1  // 默认每月 1 日重置配额
+	MaxQuotaResetDay     = 28 // quota_reset_day 上限，保证每个月都有该日期
+)
+
+// QuotaExceeded 流量配额用尽事件
+type QuotaExceeded struct {
+	RelayID   string    `json:"relay_id"`
+	RelayName string    `json:"relay_name"`
+	Used      int64     `json:"used"`
+	Quota     int64     `json:"quota"`
+	Time      time.Time `json:"time"`
+}
+
+// quotaState 配额统计，仅在 pushStatus 所在 goroutine 中修改，used 可并发读取
+type quotaState struct {
+	periodStart time.Time
+	base        int64 // 启动前本周期已入库的流量
+	mark        int64 // 本周期开始时的实例累计流量
+	used        int64 // 本周期已用流量（原子访问）
+	exceeded    bool
+}
+
+// loadQuotaResetDay 读取 quota_reset_day 设置
+func loadQuotaResetDay() int {
+	value, err := model.GetSetting("quota_reset_day")
+	if err != nil || value == "" {
+		return defaultQuotaResetDay
+	}
+	day, err := strconv.Atoi(value)
+	if err != nil || day < 1 || day > MaxQuotaResetDay {
+		return defaultQuotaResetDay
+	}
+	return day
+}
+
+// QuotaPeriodStart 返回 t 所在计费周期的开始时间，周期从每月 quota_reset_day 日零点开始
+func QuotaPeriodStart(t time.Time) time.Time {
+	day := loadQuotaResetDay()
+	y, m, d := t.Date()
+	if d < day {
+		m--
+	}
+	return time.Date(y, m, day, 0, 0, 0, 0, t.Location())
+}
+
+// QuotaUsed 返回规则本周期已用流量，运行中的规则包含尚未入库的活跃连接流量
+func (m *RelayManager) QuotaUsed(rule *model.RelayRule) (int64, error) {
+	if v, ok := m.instances.Load(rule.ID); ok {
+		if inst := v.(*RelayInstance); inst.rule.MonthlyByteQuota > 0 {
+			return atomic.LoadInt64(&inst.quota.used), nil
+		}
+	}
+	in, out, err := model.GetRelayTrafficSince(rule.ID, QuotaPeriodStart(time.Now()))
+	return in + out, err
+}
+
+// initQuotaState 读取本周期已入库的流量，配额已用尽时返回错误
+func (r *RelayInstance) initQuotaState() error {
+	if r.rule.MonthlyByteQuota <= 0 {
+		return nil
+	}
+	st := &r.quota
+	st.periodStart = QuotaPeriodStart(time.Now())
+	in, out, err := model.GetRelayTrafficSince(r.rule.ID, st.periodStart)
+	if err != nil {
+		log.Printf("[Quota] 获取本周期流量失败 %s: %v", r.rule.Name, err)
+		return nil
+	}
+	st.base = in + out
+	atomic.StoreInt64(&st.used, st.base)
+	if st.base >= r.rule.MonthlyByteQuota {
+		return fmt.Errorf("本周期流量配额已用尽 (%d/%d bytes)", st.base, r.rule.MonthlyByteQuota)
+	}
+	return nil
+}
+
+// checkQuota 由 pushStatus 定期调用，配额用尽时停止并禁用规则
+func (r *RelayInstance) checkQuota(totalBytes int64) {
+	quota := r.rule.MonthlyByteQuota
+	if quota <= 0 {
+		return
+	}
+	st := &r.quota
+	if period := QuotaPeriodStart(time.Now()); period.After(st.periodStart) {
+		// 进入新周期，重置统计
+		st.periodStart = period
+		st.base = 0
+		st.mark = totalBytes
+		st.exceeded = false
+	}
+	used := st.base + totalBytes - st.mark
+	atomic.StoreInt64(&st.used, used)
+	if st.exceeded || used < quota {
+		return
+	}
+	st.exceeded = true
+
+	log.Printf("[Quota] %s 流量配额已用尽: used=%d, quota=%d，停止并禁用规则", r.rule.Name, used, quota)
+	if err := model.SetRelayEnabled(r.rule.ID, false); err != nil {
+		log.Printf("[Quota] 禁用规则失败 %s: %v", r.rule.Name, err)
+	}
+	if r.broadcaster != nil {
+		r.broadcaster.BroadcastToRelay(r.rule.ID, "relay.quota_exceeded", QuotaExceeded{
+			RelayID:   r.rule.ID,
+			RelayName: r.rule.Name,
+			Used:      used,
+			Quota:     quota,
+			Time:      time.Now(),
+		})
+	}
+	if r.manager != nil {
+		r.manager.Stop(r.rule.ID, ReasonQuota)
+	}
+}
@@ -1,12 +1,20 @@
 package service
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/DGHeroin/relay/webui/model"
@@ -15,10 +23,50 @@ import (
 
 // RelayStatus 转发状态
 type RelayStatus struct {
-	Running     bool  `json:"running"`
+	Running bool `json:"running"`
+
+	// 本次运行的实时值，规则重启后清零；Connections 为当前活跃连接数
 	Connections int64 `json:"connections"`
 	BytesIn     int64 `json:"bytes_in"`
 	BytesOut    int64 `json:"bytes_out"`
+	// 平滑后的当前速度 (bytes/s)，与 relay.traffic 推送的值一致，按推送间隔更新
+	SpeedIn  int64 `json:"bytes_in_speed"`
+	SpeedOut int64 `json:"bytes_out_speed"`
+
+	// 统计保留期内的累计值（来自 relay_stats，不含仍在进行的连接），规则重启后保留
+	LifetimeBytesIn     int64 `json:"lifetime_bytes_in"`
+	LifetimeBytesOut    int64 `json:"lifetime_bytes_out"`
+	LifetimeConnections int64 `json:"lifetime_connections"`
+
+	// 因不在运行计划时间内而停止；未运行且为 false 表示手动停止或未启动
+	ScheduledOff bool `json:"scheduled_off,omitempty"`
+
+	// 本次运行时长（秒），未运行时为 0
+	UptimeSeconds int64 `json:"uptime_seconds"`
+	// 进程启动以来规则被重新启动的次数，首次启动不计入
+	RestartCount int64 `json:"restart_count"`
+
+	// 累计错误数与最近一条错误，完整记录通过 relay.errors 查询
+	ErrorCount int64      `json:"error_count"`
+	LastError  *RuleError `json:"last_error,omitempty"`
+
+	// 排空中：监听保持但不接受新连接，已有连接照常转发
+	Draining bool `json:"draining"`
+
+	// 反向模式的控制连接状态，listen_addr 不含服务端上的监听地址
+	Reverse *ReverseStatus `json:"reverse,omitempty"`
+
+	// 多目标规则各目标的连接计数
+	Targets []TargetStatus `json:"targets,omitempty"`
+
+	// 实际绑定的监听地址，协议为 both 时 TCP 与 UDP 各一项；未运行时为空
+	ListenAddrs []BoundAddr `json:"listen_addr,omitempty"`
+}
+
+// BoundAddr 规则实际绑定的监听地址
+type BoundAddr struct {
+	Network string `json:"network"` // tcp 或 udp
+	Addr    string `json:"addr"`
 }
 
 // Connection 连接信息
@@ -26,6 +74,9 @@ type Connection struct {
 	ID        string     `json:"id"`
 	ClientIP  string     `json:"client_ip"`
 	Location  string     `json:"client_location,omitempty"`
+	Country   string     `json:"country,omitempty"` // ISO 国家代码
+	ASN       uint       `json:"asn,omitempty"`
+	ASOrg     string     `json:"as_org,omitempty"`
 	Target    string     `json:"target"`
 	Protocol  string     `json:"protocol"`
 	BytesIn   int64      `json:"bytes_in"`
@@ -34,6 +85,108 @@ type Connection struct {
 	EndedAt   *time.Time `json:"ended_at,omitempty"`
 	Duration  int64      `json:"duration"`
 	Active    bool       `json:"active"`
+
+	// 连接目标耗时 (ms)，UDP 为首个响应包耗时，尚未收到响应时为 0
+	ConnectLatencyMs int64 `json:"connect_latency_ms"`
+
+	// TCP 断开原因：client_closed / upstream_closed 为正常关闭，
+	// client_error / upstream_error 附带错误信息，如 connection reset by peer
+	CloseReason string `json:"close_reason,omitempty"`
+
+	// mTLS 规则中已校验的客户端证书标识 (CN/SAN)
+	ClientCert string `json:"client_cert,omitempty"`
+
+	// TLS 终止规则中与客户端协商的版本、加密套件与 ALPN 协议，非 TLS 规则为空
+	TLSVersion string `json:"tls_version,omitempty"`
+	TLSCipher  string `json:"tls_cipher,omitempty"`
+	TLSALPN    string `json:"tls_alpn,omitempty"`
+
+	// HTTP 感知模式下首个请求的 Host 与路径
+	HTTPHost string `json:"http_host,omitempty"`
+	HTTPPath string `json:"http_path,omitempty"`
+	// 上游以 101 响应后切换到的协议，如 websocket
+	HTTPUpgrade string `json:"http_upgrade,omitempty"`
+
+	// 客户端为内网、回环或 CGNAT 地址，便于区分局域网流量与公网流量
+	Private bool `json:"private,omitempty"`
+
+	// 规则的静态标签，只读，与规则共享
+	Labels map[string]string `json:"labels,omitempty"`
+
+	upgradeRequested string // 请求中的 Upgrade 协议
+	upgraded         int32  // 收到 101 响应后置 1（原子访问）
+
+	closeFn func() // 规则停止时强制关闭连接，UDP 会话为 nil
+}
+
+// snapshot 复制连接信息，计数器使用原子读取，可与数据转发并发调用
+func (c *Connection) snapshot() Connection {
+	upgrade := c.HTTPUpgrade
+	if atomic.LoadInt32(&c.upgraded) == 1 {
+		upgrade = c.upgradeRequested
+	}
+	return Connection{
+		ID:               c.ID,
+		ClientIP:         c.ClientIP,
+		Location:         c.Location,
+		Country:          c.Country,
+		ASN:              c.ASN,
+		ASOrg:            c.ASOrg,
+		Target:           c.Target,
+		Protocol:         c.Protocol,
+		BytesIn:          atomic.LoadInt64(&c.BytesIn),
+		BytesOut:         atomic.LoadInt64(&c.BytesOut),
+		StartedAt:        c.StartedAt,
+		EndedAt:          c.EndedAt,
+		Duration:         c.Duration,
+		Active:           c.Active,
+		ConnectLatencyMs: atomic.LoadInt64(&c.ConnectLatencyMs),
+		CloseReason:      c.CloseReason,
+		ClientCert:       c.ClientCert,
+		TLSVersion:       c.TLSVersion,
+		TLSCipher:        c.TLSCipher,
+		TLSALPN:          c.TLSALPN,
+		HTTPHost:         c.HTTPHost,
+		HTTPPath:         c.HTTPPath,
+		HTTPUpgrade:      upgrade,
+		Private:          c.Private,
+		Labels:           c.Labels,
+	}
+}
+
+// 规则启停原因，随 relay.state 事件推送；为空表示未知
+const (
+	ReasonManual    = "manual"    // 通过 API 手动启停、修改或删除规则
+	ReasonAutoStart = "autostart" // 开机自动启动
+	ReasonSchedule  = "schedule"  // 运行计划
+	ReasonQuota     = "quota"     // 流量配额用尽
+	ReasonReload    = "reload"    // 重新加载配置、导入或恢复备份
+	ReasonShutdown  = "shutdown"  // 进程退出
+	ReasonDrain     = "drain"     // 开始排空或恢复接受新连接，规则仍在运行
+)
+
+// RelayState 规则运行状态变化事件
+type RelayState struct {
+	RelayID   string    `json:"relay_id"`
+	RelayName string    `json:"relay_name"`
+	Running   bool      `json:"running"`
+	Draining  bool      `json:"draining"`
+	Reason    string    `json:"reason,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// broadcastState 推送 relay.state 事件，headless 模式下 broadcaster 为 nil
+func broadcastState(b Broadcaster, rule *model.RelayRule, running bool, reason string) {
+	if b == nil {
+		return
+	}
+	b.BroadcastToRelay(rule.ID, "relay.state", RelayState{
+		RelayID:   rule.ID,
+		RelayName: rule.Name,
+		Running:   running,
+		Reason:    reason,
+		Time:      time.Now(),
+	})
 }
 
 // Broadcaster 广播接口
@@ -43,35 +196,126 @@ type Broadcaster interface {
 
 // RelayInstance 单个转发实例
 type RelayInstance struct {
-	rule        *model.RelayRule
-	stopCh      chan struct{}
-	tcpListener net.Listener
-	udpConn     net.PacketConn
+	rule      *model.RelayRule
+	startedAt time.Time
+	stopCh    chan struct{}
+	mappings  []AddrMapping  // 监听地址 -> 目标地址（端口段展开后逐端口映射）
+	tlsConfig *tls.Config    // 非 nil 时 TCP 监听终止 TLS
+	proxy     *upstreamProxy // 非 nil 时 TCP 经 SOCKS5 代理连接目标
+	udpConns  []net.PacketConn
+
+	// TCP 监听与 mappings 逐项对应，排空时关闭、恢复时重新监听，tcpMu 保护以下字段与 draining 的切换
+	tcpMu        sync.Mutex
+	tcpListeners []net.Listener
+	tcpPickers   []*targetPicker
+	tcpClosed    []bool // 因排空而关闭的监听
+
+	// 需要在停止时等待的 goroutine（TCP 连接处理与 UDP 接收循环），停止后不再启动新的
+	spawnMu  sync.Mutex
+	stopping bool
+	wg       sync.WaitGroup
 
 	connections sync.Map // id -> *Connection (活跃连接)
 	connCount   int64
-	bytesIn     int64
-	bytesOut    int64
+	draining    int32    // 为 1 时不再接受新连接，已有连接照常转发；只在持有 tcpMu 时修改
+	targetStats sync.Map // 目标地址 -> *targetStat，负载均衡计数
+
+	perIPMu    sync.Mutex
+	perIPConns map[string]int // 客户端 IP -> 活跃 TCP 连接数，仅在设置了单 IP 连接上限时使用
+	bytesIn    int64
+	bytesOut   int64
+
+	// 规则级 TCP 限速，所有连接共享，未限速时为 nil
+	speedInLimiter  *byteLimiter
+	speedOutLimiter *byteLimiter
+
+	// 新建连接速率限制（TCP 连接与 UDP 新会话），未限制时为 nil
+	connRate *connRateLimiter
 
 	// 速度计算（EMA 平滑）
 	lastBytesIn    int64
 	lastBytesOut   int64
 	smoothSpeedIn  float64 // EMA 平滑后的入站速度
 	smoothSpeedOut float64 // EMA 平滑后的出站速度
+	// 最近一次计算的平滑速度 (bytes/s)，供 GetStatus 并发读取
+	speedIn  int64
+	speedOut int64
+
+	// 流量告警
+	alerts alertState
+
+	// 流量配额
+	quota   quotaState
+	manager *RelayManager // 配额用尽时用于停止自身
 
-	// 连接历史记录
-	historyMu sync.Mutex
-	history   []*Connection // 已断开的连接历史
+	pushInterval time.Duration // 状态推送间隔
+
+	errors *errorRing // 最近的错误记录
+
+	// 连接历史记录，historyMu 同时保证连接从活跃列表移入历史的过程对读取方是原子的
+	historyMu   sync.Mutex
+	history     *connHistory // 已断开的连接历史
+	historySize int          // 历史记录上限
+
+	// 开启 persist_history 时已断开的连接同时写入数据库，historySaved 为写入条数
+	historyPersist bool
+	historySaved   int64
 
 	broadcaster Broadcaster
 	geoIP       *GeoIPService
+	geoWarnOnce sync.Once // GeoIP 未加载时仅提示一次
+}
+
+const (
+	defaultHistorySize = 100   // 默认保留的历史记录条数
+	MaxHistorySize     = 10000 // history_size 允许的最大值
+)
+
+// loadHistorySize 读取 history_size 设置
+func loadHistorySize() int {
+	value, err := model.GetSetting("history_size")
+	if err != nil || value == "" {
+		return defaultHistorySize
+	}
+	size, err := strconv.Atoi(value)
+	if err != nil || size < 0 {
+		return defaultHistorySize
+	}
+	if size > MaxHistorySize {
+		return MaxHistorySize
+	}
+	return size
 }
 
-const maxHistorySize = 100 // 保留最多100条历史记录
+const (
+	defaultPushInterval = time.Second            // 默认状态推送间隔
+	MinPushInterval     = 250 * time.Millisecond // 最小状态推送间隔
+)
+
+// loadPushInterval 读取 ws_push_interval_ms 设置
+func loadPushInterval() time.Duration {
+	value, err := model.GetSetting("ws_push_interval_ms")
+	if err != nil || value == "" {
+		return defaultPushInterval
+	}
+	ms, err := strconv.Atoi(value)
+	if err != nil {
+		return defaultPushInterval
+	}
+	if interval := time.Duration(ms) * time.Millisecond; interval > MinPushInterval {
+		return interval
+	}
+	return MinPushInterval
+}
 
 // RelayManager 转发管理器
 type RelayManager struct {
-	instances sync.Map // id -> *RelayInstance
+	instances    sync.Map // id -> *RelayInstance
+	manualStops  sync.Map // id -> struct{}，运行窗口内被手动停止的规则
+	scheduledOff sync.Map // id -> bool，当前处于计划停止时段的规则
+	restarts     sync.Map // id -> *int64，规则的重启次数，停止后保留
+	errors       sync.Map // id -> *errorRing，规则最近的错误，停止后保留
+	lifetime     lifetimeCache
 }
 
 // NewRelayManager 创建管理器
@@ -79,8 +323,8 @@ func NewRelayManager() *RelayManager {
 	return &RelayManager{}
 }
 
-// Start 启动转发
-func (m *RelayManager) Start(rule *model.RelayRule, broadcaster Broadcaster, geoIP *GeoIPService) error {
+// Start 启动转发，reason 为启动原因
+func (m *RelayManager) Start(rule *model.RelayRule, broadcaster Broadcaster, geoIP *GeoIPService, reason string) error {
 	log.Printf("[RelayMgr] Start 调用: id=%s, name=%s, src=%s, dst=%s, protocol=%s",
 		rule.ID, rule.Name, rule.Src, rule.Dst, rule.Protocol)
 
@@ -88,20 +332,61 @@ func (m *RelayManager) Start(rule *model.RelayRule, broadcaster Broadcaster, geo
 		log.Printf("[RelayMgr] 规则已在运行: %s", rule.ID)
 		return fmt.Errorf("规则已在运行")
 	}
+	if !ScheduleActive(rule, time.Now()) {
+		return fmt.Errorf("当前不在规则的运行计划时间内")
+	}
+	m.manualStops.Delete(rule.ID)
 
+	historySize := loadHistorySize()
 	instance := &RelayInstance{
-		rule:        rule,
-		stopCh:      make(chan struct{}),
-		broadcaster: broadcaster,
-		geoIP:       geoIP,
+		rule:           rule,
+		stopCh:         make(chan struct{}),
+		broadcaster:    broadcaster,
+		geoIP:          geoIP,
+		pushInterval:   loadPushInterval(),
+		historySize:    historySize,
+		history:        newConnHistory(historySize),
+		historyPersist: loadPersistHistory(),
+		perIPConns:     make(map[string]int),
+		manager:        m,
+		errors:         m.errorRing(rule.ID),
+
+		speedInLimiter:  newByteLimiter(rule.SpeedLimit),
+		speedOutLimiter: newByteLimiter(rule.SpeedLimit),
+	}
+	instance.connRate = newConnRateLimiter(rule.MaxNewConnectionsPerSec, instance.logRateLimited)
+
+	mappings, err := ExpandMappings(rule.Src, rule.Dst)
+	if err != nil {
+		return err
+	}
+	if err := m.checkListenerLimit(rule, mappings); err != nil {
+		return err
+	}
+	if err := instance.initQuotaState(); err != nil {
+		return err
+	}
+	if instance.tlsConfig, err = LoadTLSConfig(rule); err != nil {
+		return err
+	}
+	if instance.proxy, err = newUpstreamProxy(rule.UpstreamProxy); err != nil {
+		return err
+	}
+	instance.mappings = mappings
+	if instance.historyPersist {
+		instance.restoreHistory()
 	}
 
 	// 启动 TCP
 	if rule.Protocol == "tcp" || rule.Protocol == "both" {
 		log.Printf("[RelayMgr] 启动 TCP 监听: %s", rule.Src)
-		if err := instance.startTCP(); err != nil {
-			log.Printf("[RelayMgr] TCP 启动失败: %v", err)
-			return fmt.Errorf("TCP 启动失败: %v", err)
+		for _, m := range mappings {
+			if err := instance.startTCP(m); err != nil {
+				instance.closeListeners()
+				instance.errors.add(PhaseListen, err)
+				log.Printf("[RelayMgr] TCP 启动失败: %v", err)
+				return fmt.Errorf("TCP 启动失败: %s", DescribeListenError(err))
+			}
 		}
 		log.Printf("[RelayMgr] TCP 监听成功: %s", rule.Src)
 	}
@@ -109,47 +394,68 @@ func (m *RelayManager) Start(rule *model.RelayRule, broadcaster Broadcaster, geo
 	// 启动 UDP
 	if rule.Protocol == "udp" || rule.Protocol == "both" {
 		log.Printf("[RelayMgr] 启动 UDP 监听: %s", rule.Src)
-		if err := instance.startUDP(); err != nil {
-			if instance.tcpListener != nil {
-				instance.tcpListener.Close()
+		for i, m := range mappings {
+			// 协议为 both 时 TCP 已逐映射启动，端口 0 的 UDP 沿用 TCP 分到的端口，保证两者一致
+			if rule.Protocol == "both" {
+				m.Src = sameEphemeralPort(m.Src, instance.tcpListeners[i].Addr())
+			}
+			if err := instance.startUDP(m); err != nil {
+				instance.closeListeners()
+				instance.errors.add(PhaseListen, err)
+				log.Printf("[RelayMgr] UDP 启动失败: %v", err)
+				return fmt.Errorf("UDP 启动失败: %s", DescribeListenError(err))
 			}
-			log.Printf("[RelayMgr] UDP 启动失败: %v", err)
-			return fmt.Errorf("UDP 启动失败: %v", err)
 		}
 		log.Printf("[RelayMgr] UDP 监听成功: %s", rule.Src)
 	}
 
+	instance.startedAt = time.Now()
 	m.instances.Store(rule.ID, instance)
+	instance.initAlertState()
+
+	// 首次启动登记计数器，之后每次成功启动记为一次重启
+	if v, started := m.restarts.LoadOrStore(rule.ID, new(int64)); started {
+		atomic.AddInt64(v.(*int64), 1)
+	}
 
 	// 启动状态推送
 	go instance.pushStatus()
+	broadcastState(broadcaster, rule, true, reason)
 
 	log.Printf("[RelayMgr] 转发启动完成: %s (%s -> %s)", rule.Name, rule.Src, rule.Dst)
 	return nil
 }
 
-// Stop 停止转发
-func (m *RelayManager) Stop(id string) {
-	if v, ok := m.instances.Load(id); ok {
+// stopWaitTimeout 停止规则时等待活跃连接结束并写入统计的最长时间
+const stopWaitTimeout = 5 * time.Second
+
+// Stop 停止转发，reason 为停止原因
+// 活跃连接会被关闭，并在返回前等待它们写入断开日志与流量统计
+func (m *RelayManager) Stop(id, reason string) {
+	// LoadAndDelete 保证并发调用时只关闭一次（配额用尽时实例会自行停止）
+	if v, ok := m.instances.LoadAndDelete(id); ok {
 		instance := v.(*RelayInstance)
-		close(instance.stopCh)
-		if instance.tcpListener != nil {
-			instance.tcpListener.Close()
-		}
-		if instance.udpConn != nil {
-			instance.udpConn.Close()
+		instance.closeListeners()
+		if !instance.waitConnections(stopWaitTimeout) {
+			log.Printf("[RelayMgr] 等待连接结束超时: %s", id)
 		}
-		m.instances.Delete(id)
 		log.Printf("转发停止: %s", id)
+		broadcastState(instance.broadcaster, instance.rule, false, reason)
 	}
 }
 
-// StopAll 停止所有
-func (m *RelayManager) StopAll() {
+// StopAll 停止所有，各规则并行停止
+func (m *RelayManager) StopAll(reason string) {
+	var wg sync.WaitGroup
 	m.instances.Range(func(key, value interface{}) bool {
-		m.Stop(key.(string))
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			m.Stop(id, reason)
+		}(key.(string))
 		return true
 	})
+	wg.Wait()
 }
 
 // IsRunning 检查是否运行
@@ -158,18 +464,109 @@ func (m *RelayManager) IsRunning(id string) bool {
 	return ok
 }
 
+// SetDraining 设置运行中规则的排空状态，规则未运行时返回错误
+// 排空时关闭 TCP 监听，新连接被系统拒绝；UDP 监听需要继续为已有会话回包，只是不再为新客户端建立会话。
+// 反向模式关闭监听会断开控制连接上的全部流，因此仍接受新流后立即关闭。
+// 已有连接与会话照常转发直到结束，状态变化通过 relay.state 事件推送
+func (m *RelayManager) SetDraining(id string, draining bool) error {
+	v, ok := m.instances.Load(id)
+	if !ok {
+		return fmt.Errorf("规则未运行")
+	}
+	instance := v.(*RelayInstance)
+	changed, err := instance.setDraining(draining)
+	if err != nil {
+		return err
+	}
+	if changed {
+		log.Printf("[RelayMgr] 规则%s排空: %s, 活跃连接 %d", map[bool]string{true: "开始", false: "结束"}[draining],
+			instance.rule.Name, atomic.LoadInt64(&instance.connCount))
+		if b := instance.broadcaster; b != nil {
+			b.BroadcastToRelay(id, "relay.state", RelayState{
+				RelayID:   id,
+				RelayName: instance.rule.Name,
+				Running:   true,
+				Draining:  draining,
+				Reason:    ReasonDrain,
+				Time:      time.Now(),
+			})
+		}
+	}
+	return nil
+}
+
+// IsDraining 规则是否正在运行且处于排空状态
+func (m *RelayManager) IsDraining(id string) bool {
+	if v, ok := m.instances.Load(id); ok {
+		return atomic.LoadInt32(&v.(*RelayInstance).draining) == 1
+	}
+	return false
+}
+
+// RunningRule 返回运行中实例使用的规则快照
+func (m *RelayManager) RunningRule(id string) (*model.RelayRule, bool) {
+	if v, ok := m.instances.Load(id); ok {
+		return v.(*RelayInstance).rule, true
+	}
+	return nil, false
+}
+
+// RunningIDs 返回所有运行中规则的 ID
+func (m *RelayManager) RunningIDs() []string {
+	var ids []string
+	m.instances.Range(func(key, value interface{}) bool {
+		ids = append(ids, key.(string))
+		return true
+	})
+	return ids
+}
+
 // GetStatus 获取状态
 func (m *RelayManager) GetStatus(id string) RelayStatus {
+	status := m.runtimeStatus(id)
+	total := m.lifetime.get(id)
+	status.LifetimeBytesIn = total.BytesIn
+	status.LifetimeBytesOut = total.BytesOut
+	status.LifetimeConnections = total.Connections
+	return status
+}
+
+// runtimeStatus 返回规则的运行状态，不含累计统计
+func (m *RelayManager) runtimeStatus(id string) RelayStatus {
 	if v, ok := m.instances.Load(id); ok {
 		instance := v.(*RelayInstance)
-		return RelayStatus{
+		status := RelayStatus{
 			Running:     true,
 			Connections: atomic.LoadInt64(&instance.connCount),
 			BytesIn:     atomic.LoadInt64(&instance.bytesIn),
 			BytesOut:    atomic.LoadInt64(&instance.bytesOut),
+			SpeedIn:     atomic.LoadInt64(&instance.speedIn),
+			SpeedOut:    atomic.LoadInt64(&instance.speedOut),
+			Draining:    atomic.LoadInt32(&instance.draining) == 1,
+
+			UptimeSeconds: int64(time.Since(instance.startedAt).Seconds()),
+			RestartCount:  m.restartCount(id),
 		}
+		status.LastError, status.ErrorCount = instance.errors.last()
+		status.Targets = instance.targetStatus()
+		status.ListenAddrs = instance.boundAddrs()
+		status.Reverse = instance.reverseStatus()
+		return status
+	}
+	_, off := m.scheduledOff.Load(id)
+	status := RelayStatus{Running: false, ScheduledOff: off, RestartCount: m.restartCount(id)}
+	if v, ok := m.errors.Load(id); ok {
+		status.LastError, status.ErrorCount = v.(*errorRing).last()
 	}
-	return RelayStatus{Running: false}
+	return status
+}
+
+// restartCount 返回规则的重启次数
+func (m *RelayManager) restartCount(id string) int64 {
+	if v, ok := m.restarts.Load(id); ok {
+		return atomic.LoadInt64(v.(*int64))
+	}
+	return 0
 }
 
 // GetAllStatus 获取所有状态
@@ -193,15 +590,53 @@ func (m *RelayManager) ActiveCount() int {
 	return count
 }
 
+// TotalConnections 所有运行中规则的活跃连接数之和
+func (m *RelayManager) TotalConnections() int64 {
+	var total int64
+	m.instances.Range(func(key, value interface{}) bool {
+		total += atomic.LoadInt64(&value.(*RelayInstance).connCount)
+		return true
+	})
+	return total
+}
+
+// LiveOverview 运行中规则的实时汇总，由内存中的计数得出，不查询数据库
+type LiveOverview struct {
+	ActiveRelays      int   `json:"active_relays"`
+	ActiveConnections int64 `json:"active_connections"`
+	// 各规则本次运行的流量之和，规则重启后清零
+	BytesIn  int64 `json:"bytes_in"`
+	BytesOut int64 `json:"bytes_out"`
+	// 各规则平滑后的当前速度之和 (bytes/s)
+	SpeedIn  int64 `json:"bytes_in_speed"`
+	SpeedOut int64 `json:"bytes_out_speed"`
+}
+
+// LiveOverview 汇总所有运行中规则的实时状态
+func (m *RelayManager) LiveOverview() LiveOverview {
+	var o LiveOverview
+	m.instances.Range(func(_, value interface{}) bool {
+		instance := value.(*RelayInstance)
+		o.ActiveRelays++
+		o.ActiveConnections += atomic.LoadInt64(&instance.connCount)
+		o.BytesIn += atomic.LoadInt64(&instance.bytesIn)
+		o.BytesOut += atomic.LoadInt64(&instance.bytesOut)
+		o.SpeedIn += atomic.LoadInt64(&instance.speedIn)
+		o.SpeedOut += atomic.LoadInt64(&instance.speedOut)
+		return true
+	})
+	return o
+}
+
 // GetConnections 获取连接列表
 func (m *RelayManager) GetConnections(id string) []Connection {
 	if v, ok := m.instances.Load(id); ok {
 		instance := v.(*RelayInstance)
 		var conns []Connection
 		instance.connections.Range(func(key, value interface{}) bool {
-			conn := value.(*Connection)
-			conn.Duration = int64(time.Since(conn.StartedAt).Seconds())
-			conns = append(conns, *conn)
+			c := value.(*Connection).snapshot()
+			c.Duration = int64(time.Since(c.StartedAt).Seconds())
+			conns = append(conns, c)
 			return true
 		})
 		return conns
@@ -209,189 +644,691 @@ func (m *RelayManager) GetConnections(id string) []Connection {
 	return nil
 }
 
+// GetHistory 分页获取已断开的连接历史（最新的在前），返回当前页和总数
+func (m *RelayManager) GetHistory(id string, page, size int) ([]Connection, int) {
+	v, ok := m.instances.Load(id)
+	if !ok {
+		return nil, 0
+	}
+	instance := v.(*RelayInstance)
+	instance.historyMu.Lock()
+	defer instance.historyMu.Unlock()
+
+	total := instance.history.len()
+	start := (page - 1) * size
+	if start >= total {
+		return []Connection{}, total
+	}
+	end := start + size
+	if end > total {
+		end = total
+	}
+	conns := make([]Connection, 0, end-start)
+	for i := start; i < end; i++ {
+		conns = append(conns, *instance.history.at(i))
+	}
+	return conns, total
+}
+
 // ==================== RelayInstance ====================
 
 // countingWriter 包装 io.Writer，实时统计写入字节数
+// 每次写入以增量累加到连接和规则两级计数器，两个方向分别使用不同的计数器
 type countingWriter struct {
-	w       io.Writer
-	counter *int64      // 连接级别计数器
-	total   *int64      // 全局计数器
-	connRef *Connection // 连接引用，用于实时更新
-	isIn    bool        // true=入站, false=出站
+	w     io.Writer
+	conn  *int64 // 连接级别计数器 (Connection.BytesIn/BytesOut)
+	total *int64 // 规则级别计数器
+	err   error  // 写入错误，用于区分 io.Copy 的错误来自读端还是写端
 }
 
 func (cw *countingWriter) Write(p []byte) (int, error) {
 	n, err := cw.w.Write(p)
 	if n > 0 {
-		atomic.AddInt64(cw.counter, int64(n))
+		atomic.AddInt64(cw.conn, int64(n))
 		atomic.AddInt64(cw.total, int64(n))
-		// 实时更新连接的字节数
-		if cw.isIn {
-			atomic.StoreInt64(&cw.connRef.BytesIn, atomic.LoadInt64(cw.counter))
+	}
+	if err != nil {
+		cw.err = err
+	}
+	return n, err
+}
+
+// tcpCopyResult 单个转发方向的结束状态
+type tcpCopyResult struct {
+	fromClient bool  // true 为 client -> upstream 方向
+	err        error // 正常 EOF 时为 nil
+	writeErr   bool  // 错误发生在写端
+}
+
+// closeReason 根据先结束的方向判断断开原因
+// 先结束的方向读到 EOF 视为对应一端正常关闭；出错时按出错的一端标记
+func closeReason(first tcpCopyResult) string {
+	if first.err == nil {
+		if first.fromClient {
+			return "client_closed"
+		}
+		return "upstream_closed"
+	}
+	// client -> upstream 方向读端为客户端、写端为上游，反向相反
+	side := "upstream"
+	if first.fromClient != first.writeErr {
+		side = "client"
+	}
+	msg := first.err.Error()
+	var errno syscall.Errno
+	if errors.As(first.err, &errno) {
+		msg = errno.Error()
+	}
+	return side + "_error: " + msg
+}
+
+// sameEphemeralPort src 的端口为 0 时替换为 TCP 监听实际分配的端口，否则原样返回
+func sameEphemeralPort(src string, tcpAddr net.Addr) string {
+	host, port, err := net.SplitHostPort(src)
+	if err != nil || port != "0" {
+		return src
+	}
+	if a, ok := tcpAddr.(*net.TCPAddr); ok {
+		return net.JoinHostPort(host, strconv.Itoa(a.Port))
+	}
+	return src
+}
+
+// boundAddrs 返回监听实际绑定的地址，与配置的 src 可能不同（如端口 0 分配的端口）
+// 排空期间关闭的监听仍返回原地址，恢复时会重新绑定到同一地址
+func (r *RelayInstance) boundAddrs() []BoundAddr {
+	r.tcpMu.Lock()
+	defer r.tcpMu.Unlock()
+	addrs := make([]BoundAddr, 0, len(r.tcpListeners)+len(r.udpConns))
+	for i, ln := range r.tcpListeners {
+		// 反向模式的监听在服务端上，见 reverseStatus
+		if _, ok := ln.(*reverseListener); ok {
+			continue
+		}
+		addr := ln.Addr()
+		// Linux 上 TCP 监听的本地地址不带区域标识，按配置的监听地址补上
+		if a, ok := addr.(*net.TCPAddr); ok && a.Zone == "" && a.IP.IsLinkLocalUnicast() {
+			if host, _, err := net.SplitHostPort(r.mappings[i].Src); err == nil {
+				_, zone := model.ParseIPZone(host)
+				addr = &net.TCPAddr{IP: a.IP, Port: a.Port, Zone: zone}
+			}
+		}
+		addrs = append(addrs, BoundAddr{Network: "tcp", Addr: addr.String()})
+	}
+	for _, pc := range r.udpConns {
+		addrs = append(addrs, BoundAddr{Network: "udp", Addr: pc.LocalAddr().String()})
+	}
+	return addrs
+}
+
+// reverseStatus 反向模式规则的控制连接状态，非反向模式时返回 nil
+func (r *RelayInstance) reverseStatus() *ReverseStatus {
+	r.tcpMu.Lock()
+	defer r.tcpMu.Unlock()
+	for _, ln := range r.tcpListeners {
+		if rl, ok := ln.(*reverseListener); ok {
+			return rl.status()
+		}
+	}
+	return nil
+}
+
+// closeListeners 通知所有 goroutine 退出，关闭全部监听与活跃的 TCP 连接
+func (r *RelayInstance) closeListeners() {
+	r.spawnMu.Lock()
+	r.stopping = true
+	r.spawnMu.Unlock()
+
+	close(r.stopCh)
+	r.tcpMu.Lock()
+	for _, ln := range r.tcpListeners {
+		ln.Close()
+	}
+	r.tcpMu.Unlock()
+	for _, pc := range r.udpConns {
+		pc.Close()
+	}
+	// 此后登记的连接会在 handleTCP 中检查 stopCh 并自行关闭
+	r.connections.Range(func(key, value interface{}) bool {
+		if c := value.(*Connection); c.closeFn != nil {
+			c.closeFn()
+		}
+		return true
+	})
+}
+
+// spawn 启动一个停止时需要等待的 goroutine，实例已停止时不启动并返回 false
+func (r *RelayInstance) spawn(fn func()) bool {
+	r.spawnMu.Lock()
+	defer r.spawnMu.Unlock()
+	if r.stopping {
+		return false
+	}
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		fn()
+	}()
+	return true
+}
+
+// waitConnections 等待 spawn 启动的 goroutine 全部退出，超时返回 false
+func (r *RelayInstance) waitConnections(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// stopped 规则是否已停止
+func (r *RelayInstance) stopped() bool {
+	select {
+	case <-r.stopCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// ListenConfig 返回规则监听使用的配置，透明模式下监听 socket 需要设置 IP_TRANSPARENT
+func ListenConfig(rule *model.RelayRule) net.ListenConfig {
+	if rule.Transparent {
+		return net.ListenConfig{Control: transparentControl}
+	}
+	return net.ListenConfig{}
+}
+
+// dialUpstream 连接目标地址，透明模式下以客户端 IP 作为源地址，设置了上游代理时 TCP 经代理连接
+func (r *RelayInstance) dialUpstream(network, dst, clientIP string) (net.Conn, error) {
+	if r.proxy != nil && network == "tcp" {
+		conn, err := r.proxy.dial(dst)
+		if err != nil || !r.rule.UpstreamTLS {
+			return conn, err
+		}
+		return upstreamTLSClient(conn, dst)
+	}
+	d := net.Dialer{Timeout: DialTimeout}
+	if r.rule.Transparent {
+		ip, zone := model.ParseIPZone(clientIP)
+		if network == "udp" {
+			d.LocalAddr = &net.UDPAddr{IP: ip, Zone: zone}
 		} else {
-			atomic.StoreInt64(&cw.connRef.BytesOut, atomic.LoadInt64(cw.counter))
+			d.LocalAddr = &net.TCPAddr{IP: ip, Zone: zone}
 		}
+		d.Control = transparentControl
 	}
-	return n, err
+	conn, err := d.Dial(network, dst)
+	if err != nil || network != "tcp" || !r.rule.UpstreamTLS {
+		return conn, err
+	}
+	return upstreamTLSClient(conn, dst)
 }
 
-func (r *RelayInstance) startTCP() error {
-	ln, err := net.Listen("tcp", r.rule.Src)
+func (r *RelayInstance) startTCP(m AddrMapping) error {
+	ln, err := r.listenTCP(m.Src)
 	if err != nil {
 		return err
 	}
-	r.tcpListener = ln
+	picker := r.newTargetPicker(m.Targets)
+	r.tcpListeners = append(r.tcpListeners, ln)
+	r.tcpPickers = append(r.tcpPickers, picker)
+	r.tcpClosed = append(r.tcpClosed, false)
+	go r.acceptTCP(ln, picker)
+	return nil
+}
 
-	go func() {
-		for {
+// listenTCP 建立 src 上的 TCP 监听
+func (r *RelayInstance) listenTCP(src string) (net.Listener, error) {
+	if r.rule.IsReverse() {
+		// 反向模式连接服务端，由服务端监听 src，转入的流与普通 TCP 连接一样处理
+		return newReverseListener(r.rule.ReverseServer, r.rule.ReverseSecret, src, func(err error) {
+			r.errors.add(PhaseReverse, err)
+		}), nil
+	}
+	// 优先使用 systemd socket activation 传入的 socket
+	ln, err := activatedListener(r.rule, src)
+	if err != nil || ln != nil {
+		return ln, err
+	}
+	lc := ListenConfig(r.rule)
+	return lc.Listen(context.Background(), r.rule.ListenNetworkFor("tcp", src), src)
+}
+
+// acceptTCP 接受连接直到监听关闭（规则停止或开始排空）
+func (r *RelayInstance) acceptTCP(ln net.Listener, picker *targetPicker) {
+	if r.tlsConfig != nil {
+		ln = tls.NewListener(ln, r.tlsConfig)
+	}
+	var delay time.Duration // Accept 出错后的退避时间，与 net/http 一致
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
 			select {
 			case <-r.stopCh:
+				// 停止时关闭监听导致的错误
 				return
 			default:
-				conn, err := ln.Accept()
-				if err != nil {
-					select {
-					case <-r.stopCh:
-						return
-					default:
-						continue
-					}
-				}
-				go r.handleTCP(conn)
 			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else {
+				delay *= 2
+			}
+			if delay > time.Second {
+				delay = time.Second
+			}
+			log.Printf("[Relay] Accept 失败: rule=%s, err=%v; %v 后重试", r.rule.Name, err, delay)
+			r.errors.add(PhaseListen, err)
+			select {
+			case <-time.After(delay):
+			case <-r.stopCh:
+				return
+			}
+			continue
 		}
-	}()
+		delay = 0
+		if !r.allowNewConn(conn.RemoteAddr().String()) {
+			conn.Close()
+			continue
+		}
+		if !r.spawn(func() { r.handleTCP(conn, picker) }) {
+			conn.Close()
+			return
+		}
+	}
+}
 
-	return nil
+// setDraining 切换排空状态并关闭或重新建立 TCP 监听，返回状态是否改变
+// 重新监听失败时保持排空，已恢复的监听照常运行，未恢复的留待下次重试
+func (r *RelayInstance) setDraining(draining bool) (bool, error) {
+	r.tcpMu.Lock()
+	defer r.tcpMu.Unlock()
+	if r.stopped() {
+		return false, fmt.Errorf("规则未运行")
+	}
+	if (atomic.LoadInt32(&r.draining) == 1) == draining {
+		return false, nil
+	}
+
+	if draining {
+		atomic.StoreInt32(&r.draining, 1)
+		for i, ln := range r.tcpListeners {
+			if _, ok := ln.(*reverseListener); ok {
+				continue
+			}
+			ln.Close()
+			r.tcpClosed[i] = true
+		}
+		return true, nil
+	}
+
+	for i, ln := range r.tcpListeners {
+		if !r.tcpClosed[i] {
+			continue
+		}
+		// 端口 0 时沿用之前分配的端口，保证地址不变
+		src := sameEphemeralPort(r.mappings[i].Src, ln.Addr())
+		newLn, err := r.listenTCP(src)
+		if err != nil {
+			r.errors.add(PhaseListen, err)
+			return false, fmt.Errorf("恢复监听 %s 失败: %s", src, DescribeListenError(err))
+		}
+		r.tcpListeners[i] = newLn
+		r.tcpClosed[i] = false
+		go r.acceptTCP(newLn, r.tcpPickers[i])
+	}
+	atomic.StoreInt32(&r.draining, 0)
+	return true, nil
+}
+
+// saveAccessLog 写入访问日志并附上规则的标签，规则关闭连接日志时丢弃 connect/disconnect
+func (r *RelayInstance) saveAccessLog(l *model.AccessLog) {
+	if !r.rule.LogConnections && (l.Action == "connect" || l.Action == "disconnect") {
+		return
+	}
+	l.Labels = r.rule.Labels
+	model.SaveAccessLog(l)
+}
+
+// allowNewConn 检查规则是否在排空以及新建连接速率，clientAddr 为 host:port 形式的客户端地址
+func (r *RelayInstance) allowNewConn(clientAddr string) bool {
+	if atomic.LoadInt32(&r.draining) == 1 {
+		return false
+	}
+	if r.connRate == nil {
+		return true
+	}
+	clientIP, _, err := net.SplitHostPort(clientAddr)
+	if err != nil {
+		clientIP = clientAddr
+	}
+	return r.connRate.allow(clientIP)
 }
 
-func (r *RelayInstance) handleTCP(client net.Conn) {
+// logRateLimited 汇总记录一个周期内因新建连接速率超限被拒绝的连接
+func (r *RelayInstance) logRateLimited(total int64, perIP map[string]int64) {
+	log.Printf("[Relay] 新建连接速率超限: rule=%s, limit=%d/s, 拒绝 %d 个连接（%d 个客户端 IP）",
+		r.rule.Name, r.rule.MaxNewConnectionsPerSec, total, len(perIP))
+	for ip, n := range perIP {
+		r.saveAccessLog(&model.AccessLog{RelayID: r.rule.ID, ClientIP: ip, Action: "rate_limited",
+			Detail: fmt.Sprintf("拒绝 %d 个连接", n), Private: isPrivateClient(ip)})
+	}
+}
+
+func (r *RelayInstance) handleTCP(client net.Conn, picker *targetPicker) {
 	defer client.Close()
 
+	clientAddr := client.RemoteAddr().String()
+	clientIP, _, _ := net.SplitHostPort(clientAddr)
+	private := isPrivateClient(clientIP)
+	target := picker.next(clientIP)
+	dst := target.addr
+
+	// 国家访问控制
+	if allowed, country := r.checkCountry(clientIP); !allowed {
+		log.Printf("[GeoIP] 拒绝连接: rule=%s, client=%s, country=%s", r.rule.Name, clientIP, country)
+		r.saveAccessLog(&model.AccessLog{RelayID: r.rule.ID, ClientIP: clientIP, Action: "geo_denied", Detail: country, Country: country, Private: private})
+		return
+	}
+
+	// 单 IP 并发连接数限制
+	if !r.acquirePerIP(clientIP) {
+		log.Printf("[Relay] 超过单 IP 连接上限: rule=%s, client=%s, limit=%d", r.rule.Name, clientIP, r.rule.MaxConnectionsPerIP)
+		r.saveAccessLog(&model.AccessLog{RelayID: r.rule.ID, ClientIP: clientIP, Action: "per_ip_limit", Private: private})
+		return
+	}
+	defer r.releasePerIP(clientIP)
+
+	// TLS 规则先完成握手，得到协商结果与 mTLS 时已校验的客户端证书标识
+	tlsState, err := tlsHandshake(client)
+	if err != nil {
+		log.Printf("[TLS] 握手失败: rule=%s, client=%s, err=%v", r.rule.Name, clientIP, err)
+		r.errors.add(PhaseTLS, err)
+		r.saveAccessLog(&model.AccessLog{RelayID: r.rule.ID, ClientIP: clientIP, Action: "tls_denied", Detail: err.Error(), Private: private})
+		return
+	}
+
 	// 连接到目标
-	remote, err := net.DialTimeout("tcp", r.rule.Dst, 5*time.Second)
+	dialStart := time.Now()
+	remote, err := r.dialUpstream("tcp", dst, clientIP)
 	if err != nil {
-		log.Printf("连接目标失败: %v", err)
+		if r.proxy != nil {
+			log.Printf("[Proxy] %v", err)
+			r.errors.add(PhaseProxy, err)
+		} else {
+			log.Printf("连接目标失败: %v", err)
+			r.errors.add(PhaseDial, err)
+		}
+		target.stat.markDown()
+		r.saveAccessLog(&model.AccessLog{RelayID: r.rule.ID, ClientIP: clientIP, Action: "failed", Detail: err.Error(), Private: private})
 		return
 	}
 	defer remote.Close()
+	latency := time.Since(dialStart).Milliseconds()
+	target.stat.acquire()
+	defer target.stat.release()
+
+	// HTTP 感知模式预读首个请求头，预读的数据随后原样转发；
+	// 先连接目标，服务端先发言的协议不必等待预读超时
+	var clientReader, remoteReader io.Reader = client, remote
+	var httpInfo *httpRequestInfo
+	if r.rule.HTTPAware {
+		clientReader, remoteReader, httpInfo = sniffHTTPRequest(client, remote)
+	}
 
 	// 记录连接
 	connID := uuid.New().String()
-	clientAddr := client.RemoteAddr().String()
-	clientIP, _, _ := net.SplitHostPort(clientAddr)
 
-	location := ""
+	location, country := "", ""
+	var asn uint
+	var asOrg string
 	if r.geoIP != nil {
 		location = r.geoIP.Lookup(clientIP)
+		country = r.geoIP.LookupCountryCode(clientIP)
+		asn, asOrg = r.geoIP.LookupASN(clientIP)
 	}
 
 	connInfo := &Connection{
 		ID:        connID,
 		ClientIP:  clientIP,
 		Location:  location,
-		Target:    r.rule.Dst,
+		Country:   country,
+		ASN:       asn,
+		ASOrg:     asOrg,
+		Target:    dst,
 		Protocol:  "tcp",
 		StartedAt: time.Now(),
 		Active:    true,
+		Labels:    r.rule.Labels,
+
+		ConnectLatencyMs: latency,
+		ClientCert:       tlsState.clientCert,
+		TLSVersion:       tlsState.version,
+		TLSCipher:        tlsState.cipher,
+		TLSALPN:          tlsState.alpn,
+		Private:          private,
+
+		closeFn: func() {
+			client.Close()
+			remote.Close()
+		},
+	}
+	var httpDetail string
+	if httpInfo != nil {
+		connInfo.HTTPHost = httpInfo.Host
+		connInfo.HTTPPath = httpInfo.Path
+		connInfo.upgradeRequested = httpInfo.Upgrade
+		httpDetail = httpInfo.String()
 	}
 	r.connections.Store(connID, connInfo)
 	atomic.AddInt64(&r.connCount, 1)
+	// 登记前规则已开始停止时，closeListeners 可能没有看到这个连接
+	if r.stopped() {
+		connInfo.closeFn()
+	}
 
 	// 记录日志
-	model.SaveAccessLog(r.rule.ID, clientIP, "connect", 0, 0, 0)
+	r.saveAccessLog(&model.AccessLog{RelayID: r.rule.ID, ClientIP: clientIP, Action: "connect", Detail: httpDetail, Country: country, ASN: asn, ASOrg: asOrg, LatencyMs: latency, ClientCert: tlsState.clientCert, TLSVersion: tlsState.version, TLSCipher: tlsState.cipher, TLSALPN: tlsState.alpn, Private: private})
 
 	// 双向复制（使用 countingWriter 实时统计）
-	var bytesIn, bytesOut int64
-	done := make(chan struct{}, 2)
+	done := make(chan tcpCopyResult, 2)
 
 	// 入站：client -> remote
 	go func() {
-		cw := &countingWriter{
-			w:       remote,
-			counter: &bytesIn,
-			total:   &r.bytesIn,
-			connRef: connInfo,
-			isIn:    true,
-		}
-		io.Copy(cw, client)
+		cw := &countingWriter{w: remote, conn: &connInfo.BytesIn, total: &r.bytesIn}
+		src := newLimitedReader(clientReader, newByteLimiter(r.rule.ConnSpeedLimit), r.speedInLimiter)
+		_, err := io.Copy(cw, src)
 		// 关闭写入方向，通知对方结束
-		if tc, ok := remote.(*net.TCPConn); ok {
+		if tc, ok := remote.(interface{ CloseWrite() error }); ok {
 			tc.CloseWrite()
 		}
-		done <- struct{}{}
+		done <- tcpCopyResult{fromClient: true, err: err, writeErr: err != nil && err == cw.err}
 	}()
 
 	// 出站：remote -> client
 	go func() {
-		cw := &countingWriter{
-			w:       client,
-			counter: &bytesOut,
-			total:   &r.bytesOut,
-			connRef: connInfo,
-			isIn:    false,
+		cw := &countingWriter{w: client, conn: &connInfo.BytesOut, total: &r.bytesOut}
+		if connInfo.upgradeRequested != "" {
+			// 请求了协议升级时检查上游响应，升级后的连接不设超时，直到任一端关闭
+			br := bufio.NewReaderSize(remote, maxHTTPHeadSize)
+			if sniffSwitchingProtocols(br) {
+				atomic.StoreInt32(&connInfo.upgraded, 1)
+			}
+			remoteReader = br
 		}
-		io.Copy(cw, remote)
-		// 关闭写入方向，通知对方结束
-		if tc, ok := client.(*net.TCPConn); ok {
+		src := newLimitedReader(remoteReader, newByteLimiter(r.rule.ConnSpeedLimit), r.speedOutLimiter)
+		_, err := io.Copy(cw, src)
+		// 关闭写入方向，通知对方结束（TLS 连接会先发送 close_notify）
+		if tc, ok := client.(interface{ CloseWrite() error }); ok {
 			tc.CloseWrite()
 		}
-		done <- struct{}{}
+		done <- tcpCopyResult{fromClient: false, err: err, writeErr: err != nil && err == cw.err}
 	}()
 
-	// 等待两个方向都完成
-	<-done
+	// 等待两个方向都完成，先结束的方向决定断开原因
+	first := <-done
+	reason := closeReason(first)
 	<-done
+	if r.stopped() {
+		// 规则停止时被强制关闭
+		reason = "relay_stopped"
+	} else if first.err != nil {
+		r.errors.add(PhaseCopy, errors.New(reason))
+	}
 
-	// 更新连接信息并移入历史
-	now := time.Now()
-	connInfo.EndedAt = &now
-	connInfo.Duration = int64(now.Sub(connInfo.StartedAt).Seconds())
-	connInfo.Active = false
-	// 最终字节数已通过 countingWriter 实时更新，这里确保最终值正确
-	connInfo.BytesIn = atomic.LoadInt64(&bytesIn)
-	connInfo.BytesOut = atomic.LoadInt64(&bytesOut)
-
-	r.connections.Delete(connID)
-	atomic.AddInt64(&r.connCount, -1)
-	r.addToHistory(connInfo)
+	// 两个方向均已结束，字节数不会再变化
+	ended := r.finalizeConnection(connInfo, reason)
+	bytesIn, bytesOut := ended.BytesIn, ended.BytesOut
+	r.persistHistory(ended)
 
 	// 保存统计
 	model.SaveRelayStat(r.rule.ID, bytesIn, bytesOut, 1)
-	model.SaveAccessLog(r.rule.ID, clientIP, "disconnect", bytesIn, bytesOut, connInfo.Duration)
+	r.saveAccessLog(&model.AccessLog{
+		RelayID:    r.rule.ID,
+		ClientIP:   clientIP,
+		Action:     "disconnect",
+		Detail:     reason,
+		BytesIn:    bytesIn,
+		BytesOut:   bytesOut,
+		Duration:   ended.Duration,
+		Country:    country,
+		ASN:        asn,
+		ASOrg:      asOrg,
+		LatencyMs:  latency,
+		ClientCert: tlsState.clientCert,
+		TLSVersion: tlsState.version,
+		TLSCipher:  tlsState.cipher,
+		TLSALPN:    tlsState.alpn,
+		Private:    private,
+	})
+}
+
+// acquirePerIP 占用一个单 IP 连接名额，超过上限时返回 false
+func (r *RelayInstance) acquirePerIP(clientIP string) bool {
+	limit := r.rule.MaxConnectionsPerIP
+	if limit <= 0 {
+		return true
+	}
+	r.perIPMu.Lock()
+	defer r.perIPMu.Unlock()
+	if int64(r.perIPConns[clientIP]) >= limit {
+		return false
+	}
+	r.perIPConns[clientIP]++
+	return true
+}
+
+// releasePerIP 释放 acquirePerIP 占用的名额
+func (r *RelayInstance) releasePerIP(clientIP string) {
+	if r.rule.MaxConnectionsPerIP <= 0 {
+		return
+	}
+	r.perIPMu.Lock()
+	defer r.perIPMu.Unlock()
+	if r.perIPConns[clientIP] <= 1 {
+		delete(r.perIPConns, clientIP)
+	} else {
+		r.perIPConns[clientIP]--
+	}
+}
+
+// checkCountry 检查客户端所属国家是否允许访问
+// GeoIP 未加载时放行（fail open），避免规则在无数据库时静默失效
+func (r *RelayInstance) checkCountry(clientIP string) (bool, string) {
+	if len(r.rule.AllowCountries) == 0 && len(r.rule.DenyCountries) == 0 {
+		return true, ""
+	}
+	if r.geoIP == nil || !r.geoIP.IsLoaded() {
+		r.geoWarnOnce.Do(func() {
+			log.Printf("[GeoIP] 规则 %s 配置了国家访问控制，但 GeoIP 数据库未加载，已放行所有连接", r.rule.Name)
+		})
+		return true, ""
+	}
+
+	country := r.geoIP.LookupCountryCode(clientIP)
+	for _, c := range r.rule.DenyCountries {
+		if strings.EqualFold(c, country) {
+			return false, country
+		}
+	}
+	if len(r.rule.AllowCountries) == 0 {
+		return true, country
+	}
+	for _, c := range r.rule.AllowCountries {
+		if strings.EqualFold(c, country) {
+			return true, country
+		}
+	}
+	return false, country
 }
 
-// addToHistory 添加到历史记录
-func (r *RelayInstance) addToHistory(conn *Connection) {
+// finalizeConnection 结束连接：以最终字节数生成断开记录，并在同一把锁内移出活跃列表、加入历史
+// 持有 historyMu 读取连接列表的一方不会看到连接同时存在或同时缺失于两处，也不会看到计数跳变
+func (r *RelayInstance) finalizeConnection(c *Connection, reason string) Connection {
 	r.historyMu.Lock()
 	defer r.historyMu.Unlock()
 
-	// 添加到开头（最新的在前）
-	r.history = append([]*Connection{conn}, r.history...)
+	ended := c.snapshot()
+	now := time.Now()
+	ended.EndedAt = &now
+	ended.Duration = int64(now.Sub(ended.StartedAt).Seconds())
+	ended.Active = false
+	ended.CloseReason = reason
+
+	r.connections.Delete(c.ID)
+	atomic.AddInt64(&r.connCount, -1)
 
-	// 保持最多 maxHistorySize 条记录
-	if len(r.history) > maxHistorySize {
-		r.history = r.history[:maxHistorySize]
-	}
+	// 超过 historySize 时覆盖最旧的记录
+	record := ended
+	r.history.add(&record)
+	return ended
 }
 
-func (r *RelayInstance) startUDP() error {
-	pc, err := net.ListenPacket("udp", r.rule.Src)
+func (r *RelayInstance) startUDP(m AddrMapping) error {
+	pc, err := activatedPacketConn(r.rule, m.Src)
 	if err != nil {
 		return err
 	}
-	r.udpConn = pc
+	if pc == nil {
+		lc := ListenConfig(r.rule)
+		pc, err = lc.ListenPacket(context.Background(), r.rule.ListenNetworkFor("udp", m.Src), m.Src)
+		if err != nil {
+			return err
+		}
+	}
+	r.udpConns = append(r.udpConns, pc)
+	picker := r.newTargetPicker(m.Targets)
 
-	go func() {
+	// 退出时关闭全部会话并写入断开日志，停止规则时需要等待
+	r.spawn(func() {
 		buf := make([]byte, 65535)
-		clients := make(map[string]*udpClient)
-		var mu sync.Mutex
+		sessions := newUDPSessionTable()
+		defer sessions.closeAll()
+		denied := make(map[string]time.Time) // 被国家访问控制拒绝的客户端 -> 缓存到期时间
+		lastSweep := time.Now()
 
 		for {
 			select {
 			case <-r.stopCh:
 				return
 			default:
+				// 不再发包的客户端不会命中下面的到期检查，定期清理，避免大量源地址撑大缓存
+				if now := time.Now(); now.Sub(lastSweep) >= deniedCacheTTL {
+					sweepDenied(denied, now)
+					lastSweep = now
+				}
+
 				pc.SetReadDeadline(time.Now().Add(time.Second))
 				n, addr, err := pc.ReadFrom(buf)
 				if err != nil {
@@ -399,112 +1336,124 @@ func (r *RelayInstance) startUDP() error {
 				}
 
 				key := addr.String()
-				mu.Lock()
-				client, exists := clients[key]
-				if !exists {
-					// 新客户端
-					remote, err := net.Dial("udp", r.rule.Dst)
-					if err != nil {
-						mu.Unlock()
+				if until, ok := denied[key]; ok {
+					if time.Now().Before(until) {
 						continue
 					}
+					delete(denied, key)
+				}
 
+				session := sessions.get(key)
+				if session == nil {
+					// 新客户端
 					clientIP, _, _ := net.SplitHostPort(key)
-					location := ""
-					if r.geoIP != nil {
-						location = r.geoIP.Lookup(clientIP)
+					if allowed, country := r.checkCountry(clientIP); !allowed {
+						denied[key] = time.Now().Add(deniedCacheTTL)
+						log.Printf("[GeoIP] 拒绝 UDP 客户端: rule=%s, client=%s, country=%s", r.rule.Name, clientIP, country)
+						r.saveAccessLog(&model.AccessLog{RelayID: r.rule.ID, ClientIP: clientIP, Action: "geo_denied", Detail: country, Country: country, Private: isPrivateClient(clientIP)})
+						continue
 					}
-
-					client = &udpClient{
-						addr:      addr,
-						remote:    remote,
-						lastSeen:  time.Now(),
-						startedAt: time.Now(),
-						clientIP:  clientIP,
-						location:  location,
+					if !r.allowNewConn(key) {
+						continue
 					}
-					clients[key] = client
-
-					connID := uuid.New().String()
-					connInfo := &Connection{
-						ID:        connID,
-						ClientIP:  clientIP,
-						Location:  location,
-						Target:    r.rule.Dst,
-						Protocol:  "udp",
-						StartedAt: time.Now(),
-						Active:    true,
+
+					session, err = r.newUDPSession(sessions, pc, addr, clientIP, picker.next(clientIP))
+					if err != nil {
+						continue
 					}
-					r.connections.Store(connID, connInfo)
-					client.connID = connID
-					client.connInfo = connInfo
-					atomic.AddInt64(&r.connCount, 1)
-
-					model.SaveAccessLog(r.rule.ID, clientIP, "connect", 0, 0, 0)
-
-					// 接收远程响应
-					go func(c *udpClient) {
-						buf := make([]byte, 65535)
-						for {
-							c.remote.SetReadDeadline(time.Now().Add(30 * time.Second))
-							n, err := c.remote.Read(buf)
-							if err != nil {
-								break
-							}
-							pc.WriteTo(buf[:n], c.addr)
-							atomic.AddInt64(&c.bytesOut, int64(n))
-							atomic.AddInt64(&r.bytesOut, int64(n))
-						}
-
-						// 清理并移入历史
-						mu.Lock()
-						delete(clients, c.addr.String())
-						mu.Unlock()
-
-						now := time.Now()
-						c.connInfo.EndedAt = &now
-						c.connInfo.Duration = int64(now.Sub(c.startedAt).Seconds())
-						c.connInfo.Active = false
-						c.connInfo.BytesIn = c.bytesIn
-						c.connInfo.BytesOut = c.bytesOut
-
-						r.connections.Delete(c.connID)
-						atomic.AddInt64(&r.connCount, -1)
-						r.addToHistory(c.connInfo)
-
-						model.SaveRelayStat(r.rule.ID, c.bytesIn, c.bytesOut, 1)
-						model.SaveAccessLog(r.rule.ID, c.clientIP, "disconnect", c.bytesIn, c.bytesOut, c.connInfo.Duration)
-					}(client)
 				}
-				mu.Unlock()
-
-				client.lastSeen = time.Now()
-				client.remote.Write(buf[:n])
-				atomic.AddInt64(&client.bytesIn, int64(n))
-				atomic.AddInt64(&r.bytesIn, int64(n))
+				session.forward(buf[:n])
 			}
 		}
-	}()
+	})
 
 	return nil
 }
 
-type udpClient struct {
-	addr      net.Addr
-	remote    net.Conn
-	lastSeen  time.Time
-	startedAt time.Time
-	clientIP  string
-	location  string
-	connID    string
-	connInfo  *Connection
-	bytesIn   int64
-	bytesOut  int64
+// deniedCacheTTL 被国家访问控制拒绝的 UDP 客户端的缓存时间，期间直接丢弃其数据包
+const deniedCacheTTL = time.Minute
+
+// sweepDenied 删除已到期的拒绝缓存
+func sweepDenied(denied map[string]time.Time, now time.Time) {
+	for key, until := range denied {
+		if !now.Before(until) {
+			delete(denied, key)
+		}
+	}
+}
+
+// connectionList 返回活跃连接与最近 historyLimit 条历史记录（historyLimit <= 0 时为全部历史）
+func (r *RelayInstance) connectionList(historyLimit int) []Connection {
+	r.historyMu.Lock()
+	defer r.historyMu.Unlock()
+
+	var conns []Connection
+	r.connections.Range(func(key, value interface{}) bool {
+		c := value.(*Connection).snapshot()
+		c.Duration = int64(time.Since(c.StartedAt).Seconds())
+		conns = append(conns, c)
+		return true
+	})
+	for i := 0; i < r.history.len(); i++ {
+		if historyLimit > 0 && i >= historyLimit {
+			break
+		}
+		conns = append(conns, *r.history.at(i))
+	}
+	return conns
+}
+
+// updateSpeed 计算平滑速度并保存到 speedIn/speedOut；smoothSpeed* 不加锁，只能在 pushStatus 中调用
+func (r *RelayInstance) updateSpeed() {
+	// 计算速度（使用 EMA 指数移动平均平滑）
+	// EMA 公式: smoothed = alpha * current + (1 - alpha) * previous
+	// 每秒 alpha = 0.3 提供较好的平滑效果，同时保持响应速度；
+	// 推送间隔不为 1 秒时换算为等效 alpha，保持相同的平滑时间常数
+	seconds := r.pushInterval.Seconds()
+	alpha := 1 - math.Pow(1-0.3, seconds)
+
+	currentBytesIn := atomic.LoadInt64(&r.bytesIn)
+	currentBytesOut := atomic.LoadInt64(&r.bytesOut)
+	lastIn := atomic.LoadInt64(&r.lastBytesIn)
+	lastOut := atomic.LoadInt64(&r.lastBytesOut)
+
+	// 计算瞬时速度 (bytes/s)
+	instantSpeedIn := float64(currentBytesIn-lastIn) / seconds
+	instantSpeedOut := float64(currentBytesOut-lastOut) / seconds
+
+	// 应用 EMA 平滑
+	if r.smoothSpeedIn == 0 && instantSpeedIn > 0 {
+		// 首次有数据时直接使用瞬时值
+		r.smoothSpeedIn = instantSpeedIn
+	} else {
+		r.smoothSpeedIn = alpha*instantSpeedIn + (1-alpha)*r.smoothSpeedIn
+	}
+
+	if r.smoothSpeedOut == 0 && instantSpeedOut > 0 {
+		r.smoothSpeedOut = instantSpeedOut
+	} else {
+		r.smoothSpeedOut = alpha*instantSpeedOut + (1-alpha)*r.smoothSpeedOut
+	}
+
+	// 速度过小时归零（避免显示 0.1 B/s 这样的值）
+	if r.smoothSpeedIn < 1 {
+		r.smoothSpeedIn = 0
+	}
+	if r.smoothSpeedOut < 1 {
+		r.smoothSpeedOut = 0
+	}
+
+	// 更新上一秒的值
+	atomic.StoreInt64(&r.lastBytesIn, currentBytesIn)
+	atomic.StoreInt64(&r.lastBytesOut, currentBytesOut)
+
+	atomic.StoreInt64(&r.speedIn, int64(r.smoothSpeedIn))
+	atomic.StoreInt64(&r.speedOut, int64(r.smoothSpeedOut))
 }
 
 // pushStatus 定期推送状态
 func (r *RelayInstance) pushStatus() {
-	ticker := time.NewTicker(time.Second)
+	ticker := time.NewTicker(r.pushInterval)
 	defer ticker.Stop()
 
 	for {
@@ -512,83 +1461,39 @@ func (r *RelayInstance) pushStatus() {
 		case <-r.stopCh:
 			return
 		case <-ticker.C:
+			// 配额检查不依赖推送，headless 模式同样生效
+			r.checkQuota(atomic.LoadInt64(&r.bytesIn) + atomic.LoadInt64(&r.bytesOut))
+
+			// 速度同样不依赖推送，REST 状态查询也会用到
+			r.updateSpeed()
+			// lastBytes* 即本次计算速度时使用的字节数
+			currentBytesIn := atomic.LoadInt64(&r.lastBytesIn)
+			currentBytesOut := atomic.LoadInt64(&r.lastBytesOut)
+			speedIn := atomic.LoadInt64(&r.speedIn)
+			speedOut := atomic.LoadInt64(&r.speedOut)
+
+			// 流量告警同样不依赖推送，headless 模式下仍写入日志
+			r.checkAlerts(speedIn, speedOut, currentBytesIn+currentBytesOut, r.pushInterval)
+
 			if r.broadcaster == nil {
 				continue
 			}
 
-			// 推送连接列表（活跃 + 历史）
-			var conns []Connection
-
-			// 先添加活跃连接
-			r.connections.Range(func(key, value interface{}) bool {
-				conn := value.(*Connection)
-				c := *conn
-				c.Duration = int64(time.Since(conn.StartedAt).Seconds())
-				c.BytesIn = atomic.LoadInt64(&conn.BytesIn)
-				c.BytesOut = atomic.LoadInt64(&conn.BytesOut)
-				conns = append(conns, c)
-				return true
-			})
-
-			// 再添加历史记录
-			r.historyMu.Lock()
-			for _, h := range r.history {
-				conns = append(conns, *h)
-			}
-			r.historyMu.Unlock()
+			// 推送连接列表（活跃 + 历史，仅推送最近的部分历史，完整历史通过 relay.history 查询）
+			conns := r.connectionList(defaultHistorySize)
 
 			r.broadcaster.BroadcastToRelay(r.rule.ID, "relay.connections", map[string]interface{}{
 				"relay_id":    r.rule.ID,
 				"connections": conns,
 			})
 
-			// 计算速度（使用 EMA 指数移动平均平滑）
-			// EMA 公式: smoothed = alpha * current + (1 - alpha) * previous
-			// alpha = 0.3 提供较好的平滑效果，同时保持响应速度
-			const alpha = 0.3
-
-			currentBytesIn := atomic.LoadInt64(&r.bytesIn)
-			currentBytesOut := atomic.LoadInt64(&r.bytesOut)
-			lastIn := atomic.LoadInt64(&r.lastBytesIn)
-			lastOut := atomic.LoadInt64(&r.lastBytesOut)
-
-			// 计算瞬时速度
-			instantSpeedIn := float64(currentBytesIn - lastIn)
-			instantSpeedOut := float64(currentBytesOut - lastOut)
-
-			// 应用 EMA 平滑
-			if r.smoothSpeedIn == 0 && instantSpeedIn > 0 {
-				// 首次有数据时直接使用瞬时值
-				r.smoothSpeedIn = instantSpeedIn
-			} else {
-				r.smoothSpeedIn = alpha*instantSpeedIn + (1-alpha)*r.smoothSpeedIn
-			}
-
-			if r.smoothSpeedOut == 0 && instantSpeedOut > 0 {
-				r.smoothSpeedOut = instantSpeedOut
-			} else {
-				r.smoothSpeedOut = alpha*instantSpeedOut + (1-alpha)*r.smoothSpeedOut
-			}
-
-			// 速度过小时归零（避免显示 0.1 B/s 这样的值）
-			if r.smoothSpeedIn < 1 {
-				r.smoothSpeedIn = 0
-			}
-			if r.smoothSpeedOut < 1 {
-				r.smoothSpeedOut = 0
-			}
-
-			// 更新上一秒的值
-			atomic.StoreInt64(&r.lastBytesIn, currentBytesIn)
-			atomic.StoreInt64(&r.lastBytesOut, currentBytesOut)
-
 			// 推送流量统计（包含平滑后的速度）
 			r.broadcaster.BroadcastToRelay(r.rule.ID, "relay.traffic", map[string]interface{}{
 				"relay_id":        r.rule.ID,
 				"bytes_in":        currentBytesIn,
 				"bytes_out":       currentBytesOut,
-				"bytes_in_speed":  int64(r.smoothSpeedIn),
-				"bytes_out_speed": int64(r.smoothSpeedOut),
+				"bytes_in_speed":  speedIn,
+				"bytes_out_speed": speedOut,
 				"connections":     atomic.LoadInt64(&r.connCount),
 			})
 		}
@@ -0,0 +1,296 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DGHeroin/relay/webui/model"
+	"github.com/google/uuid"
+)
+
+// startTestRelay 启动规则并在测试结束时停止，返回管理器与运行中的实例
+// 监听地址使用 127.0.0.1:0 时由系统分配端口，通过 boundAddrs 取得
+func startTestRelay(t *testing.T, rule *model.RelayRule) (*RelayManager, *RelayInstance) {
+	t.Helper()
+	if rule.ID == "" {
+		rule.ID = uuid.New().String()
+	}
+	if rule.Name == "" {
+		rule.Name = t.Name()
+	}
+	m := NewRelayManager()
+	if err := m.Start(rule, nil, nil, ReasonManual); err != nil {
+		t.Fatalf("启动规则失败: %v", err)
+	}
+	t.Cleanup(func() { m.Stop(rule.ID, ReasonManual) })
+	v, _ := m.instances.Load(rule.ID)
+	return m, v.(*RelayInstance)
+}
+
+// relayAddr 返回实例在 network 上实际监听的地址
+func relayAddr(t *testing.T, r *RelayInstance, network string) string {
+	t.Helper()
+	for _, b := range r.boundAddrs() {
+		if b.Network == network {
+			return b.Addr
+		}
+	}
+	t.Fatalf("规则没有 %s 监听", network)
+	return ""
+}
+
+// serveUDPEcho 原样回显收到的数据包，直到 pc 关闭
+func serveUDPEcho(pc net.PacketConn) {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		pc.WriteTo(buf[:n], addr)
+	}
+}
+
+// serveTCPEcho 原样回显每个连接的数据，读到 EOF 后半关闭写方向
+func serveTCPEcho(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			io.Copy(conn, conn)
+			conn.(*net.TCPConn).CloseWrite()
+		}()
+	}
+}
+
+// TestRelayByteAccounting 多个连接同时双向传输，连接级与规则级计数都应等于实际传输的字节数
+func TestRelayByteAccounting(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go serveTCPEcho(echo)
+
+	rule := &model.RelayRule{Protocol: "tcp", Src: "127.0.0.1:0", Dst: echo.Addr().String()}
+	m, r := startTestRelay(t, rule)
+	addr := relayAddr(t, r, "tcp")
+
+	const (
+		conns = 16
+		size  = 1 << 20
+	)
+	payload := bytes.Repeat([]byte("0123456789abcdef"), size/16)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, conns)
+	for i := 0; i < conns; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(20 * time.Second))
+			// 写入与读回同时进行，两个方向的计数器并发更新
+			go func() {
+				conn.Write(payload)
+				conn.(*net.TCPConn).CloseWrite()
+			}()
+			got, err := io.ReadAll(conn)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if !bytes.Equal(got, payload) {
+				errs <- errors.New("回显内容不一致")
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("传输失败: %v", err)
+	}
+
+	// Stop 等待全部连接写入历史后返回
+	m.Stop(rule.ID, ReasonManual)
+
+	if r.history.len() != conns {
+		t.Fatalf("历史记录 %d 条, want %d", r.history.len(), conns)
+	}
+	for i := 0; i < conns; i++ {
+		c := r.history.at(i)
+		if c.BytesIn != size || c.BytesOut != size {
+			t.Errorf("连接 %s: in=%d out=%d, want %d", c.ID, c.BytesIn, c.BytesOut, size)
+		}
+	}
+	if in, out := atomic.LoadInt64(&r.bytesIn), atomic.LoadInt64(&r.bytesOut); in != conns*size || out != conns*size {
+		t.Errorf("规则计数 in=%d out=%d, want %d", in, out, conns*size)
+	}
+}
+
+// TestStopWithLiveConnections 停止仍有活跃连接的规则：Stop 返回前连接已关闭、计数归零并写入断开日志
+func TestStopWithLiveConnections(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go serveTCPEcho(echo)
+
+	rule := &model.RelayRule{Protocol: "tcp", Src: "127.0.0.1:0", Dst: echo.Addr().String(), LogConnections: true}
+	m, r := startTestRelay(t, rule)
+	addr := relayAddr(t, r, "tcp")
+
+	const conns = 5
+	clients := make([]net.Conn, conns)
+	for i := range clients {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		// 完成一次回显，确保连接已登记
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+			t.Fatal(err)
+		}
+		clients[i] = conn
+	}
+	if got := m.LiveOverview().ActiveConnections; got != conns {
+		t.Fatalf("停止前活跃连接 %d, want %d", got, conns)
+	}
+
+	m.Stop(rule.ID, ReasonManual)
+
+	if got := atomic.LoadInt64(&r.connCount); got != 0 {
+		t.Errorf("停止后实例仍计 %d 个连接", got)
+	}
+	if got := m.LiveOverview().ActiveConnections; got != 0 {
+		t.Errorf("停止后总览仍有 %d 个活跃连接", got)
+	}
+	if r.history.len() != conns {
+		t.Errorf("历史记录 %d 条, want %d", r.history.len(), conns)
+	}
+	logs, total, err := model.GetAccessLogs(model.AccessLogFilter{RelayID: rule.ID, Action: "disconnect"}, 1, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != conns {
+		t.Fatalf("断开日志 %d 条, want %d", total, conns)
+	}
+	for _, l := range logs {
+		if l.Detail != "relay_stopped" {
+			t.Errorf("断开原因 %q, want relay_stopped", l.Detail)
+		}
+	}
+	// 客户端一侧的连接也已被关闭
+	for i, conn := range clients {
+		if _, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Errorf("客户端 %d 的连接未被关闭", i)
+		}
+	}
+}
+
+// stateRecorder 记录推送的 relay.state 事件
+type stateRecorder struct {
+	mu     sync.Mutex
+	states []RelayState
+}
+
+func (s *stateRecorder) BroadcastToRelay(relayID, msgType string, data interface{}) {
+	if state, ok := data.(RelayState); ok && msgType == "relay.state" {
+		s.mu.Lock()
+		s.states = append(s.states, state)
+		s.mu.Unlock()
+	}
+}
+
+func (s *stateRecorder) last() RelayState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.states[len(s.states)-1]
+}
+
+// TestDrainClosesListener 排空时新连接被拒绝、已有连接继续转发，恢复后在原地址重新接受连接
+func TestDrainClosesListener(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go serveTCPEcho(echo)
+
+	rule := &model.RelayRule{ID: "drain-test", Name: t.Name(), Protocol: "tcp", Src: "127.0.0.1:0", Dst: echo.Addr().String()}
+	recorder := &stateRecorder{}
+	m := NewRelayManager()
+	if err := m.Start(rule, recorder, nil, ReasonManual); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop(rule.ID, ReasonManual)
+	v, _ := m.instances.Load(rule.ID)
+	addr := relayAddr(t, v.(*RelayInstance), "tcp")
+
+	roundTrip := func(conn net.Conn) error {
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			return err
+		}
+		_, err := io.ReadFull(conn, make([]byte, 4))
+		return err
+	}
+
+	existing, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer existing.Close()
+	if err := roundTrip(existing); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.SetDraining(rule.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	if state := recorder.last(); !state.Running || !state.Draining || state.Reason != ReasonDrain {
+		t.Errorf("排空事件 %+v", state)
+	}
+	if conn, err := net.Dial("tcp", addr); err == nil {
+		conn.Close()
+		t.Fatal("排空期间新连接应被拒绝")
+	}
+	if err := roundTrip(existing); err != nil {
+		t.Fatalf("排空期间已有连接中断: %v", err)
+	}
+
+	if err := m.SetDraining(rule.ID, false); err != nil {
+		t.Fatal(err)
+	}
+	if state := recorder.last(); !state.Running || state.Draining {
+		t.Errorf("恢复事件 %+v", state)
+	}
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("恢复后无法连接原地址: %v", err)
+	}
+	defer conn.Close()
+	if err := roundTrip(conn); err != nil {
+		t.Fatalf("恢复后转发失败: %v", err)
+	}
+}
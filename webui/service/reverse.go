@@ -0,0 +1,626 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DGHeroin/relay/webui/model"
+)
+
+// reverseVersion 反向隧道协议版本，2 起服务端也要证明持有密钥
+const reverseVersion = 2
+
+// MinReverseSecretLen 反向隧道密钥的最小长度
+const MinReverseSecretLen = 8
+
+// 客户端断线重连的退避时间
+const (
+	reverseRetryMin = time.Second
+	reverseRetryMax = 30 * time.Second
+)
+
+// 服务端默认允许客户端监听的端口范围，由 reverse_port_range 设置调整
+const (
+	DefaultReversePortMin = 1024
+	DefaultReversePortMax = 65535
+)
+
+// 同一来源 IP 握手失败 reverseAuthMaxFails 次后，在 reverseAuthBanTime 内直接断开其连接
+const (
+	reverseAuthMaxFails = 5
+	reverseAuthWindow   = time.Minute
+	reverseAuthBanTime  = 5 * time.Minute
+)
+
+// reverseNonceSize 握手随机数的长度
+const reverseNonceSize = 32
+
+// reverseHello 客户端握手请求
+type reverseHello struct {
+	Version int    `json:"version"`
+	Listen  string `json:"listen"` // 要求服务端监听的地址
+	MAC     string `json:"mac"`    // hex(HMAC-SHA256(secret, "client" + 服务端随机数))
+	Nonce   string `json:"nonce"`  // hex(客户端随机数)，服务端以此证明持有密钥
+}
+
+// reverseReady 服务端握手响应
+type reverseReady struct {
+	Addr string `json:"addr"` // 服务端实际监听的地址
+	MAC  string `json:"mac"`  // hex(HMAC-SHA256(secret, "server" + 客户端随机数))
+}
+
+// reverseMAC 计算握手的 HMAC，role 区分两个方向，避免把对方的应答原样反射回去
+func reverseMAC(secret, role string, nonce []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(role))
+	mac.Write(nonce)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func newReverseNonce() ([]byte, error) {
+	nonce := make([]byte, reverseNonceSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return nonce, nil
+}
+
+// ReverseStatus 反向模式规则的控制连接状态
+type ReverseStatus struct {
+	Server    string `json:"server"`
+	Connected bool   `json:"connected"`
+	Addr      string `json:"addr,omitempty"` // 服务端实际监听的地址，未连接时为空
+}
+
+// reverseListener 反向模式规则的“监听”：主动连接服务端并维持控制连接，
+// Accept 返回服务端转入的流，断线后自动重连
+type reverseListener struct {
+	server string
+	secret string
+	listen string
+	onErr  func(error)
+
+	accept    chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	mu      sync.Mutex
+	session *muxSession
+	addr    string // 服务端实际监听的地址
+}
+
+func newReverseListener(server, secret, listen string, onErr func(error)) *reverseListener {
+	l := &reverseListener{
+		server: server,
+		secret: secret,
+		listen: listen,
+		onErr:  onErr,
+		accept: make(chan net.Conn, 64),
+		closed: make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+// run 连接服务端并处理会话，断开后按指数退避重连，直到监听关闭
+func (l *reverseListener) run() {
+	delay := reverseRetryMin
+	for {
+		start := time.Now()
+		err := l.serve()
+		select {
+		case <-l.closed:
+			return
+		default:
+		}
+		log.Printf("[Reverse] 与服务端 %s 的连接断开: %v; %v 后重连", l.server, err, delay)
+		l.onErr(err)
+
+		select {
+		case <-time.After(delay):
+		case <-l.closed:
+			return
+		}
+		// 连接维持了一段时间后断开时从最短等待开始重连
+		if time.Since(start) > reverseRetryMax {
+			delay = reverseRetryMin
+		} else if delay *= 2; delay > reverseRetryMax {
+			delay = reverseRetryMax
+		}
+	}
+}
+
+// serve 建立一次控制连接，返回断开原因
+func (l *reverseListener) serve() error {
+	conn, err := net.DialTimeout("tcp", l.server, DialTimeout)
+	if err != nil {
+		return err
+	}
+	addr, err := l.handshake(conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	session := newMuxSession(conn, func(st *muxStream) {
+		select {
+		case l.accept <- st:
+		default:
+			// Accept 跟不上时拒绝新流，不阻塞其它流的数据
+			st.Close()
+		}
+	})
+	l.mu.Lock()
+	select {
+	case <-l.closed:
+		l.mu.Unlock()
+		conn.Close()
+		return net.ErrClosed
+	default:
+	}
+	l.session, l.addr = session, addr
+	l.mu.Unlock()
+	log.Printf("[Reverse] 已连接服务端 %s，公网监听 %s", l.server, addr)
+
+	err = session.run()
+
+	l.mu.Lock()
+	l.session, l.addr = nil, ""
+	l.mu.Unlock()
+	return err
+}
+
+// handshake 双向认证并请求服务端监听，返回服务端实际监听的地址；
+// 服务端必须用密钥对客户端随机数给出正确的 HMAC，否则冒充的服务端可以向本机的目标打开连接
+func (l *reverseListener) handshake(conn net.Conn) (string, error) {
+	conn.SetDeadline(time.Now().Add(muxHandshakeWait))
+	defer conn.SetDeadline(time.Time{})
+
+	typ, _, nonce, err := readFrame(conn)
+	if err != nil {
+		return "", fmt.Errorf("握手失败: %v", err)
+	}
+	if typ != frameChallenge || len(nonce) != reverseNonceSize {
+		return "", fmt.Errorf("握手失败: 服务端不是反向隧道服务")
+	}
+	clientNonce, err := newReverseNonce()
+	if err != nil {
+		return "", err
+	}
+	hello, _ := json.Marshal(reverseHello{
+		Version: reverseVersion,
+		Listen:  l.listen,
+		MAC:     reverseMAC(l.secret, "client", nonce),
+		Nonce:   hex.EncodeToString(clientNonce),
+	})
+	if err := writeFrame(conn, frameHello, 0, hello); err != nil {
+		return "", fmt.Errorf("握手失败: %v", err)
+	}
+
+	typ, _, payload, err := readFrame(conn)
+	if err != nil {
+		return "", fmt.Errorf("握手失败: %v", err)
+	}
+	switch typ {
+	case frameReady:
+		var ready reverseReady
+		if err := json.Unmarshal(payload, &ready); err != nil {
+			return "", fmt.Errorf("握手失败: %v", err)
+		}
+		if !hmac.Equal([]byte(ready.MAC), []byte(reverseMAC(l.secret, "server", clientNonce))) {
+			return "", fmt.Errorf("握手失败: 服务端认证失败，密钥不一致或服务端被冒充")
+		}
+		return ready.Addr, nil
+	case frameError:
+		return "", fmt.Errorf("服务端拒绝: %s", payload)
+	}
+	return "", fmt.Errorf("握手失败: 意外的帧类型 0x%02x", typ)
+}
+
+func (l *reverseListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.accept:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *reverseListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		l.mu.Lock()
+		if l.session != nil {
+			l.session.Close()
+		}
+		l.mu.Unlock()
+	})
+	return nil
+}
+
+// Addr 返回服务端的控制地址，实际的公网监听地址见 status
+func (l *reverseListener) Addr() net.Addr {
+	return reverseAddr(l.server)
+}
+
+func (l *reverseListener) status() *ReverseStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return &ReverseStatus{Server: l.server, Connected: l.session != nil, Addr: l.addr}
+}
+
+// ReverseServer 反向隧道服务端：接受反向模式规则的控制连接，按其要求监听公网地址，
+// 把公网连接通过控制连接转给规则所在的主机
+type ReverseServer struct {
+	mu       sync.Mutex
+	listen   string
+	secret   string
+	portMin  int // 允许客户端监听的端口范围
+	portMax  int
+	ln       net.Listener
+	sessions map[string]*reverseServerSession // 公网监听地址 -> 会话
+	failures map[string]*reverseAuthFailure   // 来源 IP -> 握手失败记录
+}
+
+// reverseAuthFailure 一个来源 IP 的握手失败记录
+type reverseAuthFailure struct {
+	count       int
+	first       time.Time // 本轮计数的开始时间
+	bannedUntil time.Time
+}
+
+// reverseServerSession 服务端上一个已认证的客户端
+type reverseServerSession struct {
+	session     *muxSession
+	ln          net.Listener
+	client      string
+	connectedAt time.Time
+}
+
+// ReverseClientInfo 已连接的反向隧道客户端
+type ReverseClientInfo struct {
+	Client      string    `json:"client"`
+	Listen      string    `json:"listen"`
+	Streams     int       `json:"streams"`
+	ConnectedAt time.Time `json:"connected_at"`
+}
+
+// NewReverseServer 创建未启动的反向隧道服务端
+func NewReverseServer() *ReverseServer {
+	return &ReverseServer{
+		portMin:  DefaultReversePortMin,
+		portMax:  DefaultReversePortMax,
+		sessions: make(map[string]*reverseServerSession),
+		failures: make(map[string]*reverseAuthFailure),
+	}
+}
+
+// SetPortRange 设置允许客户端监听的端口范围，只影响之后的握手
+func (s *ReverseServer) SetPortRange(min, max int) {
+	s.mu.Lock()
+	s.portMin, s.portMax = min, max
+	s.mu.Unlock()
+}
+
+// ParseReversePortRange 解析 reverse_port_range 设置（如 20000-30000），空值为默认范围
+func ParseReversePortRange(value string) (int, int, error) {
+	if value == "" {
+		return DefaultReversePortMin, DefaultReversePortMax, nil
+	}
+	startStr, endStr, isRange := strings.Cut(value, "-")
+	if !isRange {
+		endStr = startStr
+	}
+	start, err1 := strconv.Atoi(strings.TrimSpace(startStr))
+	end, err2 := strconv.Atoi(strings.TrimSpace(endStr))
+	if err1 != nil || err2 != nil || start < 1 || end > 65535 || start > end {
+		return 0, 0, fmt.Errorf("反向隧道端口范围格式为 起始-结束，端口在 1-65535 之间")
+	}
+	return start, end, nil
+}
+
+// Apply 按新的配置重启服务端，listen 或 secret 为空时停止；配置未变化时不做任何事
+// 重启会断开已连接的客户端，客户端会自动重连
+func (s *ReverseServer) Apply(listen, secret string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if listen == s.listen && secret == s.secret && (s.ln != nil || listen == "" || secret == "") {
+		return nil
+	}
+	s.stopLocked()
+	s.listen, s.secret = listen, secret
+	if listen == "" || secret == "" {
+		return nil
+	}
+
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		return fmt.Errorf("反向隧道服务端监听失败: %s", DescribeListenError(err))
+	}
+	s.ln = ln
+	log.Printf("[Reverse] 服务端监听: %s", ln.Addr())
+	go s.acceptLoop(ln, secret)
+	return nil
+}
+
+// Stop 停止服务端并断开全部客户端
+func (s *ReverseServer) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stopLocked()
+}
+
+func (s *ReverseServer) stopLocked() {
+	if s.ln != nil {
+		s.ln.Close()
+		s.ln = nil
+	}
+	for key, rs := range s.sessions {
+		rs.ln.Close()
+		rs.session.Close()
+		delete(s.sessions, key)
+	}
+}
+
+// Status 返回服务端监听地址与已连接的客户端
+func (s *ReverseServer) Status() (string, []ReverseClientInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var listen string
+	if s.ln != nil {
+		listen = s.ln.Addr().String()
+	}
+	clients := make([]ReverseClientInfo, 0, len(s.sessions))
+	for _, rs := range s.sessions {
+		clients = append(clients, ReverseClientInfo{
+			Client:      rs.client,
+			Listen:      rs.ln.Addr().String(),
+			Streams:     rs.session.StreamCount(),
+			ConnectedAt: rs.connectedAt,
+		})
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].Listen < clients[j].Listen })
+	return listen, clients
+}
+
+func (s *ReverseServer) acceptLoop(ln net.Listener, secret string) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.handleControl(conn, secret)
+	}
+}
+
+// handleControl 认证控制连接，按请求监听公网地址并转发其上的连接
+func (s *ReverseServer) handleControl(conn net.Conn, secret string) {
+	client := conn.RemoteAddr().String()
+	clientIP := hostOf(client)
+	if s.banned(clientIP) {
+		conn.Close()
+		return
+	}
+	hello, clientNonce, err := reverseAuthenticate(conn, secret)
+	if err != nil {
+		s.recordFailure(clientIP)
+		log.Printf("[Reverse] 客户端 %s 握手失败: %v", client, err)
+		writeFrame(conn, frameError, 0, []byte(err.Error()))
+		conn.Close()
+		return
+	}
+
+	rs, err := s.register(conn, hello.Listen, client)
+	if err != nil {
+		log.Printf("[Reverse] 客户端 %s 监听 %s 失败: %v", client, hello.Listen, err)
+		writeFrame(conn, frameError, 0, []byte(err.Error()))
+		conn.Close()
+		return
+	}
+	ready, _ := json.Marshal(reverseReady{Addr: rs.ln.Addr().String(), MAC: reverseMAC(secret, "server", clientNonce)})
+	if err := rs.session.send(frameReady, 0, ready); err != nil {
+		s.unregister(rs)
+		return
+	}
+	log.Printf("[Reverse] 客户端 %s 已连接，公网监听 %s", client, rs.ln.Addr())
+
+	go rs.acceptPublic()
+	err = rs.session.run()
+	s.unregister(rs)
+	log.Printf("[Reverse] 客户端 %s 断开: %v", client, err)
+}
+
+// reverseAuthenticate 发送随机数并校验客户端的 HMAC，返回握手请求与客户端随机数
+func reverseAuthenticate(conn net.Conn, secret string) (*reverseHello, []byte, error) {
+	conn.SetDeadline(time.Now().Add(muxHandshakeWait))
+	defer conn.SetDeadline(time.Time{})
+
+	nonce, err := newReverseNonce()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := writeFrame(conn, frameChallenge, 0, nonce); err != nil {
+		return nil, nil, err
+	}
+	typ, _, payload, err := readFrame(conn)
+	if err != nil {
+		return nil, nil, err
+	}
+	var hello reverseHello
+	if typ != frameHello || json.Unmarshal(payload, &hello) != nil {
+		return nil, nil, fmt.Errorf("无效的握手请求")
+	}
+	if hello.Version != reverseVersion {
+		return nil, nil, fmt.Errorf("不支持的协议版本 %d", hello.Version)
+	}
+	if !hmac.Equal([]byte(hello.MAC), []byte(reverseMAC(secret, "client", nonce))) {
+		return nil, nil, fmt.Errorf("密钥错误")
+	}
+	clientNonce, err := hex.DecodeString(hello.Nonce)
+	if err != nil || len(clientNonce) != reverseNonceSize {
+		return nil, nil, fmt.Errorf("无效的握手请求")
+	}
+	return &hello, clientNonce, nil
+}
+
+// checkListen 校验客户端要求的监听地址：只能监听全部地址、端口在允许范围内，
+// 且不能与本机的规则冲突（包括未运行的规则），调用方需持有 s.mu
+func (s *ReverseServer) checkListen(listen string) error {
+	host, portStr, err := net.SplitHostPort(listen)
+	if err != nil {
+		return fmt.Errorf("无效的监听地址: %s", listen)
+	}
+	if host != "" && host != "0.0.0.0" && host != "::" {
+		return fmt.Errorf("监听地址的主机部分只能为空、0.0.0.0 或 ::")
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < s.portMin || port > s.portMax {
+		return fmt.Errorf("监听端口必须在 %d-%d 之间", s.portMin, s.portMax)
+	}
+	conflict, err := model.FindConflictingRule(listen, "tcp", "")
+	if err != nil {
+		return fmt.Errorf("检查规则冲突失败: %v", err)
+	}
+	if conflict != nil {
+		return fmt.Errorf("监听地址与服务端的规则 %s 冲突", conflict.Name)
+	}
+	return nil
+}
+
+// banned 来源 IP 是否因多次握手失败被暂时拒绝
+func (s *ReverseServer) banned(ip string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.failures[ip]
+	return ok && time.Now().Before(f.bannedUntil)
+}
+
+// recordFailure 记录一次握手失败，窗口内失败过多时拒绝该 IP 一段时间；顺带清理过期记录
+func (s *ReverseServer) recordFailure(ip string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for key, f := range s.failures {
+		if now.Sub(f.first) > reverseAuthWindow && now.After(f.bannedUntil) {
+			delete(s.failures, key)
+		}
+	}
+	f, ok := s.failures[ip]
+	if !ok {
+		f = &reverseAuthFailure{first: now}
+		s.failures[ip] = f
+	}
+	f.count++
+	if f.count >= reverseAuthMaxFails {
+		f.bannedUntil = now.Add(reverseAuthBanTime)
+		f.count, f.first = 0, now
+		log.Printf("[Reverse] 来源 %s 握手失败次数过多，%v 内拒绝连接", ip, reverseAuthBanTime)
+	}
+}
+
+// register 监听客户端要求的地址；同一地址已有旧会话时，只有来自同一 IP 的新连接
+// （客户端断线重连而旧连接尚未超时）可以接管，其它客户端的请求被拒绝
+func (s *ReverseServer) register(conn net.Conn, listen, client string) (*reverseServerSession, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.checkListen(listen); err != nil {
+		return nil, err
+	}
+	if old, ok := s.sessions[listen]; ok {
+		if hostOf(old.client) != hostOf(client) {
+			return nil, fmt.Errorf("监听地址 %s 已被其它客户端使用", listen)
+		}
+		log.Printf("[Reverse] 监听 %s 由新连接 %s 接管，断开旧连接 %s", listen, client, old.client)
+		old.ln.Close()
+		old.session.Close()
+		delete(s.sessions, listen)
+	}
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, fmt.Errorf("监听 %s 失败: %s", listen, DescribeListenError(err))
+	}
+	rs := &reverseServerSession{
+		session:     newMuxSession(conn, nil),
+		ln:          ln,
+		client:      client,
+		connectedAt: time.Now(),
+	}
+	s.sessions[listen] = rs
+	return rs, nil
+}
+
+func (s *ReverseServer) unregister(rs *reverseServerSession) {
+	rs.ln.Close()
+	rs.session.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, cur := range s.sessions {
+		if cur == rs {
+			delete(s.sessions, key)
+		}
+	}
+}
+
+// acceptPublic 接受公网连接，为每个连接打开一条流并双向复制
+func (rs *reverseServerSession) acceptPublic() {
+	for {
+		conn, err := rs.ln.Accept()
+		if err != nil {
+			return
+		}
+		st, err := rs.session.openStream(conn.RemoteAddr())
+		if err != nil {
+			conn.Close()
+			return
+		}
+		go pipeStream(conn, st)
+	}
+}
+
+// pipeStream 在公网连接与流之间双向复制，一个方向正常结束时半关闭对应的写入方，
+// 出错（如客户端连接目标失败中止了流）时关闭两端
+func pipeStream(conn net.Conn, st *muxStream) {
+	defer conn.Close()
+	defer st.Close()
+	done := make(chan struct{}, 2)
+	go func() {
+		if _, err := io.Copy(st, conn); err != nil {
+			conn.Close()
+			st.Close()
+		} else {
+			st.CloseWrite()
+		}
+		done <- struct{}{}
+	}()
+	go func() {
+		if _, err := io.Copy(conn, st); err != nil {
+			conn.Close()
+			st.Close()
+		} else if tc, ok := conn.(interface{ CloseWrite() error }); ok {
+			tc.CloseWrite()
+		}
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+}
+
+// hostOf 返回 host:port 中的主机部分，格式错误时原样返回
+func hostOf(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
@@ -0,0 +1,494 @@
+package service
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 反向隧道的帧格式：9 字节帧头 + 负载
+//
+//	type(1) | stream id(4, 大端) | length(4, 大端) | payload(length)
+//
+// 握手在 stream 0 上进行：服务端发送 challenge（32 字节随机数），客户端回复 hello
+// （JSON，含 HMAC-SHA256(secret, nonce) 与要求服务端监听的地址），服务端回复 ready 或 error。
+// 之后服务端每接受一个公网连接发送 open 打开一条流，双方用 data/window/fin/reset 在流上收发数据。
+const (
+	frameChallenge byte = 0x01 // 服务端 -> 客户端，负载为随机数
+	frameHello     byte = 0x02 // 客户端 -> 服务端，负载为 reverseHello JSON
+	frameReady     byte = 0x03 // 服务端 -> 客户端，负载为 reverseReady JSON
+	frameError     byte = 0x04 // 服务端 -> 客户端，负载为错误信息，随后关闭连接
+	frameOpen      byte = 0x10 // 服务端 -> 客户端，打开流，负载为公网客户端地址
+	frameData      byte = 0x11 // 流数据，不超过对方剩余的接收窗口
+	frameWindow    byte = 0x12 // 归还接收窗口，负载为 4 字节增量
+	frameFin       byte = 0x13 // 发送方不再写入（半关闭）
+	frameReset     byte = 0x14 // 中止流
+	framePing      byte = 0x20
+	framePong      byte = 0x21
+)
+
+const (
+	muxHeaderSize    = 9
+	muxMaxPayload    = 64 * 1024  // 单帧负载上限
+	muxMaxData       = 16 * 1024  // 单个 data 帧的数据上限
+	muxWindow        = 256 * 1024 // 每条流的接收窗口
+	muxPingInterval  = 15 * time.Second
+	muxIdleTimeout   = 45 * time.Second // 超过该时间未收到任何帧视为断开
+	muxWriteTimeout  = 30 * time.Second
+	muxHandshakeWait = 10 * time.Second
+)
+
+var errStreamReset = errors.New("反向隧道的流被对端中止")
+
+// writeFrame 写入一帧，调用方需保证同一连接上的写入串行
+func writeFrame(w io.Writer, typ byte, id uint32, payload []byte) error {
+	buf := make([]byte, muxHeaderSize+len(payload))
+	buf[0] = typ
+	binary.BigEndian.PutUint32(buf[1:5], id)
+	binary.BigEndian.PutUint32(buf[5:9], uint32(len(payload)))
+	copy(buf[muxHeaderSize:], payload)
+	_, err := w.Write(buf)
+	return err
+}
+
+// readFrame 读取一帧，负载超过上限时返回错误
+func readFrame(r io.Reader) (byte, uint32, []byte, error) {
+	var header [muxHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[5:9])
+	if length > muxMaxPayload {
+		return 0, 0, nil, fmt.Errorf("反向隧道帧过大: %d", length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, 0, nil, err
+	}
+	return header[0], binary.BigEndian.Uint32(header[1:5]), payload, nil
+}
+
+// muxSession 一条控制连接上的多路复用会话，握手完成后由两端共用
+type muxSession struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	streams map[uint32]*muxStream
+	nextID  uint32
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	lastRecv  int64 // 最近一次收到帧的时间（UnixNano）
+
+	// 客户端收到 open 时调用，服务端为 nil
+	onOpen func(*muxStream)
+}
+
+func newMuxSession(conn net.Conn, onOpen func(*muxStream)) *muxSession {
+	return &muxSession{
+		conn:     conn,
+		streams:  make(map[uint32]*muxStream),
+		closed:   make(chan struct{}),
+		lastRecv: time.Now().UnixNano(),
+		onOpen:   onOpen,
+	}
+}
+
+// send 发送一帧，写入失败时关闭会话
+func (s *muxSession) send(typ byte, id uint32, payload []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	select {
+	case <-s.closed:
+		return net.ErrClosed
+	default:
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(muxWriteTimeout))
+	if err := writeFrame(s.conn, typ, id, payload); err != nil {
+		go s.Close()
+		return err
+	}
+	return nil
+}
+
+// Close 关闭控制连接与会话中的全部流
+func (s *muxSession) Close() {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		s.conn.Close()
+		s.mu.Lock()
+		streams := s.streams
+		s.streams = make(map[uint32]*muxStream)
+		s.mu.Unlock()
+		for _, st := range streams {
+			st.abort()
+		}
+	})
+}
+
+// Done 会话关闭后返回的通道被关闭
+func (s *muxSession) Done() <-chan struct{} {
+	return s.closed
+}
+
+// StreamCount 当前打开的流数量
+func (s *muxSession) StreamCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+// openStream 服务端为一个公网连接打开流
+func (s *muxSession) openStream(remote net.Addr) (*muxStream, error) {
+	s.mu.Lock()
+	s.nextID++
+	st := newMuxStream(s, s.nextID, remote)
+	s.streams[st.id] = st
+	s.mu.Unlock()
+	if err := s.send(frameOpen, st.id, []byte(remote.String())); err != nil {
+		s.removeStream(st.id)
+		return nil, err
+	}
+	return st, nil
+}
+
+func (s *muxSession) removeStream(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+func (s *muxSession) stream(id uint32) *muxStream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streams[id]
+}
+
+// run 读取并分发帧，同时维持心跳，连接断开或协议错误时关闭会话并返回原因
+func (s *muxSession) run() error {
+	s.conn.SetReadDeadline(time.Time{})
+	go s.keepalive()
+	defer s.Close()
+	for {
+		typ, id, payload, err := readFrame(s.conn)
+		if err != nil {
+			return err
+		}
+		atomic.StoreInt64(&s.lastRecv, time.Now().UnixNano())
+
+		switch typ {
+		case frameOpen:
+			if s.onOpen == nil || id == 0 {
+				return fmt.Errorf("收到意外的 open 帧")
+			}
+			remote := reverseRemoteAddr(string(payload))
+			st := newMuxStream(s, id, remote)
+			s.mu.Lock()
+			s.streams[id] = st
+			s.mu.Unlock()
+			s.onOpen(st)
+		case frameData:
+			if st := s.stream(id); st != nil {
+				if err := st.pushData(payload); err != nil {
+					return err
+				}
+			}
+		case frameWindow:
+			if len(payload) != 4 {
+				return fmt.Errorf("无效的 window 帧")
+			}
+			if st := s.stream(id); st != nil {
+				st.addSendWindow(int(binary.BigEndian.Uint32(payload)))
+			}
+		case frameFin:
+			if st := s.stream(id); st != nil {
+				st.remoteFin()
+			}
+		case frameReset:
+			if st := s.stream(id); st != nil {
+				s.removeStream(id)
+				st.abort()
+			}
+		case framePing:
+			s.send(framePong, 0, nil)
+		case framePong:
+		default:
+			return fmt.Errorf("未知的帧类型 0x%02x", typ)
+		}
+	}
+}
+
+// keepalive 定期发送 ping，长时间未收到任何帧时关闭会话
+func (s *muxSession) keepalive() {
+	ticker := time.NewTicker(muxPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-ticker.C:
+			if time.Since(time.Unix(0, atomic.LoadInt64(&s.lastRecv))) > muxIdleTimeout {
+				s.Close()
+				return
+			}
+			s.send(framePing, 0, nil)
+		}
+	}
+}
+
+// reverseAddr 经反向隧道转入的公网客户端地址
+type reverseAddr string
+
+func (a reverseAddr) Network() string { return "tcp" }
+func (a reverseAddr) String() string  { return string(a) }
+
+// reverseRemoteAddr 解析 open 帧中的客户端地址，无法解析时原样保留
+func reverseRemoteAddr(s string) net.Addr {
+	if addr, err := net.ResolveTCPAddr("tcp", s); err == nil {
+		return addr
+	}
+	return reverseAddr(s)
+}
+
+// muxStream 会话中的一条流，实现 net.Conn，可以像普通 TCP 连接一样交给 handleTCP 处理
+type muxStream struct {
+	id      uint32
+	session *muxSession
+	remote  net.Addr
+
+	mu         sync.Mutex
+	buf        []byte // 已收到未读取的数据
+	unacked    int    // 已读取但尚未归还给对方的窗口
+	sendWindow int    // 对方剩余的接收窗口
+	recvFin    bool   // 对方已半关闭
+	sentFin    bool   // 本端已半关闭
+	closed     bool   // 本端已关闭
+	reset      bool   // 被对端中止或会话已断开
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readReady     chan struct{}
+	writeReady    chan struct{}
+}
+
+func newMuxStream(s *muxSession, id uint32, remote net.Addr) *muxStream {
+	return &muxStream{
+		id:         id,
+		session:    s,
+		remote:     remote,
+		sendWindow: muxWindow,
+		readReady:  make(chan struct{}, 1),
+		writeReady: make(chan struct{}, 1),
+	}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// wait 等待通知或超时，deadline 为零表示不超时
+func wait(ch chan struct{}, deadline time.Time) error {
+	if deadline.IsZero() {
+		<-ch
+		return nil
+	}
+	d := time.Until(deadline)
+	if d <= 0 {
+		return os.ErrDeadlineExceeded
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ch:
+		return nil
+	case <-timer.C:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+func (st *muxStream) pushData(p []byte) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.closed || st.reset {
+		return nil
+	}
+	if len(st.buf)+len(p) > muxWindow {
+		return fmt.Errorf("反向隧道的流 %d 超出接收窗口", st.id)
+	}
+	st.buf = append(st.buf, p...)
+	notify(st.readReady)
+	return nil
+}
+
+func (st *muxStream) addSendWindow(n int) {
+	st.mu.Lock()
+	st.sendWindow += n
+	st.mu.Unlock()
+	notify(st.writeReady)
+}
+
+func (st *muxStream) remoteFin() {
+	st.mu.Lock()
+	st.recvFin = true
+	done := st.sentFin && st.closed
+	st.mu.Unlock()
+	notify(st.readReady)
+	if done {
+		st.session.removeStream(st.id)
+	}
+}
+
+// abort 流被中止或会话断开，唤醒阻塞的读写
+func (st *muxStream) abort() {
+	st.mu.Lock()
+	st.reset = true
+	st.mu.Unlock()
+	notify(st.readReady)
+	notify(st.writeReady)
+}
+
+func (st *muxStream) Read(p []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		if len(st.buf) > 0 {
+			n := copy(p, st.buf)
+			st.buf = st.buf[n:]
+			st.unacked += n
+			var ack int
+			// 攒够一部分或读空时再归还窗口，减少 window 帧
+			if st.unacked >= muxWindow/4 || len(st.buf) == 0 {
+				ack, st.unacked = st.unacked, 0
+			}
+			st.mu.Unlock()
+			if ack > 0 {
+				var b [4]byte
+				binary.BigEndian.PutUint32(b[:], uint32(ack))
+				st.session.send(frameWindow, st.id, b[:])
+			}
+			return n, nil
+		}
+		switch {
+		case st.closed:
+			st.mu.Unlock()
+			return 0, net.ErrClosed
+		case st.recvFin:
+			st.mu.Unlock()
+			return 0, io.EOF
+		case st.reset:
+			st.mu.Unlock()
+			return 0, errStreamReset
+		}
+		deadline := st.readDeadline
+		st.mu.Unlock()
+		if err := wait(st.readReady, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (st *muxStream) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		st.mu.Lock()
+		switch {
+		case st.closed || st.sentFin:
+			st.mu.Unlock()
+			return written, net.ErrClosed
+		case st.reset:
+			st.mu.Unlock()
+			return written, errStreamReset
+		}
+		if st.sendWindow == 0 {
+			deadline := st.writeDeadline
+			st.mu.Unlock()
+			if err := wait(st.writeReady, deadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+		n := len(p) - written
+		if n > st.sendWindow {
+			n = st.sendWindow
+		}
+		if n > muxMaxData {
+			n = muxMaxData
+		}
+		st.sendWindow -= n
+		st.mu.Unlock()
+
+		if err := st.session.send(frameData, st.id, p[written:written+n]); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// CloseWrite 半关闭，通知对端本端不再写入
+func (st *muxStream) CloseWrite() error {
+	st.mu.Lock()
+	if st.sentFin || st.closed || st.reset {
+		st.mu.Unlock()
+		return nil
+	}
+	st.sentFin = true
+	st.mu.Unlock()
+	notify(st.writeReady)
+	return st.session.send(frameFin, st.id, nil)
+}
+
+// Close 关闭流，双方未都半关闭时发送 reset 让对端停止收发
+func (st *muxStream) Close() error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.closed = true
+	graceful := st.sentFin && st.recvFin
+	aborted := st.reset
+	st.buf = nil
+	st.mu.Unlock()
+	notify(st.readReady)
+	notify(st.writeReady)
+
+	st.session.removeStream(st.id)
+	if !graceful && !aborted {
+		st.session.send(frameReset, st.id, nil)
+	}
+	return nil
+}
+
+func (st *muxStream) LocalAddr() net.Addr  { return st.session.conn.LocalAddr() }
+func (st *muxStream) RemoteAddr() net.Addr { return st.remote }
+
+func (st *muxStream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+func (st *muxStream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.mu.Unlock()
+	notify(st.readReady)
+	return nil
+}
+
+func (st *muxStream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.writeDeadline = t
+	st.mu.Unlock()
+	notify(st.writeReady)
+	return nil
+}
@@ -0,0 +1,362 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testReverseSecret = "test-secret-123"
+
+// freePort 返回一个当前空闲的 TCP 端口
+func freePort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+// startReverseServer 在回环地址上启动服务端，返回控制地址
+func startReverseServer(t *testing.T, secret string) (*ReverseServer, string) {
+	t.Helper()
+	srv := NewReverseServer()
+	if err := srv.Apply("127.0.0.1:0", secret); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(srv.Stop)
+	listen, _ := srv.Status()
+	return srv, listen
+}
+
+// reverseClient 启动客户端，errs 收集控制连接的错误
+type reverseClient struct {
+	*reverseListener
+	mu   sync.Mutex
+	errs []error
+}
+
+func startReverseClient(t *testing.T, server, secret string, port int) *reverseClient {
+	t.Helper()
+	c := &reverseClient{}
+	c.reverseListener = newReverseListener(server, secret, fmt.Sprintf(":%d", port), func(err error) {
+		c.mu.Lock()
+		c.errs = append(c.errs, err)
+		c.mu.Unlock()
+	})
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func (c *reverseClient) lastErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.errs) == 0 {
+		return nil
+	}
+	return c.errs[len(c.errs)-1]
+}
+
+// waitConnected 等待客户端完成握手
+func (c *reverseClient) waitConnected(t *testing.T, want bool, timeout time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if c.status().Connected == want {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("等待 connected=%v 超时，最近错误: %v", want, c.lastErr())
+}
+
+// serveEcho 把转入的流原样写回，对端半关闭后也半关闭
+func serveEcho(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			io.Copy(conn, conn)
+			conn.(*muxStream).CloseWrite()
+		}()
+	}
+}
+
+func dialPublic(t *testing.T, port int) net.Conn {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", port), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// echoRoundTrip 经公网端口发送 payload 并读回相同内容
+func echoRoundTrip(t *testing.T, port int, payload []byte) {
+	t.Helper()
+	conn := dialPublic(t, port)
+	go conn.Write(payload)
+	got := make([]byte, len(payload))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("读取回显失败: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatal("回显内容不一致")
+	}
+}
+
+func TestReverseEcho(t *testing.T) {
+	_, server := startReverseServer(t, testReverseSecret)
+	port := freePort(t)
+	client := startReverseClient(t, server, testReverseSecret, port)
+	client.waitConnected(t, true, 3*time.Second)
+	go serveEcho(client)
+
+	// 超过接收窗口与单帧上限，覆盖分帧与窗口归还
+	payload := make([]byte, 4*muxWindow+123)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	echoRoundTrip(t, port, payload)
+
+	if st := client.status(); !strings.HasSuffix(st.Addr, fmt.Sprintf(":%d", port)) {
+		t.Fatalf("status.Addr = %q, want port %d", st.Addr, port)
+	}
+}
+
+func TestReverseHalfClose(t *testing.T) {
+	_, server := startReverseServer(t, testReverseSecret)
+	port := freePort(t)
+	client := startReverseClient(t, server, testReverseSecret, port)
+	client.waitConnected(t, true, 3*time.Second)
+
+	// 本机一侧读到 EOF 后才应答
+	go func() {
+		conn, err := client.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		req, _ := io.ReadAll(conn)
+		conn.Write(append([]byte("got "), req...))
+		conn.(*muxStream).CloseWrite()
+	}()
+
+	conn := dialPublic(t, port)
+	conn.Write([]byte("hello"))
+	conn.(*net.TCPConn).CloseWrite()
+	resp, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp) != "got hello" {
+		t.Fatalf("resp = %q", resp)
+	}
+}
+
+// muxPair 用 net.Pipe 连接一对会话，返回服务端会话与客户端收到的流
+func muxPair(t *testing.T) (*muxSession, chan *muxStream) {
+	t.Helper()
+	a, b := net.Pipe()
+	opened := make(chan *muxStream, 1)
+	server := newMuxSession(a, nil)
+	client := newMuxSession(b, func(st *muxStream) { opened <- st })
+	go server.run()
+	go client.run()
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	return server, opened
+}
+
+func TestMuxWindowExhaustion(t *testing.T) {
+	server, opened := muxPair(t)
+	st, err := server.openStream(reverseAddr("203.0.113.1:1234"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := <-opened
+
+	// 对端不读取时最多写入一个窗口，之后阻塞到超时
+	st.SetWriteDeadline(time.Now().Add(300 * time.Millisecond))
+	n, err := st.Write(make([]byte, 2*muxWindow))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("err = %v, want deadline exceeded", err)
+	}
+	if n != muxWindow {
+		t.Fatalf("写入 %d 字节，want %d", n, muxWindow)
+	}
+
+	// 对端读取后归还窗口，剩余数据可以继续写入
+	st.SetWriteDeadline(time.Time{})
+	done := make(chan error, 1)
+	go func() {
+		_, err := st.Write(make([]byte, muxWindow))
+		done <- err
+	}()
+	if _, err := io.ReadFull(peer, make([]byte, 2*muxWindow)); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMuxReset(t *testing.T) {
+	server, opened := muxPair(t)
+	st, err := server.openStream(reverseAddr("203.0.113.1:1234"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := <-opened
+
+	// 未半关闭就关闭流时对端收到 reset
+	peer.Close()
+	st.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := st.Read(make([]byte, 1)); !errors.Is(err, errStreamReset) {
+		t.Fatalf("err = %v, want errStreamReset", err)
+	}
+	if n := server.StreamCount(); n != 0 {
+		t.Fatalf("StreamCount = %d, want 0", n)
+	}
+}
+
+func TestReverseWrongSecret(t *testing.T) {
+	srv, server := startReverseServer(t, testReverseSecret)
+	client := startReverseClient(t, server, "wrong-secret-456", freePort(t))
+
+	deadline := time.Now().Add(3 * time.Second)
+	for client.lastErr() == nil && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err := client.lastErr(); err == nil || !strings.Contains(err.Error(), "密钥错误") {
+		t.Fatalf("err = %v, want 密钥错误", err)
+	}
+	if client.status().Connected {
+		t.Fatal("密钥错误的客户端不应连接成功")
+	}
+	if _, clients := srv.Status(); len(clients) != 0 {
+		t.Fatalf("clients = %v, want none", clients)
+	}
+}
+
+// TestReverseServerImpersonation 服务端不知道密钥时客户端拒绝握手，不会接受其打开的流
+func TestReverseServerImpersonation(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		writeFrame(conn, frameChallenge, 0, make([]byte, reverseNonceSize))
+		readFrame(conn)
+		ready, _ := json.Marshal(reverseReady{Addr: "0.0.0.0:1", MAC: "00"})
+		writeFrame(conn, frameReady, 0, ready)
+		writeFrame(conn, frameOpen, 1, []byte("203.0.113.1:1"))
+		time.Sleep(time.Second)
+	}()
+
+	l := &reverseListener{server: ln.Addr().String(), secret: testReverseSecret, listen: ":1"}
+	conn, err := net.Dial("tcp", l.server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := l.handshake(conn); err == nil || !strings.Contains(err.Error(), "服务端认证失败") {
+		t.Fatalf("err = %v, want 服务端认证失败", err)
+	}
+}
+
+func TestReverseServerRestart(t *testing.T) {
+	srv, server := startReverseServer(t, testReverseSecret)
+	port := freePort(t)
+	client := startReverseClient(t, server, testReverseSecret, port)
+	client.waitConnected(t, true, 3*time.Second)
+	go serveEcho(client)
+	echoRoundTrip(t, port, []byte("before"))
+
+	// 停止后客户端断开，重新启动后按退避自动重连
+	if err := srv.Apply(server, ""); err != nil {
+		t.Fatal(err)
+	}
+	client.waitConnected(t, false, 3*time.Second)
+	if err := srv.Apply(server, testReverseSecret); err != nil {
+		t.Fatal(err)
+	}
+	client.waitConnected(t, true, 5*time.Second)
+	echoRoundTrip(t, port, []byte("after"))
+}
+
+func TestReverseServerCheckListen(t *testing.T) {
+	srv := NewReverseServer()
+	srv.SetPortRange(20000, 20010)
+	for listen, ok := range map[string]bool{
+		":20005":          true,
+		"0.0.0.0:20000":   true,
+		"[::]:20010":      true,
+		"127.0.0.1:20005": false, // 只能监听全部地址
+		":80":             false, // 超出允许的端口范围
+		":20011":          false,
+		"bad":             false,
+	} {
+		if err := srv.checkListen(listen); (err == nil) != ok {
+			t.Errorf("checkListen(%q) = %v, want ok=%v", listen, err, ok)
+		}
+	}
+}
+
+func TestReverseAuthRateLimit(t *testing.T) {
+	srv := NewReverseServer()
+	for i := 0; i < reverseAuthMaxFails-1; i++ {
+		srv.recordFailure("198.51.100.1")
+	}
+	if srv.banned("198.51.100.1") {
+		t.Fatal("未达到失败次数上限时不应拒绝")
+	}
+	srv.recordFailure("198.51.100.1")
+	if !srv.banned("198.51.100.1") {
+		t.Fatal("失败次数达到上限后应拒绝")
+	}
+	if srv.banned("198.51.100.2") {
+		t.Fatal("不应影响其它来源")
+	}
+}
+
+func TestParseReversePortRange(t *testing.T) {
+	for value, want := range map[string][2]int{
+		"":            {DefaultReversePortMin, DefaultReversePortMax},
+		"20000-30000": {20000, 30000},
+		"8080":        {8080, 8080},
+	} {
+		min, max, err := ParseReversePortRange(value)
+		if err != nil || min != want[0] || max != want[1] {
+			t.Errorf("ParseReversePortRange(%q) = %d, %d, %v", value, min, max, err)
+		}
+	}
+	for _, value := range []string{"0-10", "30000-20000", "1-70000", "a-b"} {
+		if _, _, err := ParseReversePortRange(value); err == nil {
+			t.Errorf("ParseReversePortRange(%q) 应返回错误", value)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DGHeroin/relay/webui/model"
+)
+
+// scheduleCheckInterval 计划任务检查间隔
+const scheduleCheckInterval = 15 * time.Second
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// scheduleWindow 一个运行时间窗口，结束时间小于开始时间表示跨越午夜
+type scheduleWindow struct {
+	days  [7]bool // 按 time.Weekday 索引，指窗口开始的那一天
+	start int     // 开始时间，距零点的分钟数
+	end   int     // 结束时间，距零点的分钟数，24:00 为 1440
+}
+
+// Schedule 规则的运行计划
+type Schedule struct {
+	windows []scheduleWindow
+	loc     *time.Location
+}
+
+// ParseSchedule 解析运行计划，多个窗口以分号分隔，如
+// "mon-fri 09:00-18:00; sat,sun 10:00-14:00"
+// 星期部分可省略或为 "*"（每天），tz 为 IANA 时区名，为空时使用本地时区
+func ParseSchedule(spec, tz string) (*Schedule, error) {
+	s := &Schedule{loc: time.Local}
+	if tz != "" {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			return nil, fmt.Errorf("无效的时区: %s", tz)
+		}
+		s.loc = loc
+	}
+
+	for _, item := range strings.Split(spec, ";") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		fields := strings.Fields(item)
+		var w scheduleWindow
+		var timeRange string
+		switch len(fields) {
+		case 1:
+			timeRange = fields[0]
+			w.days = [7]bool{true, true, true, true, true, true, true}
+		case 2:
+			days, err := parseWeekdays(fields[0])
+			if err != nil {
+				return nil, err
+			}
+			w.days = days
+			timeRange = fields[1]
+		default:
+			return nil, fmt.Errorf("无效的时间窗口: %s", item)
+		}
+
+		startStr, endStr, ok := strings.Cut(timeRange, "-")
+		if !ok {
+			return nil, fmt.Errorf("时间段格式应为 HH:MM-HH:MM: %s", timeRange)
+		}
+		var err error
+		if w.start, err = parseClock(startStr); err != nil || w.start == 24*60 {
+			return nil, fmt.Errorf("无效的开始时间: %s", startStr)
+		}
+		if w.end, err = parseClock(endStr); err != nil {
+			return nil, fmt.Errorf("无效的结束时间: %s", endStr)
+		}
+		if w.start == w.end {
+			return nil, fmt.Errorf("开始时间与结束时间不能相同: %s", timeRange)
+		}
+		s.windows = append(s.windows, w)
+	}
+	if len(s.windows) == 0 {
+		return nil, fmt.Errorf("运行计划为空")
+	}
+	return s, nil
+}
+
+// parseWeekdays 解析 "mon-fri"、"sat,sun"、"*" 形式的星期列表
+func parseWeekdays(s string) ([7]bool, error) {
+	var days [7]bool
+	if s == "*" {
+		return [7]bool{true, true, true, true, true, true, true}, nil
+	}
+	for _, part := range strings.Split(strings.ToLower(s), ",") {
+		from, to, isRange := strings.Cut(part, "-")
+		start, ok := weekdayNames[from]
+		if !ok {
+			return days, fmt.Errorf("无效的星期: %s", from)
+		}
+		end := start
+		if isRange {
+			if end, ok = weekdayNames[to]; !ok {
+				return days, fmt.Errorf("无效的星期: %s", to)
+			}
+		}
+		// 支持 fri-mon 这样跨周的范围
+		for d := start; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == end {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+// parseClock 解析 HH:MM，返回距零点的分钟数，允许 24:00
+func parseClock(s string) (int, error) {
+	hh, mm, ok := strings.Cut(s, ":")
+	if !ok {
+		return 0, fmt.Errorf("时间格式错误")
+	}
+	h, err1 := strconv.Atoi(hh)
+	m, err2 := strconv.Atoi(mm)
+	if err1 != nil || err2 != nil || h < 0 || h > 24 || m < 0 || m > 59 || (h == 24 && m != 0) {
+		return 0, fmt.Errorf("时间格式错误")
+	}
+	return h*60 + m, nil
+}
+
+// Active 判断 t 是否处于任一运行窗口内
+func (s *Schedule) Active(t time.Time) bool {
+	t = t.In(s.loc)
+	minute := t.Hour()*60 + t.Minute()
+	today := t.Weekday()
+	yesterday := (today + 6) % 7
+	for _, w := range s.windows {
+		if w.start < w.end {
+			if w.days[today] && minute >= w.start && minute < w.end {
+				return true
+			}
+			continue
+		}
+		// 跨午夜：开始当天的后半段，或前一天开始、延续到今天的部分
+		if (w.days[today] && minute >= w.start) || (w.days[yesterday] && minute < w.end) {
+			return true
+		}
+	}
+	return false
+}
+
+// ScheduleActive 判断规则当前是否允许运行，未设置计划时始终允许
+// 计划已在保存时校验，解析失败时不限制运行
+func ScheduleActive(rule *model.RelayRule, t time.Time) bool {
+	if rule.Schedule == "" {
+		return true
+	}
+	s, err := ParseSchedule(rule.Schedule, rule.ScheduleTZ)
+	if err != nil {
+		return true
+	}
+	return s.Active(t)
+}
+
+// StopManual 手动停止规则，当前运行窗口内计划任务不会再自动启动它
+func (m *RelayManager) StopManual(id string) {
+	m.manualStops.Store(id, struct{}{})
+	m.Stop(id, ReasonManual)
+}
+
+// ManuallyStopped 规则是否已被手动停止且之后没有再启动
+func (m *RelayManager) ManuallyStopped(id string) bool {
+	_, ok := m.manualStops.Load(id)
+	return ok
+}
+
+// RunScheduler 按规则的运行计划启动或停止实例，阻塞运行
+// load 返回需要调度的规则（通常为所有已启用的规则）
+func (m *RelayManager) RunScheduler(load func() ([]*model.RelayRule, error), broadcaster Broadcaster, geoIP *GeoIPService) {
+	ticker := time.NewTicker(scheduleCheckInterval)
+	defer ticker.Stop()
+	for {
+		m.applySchedules(load, broadcaster, geoIP)
+		<-ticker.C
+	}
+}
+
+func (m *RelayManager) applySchedules(load func() ([]*model.RelayRule, error), broadcaster Broadcaster, geoIP *GeoIPService) {
+	rules, err := load()
+	if err != nil {
+		log.Printf("[Schedule] 获取规则失败: %v", err)
+		return
+	}
+
+	now := time.Now()
+	off := make(map[string]bool)
+	for _, rule := range rules {
+		if rule.Schedule == "" {
+			continue
+		}
+		if !ScheduleActive(rule, now) {
+			off[rule.ID] = true
+			// 窗口结束后清除手动停止标记，下一个窗口照常启动
+			m.manualStops.Delete(rule.ID)
+			if m.IsRunning(rule.ID) {
+				log.Printf("[Schedule] %s 超出运行时间，停止", rule.Name)
+				m.Stop(rule.ID, ReasonSchedule)
+			}
+			continue
+		}
+		if _, manual := m.manualStops.Load(rule.ID); manual || m.IsRunning(rule.ID) {
+			continue
+		}
+		log.Printf("[Schedule] %s 进入运行时间，启动", rule.Name)
+		if err := m.Start(rule, broadcaster, geoIP, ReasonSchedule); err != nil {
+			log.Printf("[Schedule] %s 启动失败: %v", rule.Name, err)
+		}
+	}
+
+	m.scheduledOff.Range(func(key, _ interface{}) bool {
+		if !off[key.(string)] {
+			m.scheduledOff.Delete(key)
+		}
+		return true
+	})
+	for id := range off {
+		m.scheduledOff.Store(id, true)
+	}
+}
@@ -0,0 +1,114 @@
+package service
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/DGHeroin/relay/webui/model"
+)
+
+// tlsHandshakeTimeout TLS 握手超时，避免未完成握手的连接长期占用
+const tlsHandshakeTimeout = 10 * time.Second
+
+// LoadTLSConfig 按规则的证书配置创建 TLS 服务端配置，未配置证书时返回 nil
+// 设置了客户端 CA 时要求并校验客户端证书 (mTLS)
+func LoadTLSConfig(rule *model.RelayRule) (*tls.Config, error) {
+	if rule.TLSCert == "" && rule.TLSKey == "" && rule.TLSClientCA == "" {
+		return nil, nil
+	}
+	if rule.TLSCert == "" || rule.TLSKey == "" {
+		return nil, fmt.Errorf("TLS 需要同时配置证书和私钥")
+	}
+	cert, err := tls.LoadX509KeyPair(rule.TLSCert, rule.TLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("加载 TLS 证书失败: %v", err)
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   rule.TLSALPN,
+	}
+	if rule.TLSClientCA != "" {
+		pem, err := os.ReadFile(rule.TLSClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("读取客户端 CA 失败: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("客户端 CA 文件中没有有效的 PEM 证书")
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// tlsInfo 客户端 TLS 握手的协商结果，非 TLS 连接各字段为空
+type tlsInfo struct {
+	clientCert string // mTLS 客户端证书标识
+	version    string // 如 TLS 1.3
+	cipher     string // 如 TLS_AES_128_GCM_SHA256
+	alpn       string // 协商出的应用层协议，未配置 tls_alpn 或客户端未提供时为空
+}
+
+// tlsHandshake 完成 TLS 握手并返回协商结果，非 TLS 连接直接返回
+func tlsHandshake(conn net.Conn) (tlsInfo, error) {
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return tlsInfo{}, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), tlsHandshakeTimeout)
+	defer cancel()
+	if err := tc.HandshakeContext(ctx); err != nil {
+		return tlsInfo{}, err
+	}
+	state := tc.ConnectionState()
+	return tlsInfo{
+		clientCert: clientCertIdentity(state),
+		version:    tls.VersionName(state.Version),
+		cipher:     tls.CipherSuiteName(state.CipherSuite),
+		alpn:       state.NegotiatedProtocol,
+	}, nil
+}
+
+// upstreamTLSClient 在已建立的上游连接上发起 TLS 握手，按目标主机名校验服务端证书
+// 握手失败时关闭连接并返回错误
+func upstreamTLSClient(conn net.Conn, dst string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(dst)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tc := tls.Client(conn, &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12})
+	ctx, cancel := context.WithTimeout(context.Background(), tlsHandshakeTimeout)
+	defer cancel()
+	if err := tc.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("上游 TLS 握手失败: %v", err)
+	}
+	return tc, nil
+}
+
+// clientCertIdentity 返回已校验客户端证书的 CN，CN 为空时依次使用 SAN 中的 DNS、邮箱、URI
+func clientCertIdentity(state tls.ConnectionState) string {
+	if len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	cert := state.PeerCertificates[0]
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	}
+	return ""
+}
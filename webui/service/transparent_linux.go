@@ -0,0 +1,35 @@
+//go:build linux
+
+package service
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// TransparentSupported 当前系统是否支持透明代理
+const TransparentSupported = true
+
+// ipv6Transparent IPV6_TRANSPARENT，syscall 包未定义
+const ipv6Transparent = 75
+
+// transparentControl 为 socket 设置 IP_TRANSPARENT，允许绑定非本机地址
+// 需要 root 或 CAP_NET_ADMIN 权限
+func transparentControl(network, address string, c syscall.RawConn) error {
+	var opErr error
+	err := c.Control(func(fd uintptr) {
+		switch network {
+		case "tcp6", "udp6":
+			opErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+		default:
+			opErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if opErr != nil {
+		return fmt.Errorf("设置 IP_TRANSPARENT 失败（需要 root 或 CAP_NET_ADMIN 权限）: %v", opErr)
+	}
+	return nil
+}
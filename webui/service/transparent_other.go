@@ -0,0 +1,15 @@
+//go:build !linux
+
+package service
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// TransparentSupported 当前系统是否支持透明代理
+const TransparentSupported = false
+
+func transparentControl(network, address string, c syscall.RawConn) error {
+	return fmt.Errorf("透明代理仅支持 Linux")
+}
@@ -0,0 +1,220 @@
+package service
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/DGHeroin/relay/webui/model"
+	"github.com/google/uuid"
+)
+
+// udpSessionTimeout 双向均无数据超过该时长的 UDP 会话会被关闭
+const udpSessionTimeout = 30 * time.Second
+
+// udpSession 单个 UDP 客户端会话
+// 由 udpSessionTable 创建，读取目标响应的 goroutine 在 close 后退出，
+// close 可重复调用，但移出会话表、记录历史和统计只执行一次
+type udpSession struct {
+	r      *RelayInstance
+	table  *udpSessionTable
+	pc     net.PacketConn // 监听 socket，用于回复客户端
+	addr   net.Addr       // 客户端地址
+	key    string
+	remote net.Conn
+
+	startedAt time.Time
+	lastSeen  int64       // 最近一次收发数据的时间 (UnixNano)
+	connInfo  *Connection // BytesIn/BytesOut 实时累加
+	target    *targetStat
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// udpSessionTable 单个 UDP 监听上的会话表
+type udpSessionTable struct {
+	mu       sync.Mutex
+	sessions map[string]*udpSession
+}
+
+func newUDPSessionTable() *udpSessionTable {
+	return &udpSessionTable{sessions: make(map[string]*udpSession)}
+}
+
+func (t *udpSessionTable) get(key string) *udpSession {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.sessions[key]
+}
+
+func (t *udpSessionTable) add(s *udpSession) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sessions[s.key] = s
+}
+
+// remove 仅在表中仍是同一个会话时删除，避免误删同一客户端的新会话
+func (t *udpSessionTable) remove(s *udpSession) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.sessions[s.key] == s {
+		delete(t.sessions, s.key)
+	}
+}
+
+// closeAll 关闭全部会话并等待其 goroutine 退出
+func (t *udpSessionTable) closeAll() {
+	t.mu.Lock()
+	sessions := make([]*udpSession, 0, len(t.sessions))
+	for _, s := range t.sessions {
+		sessions = append(sessions, s)
+	}
+	t.mu.Unlock()
+
+	for _, s := range sessions {
+		s.close()
+		<-s.done
+	}
+}
+
+func (s *udpSession) touch() {
+	atomic.StoreInt64(&s.lastSeen, time.Now().UnixNano())
+}
+
+// forward 将客户端数据包转发到目标
+func (s *udpSession) forward(p []byte) {
+	s.touch()
+	if _, err := s.remote.Write(p); err != nil {
+		return
+	}
+	atomic.AddInt64(&s.connInfo.BytesIn, int64(len(p)))
+	atomic.AddInt64(&s.r.bytesIn, int64(len(p)))
+}
+
+// run 接收目标响应并回复客户端，会话空闲超时或出错时关闭会话
+func (s *udpSession) run() {
+	defer close(s.done)
+	defer s.close()
+
+	buf := make([]byte, 65535)
+	first := true
+	for {
+		idleUntil := time.Unix(0, atomic.LoadInt64(&s.lastSeen)).Add(udpSessionTimeout)
+		s.remote.SetReadDeadline(idleUntil)
+		n, err := s.remote.Read(buf)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) &&
+				time.Since(time.Unix(0, atomic.LoadInt64(&s.lastSeen))) < udpSessionTimeout {
+				// 期间客户端仍有数据，顺延
+				continue
+			}
+			return
+		}
+		if first {
+			// 首个响应包耗时，从首个请求包发出开始计算
+			first = false
+			atomic.StoreInt64(&s.connInfo.ConnectLatencyMs, time.Since(s.startedAt).Milliseconds())
+		}
+		s.touch()
+		s.pc.WriteTo(buf[:n], s.addr)
+		atomic.AddInt64(&s.connInfo.BytesOut, int64(n))
+		atomic.AddInt64(&s.r.bytesOut, int64(n))
+	}
+}
+
+// close 关闭会话：移出会话表、关闭目标连接并记录历史与统计
+func (s *udpSession) close() {
+	s.closeOnce.Do(func() {
+		s.table.remove(s)
+		s.remote.Close()
+
+		r := s.r
+		s.target.release()
+		reason := ""
+		if r.stopped() {
+			reason = "relay_stopped"
+		}
+		// 目标连接已关闭，run 不会再发送数据；forward 可能仍有在途写入，以快照为准
+		ended := r.finalizeConnection(s.connInfo, reason)
+		bytesIn, bytesOut := ended.BytesIn, ended.BytesOut
+		r.persistHistory(ended)
+
+		model.SaveRelayStat(r.rule.ID, bytesIn, bytesOut, 1)
+		r.saveAccessLog(&model.AccessLog{
+			RelayID:   r.rule.ID,
+			ClientIP:  s.connInfo.ClientIP,
+			Action:    "disconnect",
+			Detail:    reason,
+			BytesIn:   bytesIn,
+			BytesOut:  bytesOut,
+			Duration:  ended.Duration,
+			Country:   s.connInfo.Country,
+			ASN:       s.connInfo.ASN,
+			ASOrg:     s.connInfo.ASOrg,
+			LatencyMs: ended.ConnectLatencyMs,
+			Private:   s.connInfo.Private,
+		})
+	})
+}
+
+// newUDPSession 为新客户端建立到目标的连接并登记会话
+func (r *RelayInstance) newUDPSession(table *udpSessionTable, pc net.PacketConn, addr net.Addr, clientIP string, target pickedTarget) (*udpSession, error) {
+	dst := target.addr
+	remote, err := r.dialUpstream("udp", dst, clientIP)
+	if err != nil {
+		r.errors.add(PhaseDial, err)
+		target.stat.markDown()
+		r.saveAccessLog(&model.AccessLog{RelayID: r.rule.ID, ClientIP: clientIP, Action: "failed", Detail: err.Error(), Private: isPrivateClient(clientIP)})
+		return nil, err
+	}
+	target.stat.acquire()
+
+	location, country := "", ""
+	var asn uint
+	var asOrg string
+	if r.geoIP != nil {
+		location = r.geoIP.Lookup(clientIP)
+		country = r.geoIP.LookupCountryCode(clientIP)
+		asn, asOrg = r.geoIP.LookupASN(clientIP)
+	}
+
+	now := time.Now()
+	s := &udpSession{
+		r:         r,
+		table:     table,
+		pc:        pc,
+		addr:      addr,
+		key:       addr.String(),
+		remote:    remote,
+		target:    target.stat,
+		startedAt: now,
+		lastSeen:  now.UnixNano(),
+		done:      make(chan struct{}),
+		connInfo: &Connection{
+			ID:        uuid.New().String(),
+			ClientIP:  clientIP,
+			Location:  location,
+			Country:   country,
+			ASN:       asn,
+			ASOrg:     asOrg,
+			Target:    dst,
+			Protocol:  "udp",
+			StartedAt: now,
+			Active:    true,
+			Private:   isPrivateClient(clientIP),
+			Labels:    r.rule.Labels,
+		},
+	}
+	r.connections.Store(s.connInfo.ID, s.connInfo)
+	atomic.AddInt64(&r.connCount, 1)
+	table.add(s)
+
+	r.saveAccessLog(&model.AccessLog{RelayID: r.rule.ID, ClientIP: clientIP, Action: "connect", Country: country, ASN: asn, ASOrg: asOrg, Private: s.connInfo.Private})
+
+	go s.run()
+	return s, nil
+}
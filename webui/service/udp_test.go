@@ -0,0 +1,93 @@
+package service
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DGHeroin/relay/webui/model"
+)
+
+// TestUDPSessionChurn 大量短会话建立后停止规则，会话的 goroutine 应全部退出，历史只记录一次
+func TestUDPSessionChurn(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go serveUDPEcho(echo)
+
+	before := runtime.NumGoroutine()
+
+	rule := &model.RelayRule{Protocol: "udp", Src: "127.0.0.1:0", Dst: echo.LocalAddr().String()}
+	m, r := startTestRelay(t, rule)
+	addr := relayAddr(t, r, "udp")
+
+	const sessions = 200
+	buf := make([]byte, 64)
+	for i := 0; i < sessions; i++ {
+		c, err := net.Dial("udp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := fmt.Sprintf("ping %d", i)
+		c.Write([]byte(msg))
+		c.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, err := c.Read(buf)
+		// 保持客户端 socket 打开，避免端口被复用后命中已有会话
+		defer c.Close()
+		if err != nil || string(buf[:n]) != msg {
+			t.Fatalf("会话 %d 回显失败: %q, %v", i, buf[:n], err)
+		}
+	}
+	if got := atomic.LoadInt64(&r.connCount); got != sessions {
+		t.Fatalf("活跃会话 %d, want %d", got, sessions)
+	}
+
+	m.Stop(rule.ID, ReasonManual)
+
+	// 每个会话只记录一次历史，超出 historySize 的被覆盖
+	want := min(sessions, r.historySize)
+	if got := r.history.len(); got != want {
+		t.Errorf("历史记录 %d 条, want %d", got, want)
+	}
+	seen := make(map[string]bool)
+	for i := 0; i < r.history.len(); i++ {
+		id := r.history.at(i).ID
+		if seen[id] {
+			t.Errorf("会话 %s 重复记录历史", id)
+		}
+		seen[id] = true
+	}
+	if got := atomic.LoadInt64(&r.connCount); got != 0 {
+		t.Errorf("停止后仍有 %d 个活跃会话", got)
+	}
+
+	// 会话 goroutine 在 Stop 返回前已退出，留一点时间给运行时回收其它 goroutine
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Fatalf("goroutine 泄漏: 之前 %d, 之后 %d", before, after)
+	}
+}
+
+func TestSweepDenied(t *testing.T) {
+	now := time.Now()
+	denied := map[string]time.Time{
+		"198.51.100.1:1000": now.Add(-time.Second),
+		"198.51.100.2:1000": now,
+		"198.51.100.3:1000": now.Add(time.Second),
+	}
+	sweepDenied(denied, now)
+	if len(denied) != 1 {
+		t.Fatalf("清理后剩余 %d 项, want 1", len(denied))
+	}
+	if _, ok := denied["198.51.100.3:1000"]; !ok {
+		t.Fatal("未到期的项被删除")
+	}
+}
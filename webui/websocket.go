@@ -2,13 +2,48 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/DGHeroin/relay/webui/model"
+	"github.com/DGHeroin/relay/webui/service"
+
 	"github.com/gorilla/websocket"
 )
 
+// WebSocket 单条消息大小限制
+const (
+	defaultWSReadLimit = 4096
+	minWSReadLimit     = 512
+	maxWSReadLimit     = 1 << 20
+)
+
+// loadWSReadLimit 读取 ws_read_limit 设置（字节）
+func loadWSReadLimit() int64 {
+	value, err := model.GetSetting("ws_read_limit")
+	if err != nil || value == "" {
+		return defaultWSReadLimit
+	}
+	limit, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return defaultWSReadLimit
+	}
+	if limit < minWSReadLimit {
+		return minWSReadLimit
+	}
+	if limit > maxWSReadLimit {
+		return maxWSReadLimit
+	}
+	return limit
+}
+
+// maxConsecutiveDrops 连续丢弃多少条消息后断开客户端
+const maxConsecutiveDrops = 32
+
 // WSMessage WebSocket 消息
 type WSMessage struct {
 	Type string      `json:"type"`
@@ -32,6 +67,35 @@ type WSClient struct {
 	topics   map[string]bool
 	relayIDs map[string]bool // 订阅的 relay ID 集合，空表示匹配所有
 	mu       sync.RWMutex
+
+	readLimit int64 // 单条消息大小限制
+	drops     int32 // 发送队列已满导致的连续丢弃次数
+
+	// 客户端请求的最小推送间隔，仅作用于周期性消息，0 表示跟随服务端
+	interval time.Duration
+	lastSent map[string]time.Time // msgType:relayID -> 上次发送时间
+
+	// relay.connections 推送的过滤与排序条件，nil 表示推送全部
+	connFilter *service.ConnectionFilter
+}
+
+// periodicTopics 周期性推送的消息类型，客户端可以请求降低其频率
+var periodicTopics = map[string]bool{
+	"relay.connections": true,
+	"relay.traffic":     true,
+}
+
+// throttled 判断周期性消息是否需要按客户端请求的间隔跳过，调用方需持有 c.mu 写锁
+func (c *WSClient) throttled(msgType, relayID string, now time.Time) bool {
+	if c.interval <= 0 || !periodicTopics[msgType] {
+		return false
+	}
+	key := msgType + ":" + relayID
+	if last, ok := c.lastSent[key]; ok && now.Sub(last) < c.interval {
+		return true
+	}
+	c.lastSent[key] = now
+	return false
 }
 
 // NewWSHub 创建 Hub
@@ -62,33 +126,45 @@ func (h *WSHub) Run() {
 			h.mu.Unlock()
 
 		case message := <-h.broadcast:
-			// 收集需要移除的客户端
-			var toRemove []*WSClient
+			// 收集跟不上的客户端
+			var slow []*WSClient
 			h.mu.RLock()
 			for client := range h.clients {
-				select {
-				case client.send <- message:
-				default:
-					toRemove = append(toRemove, client)
+				if !h.trySend(client, message) {
+					slow = append(slow, client)
 				}
 			}
 			h.mu.RUnlock()
 
-			// 使用写锁移除失效客户端
-			if len(toRemove) > 0 {
-				h.mu.Lock()
-				for _, client := range toRemove {
-					if _, ok := h.clients[client]; ok {
-						delete(h.clients, client)
-						close(client.send)
-					}
-				}
-				h.mu.Unlock()
+			for _, client := range slow {
+				h.evict(client, "client too slow")
 			}
 		}
 	}
 }
 
+// ClientCount 当前连接的 WebSocket 客户端数
+func (h *WSHub) ClientCount() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.clients)
+}
+
+// HasSubscribers 是否有客户端订阅了 topic
+func (h *WSHub) HasSubscribers(topic string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for client := range h.clients {
+		client.mu.RLock()
+		subscribed := client.topics[topic]
+		client.mu.RUnlock()
+		if subscribed {
+			return true
+		}
+	}
+	return false
+}
+
 // Broadcast 广播消息
 func (h *WSHub) Broadcast(msgType string, data interface{}) {
 	msg := WSMessage{Type: msgType, Data: data}
@@ -97,21 +173,22 @@ func (h *WSHub) Broadcast(msgType string, data interface{}) {
 		return
 	}
 
+	var slow []*WSClient
 	h.mu.RLock()
-	defer h.mu.RUnlock()
-
 	for client := range h.clients {
 		client.mu.RLock()
 		subscribed := client.topics[msgType]
 		client.mu.RUnlock()
 
-		if subscribed {
-			select {
-			case client.send <- jsonData:
-			default:
-			}
+		if subscribed && !h.trySend(client, jsonData) {
+			slow = append(slow, client)
 		}
 	}
+	h.mu.RUnlock()
+
+	for _, client := range slow {
+		h.evict(client, "client too slow")
+	}
 }
 
 // BroadcastToRelay 广播到订阅特定 relay 的客户端
@@ -122,22 +199,93 @@ func (h *WSHub) BroadcastToRelay(relayID, msgType string, data interface{}) {
 		return
 	}
 
+	var slow []*WSClient
 	h.mu.RLock()
-	defer h.mu.RUnlock()
-
+	now := time.Now()
 	for client := range h.clients {
-		client.mu.RLock()
+		client.mu.Lock()
 		subscribed := client.topics[msgType]
 		matchRelay := len(client.relayIDs) == 0 || client.relayIDs[relayID]
-		client.mu.RUnlock()
+		skip := subscribed && matchRelay && client.throttled(msgType, relayID, now)
+		filter := client.connFilter
+		client.mu.Unlock()
 
-		if subscribed && matchRelay {
-			select {
-			case client.send <- jsonData:
-			default:
+		if !subscribed || !matchRelay || skip {
+			continue
+		}
+		payload := jsonData
+		if filter != nil && msgType == "relay.connections" {
+			if filtered, ok := filterConnectionsMessage(msg, filter); ok {
+				payload = filtered
 			}
 		}
+		if !h.trySend(client, payload) {
+			slow = append(slow, client)
+		}
+	}
+	h.mu.RUnlock()
+
+	for _, client := range slow {
+		h.evict(client, "client too slow")
+	}
+}
+
+// filterConnectionsMessage 按客户端的过滤条件重新生成 relay.connections 消息
+func filterConnectionsMessage(msg WSMessage, filter *service.ConnectionFilter) ([]byte, bool) {
+	data, ok := msg.Data.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	conns, ok := data["connections"].([]service.Connection)
+	if !ok && data["connections"] != nil {
+		return nil, false
+	}
+	filtered := make(map[string]interface{}, len(data))
+	for k, v := range data {
+		filtered[k] = v
+	}
+	filtered["connections"] = filter.Apply(conns)
+	jsonData, err := json.Marshal(WSMessage{Type: msg.Type, Data: filtered})
+	if err != nil {
+		return nil, false
 	}
+	return jsonData, true
+}
+
+// trySend 非阻塞发送，发送队列已满时丢弃并累计连续丢弃次数
+// 连续丢弃达到 maxConsecutiveDrops 时返回 false，调用方应断开该客户端
+func (h *WSHub) trySend(client *WSClient, message []byte) bool {
+	select {
+	case client.send <- message:
+		atomic.StoreInt32(&client.drops, 0)
+		return true
+	default:
+		return atomic.AddInt32(&client.drops, 1) < maxConsecutiveDrops
+	}
+}
+
+// evict 断开跟不上推送速度的客户端
+// 发送带原因的关闭帧，前端收到后会重连并重新同步状态，而不是静默丢失部分更新
+func (h *WSHub) evict(client *WSClient, reason string) {
+	h.mu.RLock()
+	_, ok := h.clients[client]
+	h.mu.RUnlock()
+	if !ok {
+		return
+	}
+
+	log.Printf("WebSocket 断开客户端 %s: %s (连续丢弃 %d 条消息)",
+		client.conn.RemoteAddr(), reason, atomic.LoadInt32(&client.drops))
+	client.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseTryAgainLater, reason),
+		time.Now().Add(time.Second))
+
+	h.mu.Lock()
+	if _, ok := h.clients[client]; ok {
+		delete(h.clients, client)
+		close(client.send)
+	}
+	h.mu.Unlock()
 }
 
 // readPump 读取消息
@@ -148,7 +296,7 @@ func (c *WSClient) readPump(wg *sync.WaitGroup) {
 		wg.Done()
 	}()
 
-	c.conn.SetReadLimit(512)
+	c.conn.SetReadLimit(c.readLimit)
 	c.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
 	c.conn.SetPongHandler(func(string) error {
 		c.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
@@ -158,6 +306,11 @@ func (c *WSClient) readPump(wg *sync.WaitGroup) {
 	for {
 		_, message, err := c.conn.ReadMessage()
 		if err != nil {
+			// 超出大小限制时 gorilla 已发送 1009 (Message Too Big) 关闭帧，客户端会收到明确的关闭原因
+			if errors.Is(err, websocket.ErrReadLimit) {
+				log.Printf("WebSocket 消息超出大小限制 (%d bytes)，连接已关闭", c.readLimit)
+				break
+			}
 			// 过滤掉正常的断开连接错误：1000(正常关闭)、1001(离开)、1005(无状态码)
 			if websocket.IsUnexpectedCloseError(err,
 				websocket.CloseNormalClosure,
@@ -171,9 +324,14 @@ func (c *WSClient) readPump(wg *sync.WaitGroup) {
 
 		// 处理订阅消息
 		var req struct {
-			Action  string   `json:"action"`
-			Topics  []string `json:"topics"`
-			RelayID string   `json:"relay_id"`
+			Action     string   `json:"action"`
+			Topics     []string `json:"topics"`
+			RelayID    string   `json:"relay_id"`
+			RelayIDs   []string `json:"relay_ids"`   // 可同时订阅多个 relay
+			IntervalMs int64    `json:"interval_ms"` // 可选，请求更低的推送频率
+
+			// 可选，relay.connections 的过滤与排序条件，传空对象清除
+			Filter *service.ConnectionFilter `json:"filter"`
 		}
 		if err := json.Unmarshal(message, &req); err != nil {
 			continue
@@ -187,12 +345,30 @@ func (c *WSClient) readPump(wg *sync.WaitGroup) {
 			if req.RelayID != "" {
 				c.relayIDs[req.RelayID] = true
 			}
+			for _, id := range req.RelayIDs {
+				if id != "" {
+					c.relayIDs[id] = true
+				}
+			}
+			if req.IntervalMs > 0 {
+				c.interval = time.Duration(req.IntervalMs) * time.Millisecond
+			}
+			if req.Filter != nil {
+				if req.Filter.IsZero() || req.Filter.Validate() != nil {
+					c.connFilter = nil
+				} else {
+					c.connFilter = req.Filter
+				}
+			}
 			c.mu.Unlock()
 		} else if req.Action == "unsubscribe" {
 			c.mu.Lock()
 			if req.RelayID != "" {
 				delete(c.relayIDs, req.RelayID)
 			}
+			for _, id := range req.RelayIDs {
+				delete(c.relayIDs, id)
+			}
 			for _, topic := range req.Topics {
 				delete(c.topics, topic)
 			}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DGHeroin/relay/webui/model"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// dialTestWS 启动只挂载 /ws 的测试服务并以有效会话连接
+func dialTestWS(t *testing.T) (*WSHub, *websocket.Conn) {
+	t.Helper()
+	token, err := generateToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := model.CreateSession(token, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	hub := NewWSHub()
+	go hub.Run()
+	h := &Handlers{wsHub: hub}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/ws", h.HandleWebSocket)
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+
+	header := http.Header{"Authorization": {"Bearer " + token}}
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", header)
+	if err != nil {
+		t.Fatalf("连接 WebSocket 失败: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return hub, conn
+}
+
+// TestWSSubscribeManyTopics 50 个主题的订阅消息在默认读取上限内，应被完整解析
+func TestWSSubscribeManyTopics(t *testing.T) {
+	hub, conn := dialTestWS(t)
+
+	topics := make([]string, 50)
+	for i := range topics {
+		topics[i] = fmt.Sprintf("relay.topic_%02d", i)
+	}
+	msg, _ := json.Marshal(map[string]interface{}{"action": "subscribe", "topics": topics})
+	if len(msg) <= 512 || int64(len(msg)) > defaultWSReadLimit {
+		t.Fatalf("订阅消息 %d 字节，应超过旧上限 512 且不超过 %d", len(msg), defaultWSReadLimit)
+	}
+	if err := conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !hub.HasSubscribers(topics[len(topics)-1]) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, topic := range topics {
+		if !hub.HasSubscribers(topic) {
+			t.Errorf("主题 %s 未订阅", topic)
+		}
+	}
+}
+
+// TestWSReadLimitClose 超出读取上限的消息应得到 1009 关闭帧
+func TestWSReadLimitClose(t *testing.T) {
+	_, conn := dialTestWS(t)
+
+	msg := `{"action":"subscribe","relay_id":"` + strings.Repeat("x", defaultWSReadLimit) + `"}`
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err := conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Fatalf("期望 1009 关闭帧, got %v", err)
+	}
+}